@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/dlclark/regexp2"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/sunbk201/ua3f/internal/auth"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/l3policy"
+	"github.com/sunbk201/ua3f/internal/mitm"
+	"github.com/sunbk201/ua3f/internal/rule"
+	"github.com/sunbk201/ua3f/internal/rule/match"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate a config file and print the firewall rules it would install",
+	Long: `Validate a config file as UA3F would load it, including rules, regexes,
+domain sets, the MitM CA and its passphrase, and print the nftables rules each
+server would install, without applying them. Problems are printed to stderr and
+make the command exit with a non-zero status.`,
+	Args: cobra.NoArgs,
+	RunE: runCheck,
+}
+
+var (
+	checkConfigFile string
+	checkFirewall   bool
+)
+
+func init() {
+	checkCmd.Flags().StringVarP(&checkConfigFile, "config", "c", "", "Config file path")
+	checkCmd.Flags().BoolVar(&checkFirewall, "firewall", true, "Print the firewall rules the servers would install")
+	_ = checkCmd.MarkFlagRequired("config")
+	rootCmd.AddCommand(checkCmd)
+}
+
+func runCheck(cmd *cobra.Command, args []string) error {
+	viper.SetConfigFile(checkConfigFile)
+	if err := viper.MergeInConfig(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	cfg, err := config.BuildConfigFromViper()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	// Components report most problems by logging them and carrying on.
+	problems := &problemLog{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(problems))
+	defer slog.SetDefault(defaultLogger)
+
+	found := checkConfig(cfg, problems)
+	firewalls, firewallProblems := checkFirewalls(cfg, problems)
+	found = append(found, firewallProblems...)
+
+	if checkFirewall {
+		printFirewalls(cmd.OutOrStdout(), firewalls)
+	}
+	for _, p := range found {
+		fmt.Fprintln(cmd.ErrOrStderr(), p)
+	}
+	if len(found) > 0 {
+		return fmt.Errorf("%s: %d problem(s) found", checkConfigFile, len(found))
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "%s: OK\n", checkConfigFile)
+	return nil
+}
+
+// firewallRules are the nftables rules a server would install.
+type firewallRules struct {
+	server string
+	rules  string
+}
+
+func printFirewalls(w io.Writer, firewalls []firewallRules) {
+	for _, f := range firewalls {
+		fmt.Fprintf(w, "# %s\n%s\n", f.server, f.rules)
+	}
+}
+
+// checkConfig returns the problems of cfg that BuildConfigFromViper does not
+// catch.
+func checkConfig(cfg *config.Config, problems *problemLog) []string {
+	var found []string
+	add := func(where string, errs ...string) {
+		for _, err := range errs {
+			found = append(found, where+": "+err)
+		}
+	}
+
+	if cfg.UserAgentRegex != "" {
+		if _, err := regexp2.Compile("(?i)"+cfg.UserAgentRegex, regexp2.None); err != nil {
+			add("user-agent-regex", err.Error())
+		}
+	}
+
+	targets := map[config.RuleList]common.ActionTarget{
+		config.RuleListHeader:   common.ActionTargetHeader,
+		config.RuleListBody:     common.ActionTargetBody,
+		config.RuleListRedirect: common.ActionTargetURL,
+	}
+	for _, list := range []config.RuleList{config.RuleListHeader, config.RuleListBody, config.RuleListRedirect} {
+		rules, err := cfg.Rules(list)
+		if err != nil {
+			add(list.Key(), err.Error())
+			continue
+		}
+		for i, r := range rules {
+			add(fmt.Sprintf("%s[%d]", list.Key(), i), checkRule(r, targets[list], problems)...)
+		}
+	}
+
+	if cfg.MitM.Enabled {
+		if _, err := mitm.NewMiddleMan(cfg); err != nil {
+			add("mitm", err.Error())
+		}
+	}
+	if _, err := l3policy.New(&cfg.L3Rewrite); err != nil {
+		add("l3-rewrite", err.Error())
+	}
+
+	for _, l := range cfg.ServerListeners() {
+		lcfg := cfg.ForListener(l)
+		switch l.ServerMode {
+		case config.ServerModeSocks5:
+			if _, err := auth.New(&lcfg.Socks5.Auth); err != nil {
+				add("socks5.auth", err.Error())
+			}
+		case config.ServerModeHTTP:
+			if _, err := auth.New(&lcfg.HTTPProxy.Auth); err != nil {
+				add("http-proxy.auth", err.Error())
+			}
+			if _, err := auth.NewACL(lcfg.HTTPProxy.Allow, lcfg.HTTPProxy.Deny); err != nil {
+				add("http-proxy", err.Error())
+			}
+		}
+	}
+	return found
+}
+
+// checkRule builds r as the rule engine would, disabled or not, and returns
+// its problems. Domain sets are loaded.
+func checkRule(r config.Rule, target common.ActionTarget, problems *problemLog) (found []string) {
+	r.Enabled = true
+	found = problems.collect(func() {
+		defer func() {
+			if v := recover(); v != nil {
+				slog.Error("Rule engine panicked", slog.Any("panic", v))
+			}
+		}()
+		if _, err := rule.NewEngine("", &[]config.Rule{r}, nil, target); err != nil {
+			slog.Error("rule.NewEngine", slog.Any("error", err))
+		}
+	})
+	if common.RuleType(r.Type) == common.RuleTypeDomainSet {
+		domains, err := match.LoadDomainSet(r.MatchValue)
+		if err != nil {
+			found = append(found, fmt.Sprintf("domain set %s: %v", r.MatchValue, err))
+		} else if len(domains) == 0 {
+			found = append(found, fmt.Sprintf("domain set %s is empty", r.MatchValue))
+		}
+	}
+	return found
+}
+
+// problemLog is a slog.Handler keeping the warnings and errors logged while
+// collecting, and dropping every other record.
+type problemLog struct {
+	mu         sync.Mutex
+	collecting bool
+	problems   []string
+}
+
+// collect runs fn and returns the warnings and errors it logged.
+func (l *problemLog) collect(fn func()) []string {
+	l.mu.Lock()
+	l.collecting, l.problems = true, nil
+	l.mu.Unlock()
+
+	fn()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.collecting = false
+	return l.problems
+}
+
+func (l *problemLog) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn
+}
+
+func (l *problemLog) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key != "rule" { // reported by the caller
+			fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		}
+		return true
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.collecting {
+		l.problems = append(l.problems, b.String())
+	}
+	return nil
+}
+
+func (l *problemLog) WithAttrs([]slog.Attr) slog.Handler { return l }
+
+func (l *problemLog) WithGroup(string) slog.Handler { return l }
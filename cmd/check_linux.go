@@ -0,0 +1,66 @@
+//go:build linux
+
+package cmd
+
+import (
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/l3policy"
+	"github.com/sunbk201/ua3f/internal/netfilter"
+	"github.com/sunbk201/ua3f/internal/server/desync"
+	"github.com/sunbk201/ua3f/internal/server/dnssniff"
+	"github.com/sunbk201/ua3f/internal/server/netlink"
+	"github.com/sunbk201/ua3f/internal/server/nfqueue"
+	"github.com/sunbk201/ua3f/internal/server/redirect"
+	"github.com/sunbk201/ua3f/internal/server/tproxy"
+)
+
+// checkFirewalls builds the servers cfg would start, without starting them,
+// and returns the nftables rules they would install along with their
+// problems. iptables rules are not shown.
+func checkFirewalls(cfg *config.Config, problems *problemLog) ([]firewallRules, []string) {
+	var (
+		rules []firewallRules
+		found []string
+	)
+	add := func(name string, build func() *netfilter.Firewall) {
+		var fw *netfilter.Firewall
+		for _, p := range problems.collect(func() { fw = build() }) {
+			found = append(found, name+": "+p)
+		}
+		if fw == nil {
+			return
+		}
+		ruleset, err := fw.NftDryRun()
+		if err != nil {
+			found = append(found, name+": "+err.Error())
+			return
+		}
+		rules = append(rules, firewallRules{server: name, rules: ruleset})
+	}
+
+	for _, l := range cfg.ServerListeners() {
+		lcfg := cfg.ForListener(l)
+		name := string(l.ServerMode)
+		switch l.ServerMode {
+		case config.ServerModeTProxy:
+			add(name, func() *netfilter.Firewall { return &tproxy.New(lcfg, nil, nil, nil, nil).Firewall })
+		case config.ServerModeRedirect:
+			add(name, func() *netfilter.Firewall { return &redirect.New(lcfg, nil, nil, nil, nil).Firewall })
+		case config.ServerModeNFQueue:
+			add(name, func() *netfilter.Firewall { return &nfqueue.New(lcfg, nil, nil).Firewall })
+		}
+	}
+	add("L3 rewrite", func() *netfilter.Firewall {
+		if helper := netlink.New(cfg); helper.FirewallNeeded() {
+			return &helper.Firewall
+		}
+		return nil
+	})
+	if cfg.Desync.Reorder || cfg.Desync.Inject || cfg.Desync.TLS || cfg.Desync.AutoProbe || l3policy.DesyncEnabled(&cfg.L3Rewrite) {
+		add("desync", func() *netfilter.Firewall { return &desync.New(cfg).Firewall })
+	}
+	if cfg.DNSSniff.Enabled {
+		add("DNS sniff", func() *netfilter.Firewall { return &dnssniff.New(cfg).Firewall })
+	}
+	return rules, found
+}
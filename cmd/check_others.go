@@ -0,0 +1,10 @@
+//go:build !linux
+
+package cmd
+
+import "github.com/sunbk201/ua3f/internal/config"
+
+// checkFirewalls returns no firewall rules, as they are only set up on Linux.
+func checkFirewalls(cfg *config.Config, problems *problemLog) ([]firewallRules, []string) {
+	return nil, nil
+}
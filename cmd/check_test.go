@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	domains := filepath.Join(dir, "domains.txt")
+	if err := os.WriteFile(domains, []byte("example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, yaml string) (stdout, stderr string, err error) {
+		t.Helper()
+		path := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var out, errOut bytes.Buffer
+		rootCmd.SetOut(&out)
+		rootCmd.SetErr(&errOut)
+		rootCmd.SetArgs([]string{"check", "-c", path})
+		t.Cleanup(func() {
+			rootCmd.SetOut(nil)
+			rootCmd.SetErr(nil)
+			rootCmd.SetArgs(nil)
+		})
+		err = rootCmd.Execute()
+		return out.String(), errOut.String(), err
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		stdout, stderr, err := check(t, `
+server-mode: NFQUEUE
+header-rewrite:
+  - type: DOMAIN-SET
+    match-value: `+domains+`
+    action: REPLACE-REGEX
+    rewrite-header: User-Agent
+    rewrite-regex: "(Windows|Android)"
+    rewrite-value: UA3F
+`)
+		if err != nil {
+			t.Fatalf("check error = %v\n%s", err, stderr)
+		}
+		if runtime.GOOS == "linux" && !strings.Contains(stdout, "add table inet UA3F") {
+			t.Errorf("check printed no nftables table:\n%s", stdout)
+		}
+	})
+
+	t.Run("invalid rules", func(t *testing.T) {
+		_, stderr, err := check(t, `
+server-mode: NFQUEUE
+header-rewrite:
+  - type: DOMAIN-SET
+    match-value: `+filepath.Join(dir, "missing.txt")+`
+    action: DIRECT
+  - type: HEADER-KEYWORD
+    enabled: false
+    match-header: User-Agent
+    match-value: Windows
+    action: REPLACE-REGEX
+    rewrite-header: User-Agent
+    rewrite-regex: "(Windows"
+    rewrite-value: UA3F
+`)
+		if err == nil {
+			t.Fatalf("check succeeded, want an error:\n%s", stderr)
+		}
+		for _, want := range []string{"header-rewrite[0]: domain set", "header-rewrite[1]: regexp2.Compile"} {
+			if !strings.Contains(stderr, want) {
+				t.Errorf("check output has no %q:\n%s", want, stderr)
+			}
+		}
+	})
+}
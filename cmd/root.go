@@ -13,9 +13,13 @@ import (
 	"github.com/sunbk201/ua3f/internal/api"
 	"github.com/sunbk201/ua3f/internal/config"
 	"github.com/sunbk201/ua3f/internal/daemon"
+	"github.com/sunbk201/ua3f/internal/dns"
+	"github.com/sunbk201/ua3f/internal/l3policy"
 	"github.com/sunbk201/ua3f/internal/log"
 	"github.com/sunbk201/ua3f/internal/server"
+	"github.com/sunbk201/ua3f/internal/server/base"
 	"github.com/sunbk201/ua3f/internal/server/desync"
+	"github.com/sunbk201/ua3f/internal/server/dnssniff"
 	"github.com/sunbk201/ua3f/internal/server/netlink"
 )
 
@@ -43,6 +47,8 @@ func init() {
 	rootCmd.Flags().StringP("bind", "b", "", "Bind address")
 	rootCmd.Flags().IntP("port", "p", 0, "Port")
 	rootCmd.Flags().StringP("log-level", "l", "", "Log level")
+	rootCmd.Flags().String("log-format", "", "Log format: text or json")
+	rootCmd.Flags().StringToString("log-levels", nil, "Log levels of modules, e.g. mitm=debug,nfqueue=warn")
 	rootCmd.Flags().StringP("ua", "f", "", "User-Agent")
 	rootCmd.Flags().StringP("ua-regex", "r", "", "User-Agent regex")
 	rootCmd.Flags().BoolP("partial", "s", false, "Enable regex partial replace")
@@ -51,8 +57,10 @@ func init() {
 	rootCmd.Flags().String("api-server-secret", "", "api-server secret for authentication, empty to disable auth")
 	rootCmd.Flags().BoolP("version", "v", false, "Show version")
 	rootCmd.Flags().BoolP("generate-config", "g", false, "Generate template config file")
+	rootCmd.Flags().Bool("generate-schema", false, "Generate the JSON Schema of the config file")
 
 	rootCmd.Flags().Bool("include-lan-routes", false, "Include LAN routes from proxying")
+	rootCmd.Flags().Bool("watch-config", true, "Reload when the config file changes")
 
 	// Long flags
 	rootCmd.Flags().String("header-rewrite", "", "Header rewrite json rules")
@@ -78,6 +86,21 @@ func init() {
 	rootCmd.Flags().Bool("desync-inject", false, "Enable desync inject")
 	rootCmd.Flags().Uint("desync-inject-ttl", 0, "Desync inject TTL")
 	rootCmd.Flags().String("desync-ports", "", "Desync ports")
+	rootCmd.Flags().Bool("desync-tls", false, "Enable TLS ClientHello desync strategies")
+	rootCmd.Flags().Bool("desync-auto-probe", false, "Probe desync strategies per destination on handshake failures")
+	rootCmd.Flags().String("desync-probe-ports", "", "Destination ports to auto-probe (comma-separated)")
+	rootCmd.Flags().String("desync-probe-file", "", "File the desync probe results are persisted to")
+
+	rootCmd.Flags().Bool("dns-sniff", false, "Enable passive DNS sniffing to map destination IPs back to domains")
+
+	// DNS flags
+	rootCmd.Flags().Bool("dns", false, "Enable the built-in DNS server")
+	rootCmd.Flags().String("dns-listen", "", "DNS server listen address (e.g. 127.0.0.1:1053)")
+	rootCmd.Flags().StringSlice("dns-upstream", nil, "DNS upstreams: udp://, tcp://, tls:// or https:// (comma-separated)")
+	rootCmd.Flags().Int("dns-cache-size", 0, "DNS answer cache size")
+	rootCmd.Flags().Bool("dns-fake-ip", false, "Answer A queries with fake IPs")
+	rootCmd.Flags().String("dns-fake-ip-range", "", "Fake IP range (IPv4 CIDR)")
+	rootCmd.Flags().String("dns-fake-ip-filter", "", "Domains excluded from fake IP (comma-separated, suffix match)")
 
 	// MitM flags
 	rootCmd.Flags().Bool("mitm", false, "Enable HTTPS MitM")
@@ -87,15 +110,30 @@ func init() {
 	rootCmd.Flags().String("mitm-ca-passphrase", "", "Passphrase for MitM CA PKCS#12 file")
 	rootCmd.Flags().Bool("mitm-insecure-skip-verify", false, "Skip server certificate verification in MitM")
 
+	rootCmd.Flags().String("socks5-htpasswd", "", "Path to htpasswd file for SOCKS5 authentication")
+	rootCmd.Flags().String("http-htpasswd", "", "Path to htpasswd file for HTTP proxy authentication")
+
 	// BPF
 	rootCmd.Flags().Bool("bpf-offload", false, "Enable BPF offloading (requires kernel support)")
 
+	// Statistics store flags
+	rootCmd.Flags().Bool("stats-store", false, "Persist hourly and daily statistics rollups to disk")
+	rootCmd.Flags().String("stats-store-path", "", "File the statistics rollups are persisted to")
+	rootCmd.Flags().Int("stats-store-max-size", 0, "Maximum size of the statistics store in KiB")
+
+	// Audit log flags
+	rootCmd.Flags().Bool("audit-log", false, "Write every rule decision to a JSON lines audit log")
+	rootCmd.Flags().String("audit-log-path", "", "File the audit log is written to")
+	rootCmd.Flags().Float64("audit-log-sample-rate", 0, "Fraction of requests and responses audited (0-1)")
+
 	// Bind all flags to viper using consistent key names
 	_ = viper.BindPFlag("config", rootCmd.Flags().Lookup("config"))
 	_ = viper.BindPFlag("server-mode", rootCmd.Flags().Lookup("mode"))
 	_ = viper.BindPFlag("bind-address", rootCmd.Flags().Lookup("bind"))
 	_ = viper.BindPFlag("port", rootCmd.Flags().Lookup("port"))
 	_ = viper.BindPFlag("log-level", rootCmd.Flags().Lookup("log-level"))
+	_ = viper.BindPFlag("log-format", rootCmd.Flags().Lookup("log-format"))
+	_ = viper.BindPFlag("log-levels", rootCmd.Flags().Lookup("log-levels"))
 	_ = viper.BindPFlag("user-agent", rootCmd.Flags().Lookup("ua"))
 	_ = viper.BindPFlag("user-agent-regex", rootCmd.Flags().Lookup("ua-regex"))
 	_ = viper.BindPFlag("user-agent-partial-replace", rootCmd.Flags().Lookup("partial"))
@@ -105,6 +143,7 @@ func init() {
 	_ = viper.BindPFlag("url-redirect-json", rootCmd.Flags().Lookup("url-redirect"))
 
 	_ = viper.BindPFlag("include-lan-routes", rootCmd.Flags().Lookup("include-lan-routes"))
+	_ = viper.BindPFlag("watch-config", rootCmd.Flags().Lookup("watch-config"))
 
 	_ = viper.BindPFlag("ttl", rootCmd.Flags().Lookup("ttl"))
 	_ = viper.BindPFlag("ipid", rootCmd.Flags().Lookup("ipid"))
@@ -125,6 +164,20 @@ func init() {
 	_ = viper.BindPFlag("desync.inject", rootCmd.Flags().Lookup("desync-inject"))
 	_ = viper.BindPFlag("desync.inject-ttl", rootCmd.Flags().Lookup("desync-inject-ttl"))
 	_ = viper.BindPFlag("desync.desync-ports", rootCmd.Flags().Lookup("desync-ports"))
+	_ = viper.BindPFlag("desync.tls", rootCmd.Flags().Lookup("desync-tls"))
+	_ = viper.BindPFlag("desync.auto-probe", rootCmd.Flags().Lookup("desync-auto-probe"))
+	_ = viper.BindPFlag("desync.probe-ports", rootCmd.Flags().Lookup("desync-probe-ports"))
+	_ = viper.BindPFlag("desync.probe-file", rootCmd.Flags().Lookup("desync-probe-file"))
+
+	_ = viper.BindPFlag("dns-sniff.enabled", rootCmd.Flags().Lookup("dns-sniff"))
+
+	_ = viper.BindPFlag("dns.enabled", rootCmd.Flags().Lookup("dns"))
+	_ = viper.BindPFlag("dns.listen", rootCmd.Flags().Lookup("dns-listen"))
+	_ = viper.BindPFlag("dns.upstreams", rootCmd.Flags().Lookup("dns-upstream"))
+	_ = viper.BindPFlag("dns.cache-size", rootCmd.Flags().Lookup("dns-cache-size"))
+	_ = viper.BindPFlag("dns.fake-ip", rootCmd.Flags().Lookup("dns-fake-ip"))
+	_ = viper.BindPFlag("dns.fake-ip-range", rootCmd.Flags().Lookup("dns-fake-ip-range"))
+	_ = viper.BindPFlag("dns.fake-ip-filter", rootCmd.Flags().Lookup("dns-fake-ip-filter"))
 
 	_ = viper.BindPFlag("api-server", rootCmd.Flags().Lookup("api-server"))
 	_ = viper.BindPFlag("api-server-secret", rootCmd.Flags().Lookup("api-server-secret"))
@@ -136,8 +189,19 @@ func init() {
 	_ = viper.BindPFlag("mitm.ca-passphrase", rootCmd.Flags().Lookup("mitm-ca-passphrase"))
 	_ = viper.BindPFlag("mitm.insecure-skip-verify", rootCmd.Flags().Lookup("mitm-insecure-skip-verify"))
 
+	_ = viper.BindPFlag("socks5.auth.htpasswd", rootCmd.Flags().Lookup("socks5-htpasswd"))
+	_ = viper.BindPFlag("http-proxy.auth.htpasswd", rootCmd.Flags().Lookup("http-htpasswd"))
+
 	_ = viper.BindPFlag("bpf-offload", rootCmd.Flags().Lookup("bpf-offload"))
 
+	_ = viper.BindPFlag("stats-store.enabled", rootCmd.Flags().Lookup("stats-store"))
+	_ = viper.BindPFlag("stats-store.path", rootCmd.Flags().Lookup("stats-store-path"))
+	_ = viper.BindPFlag("stats-store.max-size", rootCmd.Flags().Lookup("stats-store-max-size"))
+
+	_ = viper.BindPFlag("audit-log.enabled", rootCmd.Flags().Lookup("audit-log"))
+	_ = viper.BindPFlag("audit-log.path", rootCmd.Flags().Lookup("audit-log-path"))
+	_ = viper.BindPFlag("audit-log.sample-rate", rootCmd.Flags().Lookup("audit-log-sample-rate"))
+
 	// Bind environment variables
 	viper.SetEnvPrefix("UA3F")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
@@ -148,12 +212,14 @@ func init() {
 	_ = viper.BindEnv("bind-address", "UA3F_BIND_ADDRESS")
 	_ = viper.BindEnv("port", "UA3F_PORT")
 	_ = viper.BindEnv("log-level", "UA3F_LOG_LEVEL")
+	_ = viper.BindEnv("log-format", "UA3F_LOG_FORMAT")
 	_ = viper.BindEnv("rewrite-mode", "UA3F_REWRITE_MODE")
 	_ = viper.BindEnv("user-agent", "UA3F_PAYLOAD_UA")
 	_ = viper.BindEnv("user-agent-regex", "UA3F_UA_REGEX")
 	_ = viper.BindEnv("user-agent-partial-replace", "UA3F_PARTIAL_REPLACE")
 
 	_ = viper.BindEnv("include-lan-routes", "UA3F_INCLUDE_LAN_ROUTES")
+	_ = viper.BindEnv("watch-config", "UA3F_WATCH_CONFIG")
 
 	_ = viper.BindEnv("ttl", "UA3F_TTL")
 	_ = viper.BindEnv("ipid", "UA3F_IPID")
@@ -174,6 +240,20 @@ func init() {
 	_ = viper.BindEnv("desync.inject", "UA3F_DESYNC_INJECT")
 	_ = viper.BindEnv("desync.inject-ttl", "UA3F_DESYNC_INJECT_TTL")
 	_ = viper.BindEnv("desync.desync-ports", "UA3F_DESYNC_PORTS")
+	_ = viper.BindEnv("desync.tls", "UA3F_DESYNC_TLS")
+	_ = viper.BindEnv("desync.auto-probe", "UA3F_DESYNC_AUTO_PROBE")
+	_ = viper.BindEnv("desync.probe-ports", "UA3F_DESYNC_PROBE_PORTS")
+	_ = viper.BindEnv("desync.probe-file", "UA3F_DESYNC_PROBE_FILE")
+
+	_ = viper.BindEnv("dns-sniff.enabled", "UA3F_DNS_SNIFF_ENABLED")
+
+	_ = viper.BindEnv("dns.enabled", "UA3F_DNS_ENABLED")
+	_ = viper.BindEnv("dns.listen", "UA3F_DNS_LISTEN")
+	_ = viper.BindEnv("dns.upstreams", "UA3F_DNS_UPSTREAMS")
+	_ = viper.BindEnv("dns.cache-size", "UA3F_DNS_CACHE_SIZE")
+	_ = viper.BindEnv("dns.fake-ip", "UA3F_DNS_FAKE_IP")
+	_ = viper.BindEnv("dns.fake-ip-range", "UA3F_DNS_FAKE_IP_RANGE")
+	_ = viper.BindEnv("dns.fake-ip-filter", "UA3F_DNS_FAKE_IP_FILTER")
 
 	_ = viper.BindEnv("mitm.enabled", "UA3F_MITM_ENABLED")
 	_ = viper.BindEnv("mitm.hostname", "UA3F_MITM_HOSTNAME")
@@ -182,8 +262,24 @@ func init() {
 	_ = viper.BindEnv("mitm.ca-passphrase", "UA3F_MITM_CA_PASSPHRASE")
 	_ = viper.BindEnv("mitm.insecure-skip-verify", "UA3F_MITM_INSECURE_SKIP_VERIFY")
 
+	_ = viper.BindEnv("socks5.auth.htpasswd", "UA3F_SOCKS5_HTPASSWD")
+	_ = viper.BindEnv("http-proxy.auth.htpasswd", "UA3F_HTTP_PROXY_HTPASSWD")
+
 	_ = viper.BindEnv("bpf-offload", "UA3F_BPF_OFFLOAD")
 
+	_ = viper.BindEnv("stats-store.enabled", "UA3F_STATS_STORE")
+	_ = viper.BindEnv("stats-store.path", "UA3F_STATS_STORE_PATH")
+	_ = viper.BindEnv("stats-store.hourly-retention", "UA3F_STATS_STORE_HOURLY_RETENTION")
+	_ = viper.BindEnv("stats-store.daily-retention", "UA3F_STATS_STORE_DAILY_RETENTION")
+	_ = viper.BindEnv("stats-store.max-size", "UA3F_STATS_STORE_MAX_SIZE")
+
+	_ = viper.BindEnv("audit-log.enabled", "UA3F_AUDIT_LOG")
+	_ = viper.BindEnv("audit-log.path", "UA3F_AUDIT_LOG_PATH")
+	_ = viper.BindEnv("audit-log.sample-rate", "UA3F_AUDIT_LOG_SAMPLE_RATE")
+	_ = viper.BindEnv("audit-log.max-size", "UA3F_AUDIT_LOG_MAX_SIZE")
+	_ = viper.BindEnv("audit-log.max-backups", "UA3F_AUDIT_LOG_MAX_BACKUPS")
+	_ = viper.BindEnv("audit-log.max-age", "UA3F_AUDIT_LOG_MAX_AGE")
+
 	_ = viper.BindEnv("api-server", "UA3F_API_SERVER")
 	_ = viper.BindEnv("api-server-secret", "UA3F_API_SERVER_SECRET")
 
@@ -205,7 +301,9 @@ func initConfig() {
 	viper.SetDefault("server-mode", "SOCKS5")
 	viper.SetDefault("bind-address", "127.0.0.1")
 	viper.SetDefault("port", 1080)
+	viper.SetDefault("watch-config", true)
 	viper.SetDefault("log-level", "info")
+	viper.SetDefault("log-format", "text")
 	viper.SetDefault("user-agent", "FFF")
 	viper.SetDefault("rewrite-mode", "GLOBAL")
 	viper.SetDefault("l3-rewrite.ttl-value", config.DefaultTTL)
@@ -213,6 +311,10 @@ func initConfig() {
 	viper.SetDefault("desync.reorder-bytes", 8)
 	viper.SetDefault("desync.reorder-packets", 1500)
 	viper.SetDefault("desync.inject-ttl", 3)
+
+	viper.SetDefault("dns.listen", config.DefaultDNSListen)
+	viper.SetDefault("dns.cache-size", config.DefaultDNSCacheSize)
+	viper.SetDefault("dns.fake-ip-range", config.DefaultFakeIPRange)
 }
 
 func runRoot(cmd *cobra.Command, args []string) error {
@@ -234,6 +336,16 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	// Handle --generate-schema
+	genSchema, _ := cmd.Flags().GetBool("generate-schema")
+	if genSchema {
+		if _, err := config.GenerateSchema(true); err != nil {
+			return fmt.Errorf("failed to generate config schema: %w", err)
+		}
+		fmt.Printf("JSON Schema '%s' generated successfully.\n", config.SchemaFile)
+		return nil
+	}
+
 	// Build config from flags/env/config file
 	cfg, err := config.BuildConfigFromViper()
 	if err != nil {
@@ -241,11 +353,14 @@ func runRoot(cmd *cobra.Command, args []string) error {
 	}
 
 	// Set up logging and log the configuration
-	logBroadcaster, err := log.SetLogConf(cfg.LogLevel)
+	logBroadcaster, err := log.SetLogConf(cfg)
 	if err != nil {
 		return fmt.Errorf("log setup error: %w", err)
 	}
 	log.LogHeader(AppVersion, cfg)
+	if err := log.SetAuditConf(cfg.AuditLog); err != nil {
+		return fmt.Errorf("audit log setup error: %w", err)
+	}
 
 	if err := daemon.DaemonSetup(cfg); err != nil {
 		slog.Error("daemon.DaemonSetup", slog.Any("error", err))
@@ -269,7 +384,7 @@ func runRoot(cmd *cobra.Command, args []string) error {
 	}
 
 	// Start desync server if enabled
-	if cfg.Desync.Reorder || cfg.Desync.Inject {
+	if cfg.Desync.Reorder || cfg.Desync.Inject || cfg.Desync.TLS || cfg.Desync.AutoProbe || l3policy.DesyncEnabled(&cfg.L3Rewrite) {
 		apiSrv.Desync = desync.New(cfg)
 		if err := apiSrv.Desync.Start(); err != nil {
 			slog.Error("desync.Start", slog.Any("error", err))
@@ -278,6 +393,31 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// Start DNS server if enabled
+	if cfg.DNS.Enabled {
+		if apiSrv.DNS, err = dns.NewServer(cfg, base.SO_MARK); err != nil {
+			slog.Error("dns.NewServer", slog.Any("error", err))
+			apiSrv.CloseSystem()
+			return err
+		}
+		if err := apiSrv.DNS.Start(); err != nil {
+			slog.Error("dns.Start", slog.Any("error", err))
+			apiSrv.DNS = nil
+			apiSrv.CloseSystem()
+			return err
+		}
+	}
+
+	// Start DNS sniffer if enabled
+	if cfg.DNSSniff.Enabled {
+		apiSrv.DNSSniff = dnssniff.New(cfg)
+		if err := apiSrv.DNSSniff.Start(); err != nil {
+			slog.Error("dnssniff.Start", slog.Any("error", err))
+			apiSrv.CloseSystem()
+			return err
+		}
+	}
+
 	// Start main server
 	srv, err := server.NewServer(cfg)
 	if err != nil {
@@ -292,6 +432,19 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	// Reload on config file changes as on SIGHUP
+	var watcher *config.Watcher
+	if path := viper.ConfigFileUsed(); path != "" && cfg.WatchConfig {
+		watcher, err = config.Watch(path, func() {
+			if err := apiSrv.RestartSystem(); err != nil {
+				slog.Error("Failed to reload ua3f", slog.Any("error", err))
+			}
+		})
+		if err != nil {
+			slog.Warn("config.Watch", slog.Any("error", err))
+		}
+	}
+
 	cleanup := make(chan os.Signal, 1)
 	signal.Notify(cleanup, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
 	for {
@@ -299,6 +452,10 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		slog.Info("Received signal", slog.String("signal", s.String()))
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM:
+			// Stop reloading before the servers are closed.
+			if watcher != nil {
+				_ = watcher.Close()
+			}
 			apiSrv.CloseSystem()
 			return nil
 		case syscall.SIGHUP:
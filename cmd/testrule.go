@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/rewrite"
+	"github.com/sunbk201/ua3f/internal/rule/match"
+)
+
+var testRuleCmd = &cobra.Command{
+	Use:   "test-rule",
+	Short: "Run a synthetic request through the rewrite rules",
+	Long: `Run a synthetic request, and optionally its response, through the rewriter
+the config sets up, and print the rules matched in order, whether each let the
+next rules run, and the request and response as they would be forwarded.
+Nothing is sent anywhere, and remote domain sets are not downloaded.`,
+	Example: `  ua3f test-rule -c config.yaml --url https://example.com/ -H "User-Agent: curl/8.0"
+  ua3f test-rule -c config.yaml --url http://example.com/ --status 200 --response-header "Server: nginx"`,
+	Args: cobra.NoArgs,
+	RunE: runTestRule,
+}
+
+var (
+	testRuleConfigFile      string
+	testRuleRequest         rewrite.SimulatedRequest
+	testRuleHeaders         []string
+	testRuleStatus          int
+	testRuleResponseHeaders []string
+	testRuleResponseBody    string
+	testRuleJSON            bool
+)
+
+func init() {
+	f := testRuleCmd.Flags()
+	f.StringVarP(&testRuleConfigFile, "config", "c", "", "Config file path")
+	f.StringVarP(&testRuleRequest.Method, "method", "X", http.MethodGet, "Request method")
+	f.StringVar(&testRuleRequest.URL, "url", "", "Request URL")
+	f.StringArrayVarP(&testRuleHeaders, "header", "H", nil, `Request header as "Name: value", repeatable`)
+	f.StringVar(&testRuleRequest.Body, "body", "", "Request body")
+	f.StringVar(&testRuleRequest.Src, "src", "", "Client address, as ip:port")
+	f.StringVar(&testRuleRequest.Dst, "dst", "", "Server address, as ip:port (default the URL host)")
+	f.StringVar(&testRuleRequest.User, "user", "", "Authenticated username")
+	f.IntVar(&testRuleStatus, "status", 0, "Response status, simulates a response when set")
+	f.StringArrayVar(&testRuleResponseHeaders, "response-header", nil, `Response header as "Name: value", repeatable`)
+	f.StringVar(&testRuleResponseBody, "response-body", "", "Response body")
+	f.BoolVar(&testRuleJSON, "json", false, "Print the result as JSON")
+	_ = testRuleCmd.MarkFlagRequired("url")
+	rootCmd.AddCommand(testRuleCmd)
+}
+
+func runTestRule(cmd *cobra.Command, args []string) error {
+	if testRuleConfigFile != "" {
+		viper.SetConfigFile(testRuleConfigFile)
+		if err := viper.MergeInConfig(); err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+	cfg, err := config.BuildConfigFromViper()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	req := testRuleRequest
+	if req.Headers, err = parseHeaders(testRuleHeaders); err != nil {
+		return err
+	}
+	if testRuleStatus != 0 || len(testRuleResponseHeaders) > 0 || testRuleResponseBody != "" {
+		req.Response = &rewrite.SimulatedResponse{Status: testRuleStatus, Body: testRuleResponseBody}
+		if req.Response.Headers, err = parseHeaders(testRuleResponseHeaders); err != nil {
+			return err
+		}
+	}
+
+	// Only warnings, such as invalid rules, are worth showing.
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(cmd.ErrOrStderr(), &slog.HandlerOptions{Level: slog.LevelWarn})))
+	defer slog.SetDefault(defaultLogger)
+
+	// Remote domain sets are not downloaded; they match nothing and are
+	// listed in the warnings.
+	match.SkipRemote = true
+	rw, err := rewrite.New(cfg, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), time.Minute)
+	defer cancel()
+	if err := rewrite.WaitDomainSets(ctx, rw); err != nil {
+		return fmt.Errorf("loading domain sets: %w", err)
+	}
+	sim, err := rewrite.Simulate(rw, &req)
+	if err != nil {
+		return err
+	}
+
+	if testRuleJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(sim)
+	}
+	printSimulation(cmd.OutOrStdout(), sim)
+	return nil
+}
+
+// parseHeaders parses "Name: value" headers.
+func parseHeaders(lines []string) (map[string]string, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string, len(lines))
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, want \"Name: value\"", line)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+func printSimulation(w io.Writer, sim *rewrite.Simulation) {
+	fmt.Fprintf(w, "Rewrite mode: %s\n", sim.RewriteMode)
+	for _, warning := range sim.Warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+
+	fmt.Fprintln(w, "\nRules:")
+	if len(sim.Steps) == 0 {
+		fmt.Fprintln(w, "  none evaluated")
+	}
+	for _, step := range sim.Steps {
+		if step.RuleIndex < 0 {
+			fmt.Fprintf(w, "  %-8s %s: no rule matched\n", step.Direction, step.List)
+			continue
+		}
+		rule, _ := json.Marshal(step.Rule)
+		fmt.Fprintf(w, "  %-8s %s[%d] %s -> %s", step.Direction, step.List, step.RuleIndex, rule, step.Action)
+		if step.Header != "" {
+			fmt.Fprintf(w, " %s: %q => %q", step.Header, step.Before, step.After)
+		}
+		if step.Error != "" {
+			fmt.Fprintf(w, " error: %s", step.Error)
+		}
+		if step.Continue {
+			fmt.Fprint(w, ", continue")
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\nVerdict: %s\n", sim.Verdict)
+	if sim.Redirect != "" {
+		fmt.Fprintf(w, "\nSent back to the client:\n%s\n", strings.TrimRight(sim.Redirect, "\r\n"))
+	}
+
+	fmt.Fprintf(w, "\nRequest:\n%s %s\n", sim.Request.Method, sim.Request.URL)
+	printHeaders(w, sim.Request.Headers)
+	if sim.Request.Body != "" {
+		fmt.Fprintf(w, "\n%s\n", sim.Request.Body)
+	}
+	if sim.Response != nil {
+		fmt.Fprintf(w, "\nResponse:\n%d %s\n", sim.Response.Status, http.StatusText(sim.Response.Status))
+		printHeaders(w, sim.Response.Headers)
+		if sim.Response.Body != "" {
+			fmt.Fprintf(w, "\n%s\n", sim.Response.Body)
+		}
+	}
+}
+
+func printHeaders(w io.Writer, headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\n", name, headers[name])
+	}
+}
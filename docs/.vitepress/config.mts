@@ -44,7 +44,8 @@ const enSidebar = [
       { text: 'IPID', link: '/l3/ipid' },
       { text: 'TCP Timestamp', link: '/l3/tcp-timestamp' },
       { text: 'TCP Initial Window', link: '/l3/tcp-initial-window' },
-      { text: 'QUIC Block', link: '/l3/block-quic' }
+      { text: 'QUIC Block', link: '/l3/block-quic' },
+      { text: 'L3 Rules', link: '/l3/rules' }
     ]
   },
   {
@@ -53,7 +54,8 @@ const enSidebar = [
     items: [
       { text: 'Overview', link: '/desync/overview' },
       { text: 'TCP Segment Reordering', link: '/desync/tcp-reorder' },
-      { text: 'TCP Obfuscation Injection', link: '/desync/tcp-inject' }
+      { text: 'TCP Obfuscation Injection', link: '/desync/tcp-inject' },
+      { text: 'TLS ClientHello Desync', link: '/desync/tls' }
     ]
   },
   {
@@ -114,7 +116,8 @@ const zhSidebar = [
       { text: 'IPID', link: '/zh/l3/ipid' },
       { text: 'TCP 时间戳', link: '/zh/l3/tcp-timestamp' },
       { text: 'TCP 初始窗口', link: '/zh/l3/tcp-initial-window' },
-      { text: 'QUIC 阻断', link: '/zh/l3/block-quic' }
+      { text: 'QUIC 阻断', link: '/zh/l3/block-quic' },
+      { text: 'L3 规则', link: '/zh/l3/rules' }
     ]
   },
   {
@@ -123,7 +126,8 @@ const zhSidebar = [
     items: [
       { text: 'Desync 介绍', link: '/zh/desync/overview' },
       { text: 'TCP 分片乱序发射', link: '/zh/desync/tcp-reorder' },
-      { text: 'TCP 混淆注入', link: '/zh/desync/tcp-inject' }
+      { text: 'TCP 混淆注入', link: '/zh/desync/tcp-inject' },
+      { text: 'TLS ClientHello Desync', link: '/zh/desync/tls' }
     ]
   },
   {
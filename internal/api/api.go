@@ -3,67 +3,137 @@ package api
 import (
 	"context"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
 	applog "github.com/sunbk201/ua3f/internal/log"
+	"github.com/sunbk201/ua3f/internal/server/base"
 	"github.com/sunbk201/ua3f/internal/server/desync"
+	"github.com/sunbk201/ua3f/internal/server/dnssniff"
 	"github.com/sunbk201/ua3f/internal/server/netlink"
 )
 
 type APIServer struct {
 	Server         common.Server
-	cfg            *config.Config
+	cfg            atomic.Pointer[config.Config]
+	mu             sync.Mutex // serializes RestartSystem, CloseSystem and rule edits
+	rulesRevision  uint64     // bumped on every rule change, guarded by mu
+	closed         bool       // set by CloseSystem, guarded by mu
 	httpServer     *http.Server
 	logBroadcaster *applog.Broadcaster
 	Helper         *netlink.Server
 	Desync         *desync.Server
+	DNSSniff       *dnssniff.Server
+	DNS            *dns.Server
 	version        string
 	addr           string
 }
 
 func New(version string, cfg *config.Config, lb *applog.Broadcaster) *APIServer {
-	return &APIServer{
+	s := &APIServer{
 		version:        version,
-		cfg:            cfg,
 		addr:           cfg.APIServer,
 		logBroadcaster: lb,
 	}
+	s.cfg.Store(cfg)
+	metricsVersion.Store(&version)
+	return s
 }
 
 func (s *APIServer) Start() error {
-	if s.cfg.APIServer == "" {
+	if s.cfg.Load().APIServer == "" {
 		return nil
 	}
 
+	s.httpServer = &http.Server{
+		Addr:              s.addr,
+		Handler:           s.routes(),
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("api-server listen failed: %w", err)
+	}
+
+	slog.Info("api-server started", slog.String("addr", s.addr))
+
+	go func() {
+		if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("api-server error", slog.Any("error", err))
+		}
+	}()
+
+	return nil
+}
+
+// routes returns the handler serving the API.
+func (s *APIServer) routes() http.Handler {
+	cfg := s.cfg.Load()
 	r := chi.NewRouter()
 
 	r.Use(slogMiddleware)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RealIP)
 
-	if s.cfg.APIServerSecret != "" {
+	if cfg.APIServerSecret != "" {
 		r.Use(s.authMiddleware)
 	}
 
 	// api routes
 	r.Get("/version", s.handleVersion)
 	r.Get("/config", s.handleConfig)
+	r.Get("/config/schema", s.handleConfigSchema)
+	r.Route("/config/rules/{list}", func(r chi.Router) {
+		r.Get("/", s.handleListRules)
+		r.Post("/", s.handleAddRule)
+		r.Put("/{index}", s.handleReplaceRule)
+		r.Patch("/{index}", s.handleUpdateRule)
+		r.Delete("/{index}", s.handleDeleteRule)
+	})
 
 	r.Get("/rules", s.handleRules)
 	r.Get("/rules/header", s.handleHeaderRules)
 	r.Get("/rules/body", s.handleBodyRules)
 	r.Get("/rules/redirect", s.handleRedirectRules)
+	r.Post("/rules/test", s.handleTestRule)
 
 	r.Get("/logs", s.handleLogs)
+	r.Get("/logs/levels", s.handleLogLevels)
+	r.Put("/logs/levels", s.handleSetLogLevels)
+	r.Get("/audit", s.handleAudit)
+
+	r.Get("/dns/cache", s.handleDNSCache)
+
+	r.Get("/desync/probe", s.handleDesyncProbe)
+	r.Delete("/desync/probe", s.handleDesyncProbeReset)
+
+	r.Get("/bpf/stats", s.handleBPFStats)
+
+	r.Get("/metrics", s.handleMetrics)
+
+	r.Get("/stats/connections", s.handleConnectionStats)
+	r.Get("/stats/connections/events", s.handleConnectionEvents)
+	r.Get("/stats/rewrites", s.handleRewriteStats)
+	r.Get("/stats/passthrough", s.handlePassThroughStats)
+	r.Get("/stats/traffic", s.handleTrafficStats)
+	r.Get("/stats/rollups", s.handleRollupStats)
 
 	r.Get("/restart", s.handleRestart)
 
@@ -77,29 +147,7 @@ func (s *APIServer) Start() error {
 	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	s.httpServer = &http.Server{
-		Addr:              s.addr,
-		Handler:           r,
-		ReadTimeout:       10 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		IdleTimeout:       60 * time.Second,
-	}
-
-	ln, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("api-server listen failed: %w", err)
-	}
-
-	slog.Info("api-server started", slog.String("addr", s.addr))
-
-	go func() {
-		if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
-			slog.Error("api-server error", slog.Any("error", err))
-		}
-	}()
-
-	return nil
+	return r
 }
 
 func (s *APIServer) Close() error {
@@ -112,7 +160,13 @@ func (s *APIServer) Close() error {
 	return s.httpServer.Shutdown(ctx)
 }
 
+// ErrSystemClosed is returned by RestartSystem once CloseSystem was called.
+var ErrSystemClosed = errors.New("ua3f is stopped")
+
 func (s *APIServer) CloseSystem() {
+	s.mu.Lock()
+	s.closed = true
+
 	if s.Server != nil {
 		s.Server.Close()
 	}
@@ -122,17 +176,83 @@ func (s *APIServer) CloseSystem() {
 	if s.Helper != nil {
 		s.Helper.Close()
 	}
+	if s.DNSSniff != nil {
+		s.DNSSniff.Close()
+	}
+	if s.DNS != nil {
+		s.DNS.Close()
+	}
+	// Unlocked first, as shutting down the API waits for handlers that may be waiting for mu.
+	s.mu.Unlock()
 	s.Close()
 	slog.Info("ua3f stopped")
 }
 
+// RestartSystem re-reads the config file and applies it. When only rewrite
+// rules, User-Agent settings, MitM hostnames, log levels or the audit log
+// changed, they are swapped into the running server so live connections are
+// kept; otherwise every component is restarted. It fails with
+// ErrSystemClosed after CloseSystem.
 func (s *APIServer) RestartSystem() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSystemClosed
+	}
+
 	newCfg, err := config.ReloadFromFile()
 	if err != nil {
 		return err
 	}
 	slog.Info("config reloaded successfully")
 
+	oldCfg := s.cfg.Load()
+	if !oldCfg.SameRules(newCfg) {
+		s.rulesRevision++
+	}
+	if newCfg.LogLevel != oldCfg.LogLevel || !maps.Equal(newCfg.LogLevels, oldCfg.LogLevels) {
+		if err := applog.SetLevels(newCfg.LogLevel, newCfg.LogLevels); err != nil {
+			return err
+		}
+	}
+	if newCfg.AuditLog != oldCfg.AuditLog {
+		if err := applog.SetAuditConf(newCfg.AuditLog); err != nil {
+			return err
+		}
+	}
+
+	if r, ok := s.Server.(common.Reloader); ok && oldCfg.HotReloadable(newCfg) {
+		if err := r.Reload(newCfg); err != nil {
+			return err
+		}
+		s.cfg.Store(newCfg)
+		slog.Info("ua3f reloaded without restart")
+		return nil
+	}
+
+	// Restart the DNS server first so the main server sees the new fake IP pool.
+	if s.DNS != nil {
+		if newCfg.DNS.Enabled {
+			if newDNS, err := s.DNS.Restart(newCfg, base.SO_MARK); err != nil {
+				return err
+			} else {
+				s.DNS = newDNS
+			}
+		} else {
+			_ = s.DNS.Close()
+			s.DNS = nil
+		}
+	} else if newCfg.DNS.Enabled {
+		newDNS, err := dns.NewServer(newCfg, base.SO_MARK)
+		if err != nil {
+			return err
+		}
+		if err := newDNS.Start(); err != nil {
+			return err
+		}
+		s.DNS = newDNS
+	}
+
 	if s.Server != nil {
 		if newServer, err := s.Server.Restart(newCfg); err != nil {
 			return err
@@ -154,6 +274,19 @@ func (s *APIServer) RestartSystem() error {
 			s.Helper = newHelper
 		}
 	}
+	if s.DNSSniff != nil {
+		if newDNSSniff, err := s.DNSSniff.Restart(newCfg); err != nil {
+			return err
+		} else {
+			s.DNSSniff = newDNSSniff
+		}
+	} else if newCfg.DNSSniff.Enabled {
+		s.DNSSniff = dnssniff.New(newCfg)
+		if err := s.DNSSniff.Start(); err != nil {
+			return err
+		}
+	}
+	s.cfg.Store(newCfg)
 	slog.Info("ua3f restarted successfully")
 	return nil
 }
@@ -184,7 +317,7 @@ func (s *APIServer) authMiddleware(next http.Handler) http.Handler {
 		if token == "" {
 			token = r.URL.Query().Get("secret")
 		}
-		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.APIServerSecret)) != 1 {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Load().APIServerSecret)) != 1 {
 			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
 			return
 		}
@@ -0,0 +1,16 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+func TestRestartSystemAfterClose(t *testing.T) {
+	s := New("test", &config.Config{}, nil)
+	s.CloseSystem()
+	if err := s.RestartSystem(); !errors.Is(err, ErrSystemClosed) {
+		t.Fatalf("RestartSystem() error = %v, want ErrSystemClosed", err)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	applog "github.com/sunbk201/ua3f/internal/log"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// handleAudit returns the last audit log entries matching the query, newest
+// first:
+//
+//	?src=&dst=&host=&url=&list=&rule_type=&action=&matched=true|false&since=&until=&limit=100
+func (s *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q := applog.AuditQuery{
+		Src:      values.Get("src"),
+		Dst:      values.Get("dst"),
+		Host:     values.Get("host"),
+		URL:      values.Get("url"),
+		List:     values.Get("list"),
+		RuleType: values.Get("rule_type"),
+		Action:   values.Get("action"),
+		Limit:    defaultAuditLimit,
+	}
+	if v := values.Get("matched"); v != "" {
+		matched, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, "matched must be true or false", http.StatusBadRequest)
+			return
+		}
+		q.Matched = &matched
+	}
+	var err error
+	if q.Since, err = parseStatsTime(values.Get("since")); err != nil {
+		writeJSONError(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseStatsTime(values.Get("until")); err != nil {
+		writeJSONError(w, "until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			writeJSONError(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	entries, err := applog.QueryAudit(q)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, "audit log is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []applog.AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"items": entries,
+	})
+}
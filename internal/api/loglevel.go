@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	applog "github.com/sunbk201/ua3f/internal/log"
+)
+
+const maxLogLevelsBody = 4 << 10
+
+// logLevels is the body of PUT /logs/levels. An empty module level makes the
+// module inherit the default level again.
+type logLevels struct {
+	Default string            `json:"default"`
+	Modules map[string]string `json:"modules"`
+}
+
+func writeLogLevels(w http.ResponseWriter) {
+	def, modules := applog.Levels()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"default":   def,
+		"modules":   modules,
+		"available": applog.Modules,
+	})
+}
+
+func (s *APIServer) handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	writeLogLevels(w)
+}
+
+// handleSetLogLevels changes log levels until the next restart or config
+// reload changing them.
+func (s *APIServer) handleSetLogLevels(w http.ResponseWriter, r *http.Request) {
+	var body logLevels
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLogLevelsBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeJSONError(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := applog.UpdateLevels(body.Default, body.Modules); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeLogLevels(w)
+}
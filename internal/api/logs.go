@@ -1,13 +1,19 @@
 package api
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
+	applog "github.com/sunbk201/ua3f/internal/log"
 )
 
+const defaultLogsTail = 100
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
@@ -15,17 +21,71 @@ var upgrader = websocket.Upgrader{
 // handleLogs serves real-time log output.
 //   - WebSocket clients: upgrade to ws and stream log lines as text messages.
 //   - Plain HTTP clients: chunked transfer with text/plain, flushed per line.
+//
+// Streams start with the last lines logged and can be filtered:
+//
+//	?level=debug|info|warn|error&q=&regex=&src=&dst=&tail=100
+//
+// When lines are dropped because the client is too slow, a warning line with
+// the number of lines dropped is sent in their place.
 func (s *APIServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	filter, tail, err := parseLogFilter(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	// Try WebSocket upgrade first.
 	if websocket.IsWebSocketUpgrade(r) {
-		s.handleLogsWS(w, r)
+		s.handleLogsWS(w, r, filter, tail)
 		return
 	}
-	s.handleLogsHTTP(w, r)
+	s.handleLogsHTTP(w, r, filter, tail)
+}
+
+func parseLogFilter(r *http.Request) (applog.LogFilter, int, error) {
+	values := r.URL.Query()
+	filter := applog.LogFilter{
+		Level:    slog.LevelDebug,
+		Contains: values.Get("q"),
+		Src:      values.Get("src"),
+		Dst:      values.Get("dst"),
+	}
+	if v := values.Get("level"); v != "" {
+		level, err := applog.ParseLevel(v)
+		if err != nil {
+			return filter, 0, err
+		}
+		filter.Level = level
+	}
+	if v := values.Get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return filter, 0, fmt.Errorf("regex: %w", err)
+		}
+		filter.Regexp = re
+	}
+	tail := defaultLogsTail
+	if v := values.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > applog.ReplaySize {
+			return filter, 0, fmt.Errorf("tail must be between 0 and %d", applog.ReplaySize)
+		}
+		tail = n
+	}
+	return filter, tail, nil
+}
+
+// nextLogLines returns the dropped-lines notice before msg when lines were
+// dropped since the last call.
+func (s *APIServer) nextLogLines(sub *applog.Subscription, msg []byte) [][]byte {
+	if recent, total := sub.Dropped(); recent > 0 {
+		return [][]byte{s.logBroadcaster.DroppedNotice(recent, total), msg}
+	}
+	return [][]byte{msg}
 }
 
 // handleLogsWS streams log lines over a WebSocket connection.
-func (s *APIServer) handleLogsWS(w http.ResponseWriter, r *http.Request) {
+func (s *APIServer) handleLogsWS(w http.ResponseWriter, r *http.Request, filter applog.LogFilter, tail int) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("websocket upgrade failed", slog.Any("error", err))
@@ -35,8 +95,8 @@ func (s *APIServer) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 		_ = conn.Close()
 	}()
 
-	ch := s.logBroadcaster.Subscribe()
-	defer s.logBroadcaster.Unsubscribe(ch)
+	sub := s.logBroadcaster.Subscribe(filter, tail)
+	defer s.logBroadcaster.Unsubscribe(sub)
 
 	// Read pump – we only need it to detect client close.
 	done := make(chan struct{})
@@ -51,13 +111,15 @@ func (s *APIServer) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 
 	for {
 		select {
-		case msg, ok := <-ch:
+		case msg, ok := <-sub.C:
 			if !ok {
 				return
 			}
-			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				return
+			for _, line := range s.nextLogLines(sub, msg) {
+				_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+					return
+				}
 			}
 		case <-done:
 			return
@@ -66,12 +128,15 @@ func (s *APIServer) handleLogsWS(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleLogsHTTP streams log lines over chunked HTTP (text/plain).
-func (s *APIServer) handleLogsHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *APIServer) handleLogsHTTP(w http.ResponseWriter, r *http.Request, filter applog.LogFilter, tail int) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
 		return
 	}
+	// Filtered streams can be quiet for long; the server write timeout would
+	// end them.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -80,18 +145,20 @@ func (s *APIServer) handleLogsHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
-	ch := s.logBroadcaster.Subscribe()
-	defer s.logBroadcaster.Unsubscribe(ch)
+	sub := s.logBroadcaster.Subscribe(filter, tail)
+	defer s.logBroadcaster.Unsubscribe(sub)
 
 	ctx := r.Context()
 	for {
 		select {
-		case msg, ok := <-ch:
+		case msg, ok := <-sub.C:
 			if !ok {
 				return
 			}
-			if _, err := w.Write(msg); err != nil {
-				return
+			for _, line := range s.nextLogLines(sub, msg) {
+				if _, err := w.Write(line); err != nil {
+					return
+				}
 			}
 			flusher.Flush()
 		case <-ctx.Done():
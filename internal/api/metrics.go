@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sunbk201/ua3f/internal/bpf/bpfstats"
+	"github.com/sunbk201/ua3f/internal/dns"
+	"github.com/sunbk201/ua3f/internal/metrics"
+)
+
+// metricsVersion is the version reported by ua3f_info.
+var metricsVersion atomic.Pointer[string]
+
+// Metrics read from other packages when scraped.
+var (
+	_ = metrics.NewGaugeFunc("ua3f_info", "UA3F build information.", []string{"version"},
+		func(emit func(float64, ...string)) {
+			if v := metricsVersion.Load(); v != nil {
+				emit(1, *v)
+			}
+		})
+
+	_ = metrics.NewGaugeFunc("ua3f_dns_cache_entries", "IP to domain mappings held by the DNS cache.", nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(dns.Default.Len()))
+		})
+
+	_ = metrics.NewCounterFunc("ua3f_tc_packets", "Packets inspected and rewritten by the TC L3 rewrite programs.", []string{"feature", "result"},
+		func(emit func(float64, ...string)) {
+			tc := bpfstats.Read().TC
+			if tc == nil || !tc.Available {
+				return
+			}
+			for _, name := range tc.FeatureNames() {
+				f := tc.Features[name]
+				emit(float64(f.Seen), name, "seen")
+				emit(float64(f.Rewritten), name, "rewritten")
+			}
+		})
+
+	_ = metrics.NewCounterFunc("ua3f_sockmap_packets", "Packets handled by the sockmap offload by result.", []string{"result"},
+		func(emit func(float64, ...string)) {
+			sm := bpfstats.Read().Sockmap
+			if sm == nil || !sm.Available {
+				return
+			}
+			emit(float64(sm.RedirectedPackets), "redirected")
+			emit(float64(sm.PassedPackets), "passed")
+			emit(float64(sm.FailedRedirects), "failed")
+		})
+
+	_ = metrics.NewCounterFunc("ua3f_sockmap_redirected_bytes", "Bytes relayed in the kernel by the sockmap offload.", nil,
+		func(emit func(float64, ...string)) {
+			sm := bpfstats.Read().Sockmap
+			if sm == nil || !sm.Available {
+				return
+			}
+			emit(float64(sm.RedirectedBytes))
+		})
+)
+
+func (s *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics, contentType := metrics.Negotiate(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", contentType)
+	_ = metrics.Write(w, openMetrics)
+}
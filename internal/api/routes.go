@@ -3,6 +3,12 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+
+	"github.com/sunbk201/ua3f/internal/bpf/bpfstats"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
 )
 
 func (s *APIServer) handleVersion(w http.ResponseWriter, r *http.Request) {
@@ -14,7 +20,12 @@ func (s *APIServer) handleVersion(w http.ResponseWriter, r *http.Request) {
 
 func (s *APIServer) handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(s.cfg)
+	_ = json.NewEncoder(w).Encode(s.cfg.Load())
+}
+
+func (s *APIServer) handleConfigSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_ = json.NewEncoder(w).Encode(config.Schema())
 }
 
 func (s *APIServer) handleRules(w http.ResponseWriter, r *http.Request) {
@@ -55,3 +66,47 @@ func (s *APIServer) handleRestart(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("success"))
 }
+
+func (s *APIServer) handleDNSCache(w http.ResponseWriter, r *http.Request) {
+	records := dns.Default.Records()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Domain < records[j].Domain
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"size":    len(records),
+		"records": records,
+	})
+}
+
+func (s *APIServer) handleDesyncProbe(w http.ResponseWriter, r *http.Request) {
+	prober := tlsdesync.ActiveProber()
+	results := []tlsdesync.ProbeResult{}
+	if prober != nil {
+		results = prober.Results()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"enabled": prober != nil,
+		"size":    len(results),
+		"results": results,
+	})
+}
+
+func (s *APIServer) handleDesyncProbeReset(w http.ResponseWriter, r *http.Request) {
+	prober := tlsdesync.ActiveProber()
+	if prober == nil {
+		http.Error(w, `{"error":"desync auto-probe is not enabled"}`, http.StatusNotFound)
+		return
+	}
+	removed := prober.Reset(r.URL.Query().Get("destination"))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"removed": removed,
+	})
+}
+
+func (s *APIServer) handleBPFStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(bpfstats.Read())
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+// maxRuleBody caps the size of a rule request body.
+const maxRuleBody = 1 << 20
+
+// ruleError is an edit failure with the HTTP status to report it with.
+type ruleError struct {
+	code int
+	msg  string
+}
+
+func (e *ruleError) Error() string {
+	return e.msg
+}
+
+// rulePatch is the body of a PATCH request. Fields left out are unchanged.
+type rulePatch struct {
+	Enabled *bool `json:"enabled"`
+	Index   *int  `json:"index"`
+}
+
+// writeJSONError replies with code and a JSON body holding msg.
+func writeJSONError(w http.ResponseWriter, msg string, code int) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func ruleList(r *http.Request) (config.RuleList, error) {
+	list := config.RuleList(chi.URLParam(r, "list"))
+	if list.Key() == "" {
+		return "", &ruleError{http.StatusNotFound, fmt.Sprintf("unknown rule list %q", list)}
+	}
+	return list, nil
+}
+
+// ruleIndex parses the {index} URL parameter against a list of n rules.
+func ruleIndex(r *http.Request, n int) (int, error) {
+	i, err := strconv.Atoi(chi.URLParam(r, "index"))
+	if err != nil || i < 0 || i >= n {
+		return 0, &ruleError{http.StatusNotFound, fmt.Sprintf("rule %s not found", chi.URLParam(r, "index"))}
+	}
+	return i, nil
+}
+
+func decodeRuleBody(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &ruleError{http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+func (s *APIServer) handleListRules(w http.ResponseWriter, r *http.Request) {
+	list, err := ruleList(r)
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+
+	s.mu.Lock()
+	rules, err := s.cfg.Load().Rules(list)
+	revision := s.rulesRevision
+	s.mu.Unlock()
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(revision))
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"revision": revision,
+		"rules":    rules,
+	})
+}
+
+func (s *APIServer) handleAddRule(w http.ResponseWriter, r *http.Request) {
+	rule := config.Rule{Enabled: true}
+	if err := decodeRuleBody(w, r, &rule); err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	s.editRules(w, r, http.StatusCreated, func(rules []config.Rule) ([]config.Rule, error) {
+		i := len(rules)
+		if v := r.URL.Query().Get("index"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > len(rules) {
+				return nil, &ruleError{http.StatusBadRequest, fmt.Sprintf("index %s out of range", v)}
+			}
+			i = n
+		}
+		return append(rules[:i], append([]config.Rule{rule}, rules[i:]...)...), nil
+	})
+}
+
+func (s *APIServer) handleReplaceRule(w http.ResponseWriter, r *http.Request) {
+	rule := config.Rule{Enabled: true}
+	if err := decodeRuleBody(w, r, &rule); err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	s.editRules(w, r, http.StatusOK, func(rules []config.Rule) ([]config.Rule, error) {
+		i, err := ruleIndex(r, len(rules))
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = rule
+		return rules, nil
+	})
+}
+
+func (s *APIServer) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	var patch rulePatch
+	if err := decodeRuleBody(w, r, &patch); err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	s.editRules(w, r, http.StatusOK, func(rules []config.Rule) ([]config.Rule, error) {
+		i, err := ruleIndex(r, len(rules))
+		if err != nil {
+			return nil, err
+		}
+		if patch.Enabled != nil {
+			rules[i].Enabled = *patch.Enabled
+		}
+		if patch.Index != nil {
+			to := *patch.Index
+			if to < 0 || to >= len(rules) {
+				return nil, &ruleError{http.StatusBadRequest, fmt.Sprintf("index %d out of range", to)}
+			}
+			rule := rules[i]
+			rules = append(rules[:i], rules[i+1:]...)
+			rules = append(rules[:to], append([]config.Rule{rule}, rules[to:]...)...)
+		}
+		return rules, nil
+	})
+}
+
+func (s *APIServer) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	s.editRules(w, r, http.StatusOK, func(rules []config.Rule) ([]config.Rule, error) {
+		i, err := ruleIndex(r, len(rules))
+		if err != nil {
+			return nil, err
+		}
+		return append(rules[:i], rules[i+1:]...), nil
+	})
+}
+
+// editRules applies edit to a copy of the rule list named in the request,
+// validates the result, swaps it into the running server and writes it back
+// to the config file. The request may carry the revision it was based on in
+// If-Match; a stale revision is rejected so concurrent clients do not
+// overwrite each other.
+func (s *APIServer) editRules(w http.ResponseWriter, r *http.Request, code int, edit func([]config.Rule) ([]config.Rule, error)) {
+	list, err := ruleList(r)
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" {
+		if rev, ok := parseETag(match); !ok || rev != s.rulesRevision {
+			writeJSONError(w, fmt.Sprintf("revision mismatch: current revision is %d", s.rulesRevision), http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	cur := s.cfg.Load()
+	rules, err := cur.Rules(list)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rules, err = edit(rules); err != nil {
+		writeRuleError(w, err)
+		return
+	}
+	next, err := cur.WithRules(list, rules)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reloader, ok := s.Server.(common.Reloader)
+	if !ok {
+		writeJSONError(w, "server does not support live rule changes", http.StatusServiceUnavailable)
+		return
+	}
+	if err := reloader.Reload(next); err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	persisted, err := config.SaveRules(list, rules)
+	if err != nil {
+		if rerr := reloader.Reload(cur); rerr != nil {
+			slog.Error("reloader.Reload", slog.Any("error", rerr))
+		}
+		writeJSONError(w, fmt.Sprintf("failed to save config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.cfg.Store(next)
+	s.rulesRevision++
+	slog.Info("Rules updated", slog.String("list", string(list)), slog.Uint64("revision", s.rulesRevision), slog.Bool("persisted", persisted))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(s.rulesRevision))
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"revision":  s.rulesRevision,
+		"persisted": persisted,
+		"rules":     rules,
+	})
+}
+
+func writeRuleError(w http.ResponseWriter, err error) {
+	var re *ruleError
+	if errors.As(err, &re) {
+		writeJSONError(w, re.msg, re.code)
+		return
+	}
+	writeJSONError(w, err.Error(), http.StatusInternalServerError)
+}
+
+func etag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// parseETag is the inverse of etag and also accepts a bare revision number.
+func parseETag(tag string) (uint64, bool) {
+	n, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+// fakeServer records the configs rules are reloaded with.
+type fakeServer struct {
+	reloads  []*config.Config
+	err      error // returned by Reload
+	rewriter common.Rewriter
+}
+
+func (f *fakeServer) Start() error                                  { return nil }
+func (f *fakeServer) Close() error                                  { return nil }
+func (f *fakeServer) Restart(*config.Config) (common.Server, error) { return f, nil }
+func (f *fakeServer) GetRewriter() common.Rewriter                  { return f.rewriter }
+func (f *fakeServer) Reload(cfg *config.Config) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.reloads = append(f.reloads, cfg)
+	return nil
+}
+
+const rulesTestConfig = `# rules test
+server-mode: SOCKS5
+bind-address: 127.0.0.1
+port: 1080
+log-level: info
+rewrite-mode: RULE
+l3-rewrite:
+  ttl-value: 64
+header-rewrite:
+  - enabled: true
+    type: FINAL
+    action: DIRECT
+url-redirect-json: '[{"enabled":true,"type":"FINAL","action":"REDIRECT-302","rewrite_regex":"a","rewrite_value":"b"}]'
+`
+
+// newRulesTestServer returns an API server running on a config file with
+// the rules of rulesTestConfig.
+func newRulesTestServer(t *testing.T) (*APIServer, *fakeServer, string) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(rulesTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(path)
+	cfg, err := config.ReloadFromFile()
+	if err != nil {
+		t.Fatalf("ReloadFromFile: %v", err)
+	}
+
+	s := New("test", cfg, nil)
+	fake := &fakeServer{}
+	s.Server = fake
+	return s, fake, path
+}
+
+type rulesResponse struct {
+	Revision  uint64        `json:"revision"`
+	Persisted bool          `json:"persisted"`
+	Rules     []config.Rule `json:"rules"`
+	Error     string        `json:"error"`
+}
+
+func doRules(t *testing.T, h http.Handler, method, target, body string, header ...string) (int, http.Header, rulesResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var resp rulesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: invalid response %q: %v", method, target, rec.Body.String(), err)
+	}
+	return rec.Code, rec.Header(), resp
+}
+
+func ruleTypes(rules []config.Rule) string {
+	types := make([]string, len(rules))
+	for i, r := range rules {
+		types[i] = r.Type
+		if !r.Enabled {
+			types[i] += "(disabled)"
+		}
+	}
+	return strings.Join(types, ",")
+}
+
+func TestEditRules(t *testing.T) {
+	s, fake, _ := newRulesTestServer(t)
+	h := s.routes()
+
+	code, header, resp := doRules(t, h, http.MethodGet, "/config/rules/header/", "")
+	if code != http.StatusOK || header.Get("ETag") != `"0"` || ruleTypes(resp.Rules) != "FINAL" {
+		t.Fatalf("GET = %d %s %+v", code, header.Get("ETag"), resp)
+	}
+
+	steps := []struct {
+		method string
+		target string
+		body   string
+		code   int
+		want   string
+	}{
+		{http.MethodPost, "/config/rules/header/?index=0", `{"type":"DEST-PORT","match_value":"22","action":"DIRECT"}`, http.StatusCreated, "DEST-PORT,FINAL"},
+		{http.MethodPost, "/config/rules/header/", `{"type":"DOMAIN","match_value":"example.com","action":"DROP"}`, http.StatusCreated, "DEST-PORT,FINAL,DOMAIN"},
+		{http.MethodPut, "/config/rules/header/1", `{"type":"FINAL","action":"REPLACE","rewrite_header":"User-Agent","rewrite_value":"FFF"}`, http.StatusOK, "DEST-PORT,FINAL,DOMAIN"},
+		{http.MethodPatch, "/config/rules/header/0", `{"index":2,"enabled":false}`, http.StatusOK, "FINAL,DOMAIN,DEST-PORT(disabled)"},
+		{http.MethodDelete, "/config/rules/header/1", "", http.StatusOK, "FINAL,DEST-PORT(disabled)"},
+	}
+
+	for i, step := range steps {
+		code, header, resp := doRules(t, h, step.method, step.target, step.body)
+		if code != step.code {
+			t.Fatalf("%s %s = %d %q, want %d", step.method, step.target, code, resp.Error, step.code)
+		}
+		if got := ruleTypes(resp.Rules); got != step.want {
+			t.Errorf("%s %s rules = %s, want %s", step.method, step.target, got, step.want)
+		}
+		if want := uint64(i + 1); resp.Revision != want || header.Get("ETag") != etag(want) {
+			t.Errorf("%s %s revision = %d, ETag %s, want %d", step.method, step.target, resp.Revision, header.Get("ETag"), want)
+		}
+		if !resp.Persisted {
+			t.Errorf("%s %s not persisted", step.method, step.target)
+		}
+		last := fake.reloads[len(fake.reloads)-1]
+		if rules, _ := last.Rules(config.RuleListHeader); ruleTypes(rules) != step.want {
+			t.Errorf("%s %s reloaded rules = %s, want %s", step.method, step.target, ruleTypes(rules), step.want)
+		}
+	}
+	if got := len(fake.reloads); got != len(steps) {
+		t.Errorf("Reload called %d times, want %d", got, len(steps))
+	}
+
+	_, _, resp = doRules(t, h, http.MethodGet, "/config/rules/header/", "")
+	if resp.Rules[0].Action != "REPLACE" || resp.Rules[0].RewriteValue != "FFF" {
+		t.Errorf("replaced rule = %+v", resp.Rules[0])
+	}
+
+	errs := []struct {
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, "/config/rules/bogus/", `{"type":"FINAL","action":"DIRECT"}`, http.StatusNotFound},
+		{http.MethodPost, "/config/rules/header/", `{"type":"BOGUS","action":"DIRECT"}`, http.StatusBadRequest},
+		{http.MethodPost, "/config/rules/header/", `{"type":"FINAL","action":"DIRECT","unknown":1}`, http.StatusBadRequest},
+		{http.MethodPost, "/config/rules/header/?index=9", `{"type":"FINAL","action":"DIRECT"}`, http.StatusBadRequest},
+		{http.MethodPut, "/config/rules/header/5", `{"type":"FINAL","action":"DIRECT"}`, http.StatusNotFound},
+		{http.MethodPatch, "/config/rules/header/0", `{"index":5}`, http.StatusBadRequest},
+		{http.MethodDelete, "/config/rules/header/x", "", http.StatusNotFound},
+	}
+	for _, e := range errs {
+		code, header, resp := doRules(t, h, e.method, e.target, e.body)
+		if code != e.code || resp.Error == "" {
+			t.Errorf("%s %s = %d %+v, want %d with an error", e.method, e.target, code, resp, e.code)
+		}
+		if ct := header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s Content-Type = %q, want application/json", e.method, e.target, ct)
+		}
+	}
+	if s.rulesRevision != uint64(len(steps)) {
+		t.Errorf("revision = %d after failed edits, want %d", s.rulesRevision, len(steps))
+	}
+}
+
+func TestEditRulesIfMatch(t *testing.T) {
+	s, _, _ := newRulesTestServer(t)
+	h := s.routes()
+	body := `{"type":"DEST-PORT","match_value":"22","action":"DIRECT"}`
+
+	if code, _, _ := doRules(t, h, http.MethodPost, "/config/rules/header/", body, "If-Match", `"0"`); code != http.StatusCreated {
+		t.Fatalf("POST with current revision = %d", code)
+	}
+	code, _, resp := doRules(t, h, http.MethodDelete, "/config/rules/header/0", "", "If-Match", `"0"`)
+	if code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with stale revision = %d, want 412", code)
+	}
+	if !strings.Contains(resp.Error, "current revision is 1") {
+		t.Errorf("error = %q", resp.Error)
+	}
+	if code, _, _ := doRules(t, h, http.MethodDelete, "/config/rules/header/0", "", "If-Match", "*"); code != http.StatusOK {
+		t.Errorf("DELETE with If-Match * = %d", code)
+	}
+	if code, _, _ := doRules(t, h, http.MethodDelete, "/config/rules/header/0", "", "If-Match", "2"); code != http.StatusOK {
+		t.Errorf("DELETE with a bare revision = %d", code)
+	}
+}
+
+func TestEditRulesPersistence(t *testing.T) {
+	s, fake, path := newRulesTestServer(t)
+	h := s.routes()
+
+	if code, _, resp := doRules(t, h, http.MethodPost, "/config/rules/header/", `{"type":"DEST-PORT","match_value":"22","action":"DIRECT"}`); code != http.StatusCreated {
+		t.Fatalf("POST header = %d %q", code, resp.Error)
+	}
+	// The redirect list only exists in JSON form, which must not survive the write.
+	if code, _, resp := doRules(t, h, http.MethodDelete, "/config/rules/redirect/0", ""); code != http.StatusOK || len(resp.Rules) != 0 {
+		t.Fatalf("DELETE redirect = %d %+v", code, resp)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# rules test", "match-value: \"22\"", "url-redirect: []"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("config file lacks %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "url-redirect-json") {
+		t.Errorf("config file keeps url-redirect-json:\n%s", data)
+	}
+
+	// Reloading the written file, as the config watcher does, keeps the
+	// rules and the revision.
+	if err := s.RestartSystem(); err != nil {
+		t.Fatalf("RestartSystem: %v", err)
+	}
+	if s.rulesRevision != 2 {
+		t.Errorf("revision = %d after reloading the written rules, want 2", s.rulesRevision)
+	}
+	cfg := s.cfg.Load()
+	if rules, _ := cfg.Rules(config.RuleListHeader); ruleTypes(rules) != "FINAL,DEST-PORT" {
+		t.Errorf("reloaded header rules = %s", ruleTypes(rules))
+	}
+	if rules, _ := cfg.Rules(config.RuleListRedirect); len(rules) != 0 {
+		t.Errorf("reloaded redirect rules = %+v, want none", rules)
+	}
+
+	// A rejected reload leaves the file and the rules as they were.
+	fake.err = errors.New("reload failed")
+	if code, _, _ := doRules(t, h, http.MethodDelete, "/config/rules/header/0", ""); code != http.StatusInternalServerError {
+		t.Errorf("DELETE with a failing reload = %d, want 500", code)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Errorf("config file changed by a failed edit:\n%s", after)
+	}
+	if s.rulesRevision != 2 {
+		t.Errorf("revision = %d after a failed edit, want 2", s.rulesRevision)
+	}
+}
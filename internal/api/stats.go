@@ -0,0 +1,459 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/statistics"
+)
+
+const (
+	defaultStatsLimit = 100
+	maxStatsLimit     = 1000
+
+	// statsHeartbeat keeps idle event streams from being closed by proxies.
+	statsHeartbeat = 30 * time.Second
+)
+
+// statsList describes the fields of a statistics item that can be filtered
+// and sorted on. Field values are strings, int64, float64 or time.Time; only
+// string fields can be filtered on.
+type statsList[T any] struct {
+	fields      map[string]func(T) any
+	key         string // unique field breaking ties, so pages are stable
+	defaultSort string // sorted descending unless order=asc
+}
+
+// statsQuery holds the list parameters of a request:
+//
+//	?<field>=<substring>&q=<substring>&sort=<field>&order=asc|desc&limit=100&offset=0
+type statsQuery struct {
+	filters map[string]string // lowercased substrings by field
+	search  string            // lowercased substring of any string field
+	sort    string
+	desc    bool
+	limit   int
+	offset  int
+}
+
+var connectionStats = statsList[statistics.ConnectionTraffic]{
+	fields: map[string]func(statistics.ConnectionTraffic) any{
+		"protocol":   func(c statistics.ConnectionTraffic) any { return string(c.Protocol) },
+		"src_addr":   func(c statistics.ConnectionTraffic) any { return c.SrcAddr },
+		"dest_addr":  func(c statistics.ConnectionTraffic) any { return c.DestAddr },
+		"host":       func(c statistics.ConnectionTraffic) any { return c.Host },
+		"start_time": func(c statistics.ConnectionTraffic) any { return c.StartTime },
+		"duration":   func(c statistics.ConnectionTraffic) any { return c.Duration },
+		"upload":     func(c statistics.ConnectionTraffic) any { return c.Upload },
+		"download":   func(c statistics.ConnectionTraffic) any { return c.Download },
+	},
+	key:         "src_addr",
+	defaultSort: "start_time",
+}
+
+var rewriteStats = statsList[statistics.RewriteRecord]{
+	fields: map[string]func(statistics.RewriteRecord) any{
+		"host":        func(r statistics.RewriteRecord) any { return r.Host },
+		"original_ua": func(r statistics.RewriteRecord) any { return r.OriginalUA },
+		"mocked_ua":   func(r statistics.RewriteRecord) any { return r.MockedUA },
+		"count":       func(r statistics.RewriteRecord) any { return int64(r.Count) },
+		"last_seen":   func(r statistics.RewriteRecord) any { return r.LastSeen },
+	},
+	key:         "host",
+	defaultSort: "count",
+}
+
+var passThroughStats = statsList[statistics.PassThroughRecord]{
+	fields: map[string]func(statistics.PassThroughRecord) any{
+		"src_addr":  func(r statistics.PassThroughRecord) any { return r.SrcAddr },
+		"dest_addr": func(r statistics.PassThroughRecord) any { return r.DestAddr },
+		"ua":        func(r statistics.PassThroughRecord) any { return r.UA },
+		"count":     func(r statistics.PassThroughRecord) any { return int64(r.Count) },
+		"last_seen": func(r statistics.PassThroughRecord) any { return r.LastSeen },
+	},
+	key:         "ua",
+	defaultSort: "count",
+}
+
+var rollupStats = statsList[statistics.Rollup]{
+	fields: map[string]func(statistics.Rollup) any{
+		"kind":        func(r statistics.Rollup) any { return string(r.Kind) },
+		"name":        func(r statistics.Rollup) any { return r.Name },
+		"start":       func(r statistics.Rollup) any { return r.Start },
+		"rewrites":    func(r statistics.Rollup) any { return r.Rewrites },
+		"connections": func(r statistics.Rollup) any { return r.Connections },
+		"upload":      func(r statistics.Rollup) any { return r.Upload },
+		"download":    func(r statistics.Rollup) any { return r.Download },
+	},
+	key:         "name",
+	defaultSort: "start",
+}
+
+// parseQuery reads the list parameters of r. Parameters that are neither
+// list parameters nor string fields, like secret, are ignored.
+func (l statsList[T]) parseQuery(r *http.Request) (statsQuery, error) {
+	values := r.URL.Query()
+	q := statsQuery{
+		filters: map[string]string{},
+		search:  strings.ToLower(values.Get("q")),
+		sort:    l.defaultSort,
+		desc:    true,
+		limit:   defaultStatsLimit,
+	}
+
+	var zero T
+	for name, get := range l.fields {
+		if _, ok := get(zero).(string); ok && values.Has(name) {
+			q.filters[name] = strings.ToLower(values.Get(name))
+		}
+	}
+	if s := values.Get("sort"); s != "" {
+		if _, ok := l.fields[s]; !ok {
+			return q, fmt.Errorf("unknown sort field %q", s)
+		}
+		q.sort = s
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.desc = false
+	default:
+		return q, fmt.Errorf("order must be asc or desc")
+	}
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxStatsLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxStatsLimit)
+		}
+		q.limit = n
+	}
+	if s := values.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("offset must not be negative")
+		}
+		q.offset = n
+	}
+	return q, nil
+}
+
+// match reports whether item passes the filters and search of q.
+func (l statsList[T]) match(item T, q statsQuery) bool {
+	for name, want := range q.filters {
+		if !strings.Contains(strings.ToLower(l.fields[name](item).(string)), want) {
+			return false
+		}
+	}
+	if q.search == "" {
+		return true
+	}
+	for _, get := range l.fields {
+		if s, ok := get(item).(string); ok && strings.Contains(strings.ToLower(s), q.search) {
+			return true
+		}
+	}
+	return false
+}
+
+// page filters and sorts items, returning the requested page and the number
+// of items matching.
+func (l statsList[T]) page(items []T, q statsQuery) ([]T, int) {
+	matched := items[:0]
+	for _, item := range items {
+		if l.match(item, q) {
+			matched = append(matched, item)
+		}
+	}
+
+	sortBy, key := l.fields[q.sort], l.fields[l.key]
+	slices.SortFunc(matched, func(a, b T) int {
+		c := compareStats(sortBy(a), sortBy(b))
+		if c == 0 {
+			c = compareStats(key(a), key(b))
+		}
+		if q.desc {
+			return -c
+		}
+		return c
+	})
+
+	total := len(matched)
+	start := min(q.offset, total)
+	end := min(start+q.limit, total)
+	return matched[start:end], total
+}
+
+func compareStats(a, b any) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return 0
+}
+
+// serveStats writes the page of items requested by r.
+func serveStats[T any](w http.ResponseWriter, r *http.Request, l statsList[T], items []T) {
+	q, err := l.parseQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, total := l.page(items, q)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"total":  total,
+		"offset": q.offset,
+		"limit":  q.limit,
+		"items":  page,
+	})
+}
+
+// recorder returns the statistics recorder of the running server, or nil.
+func (s *APIServer) recorder() *statistics.Recorder {
+	if sr, ok := s.Server.(common.StatsRecorder); ok {
+		return sr.Recorder()
+	}
+	return nil
+}
+
+// statsRecorder returns the recorder, writing an error when there is none.
+func (s *APIServer) statsRecorder(w http.ResponseWriter) *statistics.Recorder {
+	rc := s.recorder()
+	if rc == nil {
+		writeJSONError(w, "statistics are not available", http.StatusServiceUnavailable)
+	}
+	return rc
+}
+
+// handleConnectionStats lists the open connections, or with ?state=closed
+// the recently closed ones, or with ?state=all both.
+func (s *APIServer) handleConnectionStats(w http.ResponseWriter, r *http.Request) {
+	rc := s.statsRecorder(w)
+	if rc == nil {
+		return
+	}
+	var conns []statistics.ConnectionTraffic
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", "active", "all":
+		conns = rc.ConnectionRecordList.Connections()
+	case "closed":
+	default:
+		writeJSONError(w, "state must be active, closed or all", http.StatusBadRequest)
+		return
+	}
+	if (state == "closed" || state == "all") && rc.Traffic != nil {
+		conns = append(conns, rc.Traffic.History()...)
+	}
+	serveStats(w, r, connectionStats, conns)
+}
+
+func (s *APIServer) handleRewriteStats(w http.ResponseWriter, r *http.Request) {
+	if rc := s.statsRecorder(w); rc != nil {
+		serveStats(w, r, rewriteStats, rc.RewriteRecordList.Records())
+	}
+}
+
+func (s *APIServer) handlePassThroughStats(w http.ResponseWriter, r *http.Request) {
+	if rc := s.statsRecorder(w); rc != nil {
+		serveStats(w, r, passThroughStats, rc.PassThroughRecordList.Records())
+	}
+}
+
+func (s *APIServer) handleTrafficStats(w http.ResponseWriter, r *http.Request) {
+	rc := s.statsRecorder(w)
+	if rc == nil {
+		return
+	}
+	if rc.Traffic == nil {
+		writeJSONError(w, "statistics are not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"devices":     rc.Traffic.Devices(),
+		"hosts":       rc.Traffic.Hosts(),
+		"connections": rc.ConnectionRecordList.Connections(),
+		"history":     rc.Traffic.History(),
+	})
+}
+
+// handleRollupStats lists the persisted rollups of ?period=hour|day|week,
+// daily by default, whose bucket starts between ?since and ?until.
+func (s *APIServer) handleRollupStats(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	period := statistics.RollupPeriod(values.Get("period"))
+	switch period {
+	case "":
+		period = statistics.PeriodDay
+	case statistics.PeriodHour, statistics.PeriodDay, statistics.PeriodWeek:
+	default:
+		writeJSONError(w, "period must be hour, day or week", http.StatusBadRequest)
+		return
+	}
+	since, err := parseStatsTime(values.Get("since"))
+	if err != nil {
+		writeJSONError(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseStatsTime(values.Get("until"))
+	if err != nil {
+		writeJSONError(w, "until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc := s.statsRecorder(w)
+	if rc == nil {
+		return
+	}
+	store := rc.Store()
+	if store == nil {
+		writeJSONError(w, "statistics store is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	serveStats(w, r, rollupStats, store.Rollups(period, since, until))
+}
+
+// parseStatsTime parses an RFC 3339 time or a local date like 2006-01-02.
+// An empty string is the zero time.
+func parseStatsTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a date", s)
+	}
+	return t, nil
+}
+
+// handleConnectionEvents streams connection open and close events, as
+// Server-Sent Events or, for WebSocket clients, as JSON text messages. The
+// field filters and q of /stats/connections select the events sent.
+func (s *APIServer) handleConnectionEvents(w http.ResponseWriter, r *http.Request) {
+	q, err := connectionStats.parseQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc := s.statsRecorder(w)
+	if rc == nil {
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		s.streamConnectionEventsWS(w, r, rc, q)
+		return
+	}
+	s.streamConnectionEventsSSE(w, r, rc, q)
+}
+
+func (s *APIServer) streamConnectionEventsSSE(w http.ResponseWriter, r *http.Request, rc *statistics.Recorder, q statsQuery) {
+	rctl := http.NewResponseController(w)
+	// Events can be minutes apart; the server write timeout would end the stream.
+	_ = rctl.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rctl.Flush(); err != nil {
+		return
+	}
+
+	ch := rc.SubscribeConnections()
+	defer rc.UnsubscribeConnections(ch)
+
+	heartbeat := time.NewTicker(statsHeartbeat)
+	defer heartbeat.Stop()
+
+	ctx := r.Context()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !connectionStats.match(ev.Connection, q) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		if err := rctl.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *APIServer) streamConnectionEventsWS(w http.ResponseWriter, r *http.Request, rc *statistics.Recorder, q statsQuery) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("websocket upgrade failed", slog.Any("error", err))
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ch := rc.SubscribeConnections()
+	defer rc.UnsubscribeConnections(ch)
+
+	// Read pump – we only need it to detect client close.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !connectionStats.match(ev.Connection, q) {
+				continue
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
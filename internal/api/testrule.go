@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/sunbk201/ua3f/internal/rewrite"
+)
+
+// handleTestRule runs a synthetic request, and optionally its response,
+// through the running rewriter and returns the rule decisions
+// and the rewritten request and response. Nothing is sent anywhere.
+func (s *APIServer) handleTestRule(w http.ResponseWriter, r *http.Request) {
+	var req rewrite.SimulatedRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSONError(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	sim, err := rewrite.Simulate(s.Server.GetRewriter(), &req)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sim)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/rewrite"
+)
+
+func TestTestRule(t *testing.T) {
+	s, fake, _ := newRulesTestServer(t)
+	h := s.routes()
+	body := `{"url":"https://www.example.com/","headers":{"User-Agent":"curl/8.0"}}`
+
+	post := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rules/test", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post(); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST without a running rewriter = %d, want 400", rec.Code)
+	}
+
+	// The running rewriter is used rather than one built from the config,
+	// whose single FINAL rule would leave the request unchanged.
+	rw, err := rewrite.NewRuleRewriter(s.cfg.Load(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.HeaderRuleEngine.Rules = nil
+	fake.rewriter = rewrite.NewReloadable(rw)
+
+	rec := post()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", rec.Code, rec.Body)
+	}
+	var sim rewrite.Simulation
+	if err := json.Unmarshal(rec.Body.Bytes(), &sim); err != nil {
+		t.Fatal(err)
+	}
+	if sim.RewriteMode != "RULE" || len(sim.Steps) != 0 {
+		t.Errorf("simulation = %+v, want no rule of the running rewriter evaluated", sim)
+	}
+}
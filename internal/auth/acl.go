@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL admits or rejects clients by source address.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL parses allow and deny entries, each an IP or a CIDR.
+// It returns nil when both lists are empty.
+func NewACL(allow, deny []string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &ACL{}
+	var err error
+	if a.allow, err = parseNets(allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if a.deny, err = parseNets(deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return a, nil
+}
+
+// Allowed reports whether ip may connect. Deny entries win over allow
+// entries, and an empty allow list admits every address not denied.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", e)
+			}
+			if ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("net.ParseCIDR: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
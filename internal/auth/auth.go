@@ -0,0 +1,50 @@
+// Package auth verifies the credentials of proxy clients.
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/tg123/go-htpasswd"
+)
+
+// Authenticator checks usernames and passwords against the inline users
+// and the htpasswd file of an AuthConfig. Inline users take precedence.
+type Authenticator struct {
+	users    map[string]string
+	htpasswd *htpasswd.File
+}
+
+// New returns nil when cfg configures no credentials.
+func New(cfg *config.AuthConfig) (*Authenticator, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	a := &Authenticator{users: make(map[string]string, len(cfg.Users))}
+	for _, u := range cfg.Users {
+		a.users[u.Username] = u.Password
+	}
+	if cfg.Htpasswd != "" {
+		f, err := htpasswd.New(cfg.Htpasswd, htpasswd.DefaultSystems, func(err error) {
+			slog.Warn("htpasswd bad line", slog.String("file", cfg.Htpasswd), slog.Any("error", err))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("htpasswd.New: %w", err)
+		}
+		a.htpasswd = f
+	}
+	return a, nil
+}
+
+// Verify reports whether password is valid for username.
+func (a *Authenticator) Verify(username, password string) bool {
+	if pw, ok := a.users[username]; ok {
+		return subtle.ConstantTimeCompare([]byte(pw), []byte(password)) == 1
+	}
+	if a.htpasswd != nil {
+		return a.htpasswd.Match(username, password)
+	}
+	return false
+}
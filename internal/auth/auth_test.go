@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+func TestNewDisabled(t *testing.T) {
+	a, err := New(&config.AuthConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a != nil {
+		t.Fatal("expected nil authenticator without credentials")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	sum := sha1.Sum([]byte("bobpass"))
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "bob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\nalice:{SHA}ignored\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write htpasswd: %v", err)
+	}
+
+	a, err := New(&config.AuthConfig{
+		Users:    []config.AuthUser{{Username: "alice", Password: "alicepass"}},
+		Htpasswd: path,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "alicepass", true},
+		{"alice", "wrong", false},
+		{"bob", "bobpass", true},
+		{"bob", "wrong", false},
+		{"carol", "", false},
+	}
+	for _, tt := range tests {
+		if got := a.Verify(tt.user, tt.pass); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestNewMissingHtpasswd(t *testing.T) {
+	_, err := New(&config.AuthConfig{Htpasswd: filepath.Join(t.TempDir(), "missing")})
+	if err == nil {
+		t.Fatal("expected error for missing htpasswd file")
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(nil, nil)
+	if err != nil || acl != nil {
+		t.Fatalf("NewACL(nil, nil) = %v, %v; want nil, nil", acl, err)
+	}
+
+	acl, err = NewACL([]string{"192.168.1.0/24", "fd00::/8"}, []string{"192.168.1.13"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.10", true},
+		{"192.168.1.13", false},
+		{"192.168.2.10", false},
+		{"fd00::1", true},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := acl.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := NewACL([]string{"not-an-ip"}, nil); err == nil {
+		t.Error("expected error for invalid entry")
+	}
+}
@@ -0,0 +1,112 @@
+// Package bpfstats collects the counters of the loaded BPF programs.
+package bpfstats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Feature names of the TC counters.
+const (
+	FeatureTTL    = "ttl"
+	FeatureIPID   = "ipid"
+	FeatureTCPTS  = "tcpts"
+	FeatureTCPWIN = "tcpwin"
+	FeatureQUIC   = "quic"
+)
+
+// Feature counts the packets a TC program inspected and the ones it rewrote.
+// For QUIC blocking, Rewritten counts dropped packets.
+type Feature struct {
+	Seen      uint64 `json:"seen"`
+	Rewritten uint64 `json:"rewritten"`
+}
+
+// TCStats are the counters of the TC L3 rewrite programs.
+// Available is false when the counters could not be read.
+type TCStats struct {
+	Available bool               `json:"available"`
+	Features  map[string]Feature `json:"features"`
+}
+
+// SockmapStats are the counters of the sockmap stream verdict program.
+// Available is false when the counters could not be read.
+type SockmapStats struct {
+	Available         bool   `json:"available"`
+	RedirectedPackets uint64 `json:"redirected_packets"`
+	RedirectedBytes   uint64 `json:"redirected_bytes"`
+	PassedPackets     uint64 `json:"passed_packets"`
+	FailedRedirects   uint64 `json:"failed_redirects"`
+}
+
+// Snapshot holds the counters of the active BPF programs.
+// A nil field means the corresponding offload is not running.
+type Snapshot struct {
+	TC      *TCStats      `json:"tc"`
+	Sockmap *SockmapStats `json:"sockmap"`
+	Time    time.Time     `json:"time"`
+}
+
+var (
+	mu      sync.RWMutex
+	tc      func() (TCStats, error)
+	sockmap func() (SockmapStats, error)
+)
+
+// SetTC registers the reader of the running TC programs, or clears it with nil.
+func SetTC(fn func() (TCStats, error)) {
+	mu.Lock()
+	tc = fn
+	mu.Unlock()
+}
+
+// SetSockmap registers the reader of the running sockmap programs, or clears it with nil.
+func SetSockmap(fn func() (SockmapStats, error)) {
+	mu.Lock()
+	sockmap = fn
+	mu.Unlock()
+}
+
+// Read returns the current counters of the registered programs.
+// Counters that fail to read are reported as unavailable.
+func Read() Snapshot {
+	mu.RLock()
+	tcFn, sockmapFn := tc, sockmap
+	mu.RUnlock()
+
+	snap := Snapshot{Time: time.Now()}
+	if tcFn != nil {
+		stats, err := tcFn()
+		if err != nil {
+			stats = TCStats{}
+		}
+		if stats.Features == nil {
+			stats.Features = map[string]Feature{}
+		}
+		snap.TC = &stats
+	}
+	if sockmapFn != nil {
+		stats, err := sockmapFn()
+		if err != nil {
+			stats = SockmapStats{}
+		}
+		snap.Sockmap = &stats
+	}
+	return snap
+}
+
+// Active reports whether any BPF offload is running.
+func (s Snapshot) Active() bool {
+	return s.TC != nil || s.Sockmap != nil
+}
+
+// FeatureNames returns the TC feature names in a stable order.
+func (s *TCStats) FeatureNames() []string {
+	names := make([]string, 0, len(s.Features))
+	for name := range s.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
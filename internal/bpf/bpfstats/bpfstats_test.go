@@ -0,0 +1,53 @@
+package bpfstats
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	defer SetTC(nil)
+	defer SetSockmap(nil)
+
+	if snap := Read(); snap.Active() {
+		t.Fatalf("Read() with no programs = %+v, want inactive", snap)
+	}
+
+	SetTC(func() (TCStats, error) {
+		return TCStats{Available: true, Features: map[string]Feature{
+			FeatureTTL:  {Seen: 10, Rewritten: 4},
+			FeatureIPID: {Seen: 10, Rewritten: 10},
+		}}, nil
+	})
+	SetSockmap(func() (SockmapStats, error) {
+		return SockmapStats{Available: true, RedirectedPackets: 3}, errors.New("lookup failed")
+	})
+
+	snap := Read()
+	if !snap.Active() {
+		t.Fatal("Read() inactive, want active")
+	}
+	if !snap.TC.Available || snap.TC.Features[FeatureTTL].Rewritten != 4 {
+		t.Errorf("TC = %+v", snap.TC)
+	}
+	if got, want := snap.TC.FeatureNames(), []string{FeatureIPID, FeatureTTL}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FeatureNames() = %v, want %v", got, want)
+	}
+	if *snap.Sockmap != (SockmapStats{}) {
+		t.Errorf("Sockmap after read error = %+v, want unavailable", snap.Sockmap)
+	}
+}
+
+func TestReadUnavailable(t *testing.T) {
+	defer SetTC(nil)
+
+	SetTC(func() (TCStats, error) { return TCStats{}, nil })
+	snap := Read()
+	if snap.TC == nil || snap.TC.Available || snap.TC.Features == nil {
+		t.Errorf("TC = %+v, want unavailable with empty features", snap.TC)
+	}
+	if snap.Sockmap != nil {
+		t.Errorf("Sockmap = %+v, want nil", snap.Sockmap)
+	}
+}
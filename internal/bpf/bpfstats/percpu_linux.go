@@ -0,0 +1,25 @@
+//go:build linux
+
+package bpfstats
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// SumPerCPU reads the first n entries of a per-CPU array of uint64 counters,
+// summing the values of every CPU.
+func SumPerCPU(m *ebpf.Map, n int) ([]uint64, error) {
+	sums := make([]uint64, n)
+	var values []uint64
+	for i := 0; i < n; i++ {
+		if err := m.Lookup(uint32(i), &values); err != nil {
+			return nil, fmt.Errorf("lookup counter %d: %w", i, err)
+		}
+		for _, v := range values {
+			sums[i] += v
+		}
+	}
+	return sums, nil
+}
@@ -19,6 +19,40 @@ struct
     __type(value, __u64); // peer cookie
 } peer SEC(".maps");
 
+// Counter indexes of sockmap_stats, mirrored by the stat* constants in stats.go.
+enum sockmap_stat {
+    STAT_REDIRECTED_PACKETS,
+    STAT_REDIRECTED_BYTES,
+    STAT_PASSED_PACKETS,
+    STAT_FAILED_REDIRECTS,
+    STAT_MAX,
+};
+
+struct
+{
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, STAT_MAX);
+    __type(key, __u32);
+    __type(value, __u64);
+} sockmap_stats SEC(".maps");
+
+// Bytes redirected from each offloaded socket, created by userspace when the
+// pair is added and read back when it is deleted.
+struct
+{
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 131072);
+    __type(key, __u64); // cookie
+    __type(value, __u64); // bytes
+} sock_bytes SEC(".maps");
+
+static __always_inline void add_stat(__u32 stat, __u64 n)
+{
+    __u64* v = bpf_map_lookup_elem(&sockmap_stats, &stat);
+    if (v)
+        *v += n;
+}
+
 SEC("sk_skb/stream_parser")
 int stream_parser(struct __sk_buff* skb)
 {
@@ -31,11 +65,22 @@ int stream_verdict(struct __sk_buff* skb)
     __u64 c = bpf_get_socket_cookie(skb);
     __u64* p = bpf_map_lookup_elem(&peer, &c);
     if (!p) {
+        add_stat(STAT_PASSED_PACKETS, 1);
         return SK_PASS;
     }
 
     __u64 peer_cookie = *p;
-    return bpf_sk_redirect_hash(skb, &sockhash, &peer_cookie, 0);
+    int verdict = bpf_sk_redirect_hash(skb, &sockhash, &peer_cookie, 0);
+    if (verdict == SK_PASS) {
+        add_stat(STAT_REDIRECTED_PACKETS, 1);
+        add_stat(STAT_REDIRECTED_BYTES, skb->len);
+        __u64* b = bpf_map_lookup_elem(&sock_bytes, &c);
+        if (b)
+            __sync_fetch_and_add(b, skb->len);
+    } else {
+        add_stat(STAT_FAILED_REDIRECTS, 1);
+    }
+    return verdict;
 }
 
 char LICENSE[] SEC("license") = "GPL";
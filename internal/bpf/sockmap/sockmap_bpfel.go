@@ -62,8 +62,10 @@ type sockmapProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type sockmapMapSpecs struct {
-	Peer     *ebpf.MapSpec `ebpf:"peer"`
-	Sockhash *ebpf.MapSpec `ebpf:"sockhash"`
+	Peer         *ebpf.MapSpec `ebpf:"peer"`
+	SockBytes    *ebpf.MapSpec `ebpf:"sock_bytes"`
+	Sockhash     *ebpf.MapSpec `ebpf:"sockhash"`
+	SockmapStats *ebpf.MapSpec `ebpf:"sockmap_stats"`
 }
 
 // sockmapVariableSpecs contains global variables before they are loaded into the kernel.
@@ -92,14 +94,18 @@ func (o *sockmapObjects) Close() error {
 //
 // It can be passed to loadSockmapObjects or ebpf.CollectionSpec.LoadAndAssign.
 type sockmapMaps struct {
-	Peer     *ebpf.Map `ebpf:"peer"`
-	Sockhash *ebpf.Map `ebpf:"sockhash"`
+	Peer         *ebpf.Map `ebpf:"peer"`
+	SockBytes    *ebpf.Map `ebpf:"sock_bytes"`
+	Sockhash     *ebpf.Map `ebpf:"sockhash"`
+	SockmapStats *ebpf.Map `ebpf:"sockmap_stats"`
 }
 
 func (m *sockmapMaps) Close() error {
 	return _SockmapClose(
 		m.Peer,
+		m.SockBytes,
 		m.Sockhash,
+		m.SockmapStats,
 	)
 }
 
@@ -7,10 +7,12 @@ package sockmap
 import (
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/sunbk201/ua3f/internal/bpf/bpfstats"
 	"github.com/sunbk201/ua3f/internal/config"
 )
 
@@ -19,6 +21,8 @@ type Sockmap struct {
 	ParserLink  link.Link
 	VerdictLink link.Link
 	rawAttach   bool // true when using BPF_PROG_ATTACH fallback
+	closeOnce   sync.Once
+	closeErr    error
 }
 
 func NewSockmap(cfg *config.Config) (*Sockmap, error) {
@@ -45,16 +49,27 @@ func NewSockmap(cfg *config.Config) (*Sockmap, error) {
 		return nil, err
 	}
 
+	bpfstats.SetSockmap(sm.Stats)
 	return sm, nil
 }
 
+// Close detaches the programs and releases the maps. It is safe to call more than once,
+// as every server sharing the Sockmap closes it.
 func (s *Sockmap) Close() error {
 	if s == nil {
 		return nil
 	}
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
 
+func (s *Sockmap) close() error {
 	var errs []error
 
+	bpfstats.SetSockmap(nil)
+
 	if s.rawAttach {
 		if s.Objs != nil {
 			if err := link.RawDetachProgram(link.RawDetachProgramOptions{
@@ -98,6 +113,17 @@ func (s *Sockmap) Close() error {
 }
 
 func (s *Sockmap) Add(lfd, rfd int, lc, rc uint64) (err error) {
+	// 0) sock_bytes: cookie -> bytes redirected, before any can be redirected
+	if err := s.trackBytes(lc, rc); err != nil {
+		return fmt.Errorf("sock_bytes put: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			s.takeBytes(lc)
+			s.takeBytes(rc)
+		}
+	}()
+
 	// 1) sockhash: cookie -> socket(fd)
 	if err := s.Objs.Sockhash.Update(lc, uint32(lfd), ebpf.UpdateAny); err != nil {
 		return fmt.Errorf("sockhash put l: %w", err)
@@ -123,11 +149,14 @@ func (s *Sockmap) Add(lfd, rfd int, lc, rc uint64) (err error) {
 	return nil
 }
 
-func (s *Sockmap) Delete(lc, rc uint64) {
+// Delete removes a pair added by Add and returns the bytes redirected in the
+// kernel from the L and the R socket.
+func (s *Sockmap) Delete(lc, rc uint64) (lbytes, rbytes uint64) {
 	_ = s.Objs.Peer.Delete(lc)
 	_ = s.Objs.Peer.Delete(rc)
 	_ = s.Objs.Sockhash.Delete(lc)
 	_ = s.Objs.Sockhash.Delete(rc)
+	return s.takeBytes(lc), s.takeBytes(rc)
 }
 
 // attachSockmapLink uses BPF_LINK_CREATE (kernel 6.10+).
@@ -0,0 +1,56 @@
+//go:build linux
+
+package sockmap
+
+import (
+	"github.com/cilium/ebpf"
+	"github.com/sunbk201/ua3f/internal/bpf/bpfstats"
+)
+
+// Counter indexes of the sockmap_stats map, mirroring enum sockmap_stat in sockmap.c.
+const (
+	statRedirectedPackets = iota
+	statRedirectedBytes
+	statPassedPackets
+	statFailedRedirects
+	statMax
+)
+
+// Stats returns the counters of the stream verdict program.
+func (s *Sockmap) Stats() (bpfstats.SockmapStats, error) {
+	var stats bpfstats.SockmapStats
+	sums, err := bpfstats.SumPerCPU(s.Objs.SockmapStats, statMax)
+	if err != nil {
+		return stats, err
+	}
+	stats.Available = true
+	stats.RedirectedPackets = sums[statRedirectedPackets]
+	stats.RedirectedBytes = sums[statRedirectedBytes]
+	stats.PassedPackets = sums[statPassedPackets]
+	stats.FailedRedirects = sums[statFailedRedirects]
+	return stats, nil
+}
+
+// trackBytes starts counting the bytes redirected from the sockets of a pair.
+func (s *Sockmap) trackBytes(lc, rc uint64) error {
+	var zero uint64
+	if err := s.Objs.SockBytes.Update(lc, zero, ebpf.UpdateAny); err != nil {
+		return err
+	}
+	if err := s.Objs.SockBytes.Update(rc, zero, ebpf.UpdateAny); err != nil {
+		_ = s.Objs.SockBytes.Delete(lc)
+		return err
+	}
+	return nil
+}
+
+// takeBytes returns and forgets the bytes redirected from the socket with
+// cookie c, 0 when they are not tracked.
+func (s *Sockmap) takeBytes(c uint64) uint64 {
+	var n uint64
+	if err := s.Objs.SockBytes.Lookup(c, &n); err != nil {
+		return 0
+	}
+	_ = s.Objs.SockBytes.Delete(c)
+	return n
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package tc
+
+import "github.com/sunbk201/ua3f/internal/bpf/bpfstats"
+
+// Counter indexes of the tc_stats map, mirroring enum tc_stat in tc.c.
+const (
+	statTTLSeen = iota
+	statTTLRewritten
+	statIPIDSeen
+	statIPIDRewritten
+	statTCPTSSeen
+	statTCPTSRewritten
+	statTCPWINSeen
+	statTCPWINRewritten
+	statQUICSeen
+	statQUICDropped
+	statMax
+)
+
+// featureStats maps each feature to its seen and rewritten counter indexes.
+var featureStats = map[string][2]int{
+	bpfstats.FeatureTTL:    {statTTLSeen, statTTLRewritten},
+	bpfstats.FeatureIPID:   {statIPIDSeen, statIPIDRewritten},
+	bpfstats.FeatureTCPTS:  {statTCPTSSeen, statTCPTSRewritten},
+	bpfstats.FeatureTCPWIN: {statTCPWINSeen, statTCPWINRewritten},
+	bpfstats.FeatureQUIC:   {statQUICSeen, statQUICDropped},
+}
+
+// Stats returns the counters of the attached programs.
+func (t *TC) Stats() (bpfstats.TCStats, error) {
+	stats := bpfstats.TCStats{Features: make(map[string]bpfstats.Feature, len(t.features))}
+	sums, err := bpfstats.SumPerCPU(t.objs.TcStats, statMax)
+	if err != nil {
+		return stats, err
+	}
+	stats.Available = true
+	for _, name := range t.features {
+		idx := featureStats[name]
+		stats.Features[name] = bpfstats.Feature{Seen: sums[idx[0]], Rewritten: sums[idx[1]]}
+	}
+	return stats, nil
+}
@@ -7,6 +7,7 @@
 #include <linux/in.h>
 #include <linux/ppp_defs.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/tcp.h>
 #include <linux/udp.h>
 
@@ -17,8 +18,50 @@
 #define IP_TTL_DEFAULT 64
 #define IP_TTL_MIN 10
 
+#ifndef PPP_IPV6
+#define PPP_IPV6 0x57
+#endif
+
 volatile const __u8 target_ttl = IP_TTL_DEFAULT;
 
+// Counter indexes of tc_stats, mirrored by the stat* constants in stats.go.
+enum tc_stat {
+    STAT_TTL_SEEN,
+    STAT_TTL_REWRITTEN,
+    STAT_IPID_SEEN,
+    STAT_IPID_REWRITTEN,
+    STAT_TCPTS_SEEN,
+    STAT_TCPTS_REWRITTEN,
+    STAT_TCPWIN_SEEN,
+    STAT_TCPWIN_REWRITTEN,
+    STAT_QUIC_SEEN,
+    STAT_QUIC_DROPPED,
+    STAT_MAX,
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, STAT_MAX);
+    __type(key, __u32);
+    __type(value, __u64);
+} tc_stats SEC(".maps");
+
+static __always_inline void count_stat(__u32 stat)
+{
+    __u64* v = bpf_map_lookup_elem(&tc_stats, &stat);
+    if (v)
+        *v += 1;
+}
+
+// Interfaces without a link layer header, such as PPP devices, keyed by
+// ifindex. Their packets start with the IP header. Filled by tc.go.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 64);
+    __type(key, __u32);
+    __type(value, __u8);
+} raw_ip_ifaces SEC(".maps");
+
 struct pppoe_hdr {
     __u8 ver_type;
     __u8 code;
@@ -26,15 +69,15 @@ struct pppoe_hdr {
     __be16 length;
 } __attribute__((packed));
 
-static __always_inline int parse_l2(void* data, void* data_end, __u32* off, __u16* proto)
+static __always_inline int parse_l2(struct __sk_buff* skb, void* data, void* data_end, __u32* off, __u16* proto)
 {
     __u8* cursor = data;
 
-    // Some tc paths (for example PPP/PPPoX style devices) provide L3 packets
-    // directly without an Ethernet header.
-    struct iphdr* l3_ip = (struct iphdr*)cursor;
-    if ((void*)(l3_ip + 1) <= data_end && l3_ip->version == 4 && l3_ip->ihl >= 5) {
-        *proto = ETH_P_IP;
+    // PPP/PPPoX style devices provide L3 packets directly, without an
+    // Ethernet header.
+    __u32 ifindex = skb->ifindex;
+    if (bpf_map_lookup_elem(&raw_ip_ifaces, &ifindex)) {
+        *proto = bpf_ntohs(skb->protocol);
         *off = 0;
         return 0;
     }
@@ -80,6 +123,8 @@ static __always_inline int parse_l2(void* data, void* data_end, __u32* off, __u1
 
     if (ppp_proto == PPP_IP)
         *proto = ETH_P_IP;
+    else if (ppp_proto == PPP_IPV6)
+        *proto = ETH_P_IPV6;
 
     return 0;
 }
@@ -115,6 +160,41 @@ static __always_inline int parse_ipv4_tcp(void* data, void* data_end, __u32* off
     return 0;
 }
 
+// Only packets whose first next header is TCP are handled; extension
+// headers are left alone.
+static __always_inline int parse_ipv6_tcp(void* data, void* data_end, __u32* off, struct ipv6hdr** ip6_out)
+{
+    __u8* cursor = data;
+
+    struct ipv6hdr* ip6 = (struct ipv6hdr*)(cursor + *off);
+    if ((void*)(ip6 + 1) > data_end)
+        return -1;
+
+    if (ip6->version != 6)
+        return -1;
+
+    if (ip6->nexthdr != IPPROTO_TCP)
+        return -1;
+
+    *ip6_out = ip6;
+    *off += sizeof(*ip6);
+    return 0;
+}
+
+// parse_ip_tcp moves off past the IPv4 or IPv6 header of a TCP packet.
+static __always_inline int parse_ip_tcp(void* data, void* data_end, __u16 proto, __u32* off)
+{
+    if (proto == ETH_P_IP) {
+        struct iphdr* ip = NULL;
+        return parse_ipv4_tcp(data, data_end, off, &ip);
+    }
+    if (proto == ETH_P_IPV6) {
+        struct ipv6hdr* ip6 = NULL;
+        return parse_ipv6_tcp(data, data_end, off, &ip6);
+    }
+    return -1;
+}
+
 static __always_inline int parse_tcp_hdr(void* data, void* data_end, __u32 off,
     struct tcphdr** tcp_out,
     int* opt_off_out, int* opt_len_out)
@@ -144,10 +224,11 @@ static __always_inline int is_first_syn(const struct tcphdr* tcp)
     return tcp->syn && !tcp->ack;
 }
 
-static __always_inline void clear_tcp_ts_option(struct __sk_buff* skb, int opt_off, int opt_len, int csum_off)
+// clear_tcp_ts_option returns 1 if a timestamp option was replaced.
+static __always_inline int clear_tcp_ts_option(struct __sk_buff* skb, int opt_off, int opt_len, int csum_off)
 {
     if (opt_len < 10)
-        return;
+        return 0;
 
     int i = 0;
 
@@ -198,11 +279,12 @@ static __always_inline void clear_tcp_ts_option(struct __sk_buff* skb, int opt_o
                 (void)bpf_l4_csum_replace(skb, csum_off, old_words[w], new_word,
                     sizeof(new_word));
             }
-            break;
+            return 1;
         }
 
         i += len;
     }
+    return 0;
 }
 
 SEC("tc/egress")
@@ -214,14 +296,13 @@ int clear_tcp_syn_ts(struct __sk_buff* skb)
     __u32 off = 0;
     __u16 proto = 0;
 
-    if (parse_l2(data, data_end, &off, &proto) < 0)
+    if (parse_l2(skb, data, data_end, &off, &proto) < 0)
         return TC_ACT_OK;
 
-    if (proto != ETH_P_IP)
+    if (proto != ETH_P_IP && proto != ETH_P_IPV6)
         return TC_ACT_OK;
 
-    struct iphdr* ip = NULL;
-    if (parse_ipv4_tcp(data, data_end, &off, &ip) < 0)
+    if (parse_ip_tcp(data, data_end, proto, &off) < 0)
         return TCX_NEXT;
 
     struct tcphdr* tcp = NULL;
@@ -233,7 +314,9 @@ int clear_tcp_syn_ts(struct __sk_buff* skb)
     if (!is_first_syn(tcp))
         return TC_ACT_OK;
 
-    clear_tcp_ts_option(skb, opt_off, opt_len, off + offsetof(struct tcphdr, check));
+    count_stat(STAT_TCPTS_SEEN);
+    if (clear_tcp_ts_option(skb, opt_off, opt_len, off + offsetof(struct tcphdr, check)))
+        count_stat(STAT_TCPTS_REWRITTEN);
 
     return TCX_NEXT;
 }
@@ -247,14 +330,13 @@ int set_tcp_syn_window(struct __sk_buff* skb)
     __u32 off = 0;
     __u16 proto = 0;
 
-    if (parse_l2(data, data_end, &off, &proto) < 0)
+    if (parse_l2(skb, data, data_end, &off, &proto) < 0)
         return TC_ACT_OK;
 
-    if (proto != ETH_P_IP)
+    if (proto != ETH_P_IP && proto != ETH_P_IPV6)
         return TC_ACT_OK;
 
-    struct iphdr* ip = NULL;
-    if (parse_ipv4_tcp(data, data_end, &off, &ip) < 0)
+    if (parse_ip_tcp(data, data_end, proto, &off) < 0)
         return TCX_NEXT;
 
     struct tcphdr* tcp = NULL;
@@ -266,6 +348,8 @@ int set_tcp_syn_window(struct __sk_buff* skb)
     if (!is_first_syn(tcp))
         return TC_ACT_OK;
 
+    count_stat(STAT_TCPWIN_SEEN);
+
     __be16 old_window = tcp->window;
     __be16 new_window = bpf_htons(65535);
 
@@ -276,6 +360,34 @@ int set_tcp_syn_window(struct __sk_buff* skb)
         old_window, new_window, sizeof(new_window));
     (void)bpf_skb_store_bytes(skb, off + offsetof(struct tcphdr, window),
         &new_window, sizeof(new_window), 0);
+    count_stat(STAT_TCPWIN_REWRITTEN);
+
+    return TCX_NEXT;
+}
+
+// IPv6 has no ID field; its per-flow identifier is the flow label, which
+// has no checksum of its own and is not part of the TCP/UDP pseudo header.
+static __always_inline int clear_ipv6_flow_label(struct __sk_buff* skb, void* data, void* data_end, __u32 off)
+{
+    __u8* cursor = data;
+    struct ipv6hdr* ip6 = (struct ipv6hdr*)(cursor + off);
+    if ((void*)(ip6 + 1) > data_end)
+        return TC_ACT_OK;
+
+    if (ip6->version != 6)
+        return TC_ACT_OK;
+
+    count_stat(STAT_IPID_SEEN);
+
+    // The flow label is the low 4 bits of flow_lbl[0] and flow_lbl[1..2];
+    // the high 4 bits of flow_lbl[0] belong to the traffic class.
+    if ((ip6->flow_lbl[0] & 0x0F) == 0 && ip6->flow_lbl[1] == 0 && ip6->flow_lbl[2] == 0)
+        return TCX_NEXT;
+
+    __u8 new_lbl[3] = { ip6->flow_lbl[0] & 0xF0, 0, 0 };
+    (void)bpf_skb_store_bytes(skb, off + offsetof(struct ipv6hdr, flow_lbl),
+        new_lbl, sizeof(new_lbl), 0);
+    count_stat(STAT_IPID_REWRITTEN);
 
     return TCX_NEXT;
 }
@@ -289,9 +401,12 @@ int set_ip_id_zero(struct __sk_buff* skb)
     __u32 off = 0;
     __u16 proto = 0;
 
-    if (parse_l2(data, data_end, &off, &proto) < 0)
+    if (parse_l2(skb, data, data_end, &off, &proto) < 0)
         return TC_ACT_OK;
 
+    if (proto == ETH_P_IPV6)
+        return clear_ipv6_flow_label(skb, data, data_end, off);
+
     if (proto != ETH_P_IP)
         return TC_ACT_OK;
 
@@ -310,6 +425,8 @@ int set_ip_id_zero(struct __sk_buff* skb)
     if ((void*)(cursor + off + ip_hlen) > data_end)
         return TC_ACT_OK;
 
+    count_stat(STAT_IPID_SEEN);
+
     if (ip->id == 0)
         return TCX_NEXT;
 
@@ -320,6 +437,35 @@ int set_ip_id_zero(struct __sk_buff* skb)
     bpf_l3_csum_replace(skb, off + offsetof(struct iphdr, check), old_id, new_id, 2);
     (void)bpf_skb_store_bytes(skb, off + offsetof(struct iphdr, id),
         &new_id, sizeof(new_id), BPF_F_RECOMPUTE_CSUM);
+    count_stat(STAT_IPID_REWRITTEN);
+
+    return TCX_NEXT;
+}
+
+// IPv6 has no header checksum, so the hop limit is stored as is.
+static __always_inline int set_ipv6_hop_limit(struct __sk_buff* skb, void* data, void* data_end, __u32 off)
+{
+    __u8* cursor = data;
+    struct ipv6hdr* ip6 = (struct ipv6hdr*)(cursor + off);
+    if ((void*)(ip6 + 1) > data_end)
+        return TC_ACT_OK;
+
+    if (ip6->version != 6)
+        return TC_ACT_OK;
+
+    count_stat(STAT_TTL_SEEN);
+
+    if (ip6->hop_limit == target_ttl)
+        return TCX_NEXT;
+
+    // prevent modify desync inject packet
+    if (ip6->hop_limit < IP_TTL_MIN)
+        return TCX_NEXT;
+
+    __u8 new_hop_limit = target_ttl;
+    (void)bpf_skb_store_bytes(skb, off + offsetof(struct ipv6hdr, hop_limit),
+        &new_hop_limit, sizeof(new_hop_limit), 0);
+    count_stat(STAT_TTL_REWRITTEN);
 
     return TCX_NEXT;
 }
@@ -333,9 +479,12 @@ int set_ip_ttl(struct __sk_buff* skb)
     __u32 off = 0;
     __u16 proto = 0;
 
-    if (parse_l2(data, data_end, &off, &proto) < 0)
+    if (parse_l2(skb, data, data_end, &off, &proto) < 0)
         return TC_ACT_OK;
 
+    if (proto == ETH_P_IPV6)
+        return set_ipv6_hop_limit(skb, data, data_end, off);
+
     if (proto != ETH_P_IP)
         return TC_ACT_OK;
 
@@ -354,6 +503,8 @@ int set_ip_ttl(struct __sk_buff* skb)
     if ((void*)(cursor + off + ip_hlen) > data_end)
         return TC_ACT_OK;
 
+    count_stat(STAT_TTL_SEEN);
+
     if (ip->ttl == target_ttl)
         return TCX_NEXT;
 
@@ -369,10 +520,21 @@ int set_ip_ttl(struct __sk_buff* skb)
         old_ttl, new_ttl_word, sizeof(new_ttl_word));
     (void)bpf_skb_store_bytes(skb, off + offsetof(struct iphdr, ttl),
         &new_ttl, sizeof(new_ttl), BPF_F_RECOMPUTE_CSUM);
+    count_stat(STAT_TTL_REWRITTEN);
 
     return TCX_NEXT;
 }
 
+static __always_inline int is_quic(void* data, void* data_end, __u32 off)
+{
+    __u8* cursor = data;
+    struct udphdr* udp = (struct udphdr*)(cursor + off);
+    if ((void*)(udp + 1) > data_end)
+        return 0;
+
+    return bpf_ntohs(udp->dest) == 443;
+}
+
 SEC("tc/egress")
 int block_quic(struct __sk_buff* skb)
 {
@@ -382,13 +544,31 @@ int block_quic(struct __sk_buff* skb)
     __u32 off = 0;
     __u16 proto = 0;
 
-    if (parse_l2(data, data_end, &off, &proto) < 0)
+    if (parse_l2(skb, data, data_end, &off, &proto) < 0)
         return TC_ACT_OK;
 
+    __u8* cursor = data;
+
+    if (proto == ETH_P_IPV6) {
+        struct ipv6hdr* ip6 = (struct ipv6hdr*)(cursor + off);
+        if ((void*)(ip6 + 1) > data_end)
+            return TC_ACT_OK;
+
+        if (ip6->version != 6 || ip6->nexthdr != IPPROTO_UDP)
+            return TCX_NEXT;
+
+        count_stat(STAT_QUIC_SEEN);
+        if (is_quic(data, data_end, off + sizeof(*ip6))) {
+            count_stat(STAT_QUIC_DROPPED);
+            return TCX_DROP;
+        }
+
+        return TCX_NEXT;
+    }
+
     if (proto != ETH_P_IP)
         return TC_ACT_OK;
 
-    __u8* cursor = data;
     struct iphdr* ip = (struct iphdr*)(cursor + off);
     if ((void*)(ip + 1) > data_end)
         return TC_ACT_OK;
@@ -413,12 +593,9 @@ int block_quic(struct __sk_buff* skb)
 
     off += ip_hlen;
 
-    struct udphdr* udp = (struct udphdr*)(cursor + off);
-    if ((void*)(udp + 1) > data_end)
-        return TCX_NEXT;
-
-    __u16 dport = bpf_ntohs(udp->dest);
-    if (dport == 443) {
+    count_stat(STAT_QUIC_SEEN);
+    if (is_quic(data, data_end, off)) {
+        count_stat(STAT_QUIC_DROPPED);
         return TCX_DROP;
     }
 
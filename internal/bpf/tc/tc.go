@@ -13,6 +13,7 @@ import (
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/sunbk201/ua3f/internal/bpf/bpfstats"
 	"github.com/sunbk201/ua3f/internal/config"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
@@ -37,11 +38,13 @@ type classicAttachment struct {
 
 type tcProgramAttachment struct {
 	name    string
+	feature string
 	program *ebpf.Program
 }
 
 type TC struct {
 	objs         *tcObjects
+	features     []string
 	links        []link.Link // TCX links (kernel >= 6.6)
 	classicLinks []classicAttachment
 }
@@ -82,13 +85,13 @@ func NewTC(cfg *config.L3RewriteConfig) (*TC, error) {
 		return nil, fmt.Errorf("list interfaces: %w", err)
 	}
 
-	defaultRouteIfaces, err := getIPv4DefaultRouteInterfaces()
+	defaultRouteIfaces, err := getDefaultRouteInterfaces()
 	if err != nil {
 		objs.Close()
-		return nil, fmt.Errorf("list ipv4 default routes: %w", err)
+		return nil, fmt.Errorf("list default routes: %w", err)
 	}
 
-	var eligible []net.Interface
+	var eligible, rawIP []net.Interface
 	for _, iface := range ifaces {
 		if iface.Flags&net.FlagLoopback != 0 {
 			continue
@@ -96,20 +99,24 @@ func NewTC(cfg *config.L3RewriteConfig) (*TC, error) {
 		if skipInterfaces[iface.Name] {
 			continue
 		}
-		if !isEthernetOrPPPInterface(iface) {
+		encap := linkEncapType(iface)
+		if encap != "ether" && encap != "ppp" {
 			slog.Info("Skip interface for TC", "name", iface.Name, "index", iface.Index, "reason", "not ethernet or pppoe")
 			continue
 		}
-		if !hasIPv4Address(iface) {
-			slog.Info("Skip interface for TC", "name", iface.Name, "index", iface.Index, "reason", "no ipv4 address")
+		if !hasIPAddress(iface) {
+			slog.Info("Skip interface for TC", "name", iface.Name, "index", iface.Index, "reason", "no ipv4 or global ipv6 address")
 			continue
 		}
 		if !defaultRouteIfaces[iface.Index] {
-			slog.Info("Skip interface for TC", "name", iface.Name, "index", iface.Index, "reason", "not on ipv4 default route")
+			slog.Info("Skip interface for TC", "name", iface.Name, "index", iface.Index, "reason", "not on ipv4 or ipv6 default route")
 			continue
 		}
 		eligible = append(eligible, iface)
-		slog.Info("Eligible interface for TC", "name", iface.Name, "index", iface.Index)
+		if encap == "ppp" {
+			rawIP = append(rawIP, iface)
+		}
+		slog.Info("Eligible interface for TC", "name", iface.Name, "index", iface.Index, "encap", encap)
 	}
 
 	if len(eligible) == 0 {
@@ -117,6 +124,14 @@ func NewTC(cfg *config.L3RewriteConfig) (*TC, error) {
 		return nil, fmt.Errorf("no eligible interfaces for TC")
 	}
 
+	// Packets of PPP interfaces have no Ethernet header to parse.
+	for _, iface := range rawIP {
+		if err := objs.RawIpIfaces.Put(uint32(iface.Index), uint8(1)); err != nil {
+			objs.Close()
+			return nil, fmt.Errorf("mark %s as raw IP: %w", iface.Name, err)
+		}
+	}
+
 	// Try TCX first (kernel >= 6.6), fall back to cls_bpf on older kernels.
 	links, err := attachAllTCX(eligible, programs)
 	var classicLinks []classicAttachment
@@ -129,72 +144,99 @@ func NewTC(cfg *config.L3RewriteConfig) (*TC, error) {
 		return nil, err
 	}
 
-	return &TC{objs: &objs, links: links, classicLinks: classicLinks}, nil
+	t := &TC{objs: &objs, links: links, classicLinks: classicLinks}
+	for _, program := range programs {
+		t.features = append(t.features, program.feature)
+	}
+	bpfstats.SetTC(t.Stats)
+	return t, nil
 }
 
-func isEthernetOrPPPInterface(iface net.Interface) bool {
+// linkEncapType returns the link layer of iface, such as "ether" or "ppp".
+func linkEncapType(iface net.Interface) string {
 	lnk, err := netlink.LinkByIndex(iface.Index)
 	if err != nil {
-		return false
+		return ""
 	}
 	attrs := lnk.Attrs()
 	if attrs == nil {
-		return false
+		return ""
 	}
-	return attrs.EncapType == "ether" || attrs.EncapType == "ppp"
+	return attrs.EncapType
 }
 
-func hasIPv4Address(iface net.Interface) bool {
+func hasIPAddress(iface net.Interface) bool {
 	addrs, err := iface.Addrs()
 	if err != nil {
 		return false
 	}
 	for _, addr := range addrs {
+		var ip net.IP
 		switch v := addr.(type) {
 		case *net.IPNet:
-			if v.IP != nil && v.IP.To4() != nil {
-				return true
-			}
+			ip = v.IP
 		case *net.IPAddr:
-			if v.IP != nil && v.IP.To4() != nil {
-				return true
-			}
+			ip = v.IP
+		}
+		if isUsableIP(ip) {
+			return true
 		}
 	}
 	return false
 }
 
-func getIPv4DefaultRouteInterfaces() (map[int]bool, error) {
-	routes, err := netlink.RouteList(nil, unix.AF_INET)
-	if err != nil {
-		return nil, err
+// isUsableIP reports whether ip can source traffic on a default route:
+// any IPv4 address, or an IPv6 address that is not link-local.
+func isUsableIP(ip net.IP) bool {
+	if ip == nil {
+		return false
 	}
+	if ip.To4() != nil {
+		return true
+	}
+	return !ip.IsLinkLocalUnicast() && !ip.IsLoopback()
+}
 
+// getDefaultRouteInterfaces returns the interfaces of the IPv4 and IPv6 default routes.
+// Multipath routes contribute each of their next hops.
+func getDefaultRouteInterfaces() (map[int]bool, error) {
 	defaultIfaces := make(map[int]bool)
-	for _, route := range routes {
-		if !isIPv4DefaultRoute(route.Dst) {
-			continue
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			// Kernels built without IPv6 fail to list AF_INET6 routes
+			if family == unix.AF_INET6 {
+				slog.Warn("List IPv6 routes for TC", "error", err)
+				continue
+			}
+			return nil, err
+		}
+		for _, route := range routes {
+			if !isDefaultRoute(route.Dst) {
+				continue
+			}
+			if route.LinkIndex > 0 {
+				defaultIfaces[route.LinkIndex] = true
+			}
+			for _, nh := range route.MultiPath {
+				defaultIfaces[nh.LinkIndex] = true
+			}
 		}
-		defaultIfaces[route.LinkIndex] = true
 	}
 
 	return defaultIfaces, nil
 }
 
-func isIPv4DefaultRoute(dst *net.IPNet) bool {
-	// Linux may represent default IPv4 route as nil or as 0.0.0.0/0.
+func isDefaultRoute(dst *net.IPNet) bool {
+	// Linux may represent default routes as nil, 0.0.0.0/0 or ::/0.
 	if dst == nil {
 		return true
 	}
-	ones, bits := dst.Mask.Size()
-	if bits != 32 || ones != 0 {
+	ones, _ := dst.Mask.Size()
+	if ones != 0 {
 		return false
 	}
-	ip4 := dst.IP.To4()
-	if ip4 == nil {
-		return false
-	}
-	return ip4.Equal(net.IPv4zero)
+	return dst.IP.IsUnspecified()
 }
 
 func (t *TC) Close() error {
@@ -204,6 +246,8 @@ func (t *TC) Close() error {
 
 	var errs []error
 
+	bpfstats.SetTC(nil)
+
 	for _, l := range t.links {
 		if err := l.Close(); err != nil {
 			errs = append(errs, err)
@@ -235,23 +279,23 @@ func selectedPrograms(objs *tcObjects, cfg *config.L3RewriteConfig) []tcProgramA
 	var programs []tcProgramAttachment
 
 	if cfg.IPID {
-		programs = append(programs, tcProgramAttachment{name: "set_ip_id_zero", program: objs.SetIpIdZero})
+		programs = append(programs, tcProgramAttachment{name: "set_ip_id_zero", feature: bpfstats.FeatureIPID, program: objs.SetIpIdZero})
 		slog.Info("Selected TC program", "Set IP ID", true)
 	}
 	if cfg.TTL {
-		programs = append(programs, tcProgramAttachment{name: "set_ip_ttl", program: objs.SetIpTtl})
+		programs = append(programs, tcProgramAttachment{name: "set_ip_ttl", feature: bpfstats.FeatureTTL, program: objs.SetIpTtl})
 		slog.Info("Selected TC program", "Set TTL", true, "TTL Value", cfg.TTLValue)
 	}
 	if cfg.TCPWIN {
-		programs = append(programs, tcProgramAttachment{name: "set_tcp_syn_window", program: objs.SetTcpSynWindow})
+		programs = append(programs, tcProgramAttachment{name: "set_tcp_syn_window", feature: bpfstats.FeatureTCPWIN, program: objs.SetTcpSynWindow})
 		slog.Info("Selected TC program", "Set TCP Initial Window", true)
 	}
 	if cfg.TCPTS {
-		programs = append(programs, tcProgramAttachment{name: "clear_tcp_syn_ts", program: objs.ClearTcpSynTs})
+		programs = append(programs, tcProgramAttachment{name: "clear_tcp_syn_ts", feature: bpfstats.FeatureTCPTS, program: objs.ClearTcpSynTs})
 		slog.Info("Selected TC program", "Clear TCP Timestamp", true)
 	}
 	if cfg.BLOCKQUIC {
-		programs = append(programs, tcProgramAttachment{name: "block_quic", program: objs.BlockQuic})
+		programs = append(programs, tcProgramAttachment{name: "block_quic", feature: bpfstats.FeatureQUIC, program: objs.BlockQuic})
 		slog.Info("Selected TC program", "Block QUIC", true)
 	}
 
@@ -338,7 +382,7 @@ func addClsBpfFilter(attachment classicAttachment, progFD int) error {
 			Handle:    attachment.handle,
 			Parent:    netlink.HANDLE_MIN_EGRESS,
 			Priority:  attachment.priority,
-			Protocol:  unix.ETH_P_IP,
+			Protocol:  unix.ETH_P_ALL,
 		},
 		Fd:           progFD,
 		Name:         attachment.name,
@@ -356,7 +400,7 @@ func deleteClsBpfFilter(attachment classicAttachment) error {
 			Handle:    attachment.handle,
 			Parent:    netlink.HANDLE_MIN_EGRESS,
 			Priority:  attachment.priority,
-			Protocol:  unix.ETH_P_IP,
+			Protocol:  unix.ETH_P_ALL,
 		},
 	}
 	err := netlink.FilterDel(filter)
@@ -65,6 +65,8 @@ type tcProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type tcMapSpecs struct {
+	RawIpIfaces *ebpf.MapSpec `ebpf:"raw_ip_ifaces"`
+	TcStats     *ebpf.MapSpec `ebpf:"tc_stats"`
 }
 
 // tcVariableSpecs contains global variables before they are loaded into the kernel.
@@ -94,10 +96,15 @@ func (o *tcObjects) Close() error {
 //
 // It can be passed to loadTcObjects or ebpf.CollectionSpec.LoadAndAssign.
 type tcMaps struct {
+	RawIpIfaces *ebpf.Map `ebpf:"raw_ip_ifaces"`
+	TcStats     *ebpf.Map `ebpf:"tc_stats"`
 }
 
 func (m *tcMaps) Close() error {
-	return _TcClose()
+	return _TcClose(
+		m.RawIpIfaces,
+		m.TcStats,
+	)
 }
 
 // tcVariables contains all global variables after they have been loaded into the kernel.
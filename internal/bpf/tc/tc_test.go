@@ -0,0 +1,121 @@
+//go:build linux
+
+package tc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+func TestIsDefaultRoute(t *testing.T) {
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"", true},
+		{"0.0.0.0/0", true},
+		{"::/0", true},
+		{"192.168.1.0/24", false},
+		{"2000::/3", false},
+		{"10.0.0.0/0", false},
+	}
+	for _, tt := range tests {
+		var dst *net.IPNet
+		if tt.dst != "" {
+			ip, ipnet, err := net.ParseCIDR(tt.dst)
+			if err != nil {
+				t.Fatalf("ParseCIDR(%q): %v", tt.dst, err)
+			}
+			// keep the host bits to check that they disqualify the route
+			ipnet.IP = ip
+			dst = ipnet
+		}
+		if got := isDefaultRoute(dst); got != tt.want {
+			t.Errorf("isDefaultRoute(%q) = %v, want %v", tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestIsUsableIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.1", true},
+		{"2001:db8::1", true},
+		{"fd00::1", true},
+		{"fe80::1", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := isUsableIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isUsableIP(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if isUsableIP(nil) {
+		t.Error("isUsableIP(nil) = true, want false")
+	}
+}
+
+// loadTestObjects loads the TC programs, skipping the test where BPF is not
+// permitted.
+func loadTestObjects(t *testing.T) *tcObjects {
+	t.Helper()
+	spec, err := loadTc()
+	if err != nil {
+		t.Fatalf("loadTc() error = %v", err)
+	}
+	var objs tcObjects
+	if err := spec.LoadAndAssign(&objs, nil); err != nil {
+		t.Skipf("BPF unavailable: %v", err)
+	}
+	t.Cleanup(func() { objs.Close() })
+	return &objs
+}
+
+// ipv6Packet returns an IPv6 TCP header with the given source and hop limit.
+func ipv6Packet(src string, hopLimit byte) []byte {
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = 6 // TCP
+	ip[7] = hopLimit
+	copy(ip[8:24], net.ParseIP(src))
+	copy(ip[24:40], net.ParseIP("2001:db8::2"))
+	return append(ip, make([]byte, 20)...)
+}
+
+func TestSetIPTTLIPv6(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	// An Ethernet frame whose destination MAC starts like an IPv6 header.
+	mac := []byte{0x64, 0x66, 0xb3, 0x01, 0x02, 0x03, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x86, 0xdd}
+	frame := append(append([]byte(nil), mac...), ipv6Packet("2001:db8::1", 128)...)
+	out := make([]byte, len(frame))
+	if _, err := objs.SetIpTtl.Run(&ebpf.RunOptions{Data: frame, DataOut: out}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !bytes.Equal(out[:len(mac)], mac) {
+		t.Errorf("Ethernet header = % x, want % x", out[:len(mac)], mac)
+	}
+	if got := out[len(mac)+7]; got != config.DefaultTTL {
+		t.Errorf("hop limit = %d, want %d", got, config.DefaultTTL)
+	}
+
+	// Packets of interfaces marked raw IP start with the IP header. The test
+	// device is lo, and bytes 12-13 of the source address give the protocol.
+	if err := objs.RawIpIfaces.Put(uint32(1), uint8(1)); err != nil {
+		t.Fatalf("mark lo as raw IP: %v", err)
+	}
+	packet := ipv6Packet("2001:db8:86dd::1", 128)
+	out = make([]byte, len(packet))
+	if _, err := objs.SetIpTtl.Run(&ebpf.RunOptions{Data: packet, DataOut: out}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := out[7]; got != config.DefaultTTL {
+		t.Errorf("raw IP hop limit = %d, want %d", got, config.DefaultTTL)
+	}
+}
@@ -13,6 +13,7 @@ const (
 	ActionRedirect302    ActionType = "REDIRECT-302"
 	ActionRedirect307    ActionType = "REDIRECT-307"
 	ActionRedirectHeader ActionType = "REDIRECT-HEADER"
+	ActionProxy          ActionType = "PROXY"
 )
 
 type ActionTarget string
@@ -36,3 +37,10 @@ type Action interface {
 	Execute(metadata *Metadata) (bool, error)
 	Direction() Direction
 }
+
+// HeaderAction is an action rewriting one header, whose value can be
+// recorded before and after the action.
+type HeaderAction interface {
+	Action
+	Header() string
+}
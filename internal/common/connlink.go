@@ -8,7 +8,9 @@ import (
 	"sync"
 	"syscall"
 
+	"github.com/sunbk201/ua3f/internal/dns"
 	"github.com/sunbk201/ua3f/internal/sniff"
+	"github.com/sunbk201/ua3f/internal/statistics"
 )
 
 type ConnLink struct {
@@ -23,6 +25,10 @@ type ConnLink struct {
 	LAddr string
 	RAddr string
 
+	User string // username the client authenticated with, empty for anonymous clients
+
+	Traffic *statistics.Traffic // bytes relayed for the link, counted once CountTraffic is called
+
 	lcookie uint64 // BPF cookie for L side
 	rcookie uint64 // BPF cookie for R side
 
@@ -41,31 +47,42 @@ func (c *ConnLink) DoneSniff() {
 }
 
 func (c *ConnLink) LIP() string {
-	if tcpAddr, ok := c.LConn.RemoteAddr().(*net.TCPAddr); ok {
-		return tcpAddr.IP.String()
-	}
-	return ""
+	ip, _ := splitAddr(c.LConn, c.LAddr)
+	return ip
 }
 
 func (c *ConnLink) RIP() string {
-	if tcpAddr, ok := c.RConn.RemoteAddr().(*net.TCPAddr); ok {
-		return tcpAddr.IP.String()
-	}
-	return ""
+	ip, _ := splitAddr(c.RConn, c.RAddr)
+	return ip
 }
 
 func (c *ConnLink) LPort() string {
-	if tcpAddr, ok := c.LConn.RemoteAddr().(*net.TCPAddr); ok {
-		return fmt.Sprintf("%d", tcpAddr.Port)
-	}
-	return ""
+	_, port := splitAddr(c.LConn, c.LAddr)
+	return port
 }
 
 func (c *ConnLink) RPort() string {
-	if tcpAddr, ok := c.RConn.RemoteAddr().(*net.TCPAddr); ok {
-		return fmt.Sprintf("%d", tcpAddr.Port)
+	_, port := splitAddr(c.RConn, c.RAddr)
+	return port
+}
+
+// splitAddr returns the remote IP and port of conn, falling back to addr when
+// conn is not yet dialed or does not expose a TCP address, as with tunnels
+// through an upstream proxy. The IP is empty when addr holds a domain.
+func splitAddr(conn net.Conn, addr string) (string, string) {
+	if conn != nil {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			return tcpAddr.IP.String(), fmt.Sprintf("%d", tcpAddr.Port)
+		}
 	}
-	return ""
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", ""
+	}
+	if net.ParseIP(host) == nil {
+		return "", port
+	}
+	return host, port
 }
 
 func (c *ConnLink) LFD() (int, error) {
@@ -86,16 +103,8 @@ func (c *ConnLink) RFD() (int, error) {
 
 func (c *ConnLink) CopyLR() {
 	defer func() {
-		if tc, ok := c.LConn.(*net.TCPConn); ok {
-			_ = tc.CloseRead()
-		} else {
-			_ = c.LConn.Close()
-		}
-		if tc, ok := c.RConn.(*net.TCPConn); ok {
-			_ = tc.CloseWrite()
-		} else {
-			_ = c.RConn.Close()
-		}
+		closeRead(c.LConn)
+		closeWrite(c.RConn)
 	}()
 	n, _ := io.CopyBuffer(c.RConn, c.LConn, one)
 	slog.Debug("CopyLR done", slog.Int64("bytes", n), slog.Any("ConnLink", c))
@@ -103,16 +112,8 @@ func (c *ConnLink) CopyLR() {
 
 func (c *ConnLink) CopyRL() {
 	defer func() {
-		if tc, ok := c.RConn.(*net.TCPConn); ok {
-			_ = tc.CloseRead()
-		} else {
-			_ = c.RConn.Close()
-		}
-		if tc, ok := c.LConn.(*net.TCPConn); ok {
-			_ = tc.CloseWrite()
-		} else {
-			_ = c.LConn.Close()
-		}
+		closeRead(c.RConn)
+		closeWrite(c.LConn)
 	}()
 	n, _ := io.CopyBuffer(c.LConn, c.RConn, one)
 	slog.Debug("CopyRL done", slog.Int64("bytes", n), slog.Any("ConnLink", c))
@@ -120,40 +121,42 @@ func (c *ConnLink) CopyRL() {
 
 func (c *ConnLink) CloseLR() error {
 	if c.LConn != nil {
-		if tc, ok := c.LConn.(*net.TCPConn); ok {
-			_ = tc.CloseRead()
-		} else {
-			_ = c.LConn.Close()
-		}
+		closeRead(c.LConn)
 	}
 	if c.RConn != nil {
-		if tc, ok := c.RConn.(*net.TCPConn); ok {
-			_ = tc.CloseWrite()
-		} else {
-			_ = c.RConn.Close()
-		}
+		closeWrite(c.RConn)
 	}
 	return nil
 }
 
 func (c *ConnLink) CloseRL() error {
 	if c.RConn != nil {
-		if tc, ok := c.RConn.(*net.TCPConn); ok {
-			_ = tc.CloseRead()
-		} else {
-			_ = c.RConn.Close()
-		}
+		closeRead(c.RConn)
 	}
 	if c.LConn != nil {
-		if tc, ok := c.LConn.(*net.TCPConn); ok {
-			_ = tc.CloseWrite()
-		} else {
-			_ = c.LConn.Close()
-		}
+		closeWrite(c.LConn)
 	}
 	return nil
 }
 
+// closeRead half-closes conn when it supports it, as *net.TCPConn and proxy
+// tunnels do, and fully closes it otherwise.
+func closeRead(conn net.Conn) {
+	if cr, ok := conn.(interface{ CloseRead() error }); ok {
+		_ = cr.CloseRead()
+	} else {
+		_ = conn.Close()
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
+
 func (c *ConnLink) Close() error {
 	if c.LConn != nil {
 		_ = c.LConn.Close()
@@ -164,10 +167,27 @@ func (c *ConnLink) Close() error {
 	return nil
 }
 
+// Host returns the destination domain, taken from RAddr when it names one and
+// otherwise looked up from the resolved IP.
+func (c *ConnLink) Host() string {
+	if host, _, err := net.SplitHostPort(c.RAddr); err == nil && host != "" && net.ParseIP(host) == nil {
+		return host
+	}
+	host, _ := dns.LookupAddr(c.RAddr)
+	return host
+}
+
 func (c *ConnLink) LogValue() slog.Value {
+	if host := c.Host(); host != "" {
+		return slog.GroupValue(
+			slog.String("src_addr", c.LAddr),
+			slog.String("dest_addr", c.RAddr),
+			slog.String("host", host),
+		)
+	}
 	return slog.GroupValue(
-		slog.String("LAddr", c.LAddr),
-		slog.String("RAddr", c.RAddr),
+		slog.String("src_addr", c.LAddr),
+		slog.String("dest_addr", c.RAddr),
 	)
 }
 
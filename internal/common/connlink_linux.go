@@ -3,9 +3,7 @@
 package common
 
 import (
-	"fmt"
 	"net"
-	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -30,30 +28,11 @@ func (c *ConnLink) RSOCookie() (uint64, error) {
 
 // socookie returns Linux SO_COOKIE (u64) for the underlying socket of conn.
 func socookie(conn net.Conn) (uint64, error) {
-	sc, ok := conn.(syscall.Conn)
-	if !ok {
-		return 0, fmt.Errorf("conn type %T does not implement syscall.Conn", conn)
-	}
-
-	rc, err := sc.SyscallConn()
+	fd, err := sockFd(conn)
 	if err != nil {
 		return 0, err
 	}
-
-	var (
-		cookie  uint64
-		sockErr error
-	)
-
-	if err := rc.Control(func(fd uintptr) {
-		cookie, sockErr = getsockoptU64(int(fd), unix.SOL_SOCKET, soCookie)
-	}); err != nil {
-		return 0, err
-	}
-	if sockErr != nil {
-		return 0, sockErr
-	}
-	return cookie, nil
+	return getsockoptU64(int(fd), unix.SOL_SOCKET, soCookie)
 }
 
 func getsockoptU64(fd, level, opt int) (uint64, error) {
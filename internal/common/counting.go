@@ -0,0 +1,130 @@
+package common
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/sunbk201/ua3f/internal/metrics"
+	"github.com/sunbk201/ua3f/internal/statistics"
+)
+
+// countingConn counts the bytes read from and written to a client
+// connection: reads are uploads, writes are downloads. ReadFrom and WriteTo
+// are passed through so relaying between TCP sockets keeps using splice.
+type countingConn struct {
+	net.Conn
+	traffic atomic.Pointer[statistics.Traffic] // per-connection counters, nil until bound to a link
+}
+
+// CountTraffic makes LConn count the bytes relayed for the link, in Traffic
+// as well as in the global metrics.
+func (c *ConnLink) CountTraffic() {
+	if c.LConn == nil {
+		return
+	}
+	conn, ok := c.LConn.(*countingConn)
+	if !ok {
+		conn = &countingConn{Conn: c.LConn}
+		c.LConn = conn
+	}
+	conn.traffic.Store(c.Traffic)
+}
+
+// CountOffloaded counts the bytes relayed in the kernel while the link was
+// offloaded to the BPF sockmap, which never pass through LConn.
+func (c *ConnLink) CountOffloaded(upload, download int64) {
+	metrics.UploadBytes.Add(upload)
+	metrics.DownloadBytes.Add(download)
+	c.Traffic.AddUpload(upload)
+	c.Traffic.AddDownload(download)
+}
+
+// CountTraffic returns conn counting its traffic, or conn itself if it
+// already does.
+func CountTraffic(conn net.Conn) net.Conn {
+	if _, ok := conn.(*countingConn); ok {
+		return conn
+	}
+	return &countingConn{Conn: conn}
+}
+
+// CountingListener returns a listener whose connections count their traffic.
+func CountingListener(l net.Listener) net.Listener {
+	return countingListener{l}
+}
+
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return CountTraffic(conn), nil
+}
+
+func (c *countingConn) upload(n int64) {
+	metrics.UploadBytes.Add(n)
+	c.traffic.Load().AddUpload(n)
+}
+
+func (c *countingConn) download(n int64) {
+	metrics.DownloadBytes.Add(n)
+	c.traffic.Load().AddDownload(n)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.upload(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.download(int64(n))
+	return n, err
+}
+
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	return copyCounted(c.Conn, r, c.download)
+}
+
+func (c *countingConn) WriteTo(w io.Writer) (int64, error) {
+	return copyCounted(w, c.Conn, c.upload)
+}
+
+// relayChunk bounds every copy of copyCounted.
+const relayChunk = 1 << 20
+
+// copyCounted copies src to dst until EOF, counting every chunk of up to
+// relayChunk bytes. Each chunk still goes through dst's ReadFrom, so copies
+// between TCP sockets are spliced while the counters stay current.
+func copyCounted(dst io.Writer, src io.Reader, count func(int64)) (int64, error) {
+	var total int64
+	for {
+		n, err := io.Copy(dst, &io.LimitedReader{R: src, N: relayChunk})
+		total += n
+		count(n)
+		if err != nil || n < relayChunk {
+			return total, err
+		}
+	}
+}
+
+func (c *countingConn) CloseRead() error {
+	closeRead(c.Conn)
+	return nil
+}
+
+func (c *countingConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// NetConn returns the wrapped connection, so that sockFd can reach the socket.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,13 @@
+package common
+
+import "net"
+
+// Datagram describes a UDP flow relayed through SOCKS5 UDP ASSOCIATE.
+type Datagram struct {
+	SrcAddr string
+	DstAddr string // destination as requested by the client, host:port
+	SrcIP   net.IP
+	DstIP   net.IP
+	DstPort uint16
+	Host    string // domain requested by the client, empty for IP destinations
+}
@@ -125,8 +125,8 @@ func (f *Frame) SerializeWithFragment() ([]byte, error) {
 	slog.Info("Serialized with fragmentation",
 		slog.Int("Original Payload Size", len(f.TCP.Payload)),
 		slog.Int("fragments", len(fragmentedFrames)),
-		slog.String("SrcAddr", f.SrcAddr),
-		slog.String("DstAddr", f.DstAddr))
+		slog.String("src_addr", f.SrcAddr),
+		slog.String("dest_addr", f.DstAddr))
 
 	combined := []byte{}
 	for _, frag := range fragmentedFrames {
@@ -247,8 +247,8 @@ func (f *Frame) SerializeFragments(cfg *FragmentConfig) ([][]byte, error) {
 		slog.Info("Serialized fragment",
 			slog.Int("Fragment Index", i),
 			slog.Int("Fragment Size", frag.length),
-			slog.String("SrcAddr", f.SrcAddr),
-			slog.String("DstAddr", f.DstAddr))
+			slog.String("src_addr", f.SrcAddr),
+			slog.String("dest_addr", f.DstAddr))
 		packets = append(packets, data)
 	}
 
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/sunbk201/ua3f/internal/dns"
 	"github.com/sunbk201/ua3f/internal/sniff"
 )
 
@@ -20,8 +21,15 @@ type Metadata struct {
 
 	Packet *Packet // NFQUEUE
 
+	Datagram *Datagram // SOCKS5 UDP
+
+	// Simulated is set on the synthetic requests of rule simulations, whose
+	// rewrites are not recorded in statistics.
+	Simulated bool
+
 	srcAddr  string
 	destAddr string
+	user     string
 }
 
 func (m *Metadata) UpdateRequest(req *http.Request) {
@@ -43,13 +51,54 @@ func (m *Metadata) SrcAddr() string {
 	if m.Packet != nil {
 		return m.Packet.SrcAddr
 	}
+	if m.Datagram != nil {
+		return m.Datagram.SrcAddr
+	}
 	return m.srcAddr
 }
 
+// SrcIP returns the client IP of a connection or datagram flow.
+func (m *Metadata) SrcIP() net.IP {
+	if m.ConnLink != nil {
+		return net.ParseIP(m.ConnLink.LIP())
+	}
+	if m.Datagram != nil {
+		return m.Datagram.SrcIP
+	}
+	return nil
+}
+
+// DestIP returns the destination IP of a connection or datagram flow.
+func (m *Metadata) DestIP() net.IP {
+	if m.ConnLink != nil {
+		return net.ParseIP(m.ConnLink.RIP())
+	}
+	if m.Datagram != nil {
+		return m.Datagram.DstIP
+	}
+	return nil
+}
+
+// User returns the username the client authenticated with, or "" for anonymous clients.
+func (m *Metadata) User() string {
+	if m.ConnLink != nil && m.ConnLink.User != "" {
+		return m.ConnLink.User
+	}
+	return m.user
+}
+
+// SetUser records the authenticated username of a request served without a ConnLink.
+func (m *Metadata) SetUser(user string) {
+	m.user = user
+}
+
 func (m *Metadata) DestPort() string {
 	if m.ConnLink != nil {
 		return m.ConnLink.RPort()
 	}
+	if m.Datagram != nil {
+		return strconv.Itoa(int(m.Datagram.DstPort))
+	}
 	if m.Request != nil {
 		port := m.Request.URL.Port()
 		if port == "" {
@@ -78,12 +127,15 @@ func (m *Metadata) DestAddr() string {
 	if m.Packet != nil {
 		return m.Packet.DstAddr
 	}
+	if m.Datagram != nil {
+		return m.Datagram.DstAddr
+	}
 	return m.destAddr
 }
 
 func (m *Metadata) Host() string {
 	if m.Request == nil {
-		return ""
+		return m.sniffedHost()
 	}
 	host := m.Request.Host
 	for i := 0; i < len(host); i++ {
@@ -95,6 +147,29 @@ func (m *Metadata) Host() string {
 	return host
 }
 
+// sniffedHost maps the destination IP back to a domain handed out as a fake IP
+// or observed in DNS answers.
+// It is used for flows that carry no HTTP Host header.
+func (m *Metadata) sniffedHost() string {
+	if m.Packet != nil && m.Packet.DstIP != nil {
+		host, _ := dns.LookupAddr(m.Packet.DstIP.String())
+		return host
+	}
+	if m.ConnLink != nil {
+		return m.ConnLink.Host()
+	}
+	if m.Datagram != nil {
+		if m.Datagram.Host != "" {
+			return m.Datagram.Host
+		}
+		if m.Datagram.DstIP != nil {
+			host, _ := dns.LookupAddr(m.Datagram.DstIP.String())
+			return host
+		}
+	}
+	return ""
+}
+
 func (m *Metadata) URL() string {
 	if m.Request == nil {
 		return ""
@@ -237,6 +312,7 @@ func (m *Metadata) LogValue() slog.Value {
 		slog.String("dest_addr", m.DestAddr()),
 		slog.String("host", m.Host()),
 		slog.String("user_agent", m.UserAgent()),
+		slog.String("user", m.User()),
 	)
 }
 
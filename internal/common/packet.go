@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 
 	nfq "github.com/florianl/go-nfqueue/v2"
 	"github.com/google/gopacket"
@@ -16,8 +17,10 @@ type Packet struct {
 	A            *nfq.Attribute
 	NetworkLayer gopacket.NetworkLayer
 	TCP          *layers.TCP
+	UDP          *layers.UDP // nil unless the packet carries UDP rather than TCP
 	SrcAddr      string
 	DstAddr      string
+	SrcIP        net.IP
 	DstIP        net.IP
 	IsIPv6       bool
 }
@@ -48,28 +51,41 @@ func NewPacket(a *nfq.Attribute) (packet *Packet, err error) {
 		packet.NetworkLayer = ip4
 	}
 
-	parser := gopacket.NewDecodingLayerParser(layerType, ipLayer, packet.TCP)
+	udp := &layers.UDP{}
+	parser := gopacket.NewDecodingLayerParser(layerType, ipLayer, packet.TCP, udp)
 	parser.IgnoreUnsupported = true
 
 	if err = parser.DecodeLayers(pktData, &decoded); err != nil {
 		return
 	}
 
+	srcPort, dstPort := uint16(packet.TCP.SrcPort), uint16(packet.TCP.DstPort)
+	if slices.Contains(decoded, layers.LayerTypeUDP) {
+		packet.UDP = udp
+		srcPort, dstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
+	}
+
 	if packet.IsIPv6 {
 		ip6 := packet.NetworkLayer.(*layers.IPv6)
-		packet.SrcAddr = fmt.Sprintf("%s:%d", ip6.SrcIP.String(), packet.TCP.SrcPort)
-		packet.DstAddr = fmt.Sprintf("%s:%d", ip6.DstIP.String(), packet.TCP.DstPort)
+		packet.SrcAddr = fmt.Sprintf("%s:%d", ip6.SrcIP.String(), srcPort)
+		packet.DstAddr = fmt.Sprintf("%s:%d", ip6.DstIP.String(), dstPort)
+		packet.SrcIP = ip6.SrcIP
 		packet.DstIP = ip6.DstIP
 	} else {
 		ip4 := packet.NetworkLayer.(*layers.IPv4)
-		packet.SrcAddr = fmt.Sprintf("%s:%d", ip4.SrcIP.String(), packet.TCP.SrcPort)
-		packet.DstAddr = fmt.Sprintf("%s:%d", ip4.DstIP.String(), packet.TCP.DstPort)
+		packet.SrcAddr = fmt.Sprintf("%s:%d", ip4.SrcIP.String(), srcPort)
+		packet.DstAddr = fmt.Sprintf("%s:%d", ip4.DstIP.String(), dstPort)
+		packet.SrcIP = ip4.SrcIP
 		packet.DstIP = ip4.DstIP
 	}
 	return
 }
 
 func (p *Packet) Serialize() ([]byte, error) {
+	if p.UDP != nil {
+		return p.serializeUDP()
+	}
+
 	var err error
 
 	networkLayer := p.NetworkLayer
@@ -106,6 +122,40 @@ func (p *Packet) Serialize() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// serializeUDP serializes a UDP packet, whose IP header may have been
+// rewritten.
+func (p *Packet) serializeUDP() ([]byte, error) {
+	udp := p.UDP
+	payload := udp.Payload
+
+	buffer := gopacket.NewSerializeBuffer()
+	serOpts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	udp.Checksum = 0
+	udp.Payload = nil
+	if err := udp.SetNetworkLayerForChecksum(p.NetworkLayer); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if p.IsIPv6 {
+		ip6 := p.NetworkLayer.(*layers.IPv6)
+		ip6.NextHeader = layers.IPProtocolUDP
+		err = gopacket.SerializeLayers(buffer, serOpts, ip6, udp, gopacket.Payload(payload))
+	} else {
+		ip4 := p.NetworkLayer.(*layers.IPv4)
+		ip4.Checksum = 0
+		err = gopacket.SerializeLayers(buffer, serOpts, ip4, udp, gopacket.Payload(payload))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
 // SerializeWithDesync splits the TCP payload into 2 fragments,
 // discards the first fragment, keeps only the second fragment,
 // and serializes the packet with the updated sequence number.
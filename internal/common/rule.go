@@ -13,6 +13,7 @@ const (
 	RuleTypeDomainSuffix  RuleType = "DOMAIN-SUFFIX"
 	RuleTypeDomainSet     RuleType = "DOMAIN-SET"
 	RuleTypeURLRegex      RuleType = "URL-REGEX"
+	RuleTypeUser          RuleType = "USER"
 	RuleTypeFinal         RuleType = "FINAL"
 )
 
@@ -2,6 +2,7 @@ package common
 
 import (
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/statistics"
 )
 
 type Server interface {
@@ -10,3 +11,14 @@ type Server interface {
 	Restart(cfg *config.Config) (Server, error)
 	GetRewriter() Rewriter
 }
+
+// Reloader is implemented by servers that can apply rewrite rule, User-Agent
+// and MitM hostname changes without restarting.
+type Reloader interface {
+	Reload(cfg *config.Config) error
+}
+
+// StatsRecorder is implemented by servers that record connection statistics.
+type StatsRecorder interface {
+	Recorder() *statistics.Recorder
+}
@@ -28,17 +28,43 @@ const (
 	RewriteModeRule   RewriteMode = "RULE"
 
 	DefaultTTL uint8 = 64
+
+	DefaultDNSListen    = "127.0.0.1:1053"
+	DefaultDNSCacheSize = 4096
+	DefaultFakeIPRange  = "198.18.0.0/16"
+
+	DefaultUDPIdleTimeout = 60 // seconds
+
+	DefaultUpstreamMaxIdleConns          = 100
+	DefaultUpstreamMaxIdleConnsPerHost   = 16
+	DefaultUpstreamIdleConnTimeout       = 90 // seconds
+	DefaultUpstreamDialTimeout           = 10 // seconds
+	DefaultUpstreamResponseHeaderTimeout = 30 // seconds
+
+	DefaultStatsHourlyRetention = 48   // hours
+	DefaultStatsDailyRetention  = 35   // days
+	DefaultStatsMaxSize         = 1024 // KiB
+
+	DefaultAuditMaxSize    = 5 // MiB
+	DefaultAuditMaxBackups = 3
+	DefaultAuditMaxAge     = 7 // days
 )
 
 type Config struct {
-	ServerMode  ServerMode `yaml:"server-mode" validate:"required,oneof=HTTP SOCKS5 TPROXY REDIRECT NFQUEUE"`
-	BindAddress string     `yaml:"bind-address" validate:"ip"`
+	ServerMode  ServerMode `yaml:"server-mode" default:"SOCKS5" validate:"required,oneof=HTTP SOCKS5 TPROXY REDIRECT NFQUEUE"`
+	BindAddress string     `yaml:"bind-address" default:"127.0.0.1" validate:"ip"`
 	Port        int        `yaml:"port" default:"1080" validate:"required,min=1,max=65535"`
 
+	Listeners []Listener `yaml:"listeners" validate:"dive"`
+
+	WatchConfig bool `yaml:"watch-config" default:"true"` // reload when the config file changes
+
 	APIServer       string `yaml:"api-server"`
 	APIServerSecret string `yaml:"api-server-secret"`
 
-	LogLevel string `yaml:"log-level" default:"info" validate:"required,oneof=debug info warn error"`
+	LogLevel  string            `yaml:"log-level" default:"info" validate:"required,oneof=debug info warn error"`
+	LogFormat string            `yaml:"log-format" default:"text" validate:"omitempty,oneof=text json"`
+	LogLevels map[string]string `yaml:"log-levels,omitempty" validate:"dive,keys,oneof=api mitm netfilter nfqueue rule,endkeys,oneof=debug info warn error"`
 
 	RewriteMode RewriteMode `yaml:"rewrite-mode" default:"GLOBAL" validate:"required,oneof=GLOBAL DIRECT RULE"`
 
@@ -57,10 +83,25 @@ type Config struct {
 
 	MitM MitMConfig `yaml:"mitm"`
 
+	Socks5 Socks5Config `yaml:"socks5"`
+
+	HTTPProxy HTTPProxyConfig `yaml:"http-proxy"`
+
+	Outbounds       []Outbound `yaml:"outbounds" validate:"dive"`
+	DefaultOutbound string     `yaml:"default-outbound"`
+
 	Desync DesyncConfig `yaml:"desync"`
 
+	DNSSniff DNSSniffConfig `yaml:"dns-sniff"`
+
+	DNS DNSConfig `yaml:"dns"`
+
 	BPFOffload bool `yaml:"bpf-offload"`
 
+	StatsStore StatsStoreConfig `yaml:"stats-store"`
+
+	AuditLog AuditLogConfig `yaml:"audit-log"`
+
 	HeaderRules     []Rule `yaml:"header-rewrite" validate:"dive"`
 	HeaderRulesJson string `yaml:"header-rewrite-json,omitempty"`
 
@@ -80,6 +121,52 @@ type MitMConfig struct {
 	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
 }
 
+type Socks5Config struct {
+	Auth AuthConfig `yaml:"auth"`
+	// UDPIdleTimeout is the number of seconds a UDP ASSOCIATE session may stay
+	// silent before it is dropped. Zero uses DefaultUDPIdleTimeout.
+	UDPIdleTimeout int `yaml:"udp-idle-timeout" validate:"min=0"`
+}
+
+// HTTPProxyConfig controls which clients may use the HTTP proxy server.
+// Allow and Deny hold IPs or CIDRs; Deny takes precedence, and an empty
+// Allow admits every address not denied.
+type HTTPProxyConfig struct {
+	Auth     AuthConfig     `yaml:"auth"`
+	Allow    []string       `yaml:"allow" validate:"dive,cidr|ip"`
+	Deny     []string       `yaml:"deny" validate:"dive,cidr|ip"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+}
+
+// UpstreamConfig tunes the transport the HTTP proxy uses to reach origin servers.
+// Timeouts are in seconds, and zero values fall back to the Default* constants.
+type UpstreamConfig struct {
+	MaxIdleConns          int  `yaml:"max-idle-conns" validate:"min=0"`
+	MaxIdleConnsPerHost   int  `yaml:"max-idle-conns-per-host" validate:"min=0"`
+	MaxConnsPerHost       int  `yaml:"max-conns-per-host" validate:"min=0"` // 0 means unlimited
+	IdleConnTimeout       int  `yaml:"idle-conn-timeout" validate:"min=0"`
+	DialTimeout           int  `yaml:"dial-timeout" validate:"min=0"`
+	ResponseHeaderTimeout int  `yaml:"response-header-timeout" validate:"min=0"`
+	HTTP2                 bool `yaml:"http2"` // negotiated with https:// origins only
+}
+
+// AuthConfig lists the credentials a proxy server accepts, inline and from an htpasswd file.
+// Authentication is disabled when neither is set.
+type AuthConfig struct {
+	Users    []AuthUser `yaml:"users" validate:"dive"`
+	Htpasswd string     `yaml:"htpasswd"`
+}
+
+type AuthUser struct {
+	Username string `json:"username" yaml:"username" validate:"required,max=255"`
+	Password string `json:"password" yaml:"password" validate:"max=255"`
+}
+
+// Enabled reports whether any credentials are configured.
+func (a *AuthConfig) Enabled() bool {
+	return len(a.Users) > 0 || a.Htpasswd != ""
+}
+
 type DesyncConfig struct {
 	DesyncPorts    string `yaml:"desync-ports,omitempty"`
 	ReorderBytes   uint32 `yaml:"reorder-bytes" default:"8" validate:"min=0"`
@@ -87,27 +174,101 @@ type DesyncConfig struct {
 	Reorder        bool   `yaml:"reorder"`
 	Inject         bool   `yaml:"inject"`
 	InjectTTL      uint8  `yaml:"inject-ttl" default:"3" validate:"min=0"`
+
+	TLS           bool                `yaml:"tls"`
+	TLSStrategies []DesyncTLSStrategy `yaml:"tls-strategies" validate:"dive"`
+
+	AutoProbe  bool   `yaml:"auto-probe"`
+	ProbePorts string `yaml:"probe-ports,omitempty"`
+	ProbeFile  string `yaml:"probe-file,omitempty"`
+}
+
+// DesyncTLSStrategy selects the ClientHello desync methods for matching destination ports and hostnames.
+type DesyncTLSStrategy struct {
+	Ports          string   `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Hostnames      string   `json:"hostnames,omitempty" yaml:"hostnames,omitempty"`
+	Methods        []string `json:"methods" yaml:"methods" validate:"required,dive,oneof=SNI-SPLIT RECORD-SPLIT FAKE-CLIENTHELLO"`
+	RecordSegments int      `json:"record_segments,omitempty" yaml:"record-segments,omitempty" validate:"min=0,max=16"`
+	FakeSNI        string   `json:"fake_sni,omitempty" yaml:"fake-sni,omitempty" validate:"omitempty,hostname"`
+	FakeFooling    string   `json:"fake_fooling,omitempty" yaml:"fake-fooling,omitempty" validate:"omitempty,oneof=TTL BADSUM"`
+	FakeTTL        uint8    `json:"fake_ttl,omitempty" yaml:"fake-ttl,omitempty"`
+}
+
+type DNSSniffConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type DNSConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Listen       string   `yaml:"listen" default:"127.0.0.1:1053" validate:"required_if=Enabled true,omitempty,hostname_port"`
+	Upstreams    []string `yaml:"upstreams" validate:"required_if=Enabled true"`
+	CacheSize    int      `yaml:"cache-size" default:"4096" validate:"min=0"`
+	FakeIP       bool     `yaml:"fake-ip"`
+	FakeIPRange  string   `yaml:"fake-ip-range" default:"198.18.0.0/16" validate:"required_if=FakeIP true,omitempty,cidrv4"`
+	FakeIPFilter string   `yaml:"fake-ip-filter"`
+}
+
+// StatsStoreConfig persists hourly and daily statistics rollups to disk so
+// reports survive restarts. Zero values fall back to the Default* constants.
+type StatsStoreConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Path            string `yaml:"path,omitempty"`
+	HourlyRetention int    `yaml:"hourly-retention" validate:"min=0"` // hours
+	DailyRetention  int    `yaml:"daily-retention" validate:"min=0"`  // days
+	MaxSize         int    `yaml:"max-size" validate:"min=0"`         // KiB
+}
+
+// AuditLogConfig writes the rule decisions to a JSON lines file rotated
+// apart from the main log. SampleRate is the fraction of requests and
+// responses audited. Zero values fall back to auditing every decision and
+// to the Default* constants.
+type AuditLogConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	Path       string  `yaml:"path,omitempty"`
+	SampleRate float64 `yaml:"sample-rate" validate:"min=0,max=1"`
+	MaxSize    int     `yaml:"max-size" validate:"min=0"` // MiB
+	MaxBackups int     `yaml:"max-backups" validate:"min=0"`
+	MaxAge     int     `yaml:"max-age" validate:"min=0"` // days
 }
 
 type L3RewriteConfig struct {
 	BPFOffload bool  `yaml:"bpf-offload"`
 	TTL        bool  `yaml:"ttl"`
-	TTLValue   uint8 `yaml:"ttl-value" validate:"min=1,max=255"`
+	TTLValue   uint8 `yaml:"ttl-value" default:"64" validate:"min=1,max=255"`
 	IPID       bool  `yaml:"ipid"`
 	TCPWIN     bool  `yaml:"tcpwin"`
 	TCPTS      bool  `yaml:"tcpts"`
 	BLOCKQUIC  bool  `yaml:"block-quic"`
+
+	Rules []L3Rule `yaml:"rules" validate:"dive"`
+}
+
+// L3Rule overrides the global L3 rewrite and desync settings for packets
+// matching all of its conditions. Unset actions inherit the global settings.
+type L3Rule struct {
+	Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+	DstCIDR string `json:"dst_cidr,omitempty" yaml:"dst-cidr,omitempty"`
+	DstPort string `json:"dst_port,omitempty" yaml:"dst-port,omitempty"`
+	SrcIP   string `json:"src_ip,omitempty" yaml:"src-ip,omitempty"`
+	Domain  string `json:"domain,omitempty" yaml:"domain,omitempty"`
+
+	TTL    *uint8   `json:"ttl,omitempty" yaml:"ttl,omitempty" validate:"omitempty,min=1"`
+	IPID   string   `json:"ipid,omitempty" yaml:"ipid,omitempty" validate:"omitempty,oneof=ZERO RANDOM KEEP"`
+	TCPTS  *bool    `json:"tcpts,omitempty" yaml:"tcpts,omitempty"`
+	TCPWIN *uint16  `json:"tcpwin,omitempty" yaml:"tcpwin,omitempty"`
+	Desync []string `json:"desync,omitempty" yaml:"desync,omitempty" validate:"omitempty,dive,oneof=NONE REORDER INJECT SNI-SPLIT FAKE-CLIENTHELLO"`
 }
 
 type Rule struct {
-	Enabled bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Enabled bool `json:"enabled" yaml:"enabled"`
 
-	Type string `json:"type" yaml:"type" validate:"required,oneof=HEADER-KEYWORD HEADER-REGEX DEST-PORT IP-CIDR SRC-IP DOMAIN-SUFFIX DOMAIN-KEYWORD DOMAIN DOMAIN-SET URL-REGEX FINAL"`
+	Type string `json:"type" yaml:"type" validate:"required,oneof=HEADER-KEYWORD HEADER-REGEX DEST-PORT IP-CIDR SRC-IP DOMAIN-SUFFIX DOMAIN-KEYWORD DOMAIN DOMAIN-SET URL-REGEX USER FINAL"`
 
 	MatchHeader string `json:"match_header,omitempty" yaml:"match-header,omitempty" validate:"required_if=Type HEADER-KEYWORD,required_if=Type HEADER-REGEX"`
-	MatchValue  string `json:"match_value,omitempty" yaml:"match-value,omitempty" validate:"required_if=Type DEST-PORT,required_if=Type HEADER-KEYWORD,required_if=Type HEADER-REGEX,required_if=Type IP-CIDR,required_if=Type SRC-IP,required_if=Type DOMAIN-SUFFIX,required_if=Type DOMAIN-KEYWORD,required_if=Type DOMAIN,required_if=Type DOMAIN-SET,required_if=Type URL-REGEX"`
+	MatchValue  string `json:"match_value,omitempty" yaml:"match-value,omitempty" validate:"required_if=Type DEST-PORT,required_if=Type HEADER-KEYWORD,required_if=Type HEADER-REGEX,required_if=Type IP-CIDR,required_if=Type SRC-IP,required_if=Type DOMAIN-SUFFIX,required_if=Type DOMAIN-KEYWORD,required_if=Type DOMAIN,required_if=Type DOMAIN-SET,required_if=Type URL-REGEX,required_if=Type USER"`
 
-	Action string `json:"action" yaml:"action" validate:"required,oneof=DIRECT REPLACE REPLACE-REGEX DELETE DROP ADD REDIRECT-302 REDIRECT-307 REDIRECT-HEADER REJECT"`
+	Action   string `json:"action" yaml:"action" validate:"required,oneof=DIRECT REPLACE REPLACE-REGEX DELETE DROP ADD REDIRECT-302 REDIRECT-307 REDIRECT-HEADER REJECT PROXY"`
+	Outbound string `json:"outbound,omitempty" yaml:"outbound,omitempty" validate:"required_if=Action PROXY"`
 
 	RewriteHeader    string `json:"rewrite_header,omitempty" yaml:"rewrite-header,omitempty"` // validate:"required_if=Action REPLACE,required_if=Action REPLACE-REGEX,required_if=Action DELETE,required_if=Action ADD"
 	RewriteValue     string `json:"rewrite_value,omitempty" yaml:"rewrite-value,omitempty" validate:"required_if=Action REPLACE,required_if=Action REPLACE-REGEX,required_if=Action ADD"`
@@ -143,7 +304,17 @@ func BuildConfigFromViper() (*Config, error) {
 
 	// Normalize case
 	cfg.ServerMode = ServerMode(strings.ToUpper(string(cfg.ServerMode)))
+	for i := range cfg.Listeners {
+		cfg.Listeners[i].ServerMode = ServerMode(strings.ToUpper(string(cfg.Listeners[i].ServerMode)))
+	}
+	for i := range cfg.Outbounds {
+		cfg.Outbounds[i].Type = OutboundType(strings.ToUpper(string(cfg.Outbounds[i].Type)))
+	}
 	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+	for module, level := range cfg.LogLevels {
+		cfg.LogLevels[module] = strings.ToLower(level)
+	}
 	cfg.RewriteMode = RewriteMode(strings.ToUpper(string(cfg.RewriteMode)))
 
 	ipid := cfg.IPID || cfg.L3Rewrite.IPID
@@ -155,6 +326,26 @@ func BuildConfigFromViper() (*Config, error) {
 	cfg.TCPTimeStamp, cfg.L3Rewrite.TCPTS = tcpts, tcpts
 	cfg.TCPInitialWindow, cfg.L3Rewrite.TCPWIN = tcpInitWindow, tcpInitWindow
 
+	for i := range cfg.L3Rewrite.Rules {
+		r := &cfg.L3Rewrite.Rules[i]
+		r.IPID = strings.ToUpper(r.IPID)
+		for j := range r.Desync {
+			r.Desync[j] = strings.ToUpper(strings.TrimSpace(r.Desync[j]))
+		}
+	}
+
+	for i := range cfg.Desync.TLSStrategies {
+		st := &cfg.Desync.TLSStrategies[i]
+		for j := range st.Methods {
+			st.Methods[j] = strings.ToUpper(strings.TrimSpace(st.Methods[j]))
+		}
+		st.FakeFooling = strings.ToUpper(st.FakeFooling)
+	}
+
+	defaultRulesEnabled("header-rewrite", cfg.HeaderRules)
+	defaultRulesEnabled("body-rewrite", cfg.BodyRules)
+	defaultRulesEnabled("url-redirect", cfg.URLRedirectRules)
+
 	// Backwards compatibility: convert deprecated "RULES" value to "RULE".
 	if cfg.RewriteMode == "RULES" {
 		cfg.RewriteMode = RewriteModeRule
@@ -164,15 +355,45 @@ func BuildConfigFromViper() (*Config, error) {
 	if err := validate.Struct(&cfg); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
+	if err := cfg.validateListeners(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	if err := cfg.validateOutbounds(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
 
 	return &cfg, nil
 }
 
+// defaultRulesEnabled enables the rules under key that do not set "enabled",
+// so hand-written rules are active unless explicitly disabled.
+func defaultRulesEnabled(key string, rules []Rule) {
+	raw, ok := viper.Get(key).([]any)
+	if !ok || len(raw) != len(rules) {
+		return
+	}
+	for i, item := range raw {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, set := m["enabled"]; !set {
+			rules[i].Enabled = true
+		}
+	}
+}
+
 func (c *Config) LogValue() slog.Value {
 	return slog.GroupValue(
 		slog.String("Log Level", c.LogLevel),
+		slog.String("Log Format", c.LogFormat),
+		slog.Any("Log Levels", c.LogLevels),
 		slog.String("Server Mode", string(c.ServerMode)),
 		slog.String("Bind Address", c.BindAddress),
+		slog.Int("Listeners", len(c.Listeners)),
+		slog.Bool("Watch Config", c.WatchConfig),
+		slog.Int("Outbounds", len(c.Outbounds)),
+		slog.String("Default Outbound", c.DefaultOutbound),
 		slog.String("Rewrite Mode", string(c.RewriteMode)),
 		slog.String("User-Agent", c.UserAgent),
 		slog.String("User-Agent Regex", c.UserAgentRegex),
@@ -190,6 +411,7 @@ func (c *Config) LogValue() slog.Value {
 				slog.Bool("Set IP ID", c.L3Rewrite.IPID),
 				slog.Bool("Delete TCP Timestamp", c.L3Rewrite.TCPTS),
 				slog.Bool("Set TCP Initial Window", c.L3Rewrite.TCPWIN),
+				slog.Int("Rules", len(c.L3Rewrite.Rules)),
 			),
 		},
 		slog.Attr{
@@ -199,6 +421,41 @@ func (c *Config) LogValue() slog.Value {
 				slog.Uint64("Reorder Packets", uint64(c.Desync.ReorderPackets)),
 				slog.Bool("Inject", c.Desync.Inject),
 				slog.Uint64("Inject TTL", uint64(c.Desync.InjectTTL)),
+				slog.Bool("TLS", c.Desync.TLS),
+				slog.Int("TLS Strategies", len(c.Desync.TLSStrategies)),
+				slog.Bool("Auto Probe", c.Desync.AutoProbe),
+			),
+		},
+		slog.Attr{
+			Key: "DNS Sniff", Value: slog.GroupValue(
+				slog.Bool("Enabled", c.DNSSniff.Enabled),
+			),
+		},
+		slog.Attr{
+			Key: "DNS", Value: slog.GroupValue(
+				slog.Bool("Enabled", c.DNS.Enabled),
+				slog.String("Listen", c.DNS.Listen),
+				slog.Any("Upstreams", c.DNS.Upstreams),
+				slog.Bool("Fake IP", c.DNS.FakeIP),
+				slog.String("Fake IP Range", c.DNS.FakeIPRange),
+			),
+		},
+		slog.Attr{
+			Key: "SOCKS5", Value: slog.GroupValue(
+				slog.Int("Auth Users", len(c.Socks5.Auth.Users)),
+				slog.String("Auth Htpasswd", c.Socks5.Auth.Htpasswd),
+				slog.Int("UDP Idle Timeout", c.Socks5.UDPIdleTimeout),
+			),
+		},
+		slog.Attr{
+			Key: "HTTP Proxy", Value: slog.GroupValue(
+				slog.Int("Auth Users", len(c.HTTPProxy.Auth.Users)),
+				slog.String("Auth Htpasswd", c.HTTPProxy.Auth.Htpasswd),
+				slog.Any("Allow", c.HTTPProxy.Allow),
+				slog.Any("Deny", c.HTTPProxy.Deny),
+				slog.Int("Upstream Max Idle Conns", c.HTTPProxy.Upstream.MaxIdleConns),
+				slog.Int("Upstream Max Conns Per Host", c.HTTPProxy.Upstream.MaxConnsPerHost),
+				slog.Bool("Upstream HTTP2", c.HTTPProxy.Upstream.HTTP2),
 			),
 		},
 		slog.Attr{
@@ -208,5 +465,18 @@ func (c *Config) LogValue() slog.Value {
 				slog.Bool("Insecure Skip Verify", c.MitM.InsecureSkipVerify),
 			),
 		},
+		slog.Attr{
+			Key: "Stats Store", Value: slog.GroupValue(
+				slog.Bool("Enabled", c.StatsStore.Enabled),
+				slog.String("Path", c.StatsStore.Path),
+			),
+		},
+		slog.Attr{
+			Key: "Audit Log", Value: slog.GroupValue(
+				slog.Bool("Enabled", c.AuditLog.Enabled),
+				slog.String("Path", c.AuditLog.Path),
+				slog.Float64("Sample Rate", c.AuditLog.SampleRate),
+			),
+		},
 	)
 }
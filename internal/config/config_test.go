@@ -1,10 +1,15 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
@@ -18,6 +23,7 @@ func resetViper(t *testing.T) {
 	viper.SetDefault("server-mode", "SOCKS5")
 	viper.SetDefault("bind-address", "127.0.0.1")
 	viper.SetDefault("port", 1080)
+	viper.SetDefault("watch-config", true)
 	viper.SetDefault("log-level", "info")
 	viper.SetDefault("user-agent", "FFF")
 	viper.SetDefault("rewrite-mode", "GLOBAL")
@@ -63,6 +69,7 @@ func TestDefaultConfig(t *testing.T) {
 		{"ServerMode", cfg.ServerMode, ServerModeSocks5},
 		{"BindAddress", cfg.BindAddress, "127.0.0.1"},
 		{"Port", cfg.Port, 1080},
+		{"WatchConfig", cfg.WatchConfig, true},
 		{"LogLevel", cfg.LogLevel, "info"},
 		{"RewriteMode", cfg.RewriteMode, RewriteModeGlobal},
 		{"UserAgent", cfg.UserAgent, "FFF"},
@@ -332,6 +339,282 @@ url-redirect:
 	}
 }
 
+func TestL3RulesFromFile(t *testing.T) {
+	resetViper(t)
+
+	yaml := `
+server-mode: TPROXY
+l3-rewrite:
+  ttl: true
+  rules:
+    - name: console
+      src-ip: 192.168.1.50
+      ttl: 128
+      ipid: keep
+      tcpts: false
+      desync: [none]
+    - domain: example.com
+      dst-port: "443"
+      tcpwin: 0
+      desync: [sni-split]
+`
+	path := writeConfigFile(t, yaml)
+	loadConfigFile(t, path)
+
+	cfg, err := BuildConfigFromViper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cfg.L3Rewrite.Rules) != 2 {
+		t.Fatalf("L3Rewrite.Rules count = %d, want 2", len(cfg.L3Rewrite.Rules))
+	}
+
+	r0 := cfg.L3Rewrite.Rules[0]
+	if r0.TTL == nil || *r0.TTL != 128 {
+		t.Errorf("Rules[0].TTL = %v, want 128", r0.TTL)
+	}
+	if r0.IPID != "KEEP" {
+		t.Errorf("Rules[0].IPID = %v, want KEEP", r0.IPID)
+	}
+	if r0.TCPTS == nil || *r0.TCPTS {
+		t.Errorf("Rules[0].TCPTS = %v, want false", r0.TCPTS)
+	}
+	if r0.TCPWIN != nil {
+		t.Errorf("Rules[0].TCPWIN = %v, want unset", *r0.TCPWIN)
+	}
+
+	r1 := cfg.L3Rewrite.Rules[1]
+	if r1.TTL != nil {
+		t.Errorf("Rules[1].TTL = %v, want unset", *r1.TTL)
+	}
+	if r1.TCPWIN == nil || *r1.TCPWIN != 0 {
+		t.Errorf("Rules[1].TCPWIN = %v, want 0", r1.TCPWIN)
+	}
+	if len(r1.Desync) != 1 || r1.Desync[0] != "SNI-SPLIT" {
+		t.Errorf("Rules[1].Desync = %v, want [SNI-SPLIT]", r1.Desync)
+	}
+}
+
+func TestL3RulesValidation(t *testing.T) {
+	resetViper(t)
+
+	yaml := `
+l3-rewrite:
+  rules:
+    - src-ip: 192.168.1.50
+      desync: [RECORD-SPLIT]
+`
+	path := writeConfigFile(t, yaml)
+	loadConfigFile(t, path)
+
+	if _, err := BuildConfigFromViper(); err == nil {
+		t.Fatal("expected validation error for unsupported desync method")
+	}
+}
+
+func TestListenersFromFile(t *testing.T) {
+	resetViper(t)
+
+	yaml := `
+server-mode: TPROXY
+port: 1080
+listeners:
+  - server-mode: socks5
+    bind-address: 10.8.0.1
+    port: 1081
+  - server-mode: HTTP
+    port: 1082
+`
+	path := writeConfigFile(t, yaml)
+	loadConfigFile(t, path)
+
+	cfg, err := BuildConfigFromViper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []Listener{
+		{ServerMode: ServerModeTProxy, BindAddress: "127.0.0.1", Port: 1080},
+		{ServerMode: ServerModeSocks5, BindAddress: "10.8.0.1", Port: 1081},
+		{ServerMode: ServerModeHTTP, BindAddress: "127.0.0.1", Port: 1082},
+	}
+	got := cfg.ServerListeners()
+	if len(got) != len(want) {
+		t.Fatalf("ServerListeners() len = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ServerListeners()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if !cfg.HasServerMode(ServerModeHTTP) || cfg.HasServerMode(ServerModeNFQueue) {
+		t.Error("HasServerMode does not reflect the listeners")
+	}
+
+	lc := cfg.ForListener(got[1])
+	if lc.ServerMode != ServerModeSocks5 || lc.BindAddress != "10.8.0.1" || lc.Port != 1081 || len(lc.Listeners) != 0 {
+		t.Errorf("ForListener() = %s %s:%d with %d listeners", lc.ServerMode, lc.BindAddress, lc.Port, len(lc.Listeners))
+	}
+	if cfg.ServerMode != ServerModeTProxy {
+		t.Errorf("ForListener modified the original config")
+	}
+}
+
+func TestListenersValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"two transparent modes", `
+server-mode: TPROXY
+listeners:
+  - server-mode: NFQUEUE
+`},
+		{"same port", `
+server-mode: SOCKS5
+bind-address: 0.0.0.0
+port: 1080
+listeners:
+  - server-mode: HTTP
+    bind-address: 10.8.0.1
+    port: 1080
+`},
+		{"missing port", `
+listeners:
+  - server-mode: HTTP
+`},
+		{"unknown mode", `
+listeners:
+  - server-mode: FTP
+    port: 21
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetViper(t)
+			loadConfigFile(t, writeConfigFile(t, tt.yaml))
+			if _, err := BuildConfigFromViper(); err == nil {
+				t.Fatal("expected validation error")
+			}
+		})
+	}
+
+	resetViper(t)
+	loadConfigFile(t, writeConfigFile(t, `
+server-mode: NFQUEUE
+port: 1080
+listeners:
+  - server-mode: SOCKS5
+    bind-address: 10.8.0.1
+    port: 1080
+  - server-mode: HTTP
+    bind-address: 10.8.0.2
+    port: 1080
+`))
+	if _, err := BuildConfigFromViper(); err != nil {
+		t.Fatalf("distinct bind addresses on one port: unexpected error: %v", err)
+	}
+}
+
+func TestOutboundsFromFile(t *testing.T) {
+	resetViper(t)
+
+	yaml := `
+rewrite-mode: RULE
+outbounds:
+  - name: corp
+    type: http
+    address: proxy.example.com:3128
+    username: alice
+    password: secret
+  - name: tor
+    type: SOCKS5
+    address: 127.0.0.1:9050
+default-outbound: corp
+header-rewrite:
+  - type: DOMAIN-SUFFIX
+    match-value: onion
+    action: PROXY
+    outbound: tor
+  - type: DEST-PORT
+    match-value: "22"
+    action: PROXY
+    outbound: DIRECT
+`
+	loadConfigFile(t, writeConfigFile(t, yaml))
+
+	cfg, err := BuildConfigFromViper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []Outbound{
+		{Name: "corp", Type: OutboundTypeHTTP, Address: "proxy.example.com:3128", Username: "alice", Password: "secret"},
+		{Name: "tor", Type: OutboundTypeSocks5, Address: "127.0.0.1:9050"},
+	}
+	if len(cfg.Outbounds) != len(want) {
+		t.Fatalf("Outbounds len = %d, want %d", len(cfg.Outbounds), len(want))
+	}
+	for i := range want {
+		if cfg.Outbounds[i] != want[i] {
+			t.Errorf("Outbounds[%d] = %+v, want %+v", i, cfg.Outbounds[i], want[i])
+		}
+	}
+	if cfg.DefaultOutbound != "corp" {
+		t.Errorf("DefaultOutbound = %q, want %q", cfg.DefaultOutbound, "corp")
+	}
+	if r := cfg.HeaderRules[0]; r.Action != "PROXY" || r.Outbound != "tor" {
+		t.Errorf("HeaderRule[0] = %+v", r)
+	}
+}
+
+func TestOutboundsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"duplicate name", `
+outbounds:
+  - {name: up, type: HTTP, address: "10.0.0.1:8080"}
+  - {name: up, type: SOCKS5, address: "10.0.0.1:1080"}
+`},
+		{"shadows DIRECT", `
+outbounds:
+  - {name: DIRECT, type: HTTP, address: "10.0.0.1:8080"}
+`},
+		{"missing address", `
+outbounds:
+  - {name: up, type: HTTP}
+`},
+		{"unknown type", `
+outbounds:
+  - {name: up, type: FTP, address: "10.0.0.1:21"}
+`},
+		{"unknown default", `
+default-outbound: up
+`},
+		{"unknown rule outbound", `
+header-rewrite:
+  - {type: FINAL, action: PROXY, outbound: up}
+`},
+		{"rule without outbound", `
+header-rewrite:
+  - {type: FINAL, action: PROXY}
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetViper(t)
+			loadConfigFile(t, writeConfigFile(t, tt.yaml))
+			if _, err := BuildConfigFromViper(); err == nil {
+				t.Fatal("expected validation error")
+			}
+		})
+	}
+}
+
 func TestCaseNormalization(t *testing.T) {
 	resetViper(t)
 
@@ -514,6 +797,18 @@ func TestValidation_InvalidLogLevel(t *testing.T) {
 	}
 }
 
+func TestValidation_InvalidLogLevels(t *testing.T) {
+	for _, levels := range []map[string]string{{"mitm": "TRACE"}, {"socks5": "debug"}} {
+		resetViper(t)
+		viper.Set("log-levels", levels)
+
+		_, err := BuildConfigFromViper()
+		if err == nil {
+			t.Errorf("expected validation error for log-levels %v, got nil", levels)
+		}
+	}
+}
+
 func TestValidation_InvalidRewriteMode(t *testing.T) {
 	resetViper(t)
 	viper.Set("rewrite-mode", "INVALID")
@@ -1272,3 +1567,329 @@ url-redirect:
 		t.Errorf("Action = %v, want REDIRECT-HEADER", cfg.URLRedirectRules[0].Action)
 	}
 }
+
+func TestHotReloadable(t *testing.T) {
+	base := `
+server-mode: SOCKS5
+port: 1080
+rewrite-mode: RULE
+user-agent: FFF
+mitm:
+  enabled: true
+  hostname: "example.com"
+header-rewrite:
+  - type: FINAL
+    action: DIRECT
+`
+	tests := []struct {
+		name     string
+		old, new string
+		want     bool
+	}{
+		{"unchanged", "", "", true},
+		{"rules", "    action: DIRECT\n", "    action: DIRECT\n  - type: DOMAIN\n    match-value: example.com\n    action: DROP\n    rewrite-direction: REQUEST\n", true},
+		{"user agent", "user-agent: FFF", "user-agent: UA3F", true},
+		{"mitm hostname", `hostname: "example.com"`, `hostname: "*.example.org"`, true},
+		{"log levels", "port: 1080\n", "port: 1080\nlog-level: warn\nlog-levels:\n  mitm: debug\n", true},
+		{"audit log", "port: 1080\n", "port: 1080\naudit-log:\n  enabled: true\n  sample-rate: 0.1\n", true},
+		{"port", "port: 1080", "port: 1081", false},
+		{"rewrite mode", "rewrite-mode: RULE", "rewrite-mode: GLOBAL", false},
+		{"mitm disabled", "enabled: true", "enabled: false", false},
+		{"listeners", "port: 1080\n", "port: 1080\nlisteners:\n  - server-mode: HTTP\n    port: 8080\n", false},
+	}
+
+	resetViper(t)
+	loadConfigFile(t, writeConfigFile(t, base))
+	cur, err := BuildConfigFromViper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetViper(t)
+			loadConfigFile(t, writeConfigFile(t, strings.Replace(base, tt.old, tt.new, 1)))
+			next, err := BuildConfigFromViper()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := cur.HotReloadable(next); got != tt.want {
+				t.Errorf("HotReloadable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("port: 1080\n"), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	changed := make(chan struct{}, 8)
+	w, err := Watch(path, func() { changed <- struct{}{} })
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+
+	expect := func(what string) {
+		t.Helper()
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change reported after %s", what)
+		}
+	}
+
+	// Several writes in a row are reported once.
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(path, []byte("port: 1081\n"), 0644); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+	}
+	expect("write")
+	select {
+	case <-changed:
+		t.Fatal("burst of writes reported more than once")
+	case <-time.After(2 * watchDebounce):
+	}
+
+	tmp := filepath.Join(dir, "config.yaml.tmp")
+	if err := os.WriteFile(tmp, []byte("port: 1082\n"), 0644); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	expect("rename")
+
+	// Other files in the directory are ignored.
+	if err := os.WriteFile(filepath.Join(dir, "other.yaml"), nil, 0644); err != nil {
+		t.Fatalf("failed to write other file: %v", err)
+	}
+	select {
+	case <-changed:
+		t.Fatal("change to another file reported")
+	case <-time.After(2 * watchDebounce):
+	}
+
+	// Rules written through the API are already applied.
+	if err := WriteRules(path, RuleListHeader, []Rule{{Enabled: true, Type: "FINAL", Action: "DIRECT"}}); err != nil {
+		t.Fatalf("WriteRules: %v", err)
+	}
+	select {
+	case <-changed:
+		t.Fatal("change written by WriteRules reported")
+	case <-time.After(2 * watchDebounce):
+	}
+
+	// A later edit of the same file is reported again.
+	if err := os.WriteFile(path, []byte("port: 1083\n"), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	expect("write after WriteRules")
+}
+
+func TestRuleEnabledDefault(t *testing.T) {
+	resetViper(t)
+
+	yaml := `
+rewrite-mode: RULE
+header-rewrite:
+  - type: FINAL
+    action: DIRECT
+  - type: DEST-PORT
+    match-value: "22"
+    action: DIRECT
+    enabled: false
+body-rewrite:
+  - type: URL-REGEX
+    match-value: "^http://example.com"
+    action: DELETE
+url-redirect: []
+`
+	path := writeConfigFile(t, yaml)
+	loadConfigFile(t, path)
+
+	cfg, err := BuildConfigFromViper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.HeaderRules[0].Enabled {
+		t.Error("HeaderRules[0] without enabled should default to enabled")
+	}
+	if cfg.HeaderRules[1].Enabled {
+		t.Error("HeaderRules[1] with enabled: false should stay disabled")
+	}
+	if !cfg.BodyRules[0].Enabled {
+		t.Error("BodyRules[0] without enabled should default to enabled")
+	}
+}
+
+func TestWithRules(t *testing.T) {
+	cfg := &Config{
+		HeaderRulesJson: `[{"enabled":true,"type":"FINAL","action":"DIRECT"}]`,
+		Outbounds:       []Outbound{{Name: "corp", Type: OutboundTypeHTTP, Address: "127.0.0.1:3128"}},
+	}
+
+	rules, err := cfg.Rules(RuleListHeader)
+	if err != nil {
+		t.Fatalf("Rules: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Type != "FINAL" {
+		t.Fatalf("Rules() = %+v, want the JSON rule", rules)
+	}
+
+	tests := []struct {
+		name    string
+		rules   []Rule
+		wantErr bool
+	}{
+		{"valid", []Rule{{Enabled: true, Type: "DEST-PORT", MatchValue: "22", Action: "DIRECT"}}, false},
+		{"empty", nil, false},
+		{"proxy to known outbound", []Rule{{Type: "FINAL", Action: "PROXY", Outbound: "corp"}}, false},
+		{"missing match value", []Rule{{Type: "DOMAIN", Action: "DIRECT"}}, true},
+		{"invalid action", []Rule{{Type: "FINAL", Action: "BOGUS"}}, true},
+		{"unknown outbound", []Rule{{Type: "FINAL", Action: "PROXY", Outbound: "missing"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, err := cfg.WithRules(RuleListHeader, tt.rules)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WithRules: %v", err)
+			}
+			if next.HeaderRulesJson != "" {
+				t.Error("WithRules should clear the JSON rules")
+			}
+			if cfg.HeaderRulesJson == "" {
+				t.Error("WithRules modified the original config")
+			}
+			if got, _ := next.Rules(RuleListHeader); len(got) != len(tt.rules) {
+				t.Errorf("Rules() = %+v, want %+v", got, tt.rules)
+			}
+		})
+	}
+
+	if _, err := cfg.WithRules("bogus", nil); err == nil {
+		t.Error("expected error for unknown list")
+	}
+}
+
+func TestWriteRules(t *testing.T) {
+	resetViper(t)
+
+	yaml := `# UA3F config
+server-mode: SOCKS5
+port: 1080 # listen port
+header-rewrite:
+  - type: FINAL
+    action: DIRECT
+body-rewrite: []
+url-redirect-json: '[{"type":"FINAL","action":"REDIRECT-302","rewrite_regex":"x","rewrite_value":"y"}]'
+`
+	path := writeConfigFile(t, yaml)
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []Rule{
+		{Enabled: false, Type: "DEST-PORT", MatchValue: "22", Action: "DIRECT"},
+		{Enabled: true, Type: "FINAL", Action: "REPLACE", RewriteHeader: "User-Agent", RewriteValue: "FFF"},
+	}
+	if err := WriteRules(path, RuleListHeader, rules); err != nil {
+		t.Fatalf("WriteRules: %v", err)
+	}
+	redirect := []Rule{{Enabled: true, Type: "URL-REGEX", MatchValue: "^http://a/", Action: "REDIRECT-302", RewriteRegex: "a", RewriteValue: "b"}}
+	if err := WriteRules(path, RuleListRedirect, redirect); err != nil {
+		t.Fatalf("WriteRules: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# UA3F config", "# listen port", "enabled: false"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("written config lacks %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "url-redirect-json") {
+		t.Errorf("written config keeps the JSON form of a written list:\n%s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want 0600", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	loadConfigFile(t, path)
+	cfg, err := BuildConfigFromViper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Port != 1080 || cfg.ServerMode != ServerModeSocks5 {
+		t.Errorf("other settings changed: port %d, mode %s", cfg.Port, cfg.ServerMode)
+	}
+	want, _ := (&Config{}).WithRules(RuleListHeader, rules)
+	want, _ = want.WithRules(RuleListRedirect, redirect)
+	if !cfg.SameRules(want) {
+		t.Errorf("rules = %+v %+v, want %+v %+v", cfg.HeaderRules, cfg.URLRedirectRules, rules, redirect)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	data, err := GenerateSchema(false)
+	if err != nil {
+		t.Fatalf("GenerateSchema: %v", err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("schema is not JSON: %v", err)
+	}
+	defs := schema["$defs"].(map[string]any)
+
+	properties := schema["properties"].(map[string]any)
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+		if _, ok := properties[name]; !ok && name != "" && name != "-" {
+			t.Errorf("schema lacks %q", name)
+		}
+	}
+	if _, ok := schema["required"]; ok {
+		t.Errorf("top level settings have defaults, none is required: %v", schema["required"])
+	}
+	if got := properties["port"].(map[string]any)["default"]; got != float64(1080) {
+		t.Errorf("port default = %v, want 1080", got)
+	}
+
+	rule := defs["Rule"].(map[string]any)
+	ruleType := rule["properties"].(map[string]any)["type"].(map[string]any)
+	if !strings.Contains(fmt.Sprint(ruleType["enum"]), "FINAL") {
+		t.Errorf("rule type enum = %v, want FINAL among them", ruleType["enum"])
+	}
+	conditions, _ := json.Marshal(rule["allOf"])
+	want := `{"if":{"properties":{"type":{"const":"HEADER-KEYWORD"}},"required":["type"]},"then":{"required":["match-header","match-value"]}}`
+	if !strings.Contains(string(conditions), want) {
+		t.Errorf("rule conditions = %s, want %s among them", conditions, want)
+	}
+
+	ruleJSON := defs["RuleJSON"].(map[string]any)["properties"].(map[string]any)
+	if _, ok := ruleJSON["match_value"]; !ok {
+		t.Errorf("RuleJSON lacks match_value: %v", ruleJSON)
+	}
+	headerJSON := properties["header-rewrite-json"].(map[string]any)
+	items := headerJSON["contentSchema"].(map[string]any)["items"].(map[string]any)
+	if items["$ref"] != "#/$defs/RuleJSON" {
+		t.Errorf("header-rewrite-json content schema = %v, want RuleJSON items", headerJSON["contentSchema"])
+	}
+}
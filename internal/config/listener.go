@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// Listener runs an additional server alongside the main server-mode.
+// An empty BindAddress inherits the main bind-address.
+type Listener struct {
+	ServerMode  ServerMode `json:"server_mode" yaml:"server-mode" validate:"required,oneof=HTTP SOCKS5 TPROXY REDIRECT NFQUEUE"`
+	BindAddress string     `json:"bind_address,omitempty" yaml:"bind-address,omitempty" validate:"omitempty,ip"`
+	Port        int        `json:"port,omitempty" yaml:"port,omitempty" validate:"required_unless=ServerMode NFQUEUE,min=0,max=65535"`
+}
+
+// transparent reports whether the mode intercepts traffic through the firewall.
+// These modes share the UA3F firewall table, so only one of them can run at a time.
+func (m ServerMode) transparent() bool {
+	return m == ServerModeTProxy || m == ServerModeRedirect || m == ServerModeNFQueue
+}
+
+// ServerListeners returns the main listener followed by the additional ones.
+func (c *Config) ServerListeners() []Listener {
+	listeners := make([]Listener, 0, len(c.Listeners)+1)
+	listeners = append(listeners, Listener{
+		ServerMode:  c.ServerMode,
+		BindAddress: c.BindAddress,
+		Port:        c.Port,
+	})
+	for _, l := range c.Listeners {
+		if l.BindAddress == "" {
+			l.BindAddress = c.BindAddress
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// HasServerMode reports whether any listener runs the given mode.
+func (c *Config) HasServerMode(mode ServerMode) bool {
+	for _, l := range c.ServerListeners() {
+		if l.ServerMode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// ForListener returns a copy of c running l as its only server.
+func (c *Config) ForListener(l Listener) *Config {
+	lc := *c
+	lc.ServerMode = l.ServerMode
+	lc.BindAddress = l.BindAddress
+	lc.Port = l.Port
+	lc.Listeners = nil
+	return &lc
+}
+
+func (c *Config) validateListeners() error {
+	listeners := c.ServerListeners()
+	var transparent ServerMode
+	for i, l := range listeners {
+		if l.ServerMode.transparent() {
+			if transparent != "" {
+				return fmt.Errorf("listeners: %s and %s cannot run together", transparent, l.ServerMode)
+			}
+			transparent = l.ServerMode
+		}
+		for _, prev := range listeners[:i] {
+			if listenersConflict(prev, l) {
+				return fmt.Errorf("listeners: %s and %s both listen on port %d", prev.ServerMode, l.ServerMode, l.Port)
+			}
+		}
+	}
+	return nil
+}
+
+// listenersConflict reports whether a and b would bind the same TCP port.
+// TPROXY and REDIRECT listen on every address regardless of bind-address.
+func listenersConflict(a, b Listener) bool {
+	if a.ServerMode == ServerModeNFQueue || b.ServerMode == ServerModeNFQueue || a.Port != b.Port {
+		return false
+	}
+	wildcard := func(l Listener) bool {
+		if l.ServerMode == ServerModeTProxy || l.ServerMode == ServerModeRedirect {
+			return true
+		}
+		ip := net.ParseIP(l.BindAddress)
+		return ip == nil || ip.IsUnspecified()
+	}
+	return wildcard(a) || wildcard(b) || net.ParseIP(a.BindAddress).Equal(net.ParseIP(b.BindAddress))
+}
@@ -0,0 +1,45 @@
+package config
+
+import "fmt"
+
+type OutboundType string
+
+const (
+	OutboundTypeDirect OutboundType = "DIRECT"
+	OutboundTypeHTTP   OutboundType = "HTTP"
+	OutboundTypeSocks5 OutboundType = "SOCKS5"
+
+	// OutboundDirect is the built-in outbound that dials origins directly.
+	OutboundDirect = "DIRECT"
+)
+
+// Outbound is a named way of reaching origin servers, selected by PROXY rules
+// or default-outbound.
+type Outbound struct {
+	Name     string       `json:"name" yaml:"name" validate:"required,excludesall= /"`
+	Type     OutboundType `json:"type" yaml:"type" validate:"required,oneof=DIRECT HTTP SOCKS5"`
+	Address  string       `json:"address,omitempty" yaml:"address,omitempty" validate:"required_unless=Type DIRECT,omitempty,hostname_port"`
+	Username string       `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string       `json:"password,omitempty" yaml:"password,omitempty"`
+}
+
+// validateOutbounds checks that outbound names are unique and that
+// default-outbound and PROXY rules refer to a defined outbound.
+func (c *Config) validateOutbounds() error {
+	names := map[string]bool{OutboundDirect: true}
+	for _, o := range c.Outbounds {
+		if names[o.Name] {
+			return fmt.Errorf("outbounds: duplicate name %q", o.Name)
+		}
+		names[o.Name] = true
+	}
+	if c.DefaultOutbound != "" && !names[c.DefaultOutbound] {
+		return fmt.Errorf("default-outbound: unknown outbound %q", c.DefaultOutbound)
+	}
+	for _, r := range c.HeaderRules {
+		if r.Action == "PROXY" && !names[r.Outbound] {
+			return fmt.Errorf("header-rewrite: unknown outbound %q", r.Outbound)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce coalesces the burst of events editors produce for one save.
+const watchDebounce = 500 * time.Millisecond
+
+// HotReloadable reports whether next differs from c only in settings that
+// running servers can swap in place: rewrite rules, User-Agent settings,
+// MitM hostnames, log levels and the audit log. Any other change needs the
+// servers to be restarted.
+func (c *Config) HotReloadable(next *Config) bool {
+	return reflect.DeepEqual(c.restartSettings(), next.restartSettings())
+}
+
+// restartSettings returns a shallow copy of c with the hot-reloadable settings cleared.
+func (c *Config) restartSettings() Config {
+	r := *c
+	r.UserAgent, r.UserAgentRegex, r.UserAgentPartialReplace = "", "", false
+	r.HeaderRules, r.HeaderRulesJson = nil, ""
+	r.BodyRules, r.BodyRulesJson = nil, ""
+	r.URLRedirectRules, r.URLRedirectJson = nil, ""
+	r.MitM.Hostname = ""
+	r.AuditLog = AuditLogConfig{}
+	r.LogLevel, r.LogLevels = "", nil
+	return r
+}
+
+// written holds the hash of the content UA3F last wrote to each config file,
+// by resolved path, so that the watcher does not reload the changes made
+// through the API, which are already applied.
+var written = struct {
+	sync.Mutex
+	hashes map[string][sha256.Size]byte
+}{hashes: make(map[string][sha256.Size]byte)}
+
+// recordWrite records that UA3F wrote data to the file at path.
+func recordWrite(path string, data []byte) {
+	written.Lock()
+	defer written.Unlock()
+	written.hashes[path] = sha256.Sum256(data)
+}
+
+// selfWritten reports whether the file at path holds the content UA3F last
+// wrote to it. The record is dropped otherwise, as the file was changed by
+// someone else and is reloaded.
+func selfWritten(path string) bool {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	written.Lock()
+	defer written.Unlock()
+	hash, ok := written.hashes[path]
+	if !ok {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err == nil && sha256.Sum256(data) == hash {
+		return true
+	}
+	delete(written.hashes, path)
+	return false
+}
+
+// Watcher calls a function when a config file changes.
+type Watcher struct {
+	fw   *fsnotify.Watcher
+	done chan struct{}
+}
+
+// Watch starts watching path. The parent directory is watched so that files
+// replaced by rename, as editors and atomic writers do, are still followed.
+// Changes written by WriteRules are not reported.
+func Watch(path string, onChange func()) (*Watcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify.NewWatcher: %w", err)
+	}
+	if err := fw.Add(filepath.Dir(path)); err != nil {
+		_ = fw.Close()
+		return nil, fmt.Errorf("fsnotify.Add: %w", err)
+	}
+
+	w := &Watcher{fw: fw, done: make(chan struct{})}
+	go w.run(path, onChange)
+	return w, nil
+}
+
+func (w *Watcher) run(path string, onChange func()) {
+	defer close(w.done)
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.fw.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+			pending = time.After(watchDebounce)
+		case <-pending:
+			pending = nil
+			if selfWritten(path) {
+				slog.Debug("Config file written by UA3F, not reloading", slog.String("path", path))
+				continue
+			}
+			slog.Info("Config file changed", slog.String("path", path))
+			onChange()
+		case err, ok := <-w.fw.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Config watcher error", slog.Any("error", err))
+		}
+	}
+}
+
+// Close stops the watcher and waits for a running onChange to return.
+func (w *Watcher) Close() error {
+	err := w.fw.Close()
+	<-w.done
+	return err
+}
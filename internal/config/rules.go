@@ -0,0 +1,217 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+)
+
+// RuleList names one of the rewrite rule lists.
+type RuleList string
+
+const (
+	RuleListHeader   RuleList = "header"
+	RuleListBody     RuleList = "body"
+	RuleListRedirect RuleList = "redirect"
+)
+
+// Key returns the YAML key holding the list, or "" for an unknown list.
+func (l RuleList) Key() string {
+	switch l {
+	case RuleListHeader:
+		return "header-rewrite"
+	case RuleListBody:
+		return "body-rewrite"
+	case RuleListRedirect:
+		return "url-redirect"
+	}
+	return ""
+}
+
+// Rules returns a copy of the rules in list. Like the rule engine, it falls
+// back to the JSON form of the list when the YAML list is empty.
+func (c *Config) Rules(list RuleList) ([]Rule, error) {
+	var (
+		rules []Rule
+		js    string
+	)
+	switch list {
+	case RuleListHeader:
+		rules, js = c.HeaderRules, c.HeaderRulesJson
+	case RuleListBody:
+		rules, js = c.BodyRules, c.BodyRulesJson
+	case RuleListRedirect:
+		rules, js = c.URLRedirectRules, c.URLRedirectJson
+	default:
+		return nil, fmt.Errorf("unknown rule list %q", list)
+	}
+	if len(rules) == 0 && js != "" {
+		if err := json.Unmarshal([]byte(js), &rules); err != nil {
+			return nil, fmt.Errorf("failed to parse %s JSON: %w", list.Key(), err)
+		}
+		return rules, nil
+	}
+	return append([]Rule{}, rules...), nil
+}
+
+// WithRules returns a copy of c with list replaced by rules. The rules are
+// validated as they would be when loading a config file. The JSON form of the
+// list is cleared so an emptied list does not fall back to it.
+func (c *Config) WithRules(list RuleList, rules []Rule) (*Config, error) {
+	validate := validator.New()
+	for i := range rules {
+		if err := validate.Struct(&rules[i]); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	next := *c
+	switch list {
+	case RuleListHeader:
+		next.HeaderRules, next.HeaderRulesJson = rules, ""
+	case RuleListBody:
+		next.BodyRules, next.BodyRulesJson = rules, ""
+	case RuleListRedirect:
+		next.URLRedirectRules, next.URLRedirectJson = rules, ""
+	default:
+		return nil, fmt.Errorf("unknown rule list %q", list)
+	}
+	if err := next.validateOutbounds(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// SameRules reports whether c and o have the same rewrite rules.
+func (c *Config) SameRules(o *Config) bool {
+	return sameRules(c.HeaderRules, o.HeaderRules) && c.HeaderRulesJson == o.HeaderRulesJson &&
+		sameRules(c.BodyRules, o.BodyRules) && c.BodyRulesJson == o.BodyRulesJson &&
+		sameRules(c.URLRedirectRules, o.URLRedirectRules) && c.URLRedirectJson == o.URLRedirectJson
+}
+
+// sameRules treats nil and empty lists as equal.
+func sameRules(a, b []Rule) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+// SaveRules writes list to the config file in use. It reports false without
+// error when UA3F was started without a config file.
+func SaveRules(list RuleList, rules []Rule) (bool, error) {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return false, nil
+	}
+	if err := WriteRules(path, list, rules); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WriteRules replaces list in the YAML file at path and keeps the rest of the
+// file, including comments, as it is. The JSON form of the list is removed, as
+// it would otherwise be read back on the next reload. The file is replaced
+// atomically.
+func WriteRules(path string, list RuleList, rules []Rule) error {
+	key := list.Key()
+	if key == "" {
+		return fmt.Errorf("unknown rule list %q", list)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: top level is not a mapping", path)
+	}
+
+	value := &yaml.Node{}
+	if err := value.Encode(rules); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		value.Style = yaml.FlowStyle
+	}
+	replaced := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			// Keep a comment trailing the list on its last line.
+			value.FootComment = root.Content[i+1].FootComment
+			root.Content[i+1] = value
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key+"-json" {
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return err
+	}
+	recordWrite(path, buf.Bytes())
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the same
+// directory, so readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
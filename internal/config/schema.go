@@ -0,0 +1,317 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SchemaFile is the file ua3f --generate-schema writes.
+const SchemaFile = "config.schema.json"
+
+// Schema returns the JSON Schema of the config file, generated from the yaml,
+// default and validate tags of Config. Settings with a default are never
+// required. Rules as written in header-rewrite-json and the rules API are
+// described by $defs/RuleJSON.
+func Schema() map[string]any {
+	g := &schemaGen{tag: "yaml", defs: make(map[string]any)}
+	schema := g.object(reflect.TypeOf(Config{}))
+
+	rules := &schemaGen{tag: "json", defs: g.defs, suffix: "JSON"}
+	rulesJSON := map[string]any{
+		"type":  "array",
+		"items": rules.ref(reflect.TypeOf(Rule{})),
+	}
+	properties := schema["properties"].(map[string]any)
+	for _, key := range []string{"header-rewrite-json", "body-rewrite-json", "url-redirect-json"} {
+		p := properties[key].(map[string]any)
+		p["contentMediaType"] = "application/json"
+		p["contentSchema"] = rulesJSON
+	}
+
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "UA3F configuration"
+	schema["$defs"] = g.defs
+	return schema
+}
+
+// GenerateSchema returns Schema as indented JSON, and writes it to
+// SchemaFile when writeToFile is set.
+func GenerateSchema(writeToFile bool) ([]byte, error) {
+	data, err := json.MarshalIndent(Schema(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config schema: %w", err)
+	}
+	data = append(data, '\n')
+	if writeToFile {
+		if err := os.WriteFile(SchemaFile, data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write config schema to file: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// schemaGen builds the schemas of Go types, naming fields after tag.
+// Structs are defined once in defs, under their type name and suffix.
+type schemaGen struct {
+	tag    string
+	defs   map[string]any
+	suffix string
+}
+
+func (g *schemaGen) ref(t reflect.Type) map[string]any {
+	name := t.Name() + g.suffix
+	if _, ok := g.defs[name]; !ok {
+		g.defs[name] = nil // breaks cycles
+		g.defs[name] = g.object(t)
+	}
+	return map[string]any{"$ref": "#/$defs/" + name}
+}
+
+// object returns the schema of struct t.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	conditions := newSchemaConditions()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get(g.tag), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		validate := f.Tag.Get("validate")
+		def, hasDefault := f.Tag.Lookup("default")
+		if hasDefault {
+			validate = withoutRequired(validate)
+		}
+		p := g.field(f.Type, validate, name, &required, conditions)
+		if hasDefault {
+			p["default"] = tagValue(f.Type, def)
+		}
+		properties[name] = p
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if all := conditions.schemas(g, t); len(all) > 0 {
+		schema["allOf"] = all
+	}
+	return schema
+}
+
+// field returns the schema of a field of type t named name, applying its
+// validate tags. Required fields are added to required, and conditionally
+// required ones to conditions.
+func (g *schemaGen) field(t reflect.Type, validate, name string, required *[]string, conditions *schemaConditions) map[string]any {
+	schema := g.typ(t)
+	target := schema // where the next tags apply, moved by dive
+	elem := t
+	dived, omitempty := false, false
+	for _, tag := range strings.Split(validate, ",") {
+		key, param, _ := strings.Cut(tag, "=")
+		switch key {
+		case "required":
+			if !dived {
+				*required = append(*required, name)
+			}
+		case "required_if":
+			field, value, _ := strings.Cut(param, " ")
+			conditions.add(field, value, true, name)
+		case "required_unless":
+			field, value, _ := strings.Cut(param, " ")
+			conditions.add(field, value, false, name)
+		case "omitempty":
+			omitempty = true
+		case "dive":
+			for elem.Kind() == reflect.Pointer {
+				elem = elem.Elem()
+			}
+			if elem.Kind() == reflect.Map {
+				target = schema["additionalProperties"].(map[string]any)
+			} else {
+				target = schema["items"].(map[string]any)
+			}
+			elem = elem.Elem()
+			dived, omitempty = true, false
+		case "keys":
+			keys := map[string]any{}
+			schema["propertyNames"] = keys
+			target = keys
+		case "endkeys":
+			target = schema["additionalProperties"].(map[string]any)
+		case "oneof":
+			var enum []any
+			if omitempty {
+				enum = append(enum, tagValue(elem, ""))
+			}
+			for _, v := range strings.Fields(param) {
+				enum = append(enum, tagValue(elem, v))
+			}
+			target["enum"] = enum
+		case "min", "max":
+			limit(target, elem, key, param)
+		case "ip":
+			target["anyOf"] = []any{
+				map[string]any{"format": "ipv4"},
+				map[string]any{"format": "ipv6"},
+			}
+			if omitempty {
+				target["anyOf"] = append(target["anyOf"].([]any), map[string]any{"const": ""})
+			}
+		case "hostname":
+			if omitempty {
+				target["anyOf"] = []any{
+					map[string]any{"format": "hostname"},
+					map[string]any{"const": ""},
+				}
+			} else {
+				target["format"] = "hostname"
+			}
+		case "excludesall":
+			target["pattern"] = "^[^" + regexp.QuoteMeta(param) + "]*$"
+		}
+	}
+	return schema
+}
+
+// withoutRequired drops the required tags of a field viper fills in.
+func withoutRequired(validate string) string {
+	var tags []string
+	for _, tag := range strings.Split(validate, ",") {
+		if key, _, _ := strings.Cut(tag, "="); !strings.HasPrefix(key, "required") {
+			tags = append(tags, tag)
+		}
+	}
+	return strings.Join(tags, ",")
+}
+
+// typ returns the schema of t, without validation.
+func (g *schemaGen) typ(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.typ(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema := map[string]any{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			schema["maximum"] = uint64(1)<<t.Bits() - 1
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.typ(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.typ(t.Elem())}
+	case reflect.Struct:
+		return g.ref(t)
+	}
+	return map[string]any{}
+}
+
+// limit applies a min or max tag: the bound of a number, or the length of a
+// string, array or object.
+func limit(schema map[string]any, t reflect.Type, key, param string) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		schema[key+"Length"] = n
+	case reflect.Slice:
+		schema[key+"Items"] = n
+	case reflect.Map:
+		schema[key+"Properties"] = n
+	default:
+		schema[key+"imum"] = n
+	}
+}
+
+// tagValue converts the value of a tag to the JSON type of t.
+func tagValue(t reflect.Type, v string) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		b, _ := strconv.ParseBool(v)
+		return b
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	}
+	return v
+}
+
+// schemaConditions collects the required_if and required_unless tags of a
+// struct, grouped by the field and value they depend on.
+type schemaConditions struct {
+	keys   []schemaCondition
+	fields map[schemaCondition][]string
+}
+
+type schemaCondition struct {
+	field string
+	value string
+	is    bool // required_if when set, required_unless otherwise
+}
+
+func newSchemaConditions() *schemaConditions {
+	return &schemaConditions{fields: make(map[schemaCondition][]string)}
+}
+
+func (c *schemaConditions) add(field, value string, is bool, name string) {
+	k := schemaCondition{field, value, is}
+	if _, ok := c.fields[k]; !ok {
+		c.keys = append(c.keys, k)
+	}
+	c.fields[k] = append(c.fields[k], name)
+}
+
+// schemas returns an if/then schema per condition of struct t.
+func (c *schemaConditions) schemas(g *schemaGen, t reflect.Type) []any {
+	var all []any
+	for _, k := range c.keys {
+		f, ok := t.FieldByName(k.field)
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get(g.tag), ",")
+		cond := map[string]any{
+			"if": map[string]any{
+				"properties": map[string]any{name: map[string]any{"const": tagValue(f.Type, k.value)}},
+				"required":   []string{name},
+			},
+		}
+		if k.is {
+			cond["then"] = map[string]any{"required": c.fields[k]}
+		} else {
+			cond["else"] = map[string]any{"required": c.fields[k]}
+		}
+		all = append(all, cond)
+	}
+	return all
+}
@@ -13,7 +13,10 @@ func GenerateTemplateConfig(writeToFile bool) (Config, error) {
 		BindAddress: "127.0.0.1",
 		Port:        1080,
 
-		LogLevel: "info",
+		WatchConfig: true,
+
+		LogLevel:  "info",
+		LogFormat: "text",
 
 		RewriteMode: "GLOBAL",
 
@@ -39,6 +42,55 @@ func GenerateTemplateConfig(writeToFile bool) (Config, error) {
 			ReorderPackets: 8,
 			Inject:         false,
 			InjectTTL:      3,
+			TLS:            false,
+			TLSStrategies: []DesyncTLSStrategy{
+				{Ports: "443", Methods: []string{"SNI-SPLIT"}},
+			},
+			AutoProbe:  false,
+			ProbePorts: "443",
+		},
+
+		DNSSniff: DNSSniffConfig{
+			Enabled: false,
+		},
+
+		DNS: DNSConfig{
+			Enabled:     false,
+			Listen:      DefaultDNSListen,
+			Upstreams:   []string{"udp://223.5.5.5:53", "https://1.1.1.1/dns-query"},
+			CacheSize:   DefaultDNSCacheSize,
+			FakeIP:      false,
+			FakeIPRange: DefaultFakeIPRange,
+		},
+
+		Socks5: Socks5Config{
+			UDPIdleTimeout: DefaultUDPIdleTimeout,
+		},
+
+		HTTPProxy: HTTPProxyConfig{
+			Upstream: UpstreamConfig{
+				MaxIdleConns:          DefaultUpstreamMaxIdleConns,
+				MaxIdleConnsPerHost:   DefaultUpstreamMaxIdleConnsPerHost,
+				IdleConnTimeout:       DefaultUpstreamIdleConnTimeout,
+				DialTimeout:           DefaultUpstreamDialTimeout,
+				ResponseHeaderTimeout: DefaultUpstreamResponseHeaderTimeout,
+				HTTP2:                 false,
+			},
+		},
+
+		StatsStore: StatsStoreConfig{
+			Enabled:         false,
+			HourlyRetention: DefaultStatsHourlyRetention,
+			DailyRetention:  DefaultStatsDailyRetention,
+			MaxSize:         DefaultStatsMaxSize,
+		},
+
+		AuditLog: AuditLogConfig{
+			Enabled:    false,
+			SampleRate: 1,
+			MaxSize:    DefaultAuditMaxSize,
+			MaxBackups: DefaultAuditMaxBackups,
+			MaxAge:     DefaultAuditMaxAge,
 		},
 
 		MitM: MitMConfig{
@@ -51,6 +103,7 @@ func GenerateTemplateConfig(writeToFile bool) (Config, error) {
 
 		HeaderRules: []Rule{
 			{
+				Enabled:       true,
 				Type:          "FINAL",
 				Action:        "REPLACE",
 				RewriteHeader: "User-Agent",
@@ -60,6 +113,7 @@ func GenerateTemplateConfig(writeToFile bool) (Config, error) {
 
 		BodyRules: []Rule{
 			{
+				Enabled:          true,
 				Type:             "URL-REGEX",
 				MatchValue:       "^http://ua-check.stagoh.com",
 				Action:           "REPLACE-REGEX",
@@ -71,6 +125,7 @@ func GenerateTemplateConfig(writeToFile bool) (Config, error) {
 
 		URLRedirectRules: []Rule{
 			{
+				Enabled:      true,
 				Type:         "URL-REGEX",
 				MatchValue:   "^http://example.com/old-path",
 				Action:       "REDIRECT-302",
@@ -31,7 +31,7 @@ func SetOOMScoreAdj(value int) error {
 }
 
 func SetUserGroup(cfg *config.Config) error {
-	groupName := determineGroup(cfg.ServerMode)
+	groupName := determineGroup(cfg)
 	if groupName == "" {
 		return nil
 	}
@@ -54,8 +54,8 @@ func SetUserGroup(cfg *config.Config) error {
 	return nil
 }
 
-func determineGroup(serverMode config.ServerMode) string {
-	if serverMode == config.ServerModeRedirect || serverMode == config.ServerModeNFQueue {
+func determineGroup(cfg *config.Config) string {
+	if cfg.HasServerMode(config.ServerModeRedirect) || cfg.HasServerMode(config.ServerModeNFQueue) {
 		return "root"
 	}
 
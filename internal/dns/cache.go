@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxEntries bounds the number of IP addresses kept in the cache.
+	DefaultMaxEntries = 65536
+	// MinTTL keeps short-lived answers around long enough for the client
+	// to actually open a connection to the resolved address.
+	MinTTL = 60 * time.Second
+	// MaxTTL caps answers with very large TTLs.
+	MaxTTL = 24 * time.Hour
+)
+
+// Default is the process-wide IP to domain cache filled by the DNS observers.
+var Default = NewCache(DefaultMaxEntries)
+
+// Record is a single IP to domain mapping observed from a DNS answer.
+type Record struct {
+	Domain string    `json:"domain"`
+	IP     net.IP    `json:"ip"`
+	Expire time.Time `json:"expire"`
+}
+
+type entry struct {
+	domain string
+	expire time.Time
+	elem   *list.Element // in Cache.order
+}
+
+// Cache maps IP addresses back to the domain name they were resolved from.
+// Every entry carries its own expiry derived from the DNS answer TTL. When
+// full, expired entries are purged first, then the least recently added.
+type Cache struct {
+	mu          sync.RWMutex
+	entries     map[netip.Addr]entry
+	order       *list.List // of netip.Addr, least recently added first
+	domains     map[string]map[netip.Addr]struct{}
+	maxEntries  int
+	subscribers map[chan Record]struct{}
+	now         func() time.Time
+}
+
+func NewCache(maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Cache{
+		entries:     make(map[netip.Addr]entry),
+		order:       list.New(),
+		domains:     make(map[string]map[netip.Addr]struct{}),
+		maxEntries:  maxEntries,
+		subscribers: make(map[chan Record]struct{}),
+		now:         time.Now,
+	}
+}
+
+// Add stores the mapping ip -> domain with the given TTL.
+// The TTL is clamped to [MinTTL, MaxTTL].
+func (c *Cache) Add(domain string, ip net.IP, ttl time.Duration) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return
+	}
+	addr = addr.Unmap()
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return
+	}
+	if ttl < MinTTL {
+		ttl = MinTTL
+	}
+	if ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+
+	c.mu.Lock()
+	now := c.now()
+	if _, exists := c.entries[addr]; !exists && len(c.entries) >= c.maxEntries {
+		c.purgeLocked(now)
+		if len(c.entries) >= c.maxEntries {
+			c.removeLocked(c.order.Front().Value.(netip.Addr))
+		}
+	}
+	if _, exists := c.entries[addr]; exists {
+		c.removeLocked(addr)
+	}
+	record := Record{
+		Domain: domain,
+		IP:     net.IP(addr.AsSlice()),
+		Expire: now.Add(ttl),
+	}
+	c.entries[addr] = entry{domain: domain, expire: record.Expire, elem: c.order.PushBack(addr)}
+	if c.domains[domain] == nil {
+		c.domains[domain] = make(map[netip.Addr]struct{})
+	}
+	c.domains[domain][addr] = struct{}{}
+	for ch := range c.subscribers {
+		select {
+		case ch <- record:
+		default:
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Lookup returns the domain an IP address was last resolved from.
+func (c *Cache) Lookup(ip net.IP) (string, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	c.mu.RLock()
+	e, ok := c.entries[addr.Unmap()]
+	c.mu.RUnlock()
+	if !ok || c.now().After(e.expire) {
+		return "", false
+	}
+	return e.domain, true
+}
+
+// LookupString is like Lookup but accepts an IP or an "ip:port" address.
+func (c *Cache) LookupString(addr string) (string, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", false
+	}
+	return c.Lookup(ip)
+}
+
+// LookupDomain returns all unexpired addresses observed for domain.
+func (c *Cache) LookupDomain(domain string) []net.IP {
+	domain = normalizeDomain(domain)
+	now := c.now()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ips []net.IP
+	for addr := range c.domains[domain] {
+		if e, ok := c.entries[addr]; ok && now.Before(e.expire) {
+			ips = append(ips, net.IP(addr.AsSlice()))
+		}
+	}
+	return ips
+}
+
+// Records returns a snapshot of all unexpired records.
+func (c *Cache) Records() []Record {
+	now := c.now()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	records := make([]Record, 0, len(c.entries))
+	for addr, e := range c.entries {
+		if now.After(e.expire) {
+			continue
+		}
+		records = append(records, Record{
+			Domain: e.domain,
+			IP:     net.IP(addr.AsSlice()),
+			Expire: e.expire,
+		})
+	}
+	return records
+}
+
+// Len returns the number of entries, including expired ones not yet purged.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// Purge removes all expired entries.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	c.purgeLocked(c.now())
+	c.mu.Unlock()
+}
+
+// Subscribe returns a channel receiving every newly added record.
+// Slow subscribers miss records instead of blocking the cache.
+// The returned cancel function closes the channel.
+func (c *Cache) Subscribe() (<-chan Record, func()) {
+	ch := make(chan Record, 256)
+	c.mu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.subscribers, ch)
+			close(ch)
+			c.mu.Unlock()
+		})
+	}
+}
+
+func (c *Cache) purgeLocked(now time.Time) {
+	for addr, e := range c.entries {
+		if now.After(e.expire) {
+			c.removeLocked(addr)
+		}
+	}
+}
+
+func (c *Cache) removeLocked(addr netip.Addr) {
+	e := c.entries[addr]
+	delete(c.entries, addr)
+	c.order.Remove(e.elem)
+	c.unlinkLocked(e.domain, addr)
+}
+
+func (c *Cache) unlinkLocked(domain string, addr netip.Addr) {
+	addrs := c.domains[domain]
+	delete(addrs, addr)
+	if len(addrs) == 0 {
+		delete(c.domains, domain)
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// MatchDomain reports whether domain equals one of the given domains
+// or is a subdomain of it.
+func MatchDomain(domain string, domains []string) bool {
+	domain = normalizeDomain(domain)
+	for _, d := range domains {
+		d = normalizeDomain(d)
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
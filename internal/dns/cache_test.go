@@ -0,0 +1,187 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildResponse(t *testing.T, name string, ttl uint32, ips ...net.IP) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeSuccess})
+	b.EnableCompression()
+	qname := dnsmessage.MustNewName(name)
+	if err := b.StartQuestions(); err != nil {
+		t.Fatalf("StartQuestions: %v", err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatalf("Question: %v", err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatalf("StartAnswers: %v", err)
+	}
+	cname := dnsmessage.MustNewName("cdn.example.net.")
+	if err := b.CNAMEResource(dnsmessage.ResourceHeader{Name: qname, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.CNAMEResource{CNAME: cname}); err != nil {
+		t.Fatalf("CNAMEResource: %v", err)
+	}
+	for _, ip := range ips {
+		h := dnsmessage.ResourceHeader{Name: cname, Class: dnsmessage.ClassINET, TTL: ttl}
+		if v4 := ip.To4(); v4 != nil {
+			var a [4]byte
+			copy(a[:], v4)
+			if err := b.AResource(h, dnsmessage.AResource{A: a}); err != nil {
+				t.Fatalf("AResource: %v", err)
+			}
+		} else {
+			var a [16]byte
+			copy(a[:], ip.To16())
+			if err := b.AAAAResource(h, dnsmessage.AAAAResource{AAAA: a}); err != nil {
+				t.Fatalf("AAAAResource: %v", err)
+			}
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	return msg
+}
+
+func TestCacheObserve(t *testing.T) {
+	c := NewCache(16)
+	msg := buildResponse(t, "www.Example.com.", 300, net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1"))
+
+	n, err := c.Observe(msg)
+	if err != nil {
+		t.Fatalf("Observe() error = %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("Observe() = %d records, want 2", n)
+	}
+
+	tests := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{"93.184.216.34", "www.example.com", true},
+		{"93.184.216.34:443", "www.example.com", true},
+		{"[2606:2800:220:1::1]:443", "www.example.com", true},
+		{"::ffff:93.184.216.34", "www.example.com", true},
+		{"1.1.1.1", "", false},
+		{"not-an-ip", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := c.LookupString(tt.addr)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("LookupString(%q) = (%q, %v), want (%q, %v)", tt.addr, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if ips := c.LookupDomain("www.example.com."); len(ips) != 2 {
+		t.Errorf("LookupDomain() = %v, want 2 addresses", ips)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(2)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Add("a.example.com", net.ParseIP("10.0.0.1"), time.Second)
+	if _, ok := c.Lookup(net.ParseIP("10.0.0.1")); !ok {
+		t.Fatal("Lookup() miss right after Add")
+	}
+
+	// TTL is clamped to MinTTL
+	now = now.Add(MinTTL - time.Second)
+	if _, ok := c.Lookup(net.ParseIP("10.0.0.1")); !ok {
+		t.Fatal("Lookup() miss before MinTTL elapsed")
+	}
+	now = now.Add(2 * time.Second)
+	if _, ok := c.Lookup(net.ParseIP("10.0.0.1")); ok {
+		t.Fatal("Lookup() hit after expiry")
+	}
+
+	// A full cache evicts expired entries to make room
+	c.Add("b.example.com", net.ParseIP("10.0.0.2"), time.Hour)
+	c.Add("c.example.com", net.ParseIP("10.0.0.3"), time.Hour)
+	if got := c.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+	// A cache full of live entries evicts the least recently added
+	c.Add("b.example.com", net.ParseIP("10.0.0.2"), time.Hour)
+	c.Add("d.example.com", net.ParseIP("10.0.0.4"), time.Hour)
+	if _, ok := c.Lookup(net.ParseIP("10.0.0.4")); !ok {
+		t.Fatal("Lookup() miss for an entry added to a full cache")
+	}
+	if _, ok := c.Lookup(net.ParseIP("10.0.0.3")); ok {
+		t.Fatal("Lookup() hit for the least recently added entry of a full cache")
+	}
+	if domain, ok := c.Lookup(net.ParseIP("10.0.0.2")); !ok || domain != "b.example.com" {
+		t.Fatalf("Lookup() = %q, %v for a refreshed entry", domain, ok)
+	}
+	if got := c.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+	if ips := c.LookupDomain("c.example.com"); len(ips) != 0 {
+		t.Fatalf("LookupDomain() = %v for an evicted entry", ips)
+	}
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	c := NewCache(16)
+	records, cancel := c.Subscribe()
+
+	c.Add("steam.example.com", net.ParseIP("10.0.0.1"), time.Minute)
+	select {
+	case r := <-records:
+		if r.Domain != "steam.example.com" || !r.IP.Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("unexpected record %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no record received")
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-records; ok {
+		t.Fatal("channel not closed after cancel")
+	}
+	c.Add("steam.example.com", net.ParseIP("10.0.0.2"), time.Minute)
+}
+
+func TestParseResponseRejectsQuery(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if _, err := ParseResponse(msg); err != ErrNotResponse {
+		t.Fatalf("ParseResponse() error = %v, want ErrNotResponse", err)
+	}
+	if _, err := ParseResponse([]byte{0x01}); err == nil {
+		t.Fatal("ParseResponse() accepted a truncated message")
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	domains := []string{"steamcontent.com", "dl.steam.clngaa.com"}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"steamcontent.com", true},
+		{"alibaba.cdn.steampipe.steamcontent.com.", true},
+		{"DL.STEAM.CLNGAA.COM", true},
+		{"notsteamcontent.com", false},
+		{"clngaa.com", false},
+	}
+	for _, tt := range tests {
+		if got := MatchDomain(tt.domain, domains); got != tt.want {
+			t.Errorf("MatchDomain(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
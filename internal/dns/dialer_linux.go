@@ -0,0 +1,25 @@
+//go:build linux
+
+package dns
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// newDialer returns a dialer that sets SO_MARK so upstream queries bypass the UA3F firewall rules.
+func newDialer(mark int) *net.Dialer {
+	return &net.Dialer{
+		Timeout: upstreamTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if mark == 0 {
+				return nil
+			}
+			return c.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+			})
+		},
+	}
+}
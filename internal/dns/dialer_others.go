@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dns
+
+import "net"
+
+func newDialer(mark int) *net.Dialer {
+	return &net.Dialer{
+		Timeout: upstreamTimeout,
+	}
+}
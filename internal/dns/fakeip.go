@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// FakeIPPool hands out addresses from a reserved IPv4 range, one per domain.
+// When the pool is exhausted the oldest allocation is recycled.
+type FakeIPPool struct {
+	mu       sync.Mutex
+	prefix   netip.Prefix
+	first    uint32
+	last     uint32
+	next     uint32
+	byDomain map[string]uint32
+	byIP     map[uint32]string
+}
+
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("netip.ParsePrefix: %w", err)
+	}
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("fake-ip range %s is not IPv4", cidr)
+	}
+	if prefix.Bits() > 29 {
+		return nil, fmt.Errorf("fake-ip range %s is too small", cidr)
+	}
+	base := addrToUint32(prefix.Addr())
+	size := uint32(1) << (32 - prefix.Bits())
+	// Skip the network address, the first host (usually a gateway) and the broadcast address.
+	first := base + 2
+	return &FakeIPPool{
+		prefix:   prefix,
+		first:    first,
+		last:     base + size - 2,
+		next:     first,
+		byDomain: make(map[string]uint32),
+		byIP:     make(map[uint32]string),
+	}, nil
+}
+
+// Alloc returns the fake IP assigned to domain, allocating one if needed.
+func (p *FakeIPPool) Alloc(domain string) net.IP {
+	domain = normalizeDomain(domain)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ip, ok := p.byDomain[domain]; ok {
+		return uint32ToIP(ip)
+	}
+	ip := p.next
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byDomain, old)
+	}
+	p.byIP[ip] = domain
+	p.byDomain[domain] = ip
+	if p.next == p.last {
+		p.next = p.first
+	} else {
+		p.next++
+	}
+	return uint32ToIP(ip)
+}
+
+// Lookup returns the domain a fake IP was allocated for.
+func (p *FakeIPPool) Lookup(ip net.IP) (string, bool) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byIP[binary.BigEndian.Uint32(v4)]
+	return domain, ok
+}
+
+// Contains reports whether ip belongs to the fake-ip range.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return p.prefix.Contains(addr.Unmap())
+}
+
+func (p *FakeIPPool) String() string {
+	return p.prefix.String()
+}
+
+func addrToUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
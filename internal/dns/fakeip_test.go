@@ -0,0 +1,49 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/29")
+	if err != nil {
+		t.Fatalf("NewFakeIPPool() error = %v", err)
+	}
+
+	a := p.Alloc("a.example.com")
+	if !a.Equal(net.ParseIP("198.18.0.2")) {
+		t.Fatalf("Alloc() = %v, want 198.18.0.2", a)
+	}
+	if again := p.Alloc("A.Example.com."); !again.Equal(a) {
+		t.Fatalf("Alloc() not stable: %v != %v", again, a)
+	}
+	if got, ok := p.Lookup(a); !ok || got != "a.example.com" {
+		t.Fatalf("Lookup(%v) = (%q, %v)", a, got, ok)
+	}
+	if !p.Contains(net.ParseIP("198.18.0.7")) || p.Contains(net.ParseIP("198.18.0.8")) {
+		t.Fatal("Contains() disagrees with the range")
+	}
+
+	// 198.18.0.2 - 198.18.0.6 are usable, the sixth allocation recycles the oldest.
+	for _, d := range []string{"b", "c", "d", "e"} {
+		p.Alloc(d + ".example.com")
+	}
+	if f := p.Alloc("f.example.com"); !f.Equal(a) {
+		t.Fatalf("Alloc() after wrap = %v, want %v", f, a)
+	}
+	if got, _ := p.Lookup(a); got != "f.example.com" {
+		t.Fatalf("Lookup(%v) after wrap = %q, want f.example.com", a, got)
+	}
+	if b := p.Alloc("a.example.com"); b.Equal(a) {
+		t.Fatal("recycled domain kept its old address")
+	}
+}
+
+func TestFakeIPPoolInvalid(t *testing.T) {
+	for _, cidr := range []string{"fd00::/64", "198.18.0.0/30", "nope"} {
+		if _, err := NewFakeIPPool(cidr); err == nil {
+			t.Errorf("NewFakeIPPool(%q) error = nil", cidr)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrNotResponse = errors.New("dns message is not a response")
+
+// ParseResponse extracts the A/AAAA answers of a DNS response.
+// Answers are attributed to the question name so that CNAME chains
+// map back to the domain the client actually asked for.
+func ParseResponse(msg []byte) ([]Record, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !header.Response {
+		return nil, ErrNotResponse
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, nil
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	domain := normalizeDomain(question.Name.String())
+
+	now := time.Now()
+	var records []Record
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return records, err
+			}
+			records = append(records, Record{Domain: domain, IP: net.IP(r.A[:]), Expire: now.Add(ttl)})
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return records, err
+			}
+			records = append(records, Record{Domain: domain, IP: net.IP(r.AAAA[:]), Expire: now.Add(ttl)})
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return records, err
+			}
+		}
+	}
+	return records, nil
+}
+
+// Observe parses a DNS response and stores its answers in the cache.
+// It returns the number of records added.
+func (c *Cache) Observe(msg []byte) (int, error) {
+	records, err := ParseResponse(msg)
+	for _, r := range records {
+		c.Add(r.Domain, r.IP, time.Until(r.Expire))
+	}
+	return len(records), err
+}
@@ -0,0 +1,555 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	fakeIPTTL   = 1
+	negativeTTL = 60 * time.Second
+	tcpIdle     = 10 * time.Second
+	// minUDPSize is the UDP payload size every client accepts, RFC 1035.
+	minUDPSize = 512
+	// maxUDPHandlers bounds the UDP queries handled at once; further
+	// datagrams wait in the socket buffer.
+	maxUDPHandlers = 256
+)
+
+// errNotQuery is returned for messages with the QR bit set, which are
+// responses rather than queries and are not forwarded.
+var errNotQuery = errors.New("message is a response, not a query")
+
+var active atomic.Pointer[Server]
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cachedAnswer struct {
+	msg     []byte
+	created time.Time
+	expire  time.Time
+}
+
+// Server is an embedded DNS forwarder. It answers on UDP and TCP, forwards
+// queries to the configured upstreams with an answer cache, and optionally
+// returns fake IPs so that flows can be steered and mapped back by domain.
+type Server struct {
+	cfg          *config.DNSConfig
+	upstreams    []Upstream
+	cache        *lru.Cache[cacheKey, *cachedAnswer]
+	fakeIP       *FakeIPPool
+	fakeIPFilter []string
+	udpConn      net.PacketConn
+	udpHandlers  chan struct{} // semaphore of the running UDP handlers
+	tcpListener  net.Listener
+	wg           sync.WaitGroup
+}
+
+func NewServer(cfg *config.Config, mark int) (*Server, error) {
+	s := &Server{
+		cfg:         &cfg.DNS,
+		udpHandlers: make(chan struct{}, maxUDPHandlers),
+	}
+	for _, raw := range cfg.DNS.Upstreams {
+		u, err := ParseUpstream(raw, mark)
+		if err != nil {
+			return nil, fmt.Errorf("ParseUpstream(%s): %w", raw, err)
+		}
+		s.upstreams = append(s.upstreams, u)
+	}
+	if len(s.upstreams) == 0 {
+		return nil, errors.New("no dns upstream configured")
+	}
+
+	size := cfg.DNS.CacheSize
+	if size <= 0 {
+		size = config.DefaultDNSCacheSize
+	}
+	cache, err := lru.New[cacheKey, *cachedAnswer](size)
+	if err != nil {
+		return nil, fmt.Errorf("lru.New: %w", err)
+	}
+	s.cache = cache
+
+	if cfg.DNS.FakeIP {
+		if s.fakeIP, err = NewFakeIPPool(cfg.DNS.FakeIPRange); err != nil {
+			return nil, err
+		}
+		for _, d := range strings.Split(cfg.DNS.FakeIPFilter, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				s.fakeIPFilter = append(s.fakeIPFilter, d)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) Start() error {
+	var err error
+	if s.udpConn, err = net.ListenPacket("udp", s.cfg.Listen); err != nil {
+		return fmt.Errorf("net.ListenPacket: %w", err)
+	}
+	if s.tcpListener, err = net.Listen("tcp", s.cfg.Listen); err != nil {
+		_ = s.udpConn.Close()
+		return fmt.Errorf("net.Listen: %w", err)
+	}
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	active.Store(s)
+
+	upstreams := make([]string, 0, len(s.upstreams))
+	for _, u := range s.upstreams {
+		upstreams = append(upstreams, u.String())
+	}
+	attrs := []any{slog.String("listen", s.cfg.Listen), slog.Any("upstreams", upstreams)}
+	if s.fakeIP != nil {
+		attrs = append(attrs, slog.String("fake_ip_range", s.fakeIP.String()))
+	}
+	slog.Info("DNS server started", attrs...)
+	return nil
+}
+
+func (s *Server) Close() error {
+	active.CompareAndSwap(s, nil)
+	if s.udpConn != nil {
+		_ = s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		_ = s.tcpListener.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) Restart(cfg *config.Config, mark int) (*Server, error) {
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+	newServer, err := NewServer(cfg, mark)
+	if err != nil {
+		return nil, err
+	}
+	// Keep fake IP allocations stable so existing client caches stay valid.
+	if s.fakeIP != nil && newServer.fakeIP != nil && s.fakeIP.String() == newServer.fakeIP.String() {
+		newServer.fakeIP = s.fakeIP
+	}
+	if err := newServer.Start(); err != nil {
+		return nil, err
+	}
+	return newServer, nil
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("DNS udpConn.ReadFrom", slog.Any("error", err))
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		s.udpHandlers <- struct{}{}
+		go func() {
+			defer func() { <-s.udpHandlers }()
+			resp, err := s.Handle(context.Background(), query)
+			if err != nil {
+				slog.Debug("DNS Handle", slog.String("client", addr.String()), slog.Any("error", err))
+				return
+			}
+			_, _ = s.udpConn.WriteTo(truncate(resp, udpSize(query)), addr)
+		}()
+	}
+}
+
+// udpSize returns the largest UDP response the client of query accepts: the
+// payload size of its EDNS OPT record, or 512 bytes without one.
+func udpSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minUDPSize
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return minUDPSize
+	}
+	h, ok := findOPT(&p)
+	if !ok {
+		return minUDPSize
+	}
+	return min(max(int(h.Class), minUDPSize), maxMessageSize)
+}
+
+// truncate returns resp as is when it fits in size bytes. Otherwise it keeps
+// the question and OPT record only and sets the TC bit, so that the client
+// retries over TCP.
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return resp
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return resp
+	}
+	header.Truncated = true
+	b := dnsmessage.NewBuilder(nil, header)
+	if err := b.StartQuestions(); err != nil {
+		return resp
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return resp
+		}
+	}
+	if h, ok := findOPT(&p); ok {
+		opt, err := p.OPTResource()
+		if err != nil {
+			return resp
+		}
+		if err := b.StartAdditionals(); err != nil {
+			return resp
+		}
+		if err := b.OPTResource(h, opt); err != nil {
+			return resp
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return resp
+	}
+	return msg
+}
+
+// findOPT advances p, past the questions, to the header of the OPT record.
+func findOPT(p *dnsmessage.Parser) (dnsmessage.ResourceHeader, bool) {
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsmessage.ResourceHeader{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return dnsmessage.ResourceHeader{}, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsmessage.ResourceHeader{}, false
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return h, true
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsmessage.ResourceHeader{}, false
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("DNS tcpListener.Accept", slog.Any("error", err))
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				_ = conn.SetDeadline(time.Now().Add(tcpIdle))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp, err := s.Handle(context.Background(), query)
+				if err != nil {
+					slog.Debug("DNS Handle", slog.String("client", conn.RemoteAddr().String()), slog.Any("error", err))
+					return
+				}
+				if err := writeTCPMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Handle answers a single raw DNS query.
+func (s *Server) Handle(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errNotQuery
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.fakeIP != nil && q.Class == dnsmessage.ClassINET && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		domain := normalizeDomain(q.Name.String())
+		if !MatchDomain(domain, s.fakeIPFilter) {
+			return s.fakeResponse(header, q, domain)
+		}
+	}
+	return s.exchange(ctx, header.ID, query, q)
+}
+
+// fakeResponse answers A queries with a fake IP and AAAA queries with an empty answer,
+// so that clients always connect over IPv4 to an address UA3F can map back.
+func (s *Server) fakeResponse(header dnsmessage.Header, q dnsmessage.Question, domain string) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeSuccess,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if q.Type == dnsmessage.TypeA {
+		ip := s.fakeIP.Alloc(domain)
+		var a [4]byte
+		copy(a[:], ip)
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: fakeIPTTL}
+		if err := b.AResource(rh, dnsmessage.AResource{A: a}); err != nil {
+			return nil, err
+		}
+		slog.Debug("DNS fake-ip allocated", slog.String("domain", domain), slog.String("ip", ip.String()))
+	}
+	return b.Finish()
+}
+
+// exchange answers a query from the cache or the upstreams.
+func (s *Server) exchange(ctx context.Context, id uint16, query []byte, q dnsmessage.Question) ([]byte, error) {
+	key := cacheKey{name: normalizeDomain(q.Name.String()), qtype: q.Type, class: q.Class}
+	if cached, ok := s.cache.Get(key); ok {
+		if time.Now().Before(cached.expire) {
+			if resp, err := rewriteCached(cached, id); err == nil {
+				metrics.CacheLookup(metrics.CacheDNSAnswer, true)
+				return resp, nil
+			}
+		}
+		s.cache.Remove(key)
+	}
+	metrics.CacheLookup(metrics.CacheDNSAnswer, false)
+
+	var lastErr error
+	for _, u := range s.upstreams {
+		ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+		resp, err := u.Exchange(ctx, query)
+		cancel()
+		if err != nil {
+			slog.Debug("DNS upstream exchange failed", slog.String("upstream", u.String()), slog.Any("error", err))
+			lastErr = err
+			continue
+		}
+		ttl, err := responseTTL(resp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		now := time.Now()
+		if ttl > 0 {
+			s.cache.Add(key, &cachedAnswer{msg: resp, created: now, expire: now.Add(ttl)})
+		}
+		_, _ = Default.Observe(resp)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("all upstreams failed: %w", lastErr)
+}
+
+// Resolve looks up the real addresses of host through the upstreams, bypassing fake IPs.
+func (s *Server) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+		if err := b.StartQuestions(); err != nil {
+			return nil, err
+		}
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+		query, err := b.Finish()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.exchange(ctx, 0, query, q)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		records, err := ParseResponse(resp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, r := range records {
+			ips = append(ips, r.IP)
+		}
+		if len(ips) > 0 {
+			break
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no address found for %s", host)
+		}
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+// responseTTL returns how long a response may be cached.
+func responseTTL(resp []byte) (time.Duration, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return 0, err
+	}
+	if !m.Response {
+		return 0, ErrNotResponse
+	}
+	if m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return 0, nil
+	}
+	if len(m.Answers) == 0 {
+		return negativeTTL, nil
+	}
+	ttl := m.Answers[0].Header.TTL
+	for _, a := range m.Answers[1:] {
+		if a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// rewriteCached returns a cached response with the query ID and decremented TTLs.
+func rewriteCached(cached *cachedAnswer, id uint16) ([]byte, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(cached.msg); err != nil {
+		return nil, err
+	}
+	m.ID = id
+	elapsed := uint32(time.Since(cached.created) / time.Second)
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities} {
+		for i := range section {
+			if section[i].Header.TTL > elapsed {
+				section[i].Header.TTL -= elapsed
+			} else {
+				section[i].Header.TTL = 1
+			}
+		}
+	}
+	return m.Pack()
+}
+
+// LookupAddr maps an IP or "ip:port" address back to a domain. Fake IPs handed out
+// by the active DNS server take precedence over addresses observed in DNS answers.
+func LookupAddr(addr string) (string, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", false
+	}
+	if s := active.Load(); s != nil && s.fakeIP != nil && s.fakeIP.Contains(ip) {
+		return s.fakeIP.Lookup(ip)
+	}
+	host, ok := Default.Lookup(ip)
+	metrics.CacheLookup(metrics.CacheDNSDomain, ok)
+	return host, ok
+}
+
+// ResolveFakeAddr translates an "ip:port" address whose IP is a fake IP into the real
+// address of the domain it stands for. ok is false if addr is not a fake IP.
+func ResolveFakeAddr(ctx context.Context, addr string) (realAddr string, ok bool, err error) {
+	s := active.Load()
+	if s == nil || s.fakeIP == nil {
+		return addr, false, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.fakeIP.Contains(ip) {
+		return addr, false, nil
+	}
+	domain, found := s.fakeIP.Lookup(ip)
+	if !found {
+		return addr, true, fmt.Errorf("fake ip %s has no domain mapping", host)
+	}
+	ips, err := s.Resolve(ctx, domain)
+	if err != nil {
+		return addr, true, fmt.Errorf("resolve %s: %w", domain, err)
+	}
+	return net.JoinHostPort(ips[0].String(), port), true, nil
+}
+
+// FakeAddrDomain translates an "ip:port" address whose IP is a fake IP into
+// "domain:port" without resolving the domain, for handing to an upstream proxy.
+// ok is false if addr is not a mapped fake IP.
+func FakeAddrDomain(addr string) (domainAddr string, ok bool) {
+	s := active.Load()
+	if s == nil || s.fakeIP == nil {
+		return addr, false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.fakeIP.Contains(ip) {
+		return addr, false
+	}
+	domain, found := s.fakeIP.Lookup(ip)
+	if !found {
+		return addr, false
+	}
+	return net.JoinHostPort(domain, port), true
+}
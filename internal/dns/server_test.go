@@ -0,0 +1,270 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type stubUpstream struct {
+	t     *testing.T
+	ip    net.IP
+	calls int
+}
+
+func (u *stubUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	u.calls++
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	resp := buildResponse(u.t, q.Name.String(), 300, u.ip)
+	resp[0], resp[1] = byte(header.ID>>8), byte(header.ID)
+	return resp, nil
+}
+
+func (u *stubUpstream) String() string { return "stub" }
+
+func buildQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatalf("StartQuestions: %v", err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatalf("Question: %v", err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	return msg
+}
+
+func answers(t *testing.T, msg []byte) (uint16, []net.IP) {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	var ips []net.IP
+	for _, a := range m.Answers {
+		switch r := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(r.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(r.AAAA[:]))
+		}
+	}
+	return m.Header.ID, ips
+}
+
+func newTestServer(t *testing.T, fakeIP bool) (*Server, *stubUpstream) {
+	t.Helper()
+	cfg := &config.Config{DNS: config.DNSConfig{
+		Enabled:      true,
+		Upstreams:    []string{"udp://127.0.0.1:53"},
+		FakeIP:       fakeIP,
+		FakeIPRange:  config.DefaultFakeIPRange,
+		FakeIPFilter: "lan, ntp.example.org",
+	}}
+	s, err := NewServer(cfg, 0)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	up := &stubUpstream{t: t, ip: net.ParseIP("93.184.216.34")}
+	s.upstreams = []Upstream{up}
+	return s, up
+}
+
+func TestServerForwardCache(t *testing.T) {
+	s, up := newTestServer(t, false)
+
+	for i, id := range []uint16{1, 2} {
+		resp, err := s.Handle(context.Background(), buildQuery(t, id, "www.example.com.", dnsmessage.TypeA))
+		if err != nil {
+			t.Fatalf("Handle() error = %v", err)
+		}
+		gotID, ips := answers(t, resp)
+		if gotID != id {
+			t.Errorf("query %d: ID = %d, want %d", i, gotID, id)
+		}
+		if len(ips) != 1 || !ips[0].Equal(up.ip) {
+			t.Errorf("query %d: answers = %v, want [%v]", i, ips, up.ip)
+		}
+	}
+	if up.calls != 1 {
+		t.Errorf("upstream calls = %d, want 1", up.calls)
+	}
+	if got, ok := Default.LookupString("93.184.216.34:443"); !ok || got != "www.example.com" {
+		t.Errorf("forwarded answer not observed: (%q, %v)", got, ok)
+	}
+}
+
+func TestServerDropsResponses(t *testing.T) {
+	s, up := newTestServer(t, false)
+
+	resp := buildResponse(t, "www.example.com.", 300, up.ip)
+	if _, err := s.Handle(context.Background(), resp); !errors.Is(err, errNotQuery) {
+		t.Errorf("Handle(response) error = %v, want %v", err, errNotQuery)
+	}
+	if up.calls != 0 {
+		t.Errorf("upstream calls = %d, want 0", up.calls)
+	}
+}
+
+func TestServerFakeIP(t *testing.T) {
+	s, up := newTestServer(t, true)
+	active.Store(s)
+	defer active.Store(nil)
+
+	resp, err := s.Handle(context.Background(), buildQuery(t, 7, "video.example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	_, ips := answers(t, resp)
+	if len(ips) != 1 || !s.fakeIP.Contains(ips[0]) {
+		t.Fatalf("answers = %v, want one fake ip", ips)
+	}
+	if up.calls != 0 {
+		t.Fatalf("fake-ip query reached upstream")
+	}
+
+	addr := net.JoinHostPort(ips[0].String(), "443")
+	if host, ok := LookupAddr(addr); !ok || host != "video.example.com" {
+		t.Errorf("LookupAddr(%s) = (%q, %v)", addr, host, ok)
+	}
+	realAddr, fake, err := ResolveFakeAddr(context.Background(), addr)
+	if err != nil || !fake || realAddr != "93.184.216.34:443" {
+		t.Errorf("ResolveFakeAddr(%s) = (%q, %v, %v)", addr, realAddr, fake, err)
+	}
+
+	resp, err = s.Handle(context.Background(), buildQuery(t, 8, "video.example.com.", dnsmessage.TypeAAAA))
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if _, ips := answers(t, resp); len(ips) != 0 {
+		t.Errorf("AAAA answers = %v, want none", ips)
+	}
+
+	// filtered domains are forwarded with real answers
+	resp, err = s.Handle(context.Background(), buildQuery(t, 9, "ntp.example.org.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if _, ips := answers(t, resp); len(ips) != 1 || !ips[0].Equal(up.ip) {
+		t.Errorf("filtered answers = %v, want [%v]", ips, up.ip)
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"223.5.5.5", "udp://223.5.5.5:53", true},
+		{"tcp://8.8.8.8", "tcp://8.8.8.8:53", true},
+		{"tls://1.1.1.1", "tls://1.1.1.1:853", true},
+		{"https://1.1.1.1/dns-query", "https://1.1.1.1/dns-query", true},
+		{"quic://1.1.1.1", "", false},
+	}
+	for _, tt := range tests {
+		u, err := ParseUpstream(tt.raw, 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseUpstream(%q) error = %v", tt.raw, err)
+			continue
+		}
+		if err == nil && u.String() != tt.want {
+			t.Errorf("ParseUpstream(%q) = %s, want %s", tt.raw, u.String(), tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	ips := make([]net.IP, 60)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, 0, byte(i+1))
+	}
+	resp := buildResponse(t, "big.example.com.", 300, ips...)
+	if len(resp) <= minUDPSize {
+		t.Fatalf("response of %d bytes fits in %d", len(resp), minUDPSize)
+	}
+
+	query := buildQuery(t, 1, "big.example.com.", dnsmessage.TypeA)
+	if got := udpSize(query); got != minUDPSize {
+		t.Errorf("udpSize() without EDNS = %d, want %d", got, minUDPSize)
+	}
+	truncated := truncate(resp, udpSize(query))
+	var m dnsmessage.Message
+	if err := m.Unpack(truncated); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !m.Header.Truncated || len(m.Answers) != 0 || len(m.Questions) != 1 {
+		t.Errorf("truncated = TC %v, %d answers, %d questions; want TC, no answers, the question",
+			m.Header.Truncated, len(m.Answers), len(m.Questions))
+	}
+
+	// EDNS clients advertise a larger UDP payload
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 2, RecursionDesired: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("big.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	_ = b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatalf("SetEDNS0: %v", err)
+	}
+	_ = b.OPTResource(opt, dnsmessage.OPTResource{})
+	ednsQuery, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if got := udpSize(ednsQuery); got != 4096 {
+		t.Errorf("udpSize() with EDNS = %d, want 4096", got)
+	}
+	if got := truncate(resp, udpSize(ednsQuery)); len(got) != len(resp) {
+		t.Errorf("response of %d bytes truncated to %d with a 4096 bytes limit", len(resp), len(got))
+	}
+}
+
+func TestUDPUpstreamMismatchedID(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer conn.Close()
+	want := buildResponse(t, "www.example.com.", 300, net.ParseIP("93.184.216.34"))
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		_, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		stale := append([]byte(nil), want...)
+		stale[0], stale[1] = buf[0], buf[1]+1
+		_, _ = conn.WriteTo(stale, addr)
+		want[0], want[1] = buf[0], buf[1]
+		_, _ = conn.WriteTo(want, addr)
+	}()
+
+	u, err := ParseUpstream("udp://"+conn.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatalf("ParseUpstream: %v", err)
+	}
+	resp, err := u.Exchange(context.Background(), buildQuery(t, 0x1234, "www.example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if id, _ := answers(t, resp); id != 0x1234 {
+		t.Errorf("Exchange() returned the answer with ID %#x, want %#x", id, 0x1234)
+	}
+}
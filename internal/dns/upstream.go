@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	upstreamTimeout = 5 * time.Second
+	maxMessageSize  = 65535
+)
+
+// Upstream exchanges a raw DNS query with a remote resolver.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// ParseUpstream parses an upstream address. Supported forms:
+//
+//	1.1.1.1 / udp://1.1.1.1:53
+//	tcp://1.1.1.1:53
+//	tls://1.1.1.1:853 (DNS over TLS)
+//	https://1.1.1.1/dns-query (DNS over HTTPS)
+//
+// Upstream hostnames are resolved by the system resolver, so prefer IP
+// addresses if the system resolver forwards to UA3F itself.
+func ParseUpstream(raw string, mark int) (Upstream, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("empty upstream")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "udp://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream %q has no host", raw)
+	}
+	dialer := newDialer(mark)
+
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: withDefaultPort(u.Host, "53"), dialer: dialer}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withDefaultPort(u.Host, "53"), dialer: dialer}, nil
+	case "tls":
+		return &tcpUpstream{
+			addr:   withDefaultPort(u.Host, "853"),
+			dialer: dialer,
+			tlsConfig: &tls.Config{
+				ServerName: u.Hostname(),
+			},
+		}, nil
+	case "https":
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Timeout: upstreamTimeout,
+				Transport: &http.Transport{
+					DialContext:         dialer.DialContext,
+					ForceAttemptHTTP2:   true,
+					MaxIdleConns:        4,
+					IdleConnTimeout:     90 * time.Second,
+					TLSHandshakeTimeout: upstreamTimeout,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+type udpUpstream struct {
+	addr   string
+	dialer *net.Dialer
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	// Datagrams not answering the query, such as late answers to an earlier
+	// one or spoofed ones, are skipped until the deadline.
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 3 && len(query) >= 2 && buf[0] == query[0] && buf[1] == query[1] && buf[2]&0x80 != 0 {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+type tcpUpstream struct {
+	addr      string
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.tlsConfig != nil {
+		tlsConn := tls.Client(conn, u.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tlsConfig != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(upstreamTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
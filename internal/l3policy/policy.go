@@ -0,0 +1,373 @@
+package l3policy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
+)
+
+const (
+	IPIDZero   = "ZERO"
+	IPIDRandom = "RANDOM"
+	IPIDKeep   = "KEEP"
+
+	DesyncNone            = "NONE"
+	DesyncReorder         = "REORDER"
+	DesyncInject          = "INJECT"
+	DesyncSNISplit        = tlsdesync.MethodSNISplit
+	DesyncFakeClientHello = tlsdesync.MethodFakeClientHello
+
+	// DefaultTCPWindow is the SYN window set by the global tcpwin toggle.
+	DefaultTCPWindow = 65535
+)
+
+// Actions is the effective L3 treatment of a packet.
+// Zero values leave the corresponding field untouched.
+type Actions struct {
+	TTL    uint8
+	IPID   string
+	TCPTS  bool
+	TCPWIN uint16
+}
+
+// Rule is a compiled config.L3Rule.
+type Rule struct {
+	Name string
+
+	dstCIDRs []netip.Prefix
+	dstPorts []uint16
+	srcIPs   []netip.Prefix
+	domains  []string
+
+	ttl    *uint8
+	ipid   string
+	tcpts  *bool
+	tcpwin *uint16
+	desync []string
+
+	// TLS is the ClientHello strategy of the rule's desync methods, nil without any.
+	TLS *tlsdesync.Strategy
+}
+
+// Policy matches packets against the L3 rules, first match wins.
+type Policy struct {
+	global *config.L3RewriteConfig
+	rules  []*Rule
+}
+
+// New compiles the rules of cfg.
+func New(cfg *config.L3RewriteConfig) (*Policy, error) {
+	p := &Policy{global: cfg}
+	for i, c := range cfg.Rules {
+		r, err := newRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("l3-rewrite.rules[%d]: %w", i, err)
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func newRule(c config.L3Rule) (*Rule, error) {
+	r := &Rule{
+		Name:   c.Name,
+		ttl:    c.TTL,
+		ipid:   strings.ToUpper(c.IPID),
+		tcpts:  c.TCPTS,
+		tcpwin: c.TCPWIN,
+	}
+
+	var err error
+	if r.dstCIDRs, err = parsePrefixes(c.DstCIDR); err != nil {
+		return nil, fmt.Errorf("dst-cidr: %w", err)
+	}
+	if r.srcIPs, err = parsePrefixes(c.SrcIP); err != nil {
+		return nil, fmt.Errorf("src-ip: %w", err)
+	}
+	if r.dstPorts, err = tlsdesync.ParsePorts(c.DstPort); err != nil {
+		return nil, fmt.Errorf("dst-port: %w", err)
+	}
+	for _, d := range strings.Split(c.Domain, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			r.domains = append(r.domains, d)
+		}
+	}
+
+	if c.Desync != nil {
+		r.desync = []string{}
+		tls := &tlsdesync.Strategy{
+			FakeSNI:     tlsdesync.DefaultFakeSNI,
+			FakeFooling: tlsdesync.FoolingTTL,
+			FakeTTL:     tlsdesync.DefaultFakeTTL,
+		}
+		for _, m := range c.Desync {
+			switch m = strings.ToUpper(strings.TrimSpace(m)); m {
+			case DesyncNone:
+			case DesyncReorder, DesyncInject:
+				r.desync = append(r.desync, m)
+			case DesyncSNISplit:
+				r.desync = append(r.desync, m)
+				tls.SNISplit = true
+			case DesyncFakeClientHello:
+				r.desync = append(r.desync, m)
+				tls.FakeClientHello = true
+			default:
+				return nil, fmt.Errorf("unknown desync method %q", m)
+			}
+		}
+		if tls.SNISplit || tls.FakeClientHello {
+			r.TLS = tls
+		}
+	}
+	return r, nil
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			prefix, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether a packet from src to dst:port satisfies every condition of the rule.
+// Domain conditions use the domain sniffed or resolved for dst.
+func (r *Rule) Match(src, dst net.IP, port uint16) bool {
+	if len(r.srcIPs) > 0 && !containsAddr(r.srcIPs, src) {
+		return false
+	}
+	if len(r.dstCIDRs) > 0 && !containsAddr(r.dstCIDRs, dst) {
+		return false
+	}
+	if len(r.dstPorts) > 0 {
+		matched := false
+		for _, p := range r.dstPorts {
+			if p == port {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.domains) > 0 {
+		domain, ok := dns.LookupAddr(dst.String())
+		if !ok || !dns.MatchDomain(domain, r.domains) {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of rules.
+func (p *Policy) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.rules)
+}
+
+// Match returns the first rule matching a packet from src to dst:port, or nil.
+func (p *Policy) Match(src, dst net.IP, port uint16) *Rule {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.rules {
+		if r.Match(src, dst, port) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Actions returns the L3 treatment of a packet: the global settings
+// overridden by the actions the matching rule sets.
+func (p *Policy) Actions(src, dst net.IP, port uint16) Actions {
+	var a Actions
+	if p == nil {
+		return a
+	}
+	if p.global.TTL {
+		a.TTL = p.global.TTLValue
+	}
+	if p.global.IPID {
+		a.IPID = IPIDZero
+	}
+	a.TCPTS = p.global.TCPTS
+	if p.global.TCPWIN {
+		a.TCPWIN = DefaultTCPWindow
+	}
+
+	r := p.Match(src, dst, port)
+	if r == nil {
+		return a
+	}
+	if r.ttl != nil {
+		a.TTL = *r.ttl
+	}
+	if r.ipid != "" {
+		a.IPID = r.ipid
+	}
+	if r.tcpts != nil {
+		a.TCPTS = *r.tcpts
+	}
+	if r.tcpwin != nil {
+		a.TCPWIN = *r.tcpwin
+	}
+	if a.IPID == IPIDKeep {
+		a.IPID = ""
+	}
+	return a
+}
+
+// Desync reports whether method applies to a packet from src to dst:port.
+// Packets matching a rule with desync methods only get those methods;
+// the others fall back to enabled, the global toggle of method.
+func (p *Policy) Desync(src, dst net.IP, port uint16, method string, enabled bool) bool {
+	r := p.Match(src, dst, port)
+	if r == nil || r.desync == nil {
+		return enabled
+	}
+	return r.HasDesync(method)
+}
+
+// HasDesync reports whether the rule enables the desync method.
+func (r *Rule) HasDesync(method string) bool {
+	for _, m := range r.desync {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Any reports whether one of the rules satisfies fn.
+func (p *Policy) Any(fn func(*Rule) bool) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.rules {
+		if fn(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// RewritesEveryPacket reports whether a rule sets the TTL or IP ID, which
+// requires every packet to be inspected rather than only SYNs.
+func (r *Rule) RewritesEveryPacket() bool {
+	return r.ttl != nil || r.ipid != ""
+}
+
+// RewritesSYN reports whether a rule sets TCP options or the window of SYNs.
+func (r *Rule) RewritesSYN() bool {
+	return r.tcpts != nil || r.tcpwin != nil
+}
+
+// DesyncsTLS reports whether the rule applies a ClientHello desync method.
+func (r *Rule) DesyncsTLS() bool {
+	return r.TLS != nil
+}
+
+// TLSStrategy returns the ClientHello strategy of the rule matching a packet
+// from src to dst:port. ok is false when no matching rule sets desync methods,
+// in which case the configured TLS strategies apply.
+func (p *Policy) TLSStrategy(src, dst net.IP, port uint16) (st *tlsdesync.Strategy, ok bool) {
+	r := p.Match(src, dst, port)
+	if r == nil || r.desync == nil {
+		return nil, false
+	}
+	return r.TLS, true
+}
+
+// DesyncEnabled reports whether one of the rules of cfg enables a desync method,
+// which requires the desync server even with every global desync toggle off.
+func DesyncEnabled(cfg *config.L3RewriteConfig) bool {
+	for _, r := range cfg.Rules {
+		for _, m := range r.Desync {
+			if !strings.EqualFold(m, DesyncNone) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DesyncPorts returns the destination ports of the rules enabling the desync
+// method. all is true when one of them has no dst-port and so covers every
+// port.
+func (p *Policy) DesyncPorts(method string) (ports []uint16, all bool) {
+	if p == nil {
+		return nil, false
+	}
+	for _, r := range p.rules {
+		if !r.HasDesync(method) {
+			continue
+		}
+		if len(r.dstPorts) == 0 {
+			return nil, true
+		}
+		ports = append(ports, r.dstPorts...)
+	}
+	return ports, false
+}
+
+// TLSPorts returns the destination ports of rules with ClientHello desync
+// methods. Rules without dst-port cover the default TLS port.
+func (p *Policy) TLSPorts() []uint16 {
+	var ports []uint16
+	if p == nil {
+		return ports
+	}
+	for _, r := range p.rules {
+		if r.TLS == nil {
+			continue
+		}
+		if len(r.dstPorts) == 0 {
+			ports = append(ports, tlsdesync.DefaultPort)
+			continue
+		}
+		ports = append(ports, r.dstPorts...)
+	}
+	return ports
+}
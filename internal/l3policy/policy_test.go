@@ -0,0 +1,165 @@
+package l3policy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
+)
+
+func u8(v uint8) *uint8    { return &v }
+func u16(v uint16) *uint16 { return &v }
+func boolp(v bool) *bool   { return &v }
+
+func TestPolicyActions(t *testing.T) {
+	dns.Default.Add("video.example.com", net.ParseIP("203.0.113.10"), time.Minute)
+
+	cfg := &config.L3RewriteConfig{
+		TTL:      true,
+		TTLValue: 64,
+		IPID:     true,
+		TCPTS:    true,
+		Rules: []config.L3Rule{
+			{Name: "console", SrcIP: "192.168.1.50,192.168.2.0/24", TTL: u8(128), IPID: IPIDKeep, TCPTS: boolp(false)},
+			{Name: "video", Domain: "example.com", DstPort: "443", TCPWIN: u16(29200), IPID: IPIDRandom},
+			{Name: "dns", DstCIDR: "8.8.8.0/24", TTL: u8(255)},
+		},
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	global := Actions{TTL: 64, IPID: IPIDZero, TCPTS: true}
+	tests := []struct {
+		name string
+		src  string
+		dst  string
+		port uint16
+		want Actions
+	}{
+		{"no match", "192.168.1.2", "198.51.100.1", 80, global},
+		{"src ip", "192.168.1.50", "198.51.100.1", 80, Actions{TTL: 128}},
+		{"src cidr", "192.168.2.7", "198.51.100.1", 80, Actions{TTL: 128}},
+		{"domain and port", "192.168.1.2", "203.0.113.10", 443, Actions{TTL: 64, IPID: IPIDRandom, TCPTS: true, TCPWIN: 29200}},
+		{"domain wrong port", "192.168.1.2", "203.0.113.10", 80, global},
+		{"dst cidr", "192.168.1.2", "8.8.8.8", 53, Actions{TTL: 255, IPID: IPIDZero, TCPTS: true}},
+		{"first match wins", "192.168.1.50", "8.8.8.8", 53, Actions{TTL: 128}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Actions(net.ParseIP(tt.src), net.ParseIP(tt.dst), tt.port)
+			if got != tt.want {
+				t.Errorf("Actions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyDesync(t *testing.T) {
+	cfg := &config.L3RewriteConfig{
+		Rules: []config.L3Rule{
+			{SrcIP: "192.168.1.50", Desync: []string{DesyncNone}},
+			{SrcIP: "192.168.1.60", Desync: []string{DesyncReorder, DesyncSNISplit}},
+			{SrcIP: "192.168.1.70", TTL: u8(64)},
+		},
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	dst := net.ParseIP("198.51.100.1")
+
+	tests := []struct {
+		src     string
+		method  string
+		enabled bool
+		want    bool
+	}{
+		{"192.168.1.50", DesyncReorder, true, false},
+		{"192.168.1.60", DesyncReorder, false, true},
+		{"192.168.1.60", DesyncInject, true, false},
+		{"192.168.1.70", DesyncReorder, true, true},
+		{"192.168.1.2", DesyncInject, true, true},
+		{"192.168.1.2", DesyncInject, false, false},
+	}
+	for _, tt := range tests {
+		if got := p.Desync(net.ParseIP(tt.src), dst, 443, tt.method, tt.enabled); got != tt.want {
+			t.Errorf("Desync(%s, %s, %v) = %v, want %v", tt.src, tt.method, tt.enabled, got, tt.want)
+		}
+	}
+
+	if st, ok := p.TLSStrategy(net.ParseIP("192.168.1.60"), dst, 443); !ok || st == nil || !st.SNISplit || st.FakeClientHello {
+		t.Errorf("TLSStrategy(192.168.1.60) = %+v, %v, want SNI-SPLIT", st, ok)
+	}
+	if st, ok := p.TLSStrategy(net.ParseIP("192.168.1.50"), dst, 443); !ok || st != nil {
+		t.Errorf("TLSStrategy(192.168.1.50) = %+v, %v, want nil, true", st, ok)
+	}
+	if _, ok := p.TLSStrategy(net.ParseIP("192.168.1.70"), dst, 443); ok {
+		t.Error("TLSStrategy(192.168.1.70) should fall back to the configured strategies")
+	}
+	if ports := p.TLSPorts(); len(ports) != 1 || ports[0] != 443 {
+		t.Errorf("TLSPorts() = %v, want [443]", ports)
+	}
+	if !DesyncEnabled(cfg) {
+		t.Error("DesyncEnabled() = false, want true")
+	}
+}
+
+func TestPolicyDesyncPorts(t *testing.T) {
+	p, err := New(&config.L3RewriteConfig{
+		Rules: []config.L3Rule{
+			{SrcIP: "192.168.1.50", DstPort: "3074", Desync: []string{DesyncReorder}},
+			{SrcIP: "192.168.1.60", DstPort: "8080,3074", Desync: []string{DesyncReorder, DesyncInject}},
+			{SrcIP: "192.168.1.70", Desync: []string{DesyncInject}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if ports, all := p.DesyncPorts(DesyncReorder); all || len(ports) != 3 || ports[0] != 3074 || ports[1] != 8080 {
+		t.Errorf("DesyncPorts(REORDER) = %v, %v, want [3074 8080 3074], false", ports, all)
+	}
+	if ports, all := p.DesyncPorts(DesyncInject); !all || ports != nil {
+		t.Errorf("DesyncPorts(INJECT) = %v, %v, want every port", ports, all)
+	}
+	if ports, all := p.DesyncPorts(DesyncSNISplit); all || len(ports) != 0 {
+		t.Errorf("DesyncPorts(SNI-SPLIT) = %v, %v, want none", ports, all)
+	}
+}
+
+func TestPolicyQueueNeeds(t *testing.T) {
+	p, err := New(&config.L3RewriteConfig{
+		Rules: []config.L3Rule{{SrcIP: "192.168.1.50", TCPTS: boolp(true)}},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if p.Any((*Rule).RewritesEveryPacket) {
+		t.Error("RewritesEveryPacket should be false for a SYN-only rule")
+	}
+	if !p.Any((*Rule).RewritesSYN) {
+		t.Error("RewritesSYN should be true")
+	}
+
+	var nilPolicy *Policy
+	if nilPolicy.Any((*Rule).RewritesSYN) || nilPolicy.Len() != 0 {
+		t.Error("nil policy should have no rules")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []config.L3Rule{
+		{DstCIDR: "10.0.0.0/33"},
+		{SrcIP: "not-an-ip"},
+		{DstPort: "http"},
+		{Desync: []string{"RECORD-SPLIT"}},
+	}
+	for _, r := range tests {
+		if _, err := New(&config.L3RewriteConfig{Rules: []config.L3Rule{r}}); err == nil {
+			t.Errorf("New(%+v) expected error", r)
+		}
+	}
+}
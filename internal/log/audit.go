@@ -0,0 +1,196 @@
+package log
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AuditEntry is a rule decision: the rule of a rule list matching a request
+// or response and the action run, or no rule matching at all. For header
+// actions, Before and After hold the header value around the action and are
+// empty when the header is absent.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	Host      string    `json:"host,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	List      string    `json:"list"`
+	Direction string    `json:"direction"`
+	RuleIndex int       `json:"rule_index"` // -1 when no rule matched
+	RuleType  string    `json:"rule_type,omitempty"`
+	Action    string    `json:"action"`
+	Header    string    `json:"header,omitempty"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLog writes rule decisions to a JSON lines file rotated apart from
+// the main log.
+type AuditLog struct {
+	writer     *lumberjack.Logger
+	sampleRate float64
+	mu         sync.Mutex
+}
+
+var auditLog atomic.Pointer[AuditLog]
+
+// SetAuditConf replaces the audit log with the one configured by cfg, or
+// stops auditing when cfg is disabled.
+func SetAuditConf(cfg config.AuditLogConfig) error {
+	var l *AuditLog
+	if cfg.Enabled {
+		path := cfg.Path
+		if path == "" {
+			path = GetAuditFilePath()
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		l = &AuditLog{
+			writer: &lumberjack.Logger{
+				Filename:   path,
+				MaxSize:    cmp.Or(cfg.MaxSize, config.DefaultAuditMaxSize),
+				MaxBackups: cmp.Or(cfg.MaxBackups, config.DefaultAuditMaxBackups),
+				MaxAge:     cmp.Or(cfg.MaxAge, config.DefaultAuditMaxAge),
+				LocalTime:  true,
+			},
+			sampleRate: cmp.Or(cfg.SampleRate, 1),
+		}
+	}
+	if old := auditLog.Swap(l); old != nil {
+		_ = old.writer.Close()
+	}
+	return nil
+}
+
+// GetAuditFilePath returns the default path of the audit log.
+func GetAuditFilePath() string {
+	return filepath.Join(GetLogDir(), "audit.log")
+}
+
+// SampleAudit reports whether the decisions of a request or response are to
+// be audited. It is false when the audit log is disabled.
+func SampleAudit() bool {
+	l := auditLog.Load()
+	return l != nil && (l.sampleRate >= 1 || rand.Float64() < l.sampleRate)
+}
+
+// Audit writes e to the audit log, if enabled.
+func Audit(e *AuditEntry) {
+	l := auditLog.Load()
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	_, _ = l.writer.Write(append(line, '\n'))
+	l.mu.Unlock()
+}
+
+// AuditQuery selects audit entries. String fields match case-insensitive
+// substrings, and zero values match every entry.
+type AuditQuery struct {
+	Src      string
+	Dst      string
+	Host     string
+	URL      string
+	List     string
+	RuleType string
+	Action   string
+	Matched  *bool
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (q *AuditQuery) match(e *AuditEntry) bool {
+	for _, f := range [][2]string{
+		{e.Src, q.Src}, {e.Dst, q.Dst}, {e.Host, q.Host}, {e.URL, q.URL},
+		{e.List, q.List}, {e.RuleType, q.RuleType}, {e.Action, q.Action},
+	} {
+		if f[1] != "" && !strings.Contains(strings.ToLower(f[0]), strings.ToLower(f[1])) {
+			return false
+		}
+	}
+	if q.Matched != nil && *q.Matched != (e.RuleIndex >= 0) {
+		return false
+	}
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) && (q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// QueryAudit returns the last q.Limit entries matching q, newest first,
+// searching the audit log and its rotated backups.
+func QueryAudit(q AuditQuery) ([]AuditEntry, error) {
+	l := auditLog.Load()
+	if l == nil {
+		return nil, os.ErrNotExist
+	}
+
+	// Backups are named <name>-<timestamp><ext>, so they sort oldest first.
+	path := l.writer.Filename
+	ext := filepath.Ext(path)
+	backups, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+
+	var entries []AuditEntry
+	for _, file := range append(backups, path) {
+		if err := scanAudit(file, &q, &entries); err != nil {
+			return nil, err
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// scanAudit appends the entries of file matching q to entries, keeping the
+// last q.Limit.
+func scanAudit(file string, q *AuditQuery, entries *[]AuditEntry) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || !q.match(&e) {
+			continue
+		}
+		if q.Limit > 0 && len(*entries) == q.Limit {
+			*entries = append((*entries)[1:], e)
+		} else {
+			*entries = append(*entries, e)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	t.Cleanup(func() { _ = SetAuditConf(config.AuditLogConfig{}) })
+
+	Audit(&AuditEntry{Src: "192.168.1.2:5000"}) // disabled: dropped
+	if SampleAudit() {
+		t.Error("SampleAudit() = true with the audit log disabled")
+	}
+	if _, err := QueryAudit(AuditQuery{}); !os.IsNotExist(err) {
+		t.Errorf("QueryAudit() error = %v with the audit log disabled", err)
+	}
+
+	if err := SetAuditConf(config.AuditLogConfig{Enabled: true, Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	if !SampleAudit() {
+		t.Error("SampleAudit() = false with every decision audited")
+	}
+
+	// A rotated backup holds the oldest entry. It is recent enough not to be
+	// removed by the max age.
+	now := time.Now()
+	rotated := now.Add(-time.Hour)
+	backup := filepath.Join(dir, "audit-"+rotated.Format("2006-01-02T15-04-05.000")+".log")
+	if err := os.WriteFile(backup, []byte(`{"time":"`+rotated.Format(time.RFC3339)+`","src":"192.168.1.3:6000","list":"header-rewrite","rule_index":-1,"action":"DIRECT"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	Audit(&AuditEntry{Time: now, Src: "192.168.1.2:5000", Host: "example.com", List: "header-rewrite", RuleIndex: 0, RuleType: "FINAL", Action: "REPLACE", Header: "User-Agent", Before: "curl/8.0", After: "FFF"})
+	Audit(&AuditEntry{Time: now.Add(time.Second), Src: "192.168.1.2:5001", Host: "example.org", List: "header-rewrite", RuleIndex: -1, Action: "DIRECT"})
+
+	matched, unmatched := true, false
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  []string // src of the entries, newest first
+	}{
+		{"all", AuditQuery{}, []string{"192.168.1.2:5001", "192.168.1.2:5000", "192.168.1.3:6000"}},
+		{"limit", AuditQuery{Limit: 2}, []string{"192.168.1.2:5001", "192.168.1.2:5000"}},
+		{"host", AuditQuery{Host: "EXAMPLE.com"}, []string{"192.168.1.2:5000"}},
+		{"matched", AuditQuery{Matched: &matched}, []string{"192.168.1.2:5000"}},
+		{"unmatched", AuditQuery{Matched: &unmatched, Src: "192.168.1.3"}, []string{"192.168.1.3:6000"}},
+		{"since", AuditQuery{Since: now.Add(-time.Minute)}, []string{"192.168.1.2:5001", "192.168.1.2:5000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := QueryAudit(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Src)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("QueryAudit() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("QueryAudit() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	entries, _ := QueryAudit(AuditQuery{RuleType: "final"})
+	if len(entries) != 1 || entries[0].Before != "curl/8.0" || entries[0].After != "FFF" {
+		t.Errorf("QueryAudit(rule_type) = %+v, want the User-Agent rewrite", entries)
+	}
+}
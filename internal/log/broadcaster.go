@@ -1,60 +1,264 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	subscriberBuffer = 256
+	// ReplaySize is the number of recent lines kept for new subscribers.
+	ReplaySize = 1000
+)
+
+// Keys of the attributes holding source and destination addresses, at the
+// top level or as the last key of a group such as ConnLink.src_addr.
+var (
+	srcKeys = []string{"src_addr", "src", "client"}
+	dstKeys = []string{"dest_addr", "dest", "dst", "destination"}
+)
+
+// LogFilter selects the log lines sent to a subscriber. Lines below Level
+// are left out; the other zero values match every line.
+type LogFilter struct {
+	Level    slog.Level
+	Contains string         // case-insensitive substring of the line
+	Regexp   *regexp.Regexp // matched against the line
+	Src      string         // source address, or its IP
+	Dst      string         // destination address, or its IP
+}
+
+// logLine is a log line, parsed on first use by a filter.
+type logLine struct {
+	raw    []byte
+	parsed bool
+	level  slog.Level
+	attrs  map[string]string
+}
+
+func (l *logLine) parse(jsonFormat bool) {
+	if l.parsed {
+		return
+	}
+	l.parsed = true
+	if jsonFormat {
+		l.attrs = jsonAttrs(l.raw)
+	} else {
+		l.attrs = textAttrs(l.raw)
+	}
+	_ = l.level.UnmarshalText([]byte(l.attrs[slog.LevelKey]))
+}
+
+// textAttrs returns the top-level key=value pairs of a line of the text
+// handler.
+func textAttrs(line []byte) map[string]string {
+	attrs := make(map[string]string)
+	s := strings.TrimRight(string(line), "\n")
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		value := s
+		if quoted, err := strconv.QuotedPrefix(s); err == nil {
+			value, _ = strconv.Unquote(quoted)
+			s = s[len(quoted):]
+		} else if sp := strings.IndexByte(s, ' '); sp >= 0 {
+			value, s = s[:sp], s[sp:]
+		} else {
+			s = ""
+		}
+		attrs[key] = value
+		s = strings.TrimLeft(s, " ")
+	}
+	return attrs
+}
+
+// jsonAttrs returns the string and number fields of a line of the JSON
+// handler. Fields of groups are keyed like the text handler does, as
+// group.key.
+func jsonAttrs(line []byte) map[string]string {
+	var fields map[string]any
+	if json.Unmarshal(line, &fields) != nil {
+		return nil
+	}
+	attrs := make(map[string]string, len(fields))
+	flattenJSON(attrs, "", fields)
+	return attrs
+}
+
+func flattenJSON(attrs map[string]string, prefix string, fields map[string]any) {
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			attrs[prefix+k] = v
+		case float64:
+			attrs[prefix+k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case map[string]any:
+			flattenJSON(attrs, prefix+k+".", v)
+		}
+	}
+}
+
+func (f *LogFilter) match(l *logLine, jsonFormat bool) bool {
+	l.parse(jsonFormat)
+	if l.level < f.Level {
+		return false
+	}
+	if f.Contains != "" && !bytes.Contains(bytes.ToLower(l.raw), []byte(strings.ToLower(f.Contains))) {
+		return false
+	}
+	if f.Regexp != nil && !f.Regexp.Match(l.raw) {
+		return false
+	}
+	return (f.Src == "" || matchAddr(l.attrs, srcKeys, f.Src)) &&
+		(f.Dst == "" || matchAddr(l.attrs, dstKeys, f.Dst))
+}
+
+// matchAddr reports whether an attribute of keys, at the top level or in a
+// group, is the address want, or has want as its IP.
+func matchAddr(attrs map[string]string, keys []string, want string) bool {
+	for k, addr := range attrs {
+		if i := strings.LastIndexByte(k, '.'); i >= 0 {
+			k = k[i+1:]
+		}
+		if addr == "" || !slices.Contains(keys, k) {
+			continue
+		}
+		if addr == want {
+			return true
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil && host == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the log lines matching its filter on C. Lines are
+// dropped when the subscriber falls behind; Dropped tells how many.
+type Subscription struct {
+	C       chan []byte
+	filter  LogFilter
+	dropped atomic.Uint64
+	total   atomic.Uint64
+}
+
+// Dropped returns the number of lines dropped since its last call, and since
+// the subscription started.
+func (s *Subscription) Dropped() (recent, total uint64) {
+	return s.dropped.Swap(0), s.total.Load()
+}
+
 // Broadcaster is an io.Writer that fans out every Write to all registered
-// subscriber channels.  It is safe for concurrent use.
+// subscribers and keeps the last ReplaySize lines for new ones. It is safe
+// for concurrent use.
 type Broadcaster struct {
-	subscribers map[chan []byte]struct{}
-	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	replay      []*logLine // ring buffer, next is the oldest once full
+	next        int
+	mu          sync.Mutex
+
+	jsonFormat bool
+	opts       *slog.HandlerOptions
 }
 
 // NewBroadcaster creates a ready-to-use Broadcaster.
 func NewBroadcaster() *Broadcaster {
 	return &Broadcaster{
-		subscribers: make(map[chan []byte]struct{}),
+		subscribers: make(map[*Subscription]struct{}),
+		replay:      make([]*logLine, 0, ReplaySize),
 	}
 }
 
 // Write implements io.Writer.  Each write (typically one log line) is copied
-// to every subscriber channel.  Slow subscribers are skipped (non-blocking
-// send) so a stuck client never blocks the logger.
+// to every subscriber whose filter matches it.  Slow subscribers are skipped
+// (non-blocking send) so a stuck client never blocks the logger.
 func (b *Broadcaster) Write(p []byte) (int, error) {
-	buf := make([]byte, len(p))
-	copy(buf, p)
+	line := &logLine{raw: bytes.Clone(p)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	if len(b.replay) < ReplaySize {
+		b.replay = append(b.replay, line)
+	} else {
+		b.replay[b.next] = line
+		b.next = (b.next + 1) % ReplaySize
+	}
 
-	for ch := range b.subscribers {
+	for s := range b.subscribers {
+		if !s.filter.match(line, b.jsonFormat) {
+			continue
+		}
 		select {
-		case ch <- buf:
+		case s.C <- line.raw:
 		default:
 			// subscriber too slow – drop the message
+			s.dropped.Add(1)
+			s.total.Add(1)
 		}
 	}
 	return len(p), nil
 }
 
-// Subscribe registers a new subscriber and returns a buffered channel that
-// will receive copies of every log line.  Call Unsubscribe when done.
-func (b *Broadcaster) Subscribe() chan []byte {
-	ch := make(chan []byte, 256)
+// Subscribe registers a new subscriber receiving the log lines matching
+// filter, starting with the last replay lines logged. Call Unsubscribe when
+// done.
+func (b *Broadcaster) Subscribe(filter LogFilter, replay int) *Subscription {
 	b.mu.Lock()
-	b.subscribers[ch] = struct{}{}
-	b.mu.Unlock()
-	return ch
+	defer b.mu.Unlock()
+
+	var lines [][]byte // newest first
+	for i := len(b.replay) - 1; i >= 0 && len(lines) < replay; i-- {
+		line := b.replay[(b.next+i)%len(b.replay)]
+		if filter.match(line, b.jsonFormat) {
+			lines = append(lines, line.raw)
+		}
+	}
+	s := &Subscription{C: make(chan []byte, subscriberBuffer+len(lines)), filter: filter}
+	for i := len(lines) - 1; i >= 0; i-- {
+		s.C <- lines[i]
+	}
+	b.subscribers[s] = struct{}{}
+	return s
 }
 
-// Unsubscribe removes a subscriber channel and closes it.
-func (b *Broadcaster) Unsubscribe(ch chan []byte) {
+// Unsubscribe removes a subscriber and closes its channel.
+func (b *Broadcaster) Unsubscribe(s *Subscription) {
 	b.mu.Lock()
-	delete(b.subscribers, ch)
+	delete(b.subscribers, s)
 	b.mu.Unlock()
-	close(ch)
+	close(s.C)
+}
+
+// DroppedNotice returns a log line, in the format of the log, telling a
+// subscriber that lines were dropped.
+func (b *Broadcaster) DroppedNotice(recent, total uint64) []byte {
+	var buf bytes.Buffer
+	var h slog.Handler
+	if b.jsonFormat {
+		h = slog.NewJSONHandler(&buf, b.opts)
+	} else {
+		h = slog.NewTextHandler(&buf, b.opts)
+	}
+	r := slog.NewRecord(time.Now(), slog.LevelWarn, "Log lines dropped, the client is too slow", 0)
+	r.AddAttrs(slog.Uint64("dropped", recent), slog.Uint64("dropped_total", total))
+	_ = h.Handle(context.Background(), r)
+	return buf.Bytes()
 }
 
 // compile-time check
@@ -0,0 +1,88 @@
+package log
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func drain(ch chan []byte) []string {
+	var lines []string
+	for {
+		select {
+		case line := <-ch:
+			lines = append(lines, strings.TrimSpace(string(line)))
+		default:
+			return lines
+		}
+	}
+}
+
+func TestBroadcasterFilter(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			b := NewBroadcaster()
+			b.jsonFormat = format == "json"
+			var h slog.Handler = slog.NewTextHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug})
+			if b.jsonFormat {
+				h = slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug})
+			}
+			logger := slog.New(h)
+
+			logger.Info("before subscribing", slog.String("src", "192.168.1.2:5000"))
+			all := b.Subscribe(LogFilter{Level: slog.LevelDebug}, 10)
+			device := b.Subscribe(LogFilter{Level: slog.LevelInfo, Src: "192.168.1.2"}, 10)
+			warn := b.Subscribe(LogFilter{Level: slog.LevelWarn, Contains: "TIMEOUT"}, 0)
+			re := b.Subscribe(LogFilter{Regexp: regexp.MustCompile(`dest.*:443`), Dst: "1.1.1.1:443"}, 0)
+
+			logger.Debug("debug", slog.String("src", "192.168.1.2:5001"))
+			logger.Info("other device", slog.String("src", "192.168.1.20:5000"))
+			logger.Warn("dial timeout", slog.String("client", "192.168.1.2:5002"), slog.String("dest", "1.1.1.1:443"))
+
+			if got := len(drain(all.C)); got != 4 {
+				t.Errorf("unfiltered subscriber got %d lines, want 4", got)
+			}
+			got := drain(device.C)
+			if len(got) != 2 || !strings.Contains(got[0], "before subscribing") || !strings.Contains(got[1], "dial timeout") {
+				t.Errorf("device subscriber got %q, want the replayed line and the warning", got)
+			}
+			if got := drain(warn.C); len(got) != 1 {
+				t.Errorf("warning subscriber got %q, want the timeout", got)
+			}
+			if got := drain(re.C); len(got) != 1 {
+				t.Errorf("regexp subscriber got %q, want the timeout", got)
+			}
+		})
+	}
+}
+
+func TestBroadcasterDropped(t *testing.T) {
+	b := NewBroadcaster()
+	b.opts = &slog.HandlerOptions{}
+	for i := 0; i < ReplaySize+10; i++ {
+		fmt.Fprintf(b, "level=INFO msg=%d\n", i)
+	}
+	s := b.Subscribe(LogFilter{}, ReplaySize)
+	if len(s.C) != ReplaySize {
+		t.Fatalf("replayed %d lines, want %d", len(s.C), ReplaySize)
+	}
+	if first := strings.TrimSpace(string(<-s.C)); first != "level=INFO msg=10" {
+		t.Errorf("first replayed line = %q, want the oldest kept", first)
+	}
+
+	// One line was read, so 5 of these do not fit.
+	for i := 0; i < subscriberBuffer+6; i++ {
+		fmt.Fprintf(b, "level=INFO msg=%d\n", i)
+	}
+	if recent, total := s.Dropped(); recent != 5 || total != 5 {
+		t.Errorf("Dropped() = %d, %d, want 5, 5", recent, total)
+	}
+	if recent, total := s.Dropped(); recent != 0 || total != 5 {
+		t.Errorf("Dropped() = %d, %d after the first call, want 0, 5", recent, total)
+	}
+	if notice := string(b.DroppedNotice(5, 5)); !strings.Contains(notice, "level=WARN") || !strings.Contains(notice, "dropped=5 dropped_total=5") {
+		t.Errorf("DroppedNotice() = %q", notice)
+	}
+}
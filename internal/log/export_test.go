@@ -0,0 +1,6 @@
+package log
+
+// SetJSONFormat sets the format the lines written to b are parsed as.
+func (b *Broadcaster) SetJSONFormat(json bool) {
+	b.jsonFormat = json
+}
@@ -0,0 +1,78 @@
+package log_test
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/log"
+)
+
+// TestBroadcasterFilterAddrs filters lines logged like the servers log
+// connections, requests and packets.
+func TestBroadcasterFilterAddrs(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			b := log.NewBroadcaster()
+			b.SetJSONFormat(format == "json")
+			var h slog.Handler = slog.NewTextHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug})
+			if format == "json" {
+				h = slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug})
+			}
+			logger := slog.New(h)
+
+			link := &common.ConnLink{LAddr: "192.168.1.2:5000", RAddr: "1.1.1.1:443"}
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = "192.168.1.3:6000"
+			metadata := &common.Metadata{Request: req}
+			packet := &common.Packet{SrcAddr: "192.168.1.4:7000", DstAddr: "8.8.8.8:53"}
+
+			logger.Info("New socks5 connection", slog.String("src_addr", "192.168.1.2:5000"))
+			logger.Info("BPF sockmap offload activated", "ConnLink", link)
+			logger.Info("Rewrite request", slog.Any("metadata", metadata))
+			logger.Debug("Processing packet", slog.Int("workerID", 0), slog.String("src_addr", packet.SrcAddr), slog.String("dest_addr", packet.DstAddr))
+
+			tests := []struct {
+				filter log.LogFilter
+				want   []string
+			}{
+				{log.LogFilter{Src: "192.168.1.2"}, []string{"New socks5 connection", "BPF sockmap offload activated"}},
+				{log.LogFilter{Src: "192.168.1.2:5000", Dst: "1.1.1.1"}, []string{"BPF sockmap offload activated"}},
+				{log.LogFilter{Src: "192.168.1.3"}, []string{"Rewrite request"}},
+				{log.LogFilter{Dst: "example.com:80"}, []string{"Rewrite request"}},
+				{log.LogFilter{Dst: "example.com"}, []string{"Rewrite request"}},
+				{log.LogFilter{Level: slog.LevelDebug, Src: "192.168.1.4", Dst: "8.8.8.8:53"}, []string{"Processing packet"}},
+				{log.LogFilter{Dst: "192.168.1.2"}, nil},
+			}
+			for _, tt := range tests {
+				s := b.Subscribe(tt.filter, log.ReplaySize)
+				var got []string
+				for _, line := range drain(s.C) {
+					for _, msg := range []string{"New socks5 connection", "BPF sockmap offload activated", "Rewrite request", "Processing packet"} {
+						if strings.Contains(line, msg) {
+							got = append(got, msg)
+						}
+					}
+				}
+				b.Unsubscribe(s)
+				if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+					t.Errorf("filter %+v got %q, want %q", tt.filter, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func drain(ch chan []byte) []string {
+	var lines []string
+	for {
+		select {
+		case line := <-ch:
+			lines = append(lines, string(line))
+		default:
+			return lines
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Modules are the subsystems whose log level can be set apart from the
+// default level.
+var Modules = []string{"api", "mitm", "netfilter", "nfqueue", "rule"}
+
+// modulePrefixes maps the functions logging to the module they belong to.
+var modulePrefixes = []struct {
+	prefix string
+	module string
+}{
+	{"github.com/sunbk201/ua3f/internal/api.", "api"},
+	{"github.com/sunbk201/ua3f/internal/mitm.", "mitm"},
+	{"github.com/sunbk201/ua3f/internal/l3policy.", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/netfilter.", "netfilter"},
+	{"github.com/sunbk201/ua3f/internal/server/base.(*NfqueueServer)", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/server/desync.", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/server/dnssniff.", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/server/netlink.", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/server/nfqueue.", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/tlsdesync.", "nfqueue"},
+	{"github.com/sunbk201/ua3f/internal/rewrite.", "rule"},
+	{"github.com/sunbk201/ua3f/internal/rule.", "rule"},
+	{"github.com/sunbk201/ua3f/internal/rule/", "rule"},
+}
+
+// levelTable is an immutable set of levels, replaced as a whole on change.
+type levelTable struct {
+	def     slog.Level
+	modules map[string]slog.Level // modules not inheriting the default level
+	min     slog.Level
+}
+
+var (
+	levels   atomic.Pointer[levelTable]
+	levelsMu sync.Mutex
+
+	pcModules sync.Map // uintptr to module, "" for none
+)
+
+func init() {
+	levels.Store(&levelTable{def: slog.LevelInfo, min: slog.LevelInfo})
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func levelName(l slog.Level) string {
+	return strings.ToLower(l.String())
+}
+
+// SetLevels replaces the default level and the levels of modules. Modules
+// left out inherit the default level.
+func SetLevels(def string, modules map[string]string) error {
+	t := &levelTable{modules: make(map[string]slog.Level, len(modules))}
+	var err error
+	if t.def, err = ParseLevel(def); err != nil {
+		return err
+	}
+	for module, level := range modules {
+		if !slices.Contains(Modules, module) {
+			return fmt.Errorf("unknown log module %q", module)
+		}
+		if t.modules[module], err = ParseLevel(level); err != nil {
+			return err
+		}
+	}
+
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	levels.Store(t.withMin())
+	return nil
+}
+
+// UpdateLevels changes the default level, unless def is empty, and the
+// levels of the given modules. An empty module level makes the module
+// inherit the default level again.
+func UpdateLevels(def string, modules map[string]string) error {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	cur := levels.Load()
+	t := &levelTable{def: cur.def, modules: maps.Clone(cur.modules)}
+	var err error
+	if def != "" {
+		if t.def, err = ParseLevel(def); err != nil {
+			return err
+		}
+	}
+	for module, level := range modules {
+		if !slices.Contains(Modules, module) {
+			return fmt.Errorf("unknown log module %q", module)
+		}
+		if level == "" {
+			delete(t.modules, module)
+			continue
+		}
+		if t.modules[module], err = ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	levels.Store(t.withMin())
+	return nil
+}
+
+func (t *levelTable) withMin() *levelTable {
+	t.min = t.def
+	for _, l := range t.modules {
+		t.min = min(t.min, l)
+	}
+	return t
+}
+
+// Levels returns the default level and the levels of the modules not
+// inheriting it.
+func Levels() (string, map[string]string) {
+	t := levels.Load()
+	modules := make(map[string]string, len(t.modules))
+	for module, l := range t.modules {
+		modules[module] = levelName(l)
+	}
+	return levelName(t.def), modules
+}
+
+// moduleOf returns the module of the function at pc, or "".
+func moduleOf(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	if m, ok := pcModules.Load(pc); ok {
+		return m.(string)
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	module := ""
+	for _, p := range modulePrefixes {
+		if strings.HasPrefix(frame.Function, p.prefix) {
+			module = p.module
+			break
+		}
+	}
+	pcModules.Store(pc, module)
+	return module
+}
+
+// moduleHandler drops the records below the level of the module logging
+// them and adds the module to the others.
+type moduleHandler struct {
+	slog.Handler
+}
+
+func (h moduleHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= levels.Load().min
+}
+
+func (h moduleHandler) Handle(ctx context.Context, r slog.Record) error {
+	t := levels.Load()
+	module := moduleOf(r.PC)
+	level, ok := t.modules[module]
+	if !ok {
+		level = t.def
+	}
+	if r.Level < level {
+		return nil
+	}
+	if module != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("module", module))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return moduleHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h moduleHandler) WithGroup(name string) slog.Handler {
+	return moduleHandler{h.Handler.WithGroup(name)}
+}
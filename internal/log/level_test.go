@@ -0,0 +1,77 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logAsMitm logs as a function of the mitm module.
+func logAsMitm(logger *slog.Logger, level slog.Level, msg string) {
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	if logger.Enabled(context.Background(), level) {
+		_ = logger.Handler().Handle(context.Background(), r)
+	}
+}
+
+func TestModuleLevels(t *testing.T) {
+	saved := modulePrefixes
+	modulePrefixes = append(modulePrefixes, struct {
+		prefix string
+		module string
+	}{"github.com/sunbk201/ua3f/internal/log.logAsMitm", "mitm"})
+	t.Cleanup(func() {
+		modulePrefixes = saved
+		_ = SetLevels("info", nil)
+	})
+
+	var buf bytes.Buffer
+	logger := slog.New(moduleHandler{slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})})
+
+	if err := SetLevels("info", map[string]string{"mitm": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("other debug")
+	logger.Info("other info")
+	logAsMitm(logger, slog.LevelDebug, "mitm debug")
+	out := buf.String()
+	if strings.Contains(out, "other debug") || !strings.Contains(out, "other info") {
+		t.Errorf("default level not applied:\n%s", out)
+	}
+	if !strings.Contains(out, `msg="mitm debug" module=mitm`) {
+		t.Errorf("mitm debug record missing or without its module:\n%s", out)
+	}
+
+	// Resetting the module level makes it inherit the default level.
+	buf.Reset()
+	if err := UpdateLevels("", map[string]string{"mitm": ""}); err != nil {
+		t.Fatal(err)
+	}
+	logAsMitm(logger, slog.LevelDebug, "mitm debug")
+	if buf.Len() != 0 {
+		t.Errorf("mitm debug record logged at the info level:\n%s", buf.String())
+	}
+
+	if err := UpdateLevels("warn", map[string]string{"nfqueue": "error"}); err != nil {
+		t.Fatal(err)
+	}
+	def, modules := Levels()
+	if def != "warn" || len(modules) != 1 || modules["nfqueue"] != "error" {
+		t.Errorf("Levels() = %s, %v, want warn and nfqueue=error", def, modules)
+	}
+
+	for _, bad := range []map[string]string{{"mitm": "trace"}, {"socks5": "debug"}} {
+		if err := UpdateLevels("", bad); err == nil {
+			t.Errorf("UpdateLevels(%v) succeeded, want an error", bad)
+		}
+	}
+	if def, _ := Levels(); def != "warn" {
+		t.Errorf("default level = %s after failed updates, want warn", def)
+	}
+}
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"cmp"
+	"context"
 	"io"
 	"log/slog"
 	"os"
+	"runtime"
 	"strings"
 	"time"
 
@@ -11,7 +14,10 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func SetLogConf(level string) (*Broadcaster, error) {
+// SetLogConf sets up the default logger writing to stdout, the log file and
+// the returned Broadcaster, in the text or JSON format of cfg, at the levels
+// of cfg.
+func SetLogConf(cfg *config.Config) (*Broadcaster, error) {
 	writer2 := os.Stdout
 	writer3 := &lumberjack.Logger{
 		Filename:   GetLogFilePath(),
@@ -25,33 +31,34 @@ func SetLogConf(level string) (*Broadcaster, error) {
 	broadcaster := NewBroadcaster()
 	multiWriter := io.MultiWriter(writer2, writer3, broadcaster)
 
-	var logLevel slog.Level
-	switch strings.ToLower(level) {
-	case "debug":
-		logLevel = slog.LevelDebug
-	case "info":
-		logLevel = slog.LevelInfo
-	case "warn":
-		logLevel = slog.LevelWarn
-	case "error":
-		logLevel = slog.LevelError
-	default:
-		logLevel = slog.LevelInfo
+	if err := SetLevels(cmp.Or(cfg.LogLevel, "info"), cfg.LogLevels); err != nil {
+		return nil, err
 	}
 
 	loc := LoadLocalLocation()
+	jsonFormat := strings.EqualFold(cfg.LogFormat, "json")
 	opts := &slog.HandlerOptions{
-		Level: logLevel,
+		Level: slog.LevelDebug, // filtered by moduleHandler
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-			if a.Key == slog.TimeKey {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
 				t := a.Value.Time().In(loc)
+				if jsonFormat {
+					return slog.Time(slog.TimeKey, t)
+				}
 				return slog.String(slog.TimeKey, t.Format("2006-01-02 15:04:05"))
 			}
 			return a
 		},
 	}
-	logger := slog.New(slog.NewTextHandler(multiWriter, opts))
-	slog.SetDefault(logger)
+	broadcaster.jsonFormat, broadcaster.opts = jsonFormat, opts
+
+	var handler slog.Handler
+	if jsonFormat {
+		handler = slog.NewJSONHandler(multiWriter, opts)
+	} else {
+		handler = slog.NewTextHandler(multiWriter, opts)
+	}
+	slog.SetDefault(slog.New(moduleHandler{handler}))
 	return broadcaster, nil
 }
 
@@ -62,19 +69,34 @@ func LogHeader(version string, cfg *config.Config) {
 }
 
 func LogDebugWithAddr(src string, dest string, msg string) {
-	slog.Debug(msg, slog.String("src", src), slog.String("dest", dest))
+	logWithAddr(slog.LevelDebug, src, dest, msg)
 }
 
 func LogInfoWithAddr(src string, dest string, msg string) {
-	slog.Info(msg, slog.String("src", src), slog.String("dest", dest))
+	logWithAddr(slog.LevelInfo, src, dest, msg)
 }
 
 func LogWarnWithAddr(src string, dest string, msg string) {
-	slog.Warn(msg, slog.String("src", src), slog.String("dest", dest))
+	logWithAddr(slog.LevelWarn, src, dest, msg)
 }
 
 func LogErrorWithAddr(src string, dest string, msg string) {
-	slog.Error(msg, slog.String("src", src), slog.String("dest", dest))
+	logWithAddr(slog.LevelError, src, dest, msg)
+}
+
+// logWithAddr logs msg as called from the caller of its caller, so the
+// record is filtered by the level of that caller's module.
+func logWithAddr(level slog.Level, src string, dest string, msg string) {
+	ctx := context.Background()
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, logWithAddr and the Log*WithAddr function
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.AddAttrs(slog.String("src", src), slog.String("dest", dest))
+	_ = logger.Handler().Handle(ctx, r)
 }
 
 // LoadLocalLocation tries to detect and load the system local timezone from
@@ -0,0 +1,163 @@
+// Package metrics keeps process-wide counters and writes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Type is the type of a metric family.
+type Type string
+
+const (
+	TypeCounter Type = "counter"
+	TypeGauge   Type = "gauge"
+)
+
+// Family is a metric with a fixed set of label names. Counter family names
+// omit the "_total" suffix, which is added when writing samples.
+type Family struct {
+	name   string
+	help   string
+	typ    Type
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*Value
+
+	// collect reports the samples of families whose values are read at
+	// scrape time rather than kept here.
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// Value is one series of a family.
+type Value struct {
+	labelValues []string
+	v           atomic.Int64
+}
+
+func (v *Value) Add(n int64) {
+	v.v.Add(n)
+}
+
+func (v *Value) Inc() {
+	v.v.Add(1)
+}
+
+func (v *Value) Dec() {
+	v.v.Add(-1)
+}
+
+func (v *Value) Load() int64 {
+	return v.v.Load()
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Family
+)
+
+func register(f *Family) *Family {
+	registryMu.Lock()
+	registry = append(registry, f)
+	registryMu.Unlock()
+	return f
+}
+
+// NewCounter registers a counter family.
+func NewCounter(name, help string, labels ...string) *Family {
+	return register(&Family{name: name, help: help, typ: TypeCounter, labels: labels, series: map[string]*Value{}})
+}
+
+// NewGauge registers a gauge family.
+func NewGauge(name, help string, labels ...string) *Family {
+	return register(&Family{name: name, help: help, typ: TypeGauge, labels: labels, series: map[string]*Value{}})
+}
+
+// NewCounterFunc registers a counter family whose samples collect reports on every scrape.
+func NewCounterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *Family {
+	return register(&Family{name: name, help: help, typ: TypeCounter, labels: labels, collect: collect})
+}
+
+// NewGaugeFunc registers a gauge family whose samples collect reports on every scrape.
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *Family {
+	return register(&Family{name: name, help: help, typ: TypeGauge, labels: labels, collect: collect})
+}
+
+// With returns the series for labelValues, creating it on first use.
+// Hot paths should keep the returned Value instead of looking it up each time.
+func (f *Family) With(labelValues ...string) *Value {
+	if len(labelValues) != len(f.labels) {
+		panic("metrics: " + f.name + ": wrong number of label values")
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.RLock()
+	v, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v, ok = f.series[key]; !ok {
+		v = &Value{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = v
+	}
+	return v
+}
+
+func (f *Family) Add(n int64, labelValues ...string) {
+	f.With(labelValues...).Add(n)
+}
+
+func (f *Family) Inc(labelValues ...string) {
+	f.With(labelValues...).Inc()
+}
+
+func (f *Family) Dec(labelValues ...string) {
+	f.With(labelValues...).Dec()
+}
+
+// Sample is a single value of a family at scrape time.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// samples returns the current samples of f ordered by label values.
+func (f *Family) samples() []Sample {
+	var out []Sample
+	if f.collect != nil {
+		f.collect(func(value float64, labelValues ...string) {
+			out = append(out, Sample{LabelValues: labelValues, Value: value})
+		})
+	} else {
+		f.mu.RLock()
+		out = make([]Sample, 0, len(f.series))
+		for _, v := range f.series {
+			out = append(out, Sample{LabelValues: v.labelValues, Value: float64(v.Load())})
+		}
+		f.mu.RUnlock()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].LabelValues, out[j].LabelValues
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return out
+}
+
+func families() []*Family {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return append([]*Family(nil), registry...)
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, f *Family, openMetrics bool) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeFamily(w, f, openMetrics)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestWriteFamily(t *testing.T) {
+	counter := &Family{name: "test_requests", help: "Requests\nseen.", typ: TypeCounter, labels: []string{"code", "path"}, series: map[string]*Value{}}
+	counter.Add(3, "200", "/a")
+	counter.Inc("500", `/"b"\`)
+	counter.Inc("200", "/a")
+
+	gauge := &Family{name: "test_open", help: "Open things.", typ: TypeGauge, series: map[string]*Value{}}
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	fn := &Family{name: "test_ratio", help: "A ratio.", typ: TypeGauge, labels: []string{"kind"},
+		collect: func(emit func(float64, ...string)) {
+			emit(0.5, "b")
+			emit(1e21, "a")
+		}}
+
+	tests := []struct {
+		name        string
+		family      *Family
+		openMetrics bool
+		want        string
+	}{
+		{"counter", counter, false, `# HELP test_requests_total Requests\nseen.
+# TYPE test_requests_total counter
+test_requests_total{code="200",path="/a"} 4
+test_requests_total{code="500",path="/\"b\"\\"} 1
+`},
+		{"counter openmetrics", counter, true, `# HELP test_requests Requests\nseen.
+# TYPE test_requests counter
+test_requests_total{code="200",path="/a"} 4
+test_requests_total{code="500",path="/\"b\"\\"} 1
+`},
+		{"gauge", gauge, false, `# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 1
+`},
+		{"func", fn, false, `# HELP test_ratio A ratio.
+# TYPE test_ratio gauge
+test_ratio{kind="a"} 1e+21
+test_ratio{kind="b"} 0.5
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := render(t, tt.family, tt.openMetrics); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithLabelCount(t *testing.T) {
+	f := &Family{name: "test_labels", typ: TypeCounter, labels: []string{"a"}, series: map[string]*Value{}}
+	if f.With("x") != f.With("x") {
+		t.Error("With() returned different series for the same labels")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("With() with a wrong label count did not panic")
+		}
+	}()
+	f.With("x", "y")
+}
+
+func TestWrite(t *testing.T) {
+	Connections.Inc()
+	CacheLookup(CacheMitMCert, true)
+
+	var buf bytes.Buffer
+	if err := Write(&buf, true); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE ua3f_connections counter\n",
+		`ua3f_cache_lookups_total{cache="mitm_cert",result="hit"} `,
+		"# TYPE ua3f_connections_active gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Error("OpenMetrics output does not end with # EOF")
+	}
+
+	if om, ct := Negotiate("application/openmetrics-text;version=1.0.0,text/plain;q=0.5"); !om || ct != ContentTypeOpenMetrics {
+		t.Errorf("Negotiate(openmetrics) = %v, %s", om, ct)
+	}
+	if om, ct := Negotiate("*/*"); om || ct != ContentTypeText {
+		t.Errorf("Negotiate(*/*) = %v, %s", om, ct)
+	}
+}
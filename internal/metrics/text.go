@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Content types of the two supported exposition formats.
+const (
+	ContentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Negotiate returns whether the OpenMetrics format should be written for a
+// request with the given Accept header, and the matching content type.
+func Negotiate(accept string) (openMetrics bool, contentType string) {
+	if strings.Contains(accept, "application/openmetrics-text") {
+		return true, ContentTypeOpenMetrics
+	}
+	return false, ContentTypeText
+}
+
+// Write writes every registered family to w, in the OpenMetrics format when
+// openMetrics is set and in the Prometheus text format otherwise.
+func Write(w io.Writer, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families() {
+		writeFamily(bw, f, openMetrics)
+	}
+	if openMetrics {
+		_, _ = bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func writeFamily(w *bufio.Writer, f *Family, openMetrics bool) {
+	name, sample := f.name, f.name
+	if f.typ == TypeCounter {
+		sample += "_total"
+		if !openMetrics {
+			name = sample
+		}
+	}
+
+	_, _ = w.WriteString("# HELP " + name + " " + escapeHelp(f.help) + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + string(f.typ) + "\n")
+	for _, s := range f.samples() {
+		_, _ = w.WriteString(sample)
+		if len(f.labels) > 0 {
+			_ = w.WriteByte('{')
+			for i, label := range f.labels {
+				if i > 0 {
+					_ = w.WriteByte(',')
+				}
+				value := ""
+				if i < len(s.LabelValues) {
+					value = s.LabelValues[i]
+				}
+				_, _ = w.WriteString(label + `="` + escapeLabel(value) + `"`)
+			}
+			_ = w.WriteByte('}')
+		}
+		_ = w.WriteByte(' ')
+		_, _ = w.WriteString(formatValue(s.Value))
+		_ = w.WriteByte('\n')
+	}
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+// Metrics updated by the servers. Values read from other packages at scrape
+// time, such as the BPF counters, are registered by the API server.
+var (
+	ConnectionsActive = NewGauge("ua3f_connections_active",
+		"Open client connections by sniffed protocol.", "protocol")
+	Connections = NewCounter("ua3f_connections",
+		"Client connections accepted.")
+	TransferredBytes = NewCounter("ua3f_transferred_bytes",
+		"Bytes relayed between clients and origin servers. Bytes offloaded to BPF are added when their connection closes.", "direction")
+
+	RuleMatches = NewCounter("ua3f_rule_matches",
+		"Rewrite rule matches by rule list and position.", "list", "index", "type", "action")
+	Rewrites = NewCounter("ua3f_rewrites",
+		"Header rewrites performed in any rewrite mode.")
+
+	MitMHandshakes = NewCounter("ua3f_mitm_handshakes",
+		"MitM TLS handshakes with clients and servers by result.", "side", "result")
+
+	NfqueueVerdicts = NewCounter("ua3f_nfqueue_verdicts",
+		"Verdicts set on NFQUEUE packets by queue and verdict.", "queue", "verdict")
+	NfqueueDropped = NewCounter("ua3f_nfqueue_dropped",
+		"NFQUEUE packets accepted unprocessed because the worker channel was full.", "queue")
+
+	CacheLookups = NewCounter("ua3f_cache_lookups",
+		"Cache lookups by cache and result.", "cache", "result")
+)
+
+// Directions of TransferredBytes.
+var (
+	UploadBytes   = TransferredBytes.With("upload")
+	DownloadBytes = TransferredBytes.With("download")
+)
+
+// Cache names of CacheLookups.
+const (
+	CacheDestination = "destination" // destinations known not to carry HTTP
+	CacheDNSAnswer   = "dns_answer"  // answers of the DNS server
+	CacheDNSDomain   = "dns_domain"  // IP to domain mappings
+	CacheMitMCert    = "mitm_cert"   // certificates generated for MitM
+)
+
+// CacheLookup counts a lookup of cache.
+func CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheLookups.Inc(cache, result)
+}
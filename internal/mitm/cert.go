@@ -12,6 +12,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/sunbk201/ua3f/internal/metrics"
 )
 
 // CertManager dynamically generates and caches TLS certificates
@@ -41,7 +43,9 @@ func (cm *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certific
 
 // GetCertificateForHost returns a TLS certificate for the given hostname.
 func (cm *CertManager) GetCertificateForHost(host string) (*tls.Certificate, error) {
-	if cached, ok := cm.cache.Load(host); ok {
+	cached, ok := cm.cache.Load(host)
+	metrics.CacheLookup(metrics.CacheMitMCert, ok)
+	if ok {
 		return cached.(*tls.Certificate), nil
 	}
 
@@ -6,17 +6,20 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sync/atomic"
 
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
 )
 
 // MiddleMan performs HTTPS MitM by terminating client TLS, decrypting traffic,
 // then handing the cleartext streams back to the standard processing pipeline.
 type MiddleMan struct {
 	CertManager        *CertManager
-	HostnameFilter     *HostnameFilter
 	InsecureSkipVerify bool
+
+	hostnameFilter atomic.Pointer[HostnameFilter]
 }
 
 func NewMiddleMan(cfg *config.Config) (*MiddleMan, error) {
@@ -35,11 +38,22 @@ func NewMiddleMan(cfg *config.Config) (*MiddleMan, error) {
 		return nil, fmt.Errorf("MitM hostname filter init failed: %w", err)
 	}
 
-	return &MiddleMan{
+	h := &MiddleMan{
 		CertManager:        NewCertManager(ca),
-		HostnameFilter:     hostnameFilter,
 		InsecureSkipVerify: cfg.MitM.InsecureSkipVerify,
-	}, nil
+	}
+	h.SetHostnameFilter(hostnameFilter)
+	return h, nil
+}
+
+// HostnameFilter returns the filter selecting the connections to intercept.
+func (h *MiddleMan) HostnameFilter() *HostnameFilter {
+	return h.hostnameFilter.Load()
+}
+
+// SetHostnameFilter replaces the filter; connections already intercepted are not affected.
+func (h *MiddleMan) SetHostnameFilter(f *HostnameFilter) {
+	h.hostnameFilter.Store(f)
 }
 
 // HandleTLS intercepts a TLS connection given the original ConnLink.
@@ -50,7 +64,7 @@ func (h *MiddleMan) HandleTLS(c *common.ConnLink, clientReader *bufio.Reader, se
 	destPort := c.RPort()
 
 	// Check if this hostname:port should be MitM'd
-	if !h.HostnameFilter.Allow(serverName, destPort) {
+	if !h.HostnameFilter().Allow(serverName, destPort) {
 		slog.Debug("MitM: skipping connection", "serverName", serverName, "destPort", destPort, "ConnLink", c)
 		return false, nil
 	}
@@ -69,8 +83,10 @@ func (h *MiddleMan) HandleTLS(c *common.ConnLink, clientReader *bufio.Reader, se
 		Certificates: []tls.Certificate{*cert},
 	})
 	if err := clientTLS.Handshake(); err != nil {
+		metrics.MitMHandshakes.Inc("client", "failure")
 		return false, fmt.Errorf("MitM: client TLS handshake failed: %w", err)
 	}
+	metrics.MitMHandshakes.Inc("client", "success")
 
 	slog.Info("MitM: client TLS handshake completed", "serverName", serverName, "ConnLink", c)
 
@@ -80,10 +96,12 @@ func (h *MiddleMan) HandleTLS(c *common.ConnLink, clientReader *bufio.Reader, se
 		InsecureSkipVerify: h.InsecureSkipVerify,
 	})
 	if err := serverTLS.Handshake(); err != nil {
+		metrics.MitMHandshakes.Inc("server", "failure")
 		_ = clientTLS.Close()
 		return false, fmt.Errorf("MitM: server TLS handshake failed for %s: %w", serverName, err)
 	}
 
+	metrics.MitMHandshakes.Inc("server", "success")
 	slog.Info("MitM: server TLS handshake completed", "serverName", serverName, "ConnLink", c)
 
 	// Replace the ConnLink's connections in-place with the decrypted streams.
@@ -14,6 +14,7 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/sunbk201/ua3f/internal/config"
 	"github.com/sunbk201/ua3f/internal/daemon"
+	"github.com/sunbk201/ua3f/internal/dns"
 	"sigs.k8s.io/knftables"
 )
 
@@ -30,6 +31,8 @@ const (
 	HELPER_QUEUE         = 10301
 	DESYNC_REORDER_QUEUE = 10901
 	DESYNC_INJECT_QUEUE  = 10902
+	DESYNC_TLS_QUEUE     = 10903
+	DNS_SNIFF_QUEUE      = 10401
 )
 
 const (
@@ -84,11 +87,14 @@ func init() {
 type Firewall struct {
 	Nftable    *knftables.Table
 	NftSetup   func() error
+	NftRuleset func(tx *knftables.Transaction) // used by NftDryRun
 	NftCleanup func() error
 	NftWatch   func()
 	IptSetup   func() error
 	IptCleanup func() error
 	IptWatch   func()
+
+	dnsWatchCancel func()
 }
 
 func (f *Firewall) Setup(cfg *config.Config) (err error) {
@@ -104,6 +110,7 @@ func (f *Firewall) Setup(cfg *config.Config) (err error) {
 		err = f.NftSetup()
 		if f.NftWatch != nil {
 			f.NftWatch()
+			f.watchSkipDomains(backend)
 		}
 	case IPT:
 		if f.IptSetup == nil {
@@ -112,6 +119,7 @@ func (f *Firewall) Setup(cfg *config.Config) (err error) {
 		err = f.IptSetup()
 		if f.IptWatch != nil {
 			f.IptWatch()
+			f.watchSkipDomains(backend)
 		}
 	default:
 		err = fmt.Errorf("unsupported or no firewall backend: %s", backend)
@@ -125,6 +133,10 @@ func (f *Firewall) Setup(cfg *config.Config) (err error) {
 }
 
 func (f *Firewall) Cleanup() error {
+	if f.dnsWatchCancel != nil {
+		f.dnsWatchCancel()
+		f.dnsWatchCancel = nil
+	}
 	if f.NftCleanup != nil {
 		_ = f.NftCleanup()
 	}
@@ -194,8 +206,8 @@ func detectFirewallBackend(cfg *config.Config) string {
 	iptAvailable := daemon.IsCommandAvailable("iptables")
 	nftTproxyAvailable := daemon.IsPackageInstalled("kmod-nft-tproxy") && nftAvailable
 	nftNfqueueAvailable := daemon.IsPackageInstalled("kmod-nft-queue") && nftAvailable
-	tproxyNeeded := cfg.ServerMode == config.ServerModeTProxy
-	nfqueueNeeded := cfg.TCPInitialWindow || cfg.TCPTimeStamp || cfg.IPID || cfg.ServerMode == config.ServerModeNFQueue || cfg.Desync.Reorder || cfg.Desync.Inject
+	tproxyNeeded := cfg.HasServerMode(config.ServerModeTProxy)
+	nfqueueNeeded := cfg.TCPInitialWindow || cfg.TCPTimeStamp || cfg.IPID || cfg.HasServerMode(config.ServerModeNFQueue) || cfg.Desync.Reorder || cfg.Desync.Inject || cfg.Desync.TLS || cfg.Desync.AutoProbe || cfg.DNSSniff.Enabled || len(cfg.L3Rewrite.Rules) > 0
 
 	selectNFT := func() bool {
 		if !nftAvailable {
@@ -228,27 +240,70 @@ func detectFirewallBackend(cfg *config.Config) string {
 	}
 }
 
+// resolveDomains resolves domains to their IPv4 and IPv6 addresses.
+// Addresses observed by the DNS sniffer are merged with the local lookup result,
+// since CDNs often hand out different addresses to different clients.
 func (f *Firewall) resolveDomains(domains []string) (v4 []string, v6 []string) {
 	var ipv4Addrs []string
 	var ipv6Addrs []string
 
+	seen := make(map[string]struct{})
+	add := func(ip net.IP) {
+		key := ip.String()
+		if _, ok := seen[key]; ok {
+			return
+		}
+		seen[key] = struct{}{}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ipv4Addrs = append(ipv4Addrs, ipv4.String())
+		} else if ipv6 := ip.To16(); ipv6 != nil {
+			ipv6Addrs = append(ipv6Addrs, ipv6.String())
+		}
+	}
+
 	for _, domain := range domains {
+		for _, ip := range dns.Default.LookupDomain(domain) {
+			add(ip)
+		}
 		ips, err := net.LookupIP(domain)
 		if err != nil {
 			slog.Warn("net.LookupIP", slog.String("domain", domain), slog.Any("error", err))
 			continue
 		}
 		for _, ip := range ips {
-			if ipv4 := ip.To4(); ipv4 != nil {
-				ipv4Addrs = append(ipv4Addrs, ipv4.String())
-			} else if ipv6 := ip.To16(); ipv6 != nil {
-				ipv6Addrs = append(ipv6Addrs, ipv6.String())
-			}
+			add(ip)
 		}
 	}
 	return ipv4Addrs, ipv6Addrs
 }
 
+// watchSkipDomains adds addresses of SKIP_DOMAINS to the skip set as soon as
+// they are observed in DNS answers, instead of waiting for the next periodic resolve.
+func (f *Firewall) watchSkipDomains(backend string) {
+	records, cancel := dns.Default.Subscribe()
+	f.dnsWatchCancel = cancel
+	go func() {
+		for r := range records {
+			if !dns.MatchDomain(r.Domain, SKIP_DOMAINS) {
+				continue
+			}
+			slog.Debug("Skip domain observed", slog.String("domain", r.Domain), slog.String("ip", r.IP.String()))
+			switch backend {
+			case NFT:
+				if r.IP.To4() != nil {
+					_ = f.NftAddSkipIP(f.Nftable, []string{r.IP.String()})
+				} else {
+					_ = f.NftAddSkipIP6(f.Nftable, []string{r.IP.String()})
+				}
+			case IPT:
+				if r.IP.To4() != nil {
+					_ = f.IptAddSkipIP(r.IP.String())
+				}
+			}
+		}
+	}()
+}
+
 func getWanNexthops() ([]string, error) {
 	out, err := exec.Command("ubus", "call", "network.interface.wan", "status").Output()
 	if err != nil {
@@ -58,6 +58,23 @@ func (f *Firewall) DumpNFTables() {
 	slog.Debug("nftables ruleset:\n" + string(output))
 }
 
+// NftDryRun returns the nftables table NftRuleset builds, as nft commands,
+// without applying it. Sets filled at runtime, such as the skip sets, are
+// left empty.
+func (f *Firewall) NftDryRun() (string, error) {
+	if f.NftRuleset == nil {
+		return "", fmt.Errorf("nftables ruleset function is nil")
+	}
+	nft := knftables.NewFake(f.Nftable.Family, f.Nftable.Name)
+	tx := nft.NewTransaction()
+	tx.Add(f.Nftable)
+	f.NftRuleset(tx)
+	if err := nft.Run(context.TODO(), tx); err != nil {
+		return "", err
+	}
+	return nft.Dump(), nil
+}
+
 func (f *Firewall) NftSetLanIP(tx *knftables.Transaction, table *knftables.Table) {
 	ipset := &knftables.Set{
 		Name:   LANSET,
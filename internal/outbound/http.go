@@ -0,0 +1,101 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTP tunnels connections through an upstream HTTP proxy with CONNECT.
+type HTTP struct {
+	name     string
+	address  string
+	username string
+	password string
+	forward  DialFunc
+}
+
+func NewHTTP(name, address, username, password string, forward DialFunc) *HTTP {
+	return &HTTP{
+		name:     name,
+		address:  address,
+		username: username,
+		password: password,
+		forward:  forward,
+	}
+}
+
+func (h *HTTP) Name() string {
+	return h.name
+}
+
+func (h *HTTP) URL() *url.URL {
+	u := &url.URL{Scheme: "http", Host: h.address}
+	if h.username != "" {
+		u.User = url.UserPassword(h.username, h.password)
+	}
+	return u
+}
+
+func (h *HTTP) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := h.forward(ctx, h.address)
+	if err != nil {
+		return nil, fmt.Errorf("outbound %s: %w", h.name, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	target := targetAddr(addr)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if h.username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.username + ":" + h.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("outbound %s: write CONNECT: %w", h.name, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("outbound %s: read CONNECT response: %w", h.name, err)
+	}
+	// The body of a successful CONNECT response is the tunnel itself, so it
+	// is never closed here.
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("outbound %s: CONNECT %s: %s", h.name, target, resp.Status)
+	}
+
+	tc := newTunnelConn(conn, addr)
+	if br.Buffered() > 0 {
+		return &bufferedConn{tunnelConn: tc, r: br}, nil
+	}
+	return tc, nil
+}
+
+// bufferedConn returns bytes the proxy sent right after its CONNECT response
+// before reading from the connection again.
+type bufferedConn struct {
+	*tunnelConn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
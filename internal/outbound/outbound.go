@@ -0,0 +1,153 @@
+// Package outbound dials origin servers directly or through an upstream proxy.
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
+	"github.com/sunbk201/ua3f/internal/rule"
+)
+
+// DialFunc opens a TCP connection to addr. Outbounds use it both for direct
+// connections and to reach their upstream proxy.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// Outbound is one way of reaching origin servers.
+type Outbound interface {
+	Name() string
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+	// URL returns the upstream proxy for use with http.Transport, or nil for direct.
+	URL() *url.URL
+}
+
+// Manager holds the configured outbounds and picks one per connection.
+type Manager struct {
+	outbounds map[string]Outbound
+	def       Outbound
+}
+
+// New builds the outbounds of cfg. forward dials without any proxy.
+func New(cfg *config.Config, forward DialFunc) (*Manager, error) {
+	direct := &Direct{name: config.OutboundDirect, forward: forward}
+	m := &Manager{
+		outbounds: map[string]Outbound{config.OutboundDirect: direct},
+		def:       direct,
+	}
+	for _, o := range cfg.Outbounds {
+		var ob Outbound
+		switch o.Type {
+		case config.OutboundTypeDirect:
+			ob = &Direct{name: o.Name, forward: forward}
+		case config.OutboundTypeHTTP:
+			ob = NewHTTP(o.Name, o.Address, o.Username, o.Password, forward)
+		case config.OutboundTypeSocks5:
+			ob = NewSocks5(o.Name, o.Address, o.Username, o.Password, forward)
+		default:
+			return nil, fmt.Errorf("outbound %s: unsupported type %q", o.Name, o.Type)
+		}
+		m.outbounds[o.Name] = ob
+	}
+	if cfg.DefaultOutbound != "" {
+		ob, ok := m.outbounds[cfg.DefaultOutbound]
+		if !ok {
+			return nil, fmt.Errorf("default-outbound: unknown outbound %q", cfg.DefaultOutbound)
+		}
+		m.def = ob
+	}
+	return m, nil
+}
+
+// Select returns the outbound named by the first matching PROXY rule, or the
+// default outbound.
+func (m *Manager) Select(rules []common.Rule, metadata *common.Metadata) Outbound {
+	name := rule.MatchOutbound(rules, metadata)
+	if name == "" {
+		return m.def
+	}
+	ob, ok := m.outbounds[name]
+	if !ok {
+		slog.Warn("Unknown outbound, using default", slog.String("outbound", name), slog.String("default", m.def.Name()))
+		return m.def
+	}
+	return ob
+}
+
+// Direct dials origin servers without a proxy.
+type Direct struct {
+	name    string
+	forward DialFunc
+}
+
+func (d *Direct) Name() string {
+	return d.name
+}
+
+func (d *Direct) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return d.forward(ctx, addr)
+}
+
+func (d *Direct) URL() *url.URL {
+	return nil
+}
+
+// targetAddr returns the address to hand to an upstream proxy. Fake IPs are
+// replaced by their domain so the proxy resolves it.
+func targetAddr(addr string) string {
+	if da, ok := dns.FakeAddrDomain(addr); ok {
+		return da
+	}
+	return addr
+}
+
+// tunnelConn is a connection to an upstream proxy carrying a tunnel to target.
+// RemoteAddr reports the target so that rules and statistics see the origin
+// rather than the proxy.
+type tunnelConn struct {
+	net.Conn
+	target net.Addr
+}
+
+func newTunnelConn(conn net.Conn, target string) *tunnelConn {
+	return &tunnelConn{Conn: conn, target: tunnelAddr(target)}
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.target
+}
+
+func (c *tunnelConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+func (c *tunnelConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// tunnelAddr returns a *net.TCPAddr for IP targets and a domain address otherwise.
+func tunnelAddr(target string) net.Addr {
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			p, _ := strconv.Atoi(port)
+			return &net.TCPAddr{IP: ip, Port: p}
+		}
+	}
+	return domainAddr(target)
+}
+
+type domainAddr string
+
+func (a domainAddr) Network() string { return "tcp" }
+func (a domainAddr) String() string  { return string(a) }
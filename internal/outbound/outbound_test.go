@@ -0,0 +1,231 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/rule"
+)
+
+func forward(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func pipe(a, b net.Conn) {
+	go func() { _, _ = io.Copy(a, b); _ = a.Close() }()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
+
+// startEchoServer echoes everything it receives.
+func startEchoServer(t *testing.T) string {
+	l := listen(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); _ = conn.Close() }()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startConnectProxy runs an HTTP CONNECT proxy requiring the given credentials.
+func startConnectProxy(t *testing.T, username, password string) string {
+	l := listen(t)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+		if user, pass, _ := r.BasicAuth(); user != username || pass != password {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		dest, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		src, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_ = dest.Close()
+			return
+		}
+		pipe(src, dest)
+	})}
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return l.Addr().String()
+}
+
+// startSocks5Proxy runs a SOCKS5 proxy without authentication.
+func startSocks5Proxy(t *testing.T) string {
+	l := listen(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+					return
+				}
+				req, err := socks.ReadRequest(conn)
+				if err != nil {
+					return
+				}
+				dest, err := net.Dial("tcp", req.Addr.String())
+				if err != nil {
+					_ = socks.NewReply(socks.HostUnreachable, nil).Write(conn)
+					return
+				}
+				if err := socks.NewReply(socks.Succeeded, nil).Write(conn); err != nil {
+					_ = dest.Close()
+					return
+				}
+				pipe(conn, dest)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestOutboundDial(t *testing.T) {
+	echo := startEchoServer(t)
+	httpProxy := startConnectProxy(t, "alice", "secret")
+	socksProxy := startSocks5Proxy(t)
+
+	m, err := New(&config.Config{
+		Outbounds: []config.Outbound{
+			{Name: "http", Type: config.OutboundTypeHTTP, Address: httpProxy, Username: "alice", Password: "secret"},
+			{Name: "http-bad-auth", Type: config.OutboundTypeHTTP, Address: httpProxy, Username: "alice", Password: "wrong"},
+			{Name: "socks5", Type: config.OutboundTypeSocks5, Address: socksProxy},
+		},
+	}, forward)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		outbound string
+		wantErr  bool
+	}{
+		{outbound: config.OutboundDirect},
+		{outbound: "http"},
+		{outbound: "http-bad-auth", wantErr: true},
+		{outbound: "socks5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outbound, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := m.outbounds[tt.outbound].DialContext(ctx, echo)
+			if tt.wantErr {
+				if err == nil {
+					_ = conn.Close()
+					t.Fatal("expected dial error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialContext: %v", err)
+			}
+			defer func() { _ = conn.Close() }()
+
+			if conn.RemoteAddr().String() != echo {
+				t.Errorf("RemoteAddr() = %s, want %s", conn.RemoteAddr(), echo)
+			}
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if string(buf) != "ping" {
+				t.Errorf("got %q, want %q", buf, "ping")
+			}
+		})
+	}
+}
+
+func TestManagerSelect(t *testing.T) {
+	cfg := &config.Config{
+		Outbounds: []config.Outbound{
+			{Name: "corp", Type: config.OutboundTypeHTTP, Address: "127.0.0.1:3128"},
+			{Name: "tor", Type: config.OutboundTypeSocks5, Address: "127.0.0.1:9050"},
+		},
+		DefaultOutbound: "corp",
+		HeaderRules: []config.Rule{
+			{Enabled: true, Type: "DEST-PORT", MatchValue: "22", Action: "PROXY", Outbound: "DIRECT", RewriteDirection: "REQUEST"},
+			{Enabled: true, Type: "SRC-IP", MatchValue: "10.0.0.2/32", Action: "PROXY", Outbound: "tor", RewriteDirection: "REQUEST"},
+			{Enabled: true, Type: "HEADER-KEYWORD", MatchHeader: "User-Agent", MatchValue: "curl", Action: "PROXY", Outbound: "tor", RewriteDirection: "REQUEST"},
+		},
+	}
+	engine, err := rule.NewEngine("", &cfg.HeaderRules, nil, common.ActionTargetHeader)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	m, err := New(cfg, forward)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	link := func(src string, port int) *common.Metadata {
+		return &common.Metadata{ConnLink: &common.ConnLink{
+			LAddr: src + ":40000",
+			RAddr: net.JoinHostPort("192.0.2.1", strconv.Itoa(port)),
+		}}
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://192.0.2.1/", nil)
+	req.RemoteAddr = "10.0.0.3:40000"
+	req.Header.Set("User-Agent", "curl/8.0")
+	request := &common.Metadata{Request: req}
+
+	tests := []struct {
+		name     string
+		metadata *common.Metadata
+		want     string
+	}{
+		{"rule to DIRECT", link("10.0.0.2", 22), config.OutboundDirect},
+		{"rule to tor", link("10.0.0.2", 443), "tor"},
+		{"default", link("10.0.0.3", 443), "corp"},
+		{"header rule skipped without request", link("10.0.0.3", 80), "corp"},
+		{"header rule with request", request, "tor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Select(engine.Rules, tt.metadata).Name(); got != tt.want {
+				t.Errorf("Select() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
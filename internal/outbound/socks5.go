@@ -0,0 +1,66 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// Socks5 tunnels connections through an upstream SOCKS5 proxy.
+type Socks5 struct {
+	name     string
+	address  string
+	username string
+	password string
+	dialer   proxy.ContextDialer
+}
+
+func NewSocks5(name, address, username, password string, forward DialFunc) *Socks5 {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	// proxy.SOCKS5 only fails for unsupported networks.
+	d, _ := proxy.SOCKS5("tcp", address, auth, forwardDialer(forward))
+	return &Socks5{
+		name:     name,
+		address:  address,
+		username: username,
+		password: password,
+		dialer:   d.(proxy.ContextDialer),
+	}
+}
+
+func (s *Socks5) Name() string {
+	return s.name
+}
+
+func (s *Socks5) URL() *url.URL {
+	u := &url.URL{Scheme: "socks5", Host: s.address}
+	if s.username != "" {
+		u.User = url.UserPassword(s.username, s.password)
+	}
+	return u
+}
+
+func (s *Socks5) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", targetAddr(addr))
+	if err != nil {
+		return nil, fmt.Errorf("outbound %s: %w", s.name, err)
+	}
+	return newTunnelConn(conn, addr), nil
+}
+
+// forwardDialer adapts a DialFunc to proxy.Dialer and proxy.ContextDialer.
+type forwardDialer DialFunc
+
+func (f forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), addr)
+}
+
+func (f forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, addr)
+}
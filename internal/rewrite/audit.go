@@ -0,0 +1,76 @@
+package rewrite
+
+import (
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/log"
+	"github.com/sunbk201/ua3f/internal/rule"
+)
+
+// auditor records a rule decision, and whether the rules after it are still
+// matched.
+type auditor func(entry *log.AuditEntry, contine bool)
+
+// auditLog records decisions to the audit log.
+func auditLog(entry *log.AuditEntry, _ bool) {
+	log.Audit(entry)
+}
+
+// nextRule returns the next rule of e matching metadata after index. When
+// audited, a request or response matching no rule of e is recorded.
+func nextRule(e *rule.Engine, metadata *common.Metadata, index int, direction common.Direction, audit auditor) (common.Rule, int) {
+	matched, i := e.MatchWithRuleIndex(metadata, index+1, direction)
+	if matched == nil && index < 0 && audit != nil && e.RulesCount() > 0 {
+		entry := newAuditEntry(e, metadata, direction)
+		entry.RuleIndex, entry.Action = -1, string(common.ActionDirect)
+		audit(entry, false)
+	}
+	return matched, i
+}
+
+// execute runs the action of the rule of e matched at index. When audited,
+// the decision is recorded with the header value before and after a header
+// action.
+func execute(e *rule.Engine, metadata *common.Metadata, matched common.Rule, index int, direction common.Direction, audit auditor) (bool, error) {
+	act := matched.Action()
+	if audit == nil {
+		return act.Execute(metadata)
+	}
+
+	entry := newAuditEntry(e, metadata, direction)
+	entry.RuleIndex, entry.RuleType, entry.Action = index, string(matched.Type()), string(act.Type())
+	ha, isHeader := act.(common.HeaderAction)
+	if isHeader {
+		entry.Header = ha.Header()
+		entry.Before = headerValue(metadata, direction, entry.Header)
+	}
+	contine, err := act.Execute(metadata)
+	if isHeader {
+		entry.After = headerValue(metadata, direction, entry.Header)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	audit(entry, contine)
+	return contine, err
+}
+
+func newAuditEntry(e *rule.Engine, metadata *common.Metadata, direction common.Direction) *log.AuditEntry {
+	return &log.AuditEntry{
+		Src:       metadata.SrcAddr(),
+		Dst:       metadata.DestAddr(),
+		Host:      metadata.Host(),
+		URL:       metadata.URL(),
+		List:      e.List(),
+		Direction: string(direction),
+	}
+}
+
+func headerValue(metadata *common.Metadata, direction common.Direction, header string) string {
+	switch {
+	case direction == common.DirectionRequest && metadata.Request != nil:
+		return metadata.Request.Header.Get(header)
+	case direction == common.DirectionResponse && metadata.Response != nil:
+		return metadata.Response.Header.Get(header)
+	}
+	return ""
+}
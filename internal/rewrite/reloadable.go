@@ -0,0 +1,58 @@
+package rewrite
+
+import (
+	"sync/atomic"
+
+	"github.com/sunbk201/ua3f/internal/common"
+)
+
+// Reloadable is a Rewriter whose implementation can be replaced while servers
+// are running. Every call goes to the Rewriter stored at the time of the call,
+// so live connections pick up new rules with their next request.
+type Reloadable struct {
+	current atomic.Pointer[common.Rewriter]
+}
+
+func NewReloadable(rw common.Rewriter) *Reloadable {
+	r := &Reloadable{}
+	r.Store(rw)
+	return r
+}
+
+// Store replaces the current Rewriter.
+func (r *Reloadable) Store(rw common.Rewriter) {
+	r.current.Store(&rw)
+}
+
+// Load returns the current Rewriter.
+func (r *Reloadable) Load() common.Rewriter {
+	return *r.current.Load()
+}
+
+func (r *Reloadable) RewriteRequest(metadata *common.Metadata) *common.RewriteDecision {
+	return r.Load().RewriteRequest(metadata)
+}
+
+func (r *Reloadable) RewriteResponse(metadata *common.Metadata) *common.RewriteDecision {
+	return r.Load().RewriteResponse(metadata)
+}
+
+func (r *Reloadable) ServeRequest() bool {
+	return r.Load().ServeRequest()
+}
+
+func (r *Reloadable) ServeResponse() bool {
+	return r.Load().ServeResponse()
+}
+
+func (r *Reloadable) HeaderRules() []common.Rule {
+	return r.Load().HeaderRules()
+}
+
+func (r *Reloadable) BodyRules() []common.Rule {
+	return r.Load().BodyRules()
+}
+
+func (r *Reloadable) RedirectRules() []common.Rule {
+	return r.Load().RedirectRules()
+}
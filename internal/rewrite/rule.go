@@ -17,11 +17,14 @@ type RuleRewriter struct {
 	BodyRuleEngine    *rule.Engine
 	URLRedirectEngine *rule.Engine
 	Recorder          *statistics.Recorder
+
+	trace auditor // records every decision instead of the audit log
 }
 
 func (r *RuleRewriter) RewriteRequest(metadata *common.Metadata) (decision *common.RewriteDecision) {
 	ua := metadata.UserAgent()
 	log.LogInfoWithAddr(metadata.SrcAddr(), metadata.DestAddr(), fmt.Sprintf("Original User-Agent: (%s)", ua))
+	audit := r.auditor()
 
 	var matchedRule common.Rule
 
@@ -31,12 +34,12 @@ func (r *RuleRewriter) RewriteRequest(metadata *common.Metadata) (decision *comm
 	matchedRule = nil
 	index := -1
 	for {
-		matchedRule, index = r.BodyRuleEngine.MatchWithRuleIndex(metadata, index+1, common.DirectionRequest)
+		matchedRule, index = nextRule(r.BodyRuleEngine, metadata, index, common.DirectionRequest, audit)
 		if matchedRule == nil {
 			break
 		}
 		decision.Action = matchedRule.Action()
-		contine, err := decision.Action.Execute(metadata)
+		contine, err := execute(r.BodyRuleEngine, metadata, matchedRule, index, common.DirectionRequest, audit)
 		if err != nil {
 			log.LogErrorWithAddr(metadata.SrcAddr(), metadata.DestAddr(), fmt.Sprintf("decision.Action.Execute: %s", err.Error()))
 		}
@@ -54,14 +57,14 @@ func (r *RuleRewriter) RewriteRequest(metadata *common.Metadata) (decision *comm
 	matchedRule = nil
 	index = -1
 	for {
-		matchedRule, index = r.HeaderRuleEngine.MatchWithRuleIndex(metadata, index+1, common.DirectionRequest)
+		matchedRule, index = nextRule(r.HeaderRuleEngine, metadata, index, common.DirectionRequest, audit)
 		if matchedRule == nil {
 			_, _ = decision.Action.Execute(metadata)
 			return
 		}
 		decision.MatchedRule = matchedRule
 		decision.Action = matchedRule.Action()
-		contine, err := decision.Action.Execute(metadata)
+		contine, err := execute(r.HeaderRuleEngine, metadata, matchedRule, index, common.DirectionRequest, audit)
 		if err != nil {
 			log.LogErrorWithAddr(metadata.SrcAddr(), metadata.DestAddr(), fmt.Sprintf("decision.Action.Execute: %s", err.Error()))
 			return
@@ -81,13 +84,13 @@ func (r *RuleRewriter) RewriteRequest(metadata *common.Metadata) (decision *comm
 	matchedRule = nil
 	index = -1
 	for {
-		matchedRule, index = r.URLRedirectEngine.MatchWithRuleIndex(metadata, index+1, common.DirectionRequest)
+		matchedRule, index = nextRule(r.URLRedirectEngine, metadata, index, common.DirectionRequest, audit)
 		if matchedRule == nil {
 			return
 		}
 		decision.MatchedRule = matchedRule
 		decision.Action = matchedRule.Action()
-		contine, err := decision.Action.Execute(metadata)
+		contine, err := execute(r.URLRedirectEngine, metadata, matchedRule, index, common.DirectionRequest, audit)
 		if err != nil {
 			log.LogErrorWithAddr(metadata.SrcAddr(), metadata.DestAddr(), fmt.Sprintf("decision.Action.Execute: %s", err.Error()))
 			return
@@ -103,6 +106,7 @@ func (r *RuleRewriter) RewriteRequest(metadata *common.Metadata) (decision *comm
 
 func (r *RuleRewriter) RewriteResponse(metadata *common.Metadata) (decision *common.RewriteDecision) {
 	var matchedRule common.Rule
+	audit := r.auditor()
 
 	decision = &common.RewriteDecision{
 		Action: action.DirectAction,
@@ -110,12 +114,12 @@ func (r *RuleRewriter) RewriteResponse(metadata *common.Metadata) (decision *com
 	matchedRule = nil
 	index := -1
 	for {
-		matchedRule, index = r.BodyRuleEngine.MatchWithRuleIndex(metadata, index+1, common.DirectionResponse)
+		matchedRule, index = nextRule(r.BodyRuleEngine, metadata, index, common.DirectionResponse, audit)
 		if matchedRule == nil {
 			break
 		}
 		decision.Action = matchedRule.Action()
-		contine, err := decision.Action.Execute(metadata)
+		contine, err := execute(r.BodyRuleEngine, metadata, matchedRule, index, common.DirectionResponse, audit)
 		if err != nil {
 			log.LogErrorWithAddr(metadata.SrcAddr(), metadata.DestAddr(), fmt.Sprintf("decision.Action.Execute: %s", err.Error()))
 		}
@@ -133,14 +137,14 @@ func (r *RuleRewriter) RewriteResponse(metadata *common.Metadata) (decision *com
 	matchedRule = nil
 	index = -1
 	for {
-		matchedRule, index = r.HeaderRuleEngine.MatchWithRuleIndex(metadata, index+1, common.DirectionResponse)
+		matchedRule, index = nextRule(r.HeaderRuleEngine, metadata, index, common.DirectionResponse, audit)
 		if matchedRule == nil {
 			_, _ = decision.Action.Execute(metadata)
 			return
 		}
 		decision.MatchedRule = matchedRule
 		decision.Action = matchedRule.Action()
-		contine, err := decision.Action.Execute(metadata)
+		contine, err := execute(r.HeaderRuleEngine, metadata, matchedRule, index, common.DirectionResponse, audit)
 		if err != nil {
 			log.LogErrorWithAddr(metadata.SrcAddr(), metadata.DestAddr(), fmt.Sprintf("decision.Action.Execute: %s", err.Error()))
 			return
@@ -153,6 +157,18 @@ func (r *RuleRewriter) RewriteResponse(metadata *common.Metadata) (decision *com
 	return
 }
 
+// auditor returns the auditor of a request or response, or nil when it is
+// neither traced nor sampled for the audit log.
+func (r *RuleRewriter) auditor() auditor {
+	if r.trace != nil {
+		return r.trace
+	}
+	if log.SampleAudit() {
+		return auditLog
+	}
+	return nil
+}
+
 func (r *RuleRewriter) ServeRequest() bool {
 	return r.HeaderRuleEngine.ServeRequest || r.BodyRuleEngine.ServeRequest
 }
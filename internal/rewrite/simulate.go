@@ -0,0 +1,296 @@
+package rewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/log"
+	"github.com/sunbk201/ua3f/internal/rule"
+	"github.com/sunbk201/ua3f/internal/rule/action"
+	"github.com/sunbk201/ua3f/internal/rule/match"
+	"github.com/sunbk201/ua3f/internal/sniff"
+)
+
+// SimulatedRequest is a synthetic request, and optionally its response, to
+// run through the rewriter.
+type SimulatedRequest struct {
+	Method   string             `json:"method,omitempty"` // GET when empty
+	URL      string             `json:"url"`
+	Headers  map[string]string  `json:"headers,omitempty"`
+	Body     string             `json:"body,omitempty"`
+	Src      string             `json:"src,omitempty"`  // client address, for SRC-IP rules
+	Dst      string             `json:"dst,omitempty"`  // server address, the URL host when empty
+	User     string             `json:"user,omitempty"` // authenticated username, for USER rules
+	Response *SimulatedResponse `json:"response,omitempty"`
+}
+
+// SimulatedResponse is a synthetic response to a SimulatedRequest.
+type SimulatedResponse struct {
+	Status  int               `json:"status,omitempty"` // 200 when zero
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// Step is a rule decision of a simulation. RuleIndex is the index of the
+// rule among the enabled rules of the list, or -1 when no rule matched.
+type Step struct {
+	List      string      `json:"list"`
+	Direction string      `json:"direction"`
+	RuleIndex int         `json:"rule_index"`
+	Rule      common.Rule `json:"rule,omitempty"`
+	Action    string      `json:"action"`
+	Header    string      `json:"header,omitempty"`
+	Before    string      `json:"before,omitempty"`
+	After     string      `json:"after,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Continue  bool        `json:"continue"`
+}
+
+// Simulation is the outcome of a SimulatedRequest: the rule decisions in the
+// order they were taken, and the request and response as they would be
+// forwarded.
+type Simulation struct {
+	RewriteMode config.RewriteMode `json:"rewrite_mode"`
+	Steps       []Step             `json:"steps"`
+	// Verdict is FORWARD, or the action stopping the request: REJECT, DROP
+	// or a redirect.
+	Verdict  string             `json:"verdict"`
+	Redirect string             `json:"redirect,omitempty"` // written back to the client by a redirect
+	Request  SimulatedRequest   `json:"request"`
+	Response *SimulatedResponse `json:"response,omitempty"`
+	Warnings []string           `json:"warnings,omitempty"`
+}
+
+// VerdictForward is the verdict of a request forwarded to the server.
+const VerdictForward = "FORWARD"
+
+// Simulate runs req through rw, and its response when req has one and a rule
+// serves responses. rw may be the rewriter of running servers: it is left
+// unchanged, no connection is opened, and statistics, metrics and the audit
+// log are left untouched. Domain sets are not waited for; those not loaded
+// yet match nothing and are listed in the warnings.
+func Simulate(rw common.Rewriter, req *SimulatedRequest) (*Simulation, error) {
+	if r, ok := rw.(*Reloadable); ok {
+		rw = r.Load()
+	}
+	sim := &Simulation{Steps: []Step{}, Verdict: VerdictForward}
+	switch r := rw.(type) {
+	case *DirectRewriter:
+		sim.RewriteMode = config.RewriteModeDirect
+	case *GlobalRewriter:
+		sim.RewriteMode = config.RewriteModeGlobal
+	case *RuleRewriter:
+		sim.RewriteMode = config.RewriteModeRule
+		rr := &RuleRewriter{
+			HeaderRuleEngine:  r.HeaderRuleEngine.WithoutMetrics(),
+			BodyRuleEngine:    r.BodyRuleEngine.WithoutMetrics(),
+			URLRedirectEngine: r.URLRedirectEngine.WithoutMetrics(),
+			Recorder:          r.Recorder,
+		}
+		rr.trace = func(e *log.AuditEntry, contine bool) {
+			step := Step{
+				List: e.List, Direction: e.Direction, RuleIndex: e.RuleIndex, Action: e.Action,
+				Header: e.Header, Before: e.Before, After: e.After, Error: e.Error, Continue: contine,
+			}
+			if e.RuleIndex >= 0 {
+				step.Rule = rr.engine(e.List).Rules[e.RuleIndex]
+			}
+			sim.Steps = append(sim.Steps, step)
+		}
+		for _, ds := range domainSets(rr) {
+			if err := ds.Err(); err != nil {
+				sim.Warnings = append(sim.Warnings, fmt.Sprintf("domain set not loaded, it matches nothing: %v", err))
+			}
+		}
+		rw = rr
+	case *PacketRewriter:
+		return nil, errors.New("NFQUEUE mode rewrites packets, rewrite rules do not apply")
+	default:
+		return nil, errors.New("no rewriter is running")
+	}
+
+	metadata, client, err := newSimulatedMetadata(req)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := rw.RewriteRequest(metadata)
+	switch {
+	case decision.Redirect || client.written.Len() > 0:
+		sim.Verdict = string(decision.Action.Type())
+		sim.Redirect = client.written.String()
+	case decision.Action == action.DropRequestAction || decision.Action == action.RejectRequestAction:
+		sim.Verdict = string(decision.Action.Type())
+	}
+	sim.Request = simulatedRequest(metadata)
+
+	if req.Response == nil || sim.Verdict != VerdictForward {
+		return sim, nil
+	}
+	metadata.UpdateResponse(newSimulatedResponse(req.Response, metadata.Request))
+	if rw.ServeResponse() {
+		decision = rw.RewriteResponse(metadata)
+		if decision.Action == action.DropResponseAction || decision.Action == action.RejectResponseAction {
+			sim.Verdict = string(decision.Action.Type())
+		}
+	}
+	sim.Response = simulatedResponse(metadata)
+	return sim, nil
+}
+
+// WaitDomainSets waits for the domain sets of the rules of rw to end
+// loading, successfully or not.
+func WaitDomainSets(ctx context.Context, rw common.Rewriter) error {
+	for _, ds := range domainSets(rw) {
+		_ = ds.Wait(ctx)
+	}
+	return ctx.Err()
+}
+
+// domainSets returns the domain sets among the rules of rw.
+func domainSets(rw common.Rewriter) []*match.DomainSet {
+	var sets []*match.DomainSet
+	for _, rules := range [][]common.Rule{rw.HeaderRules(), rw.BodyRules(), rw.RedirectRules()} {
+		for _, r := range rules {
+			if ds, ok := r.(*match.DomainSet); ok {
+				sets = append(sets, ds)
+			}
+		}
+	}
+	return sets
+}
+
+// engine returns the rule engine of the rule list named list.
+func (r *RuleRewriter) engine(list string) *rule.Engine {
+	switch list {
+	case r.BodyRuleEngine.List():
+		return r.BodyRuleEngine
+	case r.URLRedirectEngine.List():
+		return r.URLRedirectEngine
+	}
+	return r.HeaderRuleEngine
+}
+
+// clientConn stands for the client connection of a simulation, keeping what
+// redirect actions write back.
+type clientConn struct {
+	net.Conn // nil, only Write is used
+	written  bytes.Buffer
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func newSimulatedMetadata(req *SimulatedRequest) (*common.Metadata, *clientConn, error) {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequest(strings.ToUpper(method), req.URL, strings.NewReader(req.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.URL.Host == "" {
+		return nil, nil, fmt.Errorf("url %q has no host", req.URL)
+	}
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, "Host") {
+			r.Host = v
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	if req.Body == "" {
+		r.Body = http.NoBody
+	}
+
+	dst := req.Dst
+	if dst == "" {
+		dst = r.URL.Host
+		if r.URL.Port() == "" {
+			port := "80"
+			if r.URL.Scheme == "https" {
+				port = "443"
+			}
+			dst = net.JoinHostPort(r.URL.Hostname(), port)
+		}
+	}
+	client := &clientConn{}
+	link := &common.ConnLink{
+		LConn:    client,
+		LAddr:    req.Src,
+		RAddr:    dst,
+		User:     req.User,
+		Protocol: sniff.HTTP,
+	}
+	if r.URL.Scheme == "https" {
+		link.Protocol = sniff.HTTPS
+	}
+	metadata := &common.Metadata{ConnLink: link, Request: r, Simulated: true}
+	link.Metadata = metadata
+	return metadata, client, nil
+}
+
+func newSimulatedResponse(resp *SimulatedResponse, req *http.Request) *http.Response {
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	r := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       req,
+	}
+	for k, v := range resp.Headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func simulatedRequest(metadata *common.Metadata) SimulatedRequest {
+	r := metadata.Request
+	return SimulatedRequest{
+		Method:  r.Method,
+		URL:     metadata.URL(),
+		Headers: flattenHeader(r.Header),
+		Body:    string(metadata.RequestBody(false)),
+		Src:     metadata.SrcAddr(),
+		Dst:     metadata.ConnLink.RAddr,
+		User:    metadata.User(),
+	}
+}
+
+func simulatedResponse(metadata *common.Metadata) *SimulatedResponse {
+	return &SimulatedResponse{
+		Status:  metadata.Response.StatusCode,
+		Headers: flattenHeader(metadata.Response.Header),
+		Body:    string(metadata.ResponseBody(false)),
+	}
+}
+
+func flattenHeader(h http.Header) map[string]string {
+	headers := make(map[string]string, len(h))
+	for k, v := range h {
+		headers[k] = strings.Join(v, ", ")
+	}
+	return headers
+}
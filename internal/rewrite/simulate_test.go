@@ -0,0 +1,107 @@
+package rewrite
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
+	"github.com/sunbk201/ua3f/internal/rule/match"
+	"github.com/sunbk201/ua3f/internal/statistics"
+)
+
+func TestSimulate(t *testing.T) {
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeSocks5,
+		RewriteMode: config.RewriteModeRule,
+		HeaderRules: []config.Rule{
+			{Enabled: true, Type: "DOMAIN-SUFFIX", MatchValue: "example.com", Action: "REPLACE", RewriteHeader: "User-Agent", RewriteValue: "FFF", Continue: true},
+			{Enabled: true, Type: "HEADER-KEYWORD", MatchHeader: "User-Agent", MatchValue: "FFF", Action: "ADD", RewriteHeader: "X-Rewritten", RewriteValue: "1"},
+			{Enabled: true, Type: "FINAL", Action: "DIRECT"},
+		},
+		URLRedirectRules: []config.Rule{
+			{Enabled: true, Type: "URL-REGEX", MatchValue: `^http://old\.example\.org`, Action: "REDIRECT-302", RewriteRegex: `old\.`, RewriteValue: "new."},
+		},
+	}
+	rw, err := NewRuleRewriter(cfg, statistics.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulations run on the rewriter of running servers, which they must
+	// leave as it is and whose statistics and metrics they must not count.
+	running := NewReloadable(rw)
+	rewrites := metrics.Rewrites.With().Load()
+	matches := metrics.RuleMatches.With("header", "0", "DOMAIN-SUFFIX", "REPLACE").Load()
+
+	sim, err := Simulate(running, &SimulatedRequest{
+		URL:      "https://www.example.com/",
+		Headers:  map[string]string{"User-Agent": "curl/8.0"},
+		Response: &SimulatedResponse{Body: "ok"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sim.Steps) < 2 || sim.Steps[0].RuleIndex != 0 || !sim.Steps[0].Continue || sim.Steps[0].Before != "curl/8.0" ||
+		sim.Steps[1].RuleIndex != 1 || sim.Steps[1].Continue {
+		t.Errorf("steps = %+v, want rule 0 continuing to rule 1", sim.Steps)
+	}
+	if sim.Verdict != VerdictForward || sim.Request.Headers["User-Agent"] != "FFF" || sim.Request.Headers["X-Rewritten"] != "1" {
+		t.Errorf("simulation = %+v, want the request forwarded with both rewrites", sim)
+	}
+
+	if rw.trace != nil {
+		t.Error("Simulate left a trace on the rewriter")
+	}
+	if got := metrics.Rewrites.With().Load(); got != rewrites {
+		t.Errorf("rewrites metric = %d after a simulation, want %d", got, rewrites)
+	}
+	if got := metrics.RuleMatches.With("header", "0", "DOMAIN-SUFFIX", "REPLACE").Load(); got != matches {
+		t.Errorf("rule matches metric = %d after a simulation, want %d", got, matches)
+	}
+
+	sim, err = Simulate(running, &SimulatedRequest{URL: "http://old.example.org/path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.Verdict != "REDIRECT-302" || !strings.Contains(sim.Redirect, "Location: http://new.example.org/path") {
+		t.Errorf("simulation = %+v, want a redirect to new.example.org", sim)
+	}
+}
+
+func TestSimulateRemoteDomainSet(t *testing.T) {
+	match.SkipRemote = true
+	t.Cleanup(func() { match.SkipRemote = false })
+
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeSocks5,
+		RewriteMode: config.RewriteModeRule,
+		HeaderRules: []config.Rule{
+			{Enabled: true, Type: "DOMAIN-SET", MatchValue: "https://127.0.0.1:1/domains.txt", Action: "REPLACE", RewriteHeader: "User-Agent", RewriteValue: "FFF"},
+			{Enabled: true, Type: "FINAL", Action: "DIRECT"},
+		},
+	}
+	rw, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := Simulate(rw, &SimulatedRequest{URL: "https://www.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.Verdict != VerdictForward || len(sim.Warnings) != 1 || !strings.Contains(sim.Warnings[0], match.ErrRemoteSkipped.Error()) {
+		t.Errorf("simulation = %+v, want the request forwarded with the domain set reported unloaded", sim)
+	}
+}
+
+func TestSimulateNFQueue(t *testing.T) {
+	rw, err := New(&config.Config{ServerMode: config.ServerModeNFQueue, RewriteMode: config.RewriteModeGlobal}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Simulate(rw, &SimulatedRequest{URL: "https://www.example.com/"}); err == nil {
+		t.Error("Simulate on a packet rewriter succeeded, want an error")
+	}
+	if _, err := Simulate(nil, &SimulatedRequest{URL: "https://www.example.com/"}); err == nil {
+		t.Error("Simulate without a rewriter succeeded, want an error")
+	}
+}
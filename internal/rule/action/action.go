@@ -51,6 +51,8 @@ func NewHeaderAction(rule *config.Rule, recorder *statistics.Recorder) common.Ac
 		default:
 			return nil
 		}
+	case common.ActionProxy:
+		return NewProxy(rule.Outbound)
 	case common.ActionDelete:
 		return header.NewDelete(recorder, rule.RewriteHeader, rule.Continue, direction)
 	case common.ActionAdd:
@@ -58,7 +60,10 @@ func NewHeaderAction(rule *config.Rule, recorder *statistics.Recorder) common.Ac
 	case common.ActionReplace:
 		return header.NewReplace(recorder, rule.RewriteHeader, rule.RewriteValue, rule.Continue, direction)
 	case common.ActionReplaceRegex:
-		return header.NewReplaceRegex(recorder, rule.RewriteHeader, rule.RewriteRegex, rule.RewriteValue, rule.Continue, direction)
+		if a := header.NewReplaceRegex(recorder, rule.RewriteHeader, rule.RewriteRegex, rule.RewriteValue, rule.Continue, direction); a != nil {
+			return a
+		}
+		return nil
 	default:
 		return nil
 	}
@@ -95,7 +100,10 @@ func NewBodyAction(rule *config.Rule, recorder *statistics.Recorder) common.Acti
 			return nil
 		}
 	case common.ActionReplaceRegex:
-		return body.NewReplaceRegex(recorder, rule.RewriteRegex, rule.RewriteValue, rule.Continue, direction)
+		if a := body.NewReplaceRegex(recorder, rule.RewriteRegex, rule.RewriteValue, rule.Continue, direction); a != nil {
+			return a
+		}
+		return nil
 	default:
 		return nil
 	}
@@ -107,11 +115,20 @@ func NewURLAction(rule *config.Rule, recorder *statistics.Recorder) common.Actio
 		DirectAction.SetRecorder(recorder)
 		return DirectAction
 	case common.ActionRedirect302:
-		return redirect.NewRedirect302(rule.RewriteRegex, rule.RewriteValue)
+		if a := redirect.NewRedirect302(rule.RewriteRegex, rule.RewriteValue); a != nil {
+			return a
+		}
+		return nil
 	case common.ActionRedirect307:
-		return redirect.NewRedirect307(rule.RewriteRegex, rule.RewriteValue)
+		if a := redirect.NewRedirect307(rule.RewriteRegex, rule.RewriteValue); a != nil {
+			return a
+		}
+		return nil
 	case common.ActionRedirectHeader:
-		return redirect.NewRedirectHeader(rule.RewriteRegex, rule.RewriteValue)
+		if a := redirect.NewRedirectHeader(rule.RewriteRegex, rule.RewriteValue); a != nil {
+			return a
+		}
+		return nil
 	default:
 		return nil
 	}
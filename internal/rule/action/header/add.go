@@ -39,7 +39,7 @@ func (a *Add) Execute(metadata *common.Metadata) (bool, error) {
 		return a.contine, fmt.Errorf("unknown direction %s", a.direction)
 	}
 
-	if a.recorder != nil {
+	if a.recorder != nil && !metadata.Simulated {
 		a.recorder.AddRecord(&statistics.RewriteRecord{
 			Host:       metadata.DestAddr(),
 			OriginalUA: "",
@@ -51,6 +51,10 @@ func (a *Add) Execute(metadata *common.Metadata) (bool, error) {
 	return a.contine, nil
 }
 
+func (a *Add) Header() string {
+	return a.header
+}
+
 func (a *Add) Direction() common.Direction {
 	return a.direction
 }
@@ -45,7 +45,7 @@ func (d *Delete) Execute(metadata *common.Metadata) (bool, error) {
 		return d.contine, nil
 	}
 
-	if d.recorder != nil {
+	if d.recorder != nil && !metadata.Simulated {
 		d.recorder.AddRecord(&statistics.RewriteRecord{
 			Host:       metadata.DestAddr(),
 			OriginalUA: header,
@@ -57,6 +57,10 @@ func (d *Delete) Execute(metadata *common.Metadata) (bool, error) {
 	return d.contine, nil
 }
 
+func (d *Delete) Header() string {
+	return d.header
+}
+
 func (d *Delete) Direction() common.Direction {
 	return d.direction
 }
@@ -46,7 +46,7 @@ func (r *Replace) Execute(metadata *common.Metadata) (bool, error) {
 		return r.contine, nil
 	}
 
-	if r.recorder != nil {
+	if r.recorder != nil && !metadata.Simulated {
 		r.recorder.AddRecord(&statistics.RewriteRecord{
 			Host:       metadata.DestAddr(),
 			OriginalUA: header,
@@ -58,6 +58,10 @@ func (r *Replace) Execute(metadata *common.Metadata) (bool, error) {
 	return r.contine, nil
 }
 
+func (r *Replace) Header() string {
+	return r.header
+}
+
 func (r *Replace) Direction() common.Direction {
 	return r.direction
 }
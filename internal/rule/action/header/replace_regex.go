@@ -65,7 +65,7 @@ func (r *ReplaceRegex) Execute(metadata *common.Metadata) (bool, error) {
 		metadata.Response.Header.Set(r.replaceHeader, replaceValue)
 	}
 
-	if r.recorder != nil {
+	if r.recorder != nil && !metadata.Simulated {
 		r.recorder.AddRecord(&statistics.RewriteRecord{
 			Host:       metadata.DestAddr(),
 			OriginalUA: header,
@@ -77,6 +77,10 @@ func (r *ReplaceRegex) Execute(metadata *common.Metadata) (bool, error) {
 	return r.contine, nil
 }
 
+func (r *ReplaceRegex) Header() string {
+	return r.replaceHeader
+}
+
 func (r *ReplaceRegex) Direction() common.Direction {
 	return r.direction
 }
@@ -0,0 +1,51 @@
+package action
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/sunbk201/ua3f/internal/common"
+)
+
+// Proxy routes matching connections through a named outbound. The outbound is
+// chosen when the connection is dialed, so Execute only lets later rules run.
+type Proxy struct {
+	outbound string
+}
+
+func (p *Proxy) Type() common.ActionType {
+	return common.ActionProxy
+}
+
+func (p *Proxy) Execute(metadata *common.Metadata) (bool, error) {
+	return true, nil
+}
+
+func (p *Proxy) Direction() common.Direction {
+	return common.DirectionRequest
+}
+
+// Outbound returns the name of the outbound to dial through.
+func (p *Proxy) Outbound() string {
+	return p.outbound
+}
+
+func (p *Proxy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"type":     p.Type(),
+		"outbound": p.outbound,
+	})
+}
+
+func (p *Proxy) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("type", string(p.Type())),
+		slog.String("outbound", p.outbound),
+	)
+}
+
+func NewProxy(outbound string) *Proxy {
+	return &Proxy{
+		outbound: outbound,
+	}
+}
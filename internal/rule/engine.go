@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
 	"github.com/sunbk201/ua3f/internal/rule/action"
 	"github.com/sunbk201/ua3f/internal/rule/match"
 	"github.com/sunbk201/ua3f/internal/statistics"
@@ -17,6 +20,21 @@ type Engine struct {
 	Rules         []common.Rule
 	ServeRequest  bool
 	ServeResponse bool
+
+	list        string // rule list name reported in metrics
+	skipMetrics bool
+}
+
+// ruleOrNil returns the rule a match constructor built, or a nil Rule
+// rather than a nil pointer when it failed.
+func ruleOrNil[R any, P interface {
+	*R
+	common.Rule
+}](p P) common.Rule {
+	if p == nil {
+		return nil
+	}
+	return p
 }
 
 func NewEngine(rulesJSON string, ruleSet *[]config.Rule, recorder *statistics.Recorder, target common.ActionTarget) (*Engine, error) {
@@ -27,12 +45,11 @@ func NewEngine(rulesJSON string, ruleSet *[]config.Rule, recorder *statistics.Re
 
 	if ruleSet != nil && len(*ruleSet) > 0 {
 		for i := range *ruleSet {
-			(*ruleSet)[i].Enabled = true
 			rulesCfg = append(rulesCfg, &(*ruleSet)[i])
 		}
 	} else {
 		if rulesJSON == "" {
-			return &Engine{Rules: []common.Rule{}}, nil
+			return &Engine{Rules: []common.Rule{}, list: ruleListName(target)}, nil
 		}
 		if err := json.Unmarshal([]byte(rulesJSON), &rulesCfg); err != nil {
 			return nil, fmt.Errorf("failed to parse rules JSON: %w", err)
@@ -56,27 +73,29 @@ func NewEngine(rulesJSON string, ruleSet *[]config.Rule, recorder *statistics.Re
 
 		switch common.RuleType(rule.Type) {
 		case common.RuleTypeHeaderKeyword:
-			r = match.NewHeaderKeyword(rule, recorder, target)
+			r = ruleOrNil(match.NewHeaderKeyword(rule, recorder, target))
 		case common.RuleTypeHeaderRegex:
-			r = match.NewHeaderRegex(rule, recorder, target)
+			r = ruleOrNil(match.NewHeaderRegex(rule, recorder, target))
 		case common.RuleTypeIPCIDR:
-			r = match.NewIPCIDR(rule, recorder, target)
+			r = ruleOrNil(match.NewIPCIDR(rule, recorder, target))
 		case common.RuleTypeSrcIP:
-			r = match.NewSrcIP(rule, recorder, target)
+			r = ruleOrNil(match.NewSrcIP(rule, recorder, target))
 		case common.RuleTypeDestPort:
-			r = match.NewDestPort(rule, recorder, target)
+			r = ruleOrNil(match.NewDestPort(rule, recorder, target))
 		case common.RuleTypeDomain:
-			r = match.NewDomain(rule, recorder, target)
+			r = ruleOrNil(match.NewDomain(rule, recorder, target))
 		case common.RuleTypeDomainKeyword:
-			r = match.NewDomainKeyword(rule, recorder, target)
+			r = ruleOrNil(match.NewDomainKeyword(rule, recorder, target))
 		case common.RuleTypeDomainSuffix:
-			r = match.NewDomainSuffix(rule, recorder, target)
+			r = ruleOrNil(match.NewDomainSuffix(rule, recorder, target))
 		case common.RuleTypeDomainSet:
-			r = match.NewDomainSet(rule, recorder, target)
+			r = ruleOrNil(match.NewDomainSet(rule, recorder, target))
 		case common.RuleTypeURLRegex:
-			r = match.NewURLRegex(rule, recorder, target)
+			r = ruleOrNil(match.NewURLRegex(rule, recorder, target))
+		case common.RuleTypeUser:
+			r = ruleOrNil(match.NewUser(rule, recorder, target))
 		case common.RuleTypeFinal:
-			r = match.NewFinal(rule, recorder, target)
+			r = ruleOrNil(match.NewFinal(rule, recorder, target))
 		default:
 			slog.Warn("Unsupported rule type", slog.String("type", rule.Type))
 			continue
@@ -96,7 +115,20 @@ func NewEngine(rulesJSON string, ruleSet *[]config.Rule, recorder *statistics.Re
 		}
 	}
 
-	return &Engine{Rules: rules, ServeRequest: serveRequest, ServeResponse: serveResponse}, nil
+	return &Engine{Rules: rules, ServeRequest: serveRequest, ServeResponse: serveResponse, list: ruleListName(target)}, nil
+}
+
+// ruleListName returns the name the rule lists of target have in the config API.
+func ruleListName(target common.ActionTarget) string {
+	switch target {
+	case common.ActionTargetHeader:
+		return string(config.RuleListHeader)
+	case common.ActionTargetBody:
+		return string(config.RuleListBody)
+	case common.ActionTargetURL:
+		return string(config.RuleListRedirect)
+	}
+	return strings.ToLower(string(target))
 }
 
 func (e *Engine) MatchWithRuleIndex(metadata *common.Metadata, startIndex int, direction common.Direction) (common.Rule, int) {
@@ -110,7 +142,10 @@ func (e *Engine) MatchWithRuleIndex(metadata *common.Metadata, startIndex int, d
 		}
 		matched := rule.Match(metadata)
 		if matched {
-			slog.Info("Rule matched", slog.Any("rule", rule), slog.Any("metadata", metadata))
+			slog.Debug("Rule matched", slog.Any("rule", rule), slog.Any("metadata", metadata))
+			if !e.skipMetrics {
+				metrics.RuleMatches.Inc(e.list, strconv.Itoa(i), string(rule.Type()), string(rule.Action().Type()))
+			}
 			return rule, i
 		}
 	}
@@ -118,6 +153,64 @@ func (e *Engine) MatchWithRuleIndex(metadata *common.Metadata, startIndex int, d
 	return nil, -1
 }
 
+// MatchOutbound returns the outbound named by the first matching PROXY rule, or
+// "" when none matches. Header and URL rules only apply when metadata carries
+// an HTTP request.
+func MatchOutbound(rules []common.Rule, metadata *common.Metadata) string {
+	for _, rule := range rules {
+		p, ok := rule.Action().(*action.Proxy)
+		if !ok || (metadata.Request == nil && !connectionRule(rule)) {
+			continue
+		}
+		if rule.Match(metadata) {
+			slog.Info("Outbound rule matched", slog.Any("rule", rule), slog.Any("metadata", metadata))
+			return p.Outbound()
+		}
+	}
+	return ""
+}
+
+// connectionRule reports whether rule can be evaluated without an HTTP request.
+func connectionRule(rule common.Rule) bool {
+	switch rule.Type() {
+	case common.RuleTypeHeaderKeyword, common.RuleTypeHeaderRegex, common.RuleTypeURLRegex:
+		return false
+	}
+	return true
+}
+
+// MatchConnection returns the first request rule that matches a connection-level
+// flow such as a SOCKS5 UDP session. Rules that inspect HTTP headers, URLs or
+// bodies are skipped since no request is available.
+func MatchConnection(rules []common.Rule, metadata *common.Metadata) common.Rule {
+	for _, rule := range rules {
+		if rule.Action().Direction() != common.DirectionDual && rule.Action().Direction() != common.DirectionRequest {
+			continue
+		}
+		if !connectionRule(rule) {
+			continue
+		}
+		if rule.Match(metadata) {
+			slog.Info("Rule matched", slog.Any("rule", rule), slog.Any("metadata", metadata))
+			return rule
+		}
+	}
+	return nil
+}
+
+// List returns the name of the rule list, as in the config API.
+func (e *Engine) List() string {
+	return e.list
+}
+
+// WithoutMetrics returns a copy of e, sharing its rules, whose matches are
+// not counted in metrics.
+func (e *Engine) WithoutMetrics() *Engine {
+	c := *e
+	c.skipMetrics = true
+	return &c
+}
+
 func (e *Engine) RulesCount() int {
 	return len(e.Rules)
 }
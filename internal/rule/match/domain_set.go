@@ -3,7 +3,10 @@ package match
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -17,12 +20,25 @@ import (
 	"github.com/sunbk201/ua3f/internal/statistics"
 )
 
+// SkipRemote leaves the domain sets of remote sources unloaded, matching
+// nothing, instead of downloading them. Set it before building rules.
+var SkipRemote bool
+
+// ErrRemoteSkipped is the load error of a remote domain set left unloaded
+// because of SkipRemote.
+var ErrRemoteSkipped = errors.New("remote domain set not downloaded")
+
+// errLoading is the load error of a domain set still loading.
+var errLoading = errors.New("domain set still loading")
+
 type DomainSet struct {
 	action    common.Action
 	source    string // local file path or remote url
 	domainSet []string
 	mu        sync.RWMutex
 	loaded    bool
+	ready     chan struct{} // closed once loading ended
+	loadErr   error
 }
 
 func (d *DomainSet) Type() common.RuleType {
@@ -80,12 +96,21 @@ func NewDomainSet(rule *config.Rule, recorder *statistics.Recorder, target commo
 	d := &DomainSet{
 		action: a,
 		source: rule.MatchValue,
+		ready:  make(chan struct{}),
+	}
+
+	if SkipRemote && isRemote(rule.MatchValue) {
+		d.loadErr = ErrRemoteSkipped
+		close(d.ready)
+		return d
 	}
 
 	// Load domain set asynchronously to avoid blocking
 	go func() {
+		defer close(d.ready)
 		slog.Info("loading domain set", "source", rule.MatchValue)
 		if err := d.loadDomainSet(); err != nil {
+			d.loadErr = err
 			slog.Error("failed to load domain set", "source", rule.MatchValue, "error", err)
 			return
 		}
@@ -95,49 +120,88 @@ func NewDomainSet(rule *config.Rule, recorder *statistics.Recorder, target commo
 	return d
 }
 
+// Wait waits for the domain set to be loaded and returns the error loading
+// it, if any.
+func (d *DomainSet) Wait(ctx context.Context) error {
+	select {
+	case <-d.ready:
+		return d.loadErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Err returns the error loading the domain set, if any, without waiting for
+// it to be loaded.
+func (d *DomainSet) Err() error {
+	select {
+	case <-d.ready:
+		return d.loadErr
+	default:
+		return errLoading
+	}
+}
+
 // loadDomainSet loads domain list from source (local file or remote URL)
 func (d *DomainSet) loadDomainSet() error {
+	domains, err := LoadDomainSet(d.source)
+	if err != nil {
+		return err
+	}
+
+	// Update domain set with lock
+	d.mu.Lock()
+	d.domainSet = domains
+	d.loaded = true
+	d.mu.Unlock()
+
+	return nil
+}
+
+// LoadDomainSet reads the domains of a domain set from source, a local file
+// or a remote URL.
+func LoadDomainSet(source string) ([]string, error) {
 	var data []byte
 	var err error
 
 	// Check if source is a URL or local file
-	if strings.HasPrefix(d.source, "http://") || strings.HasPrefix(d.source, "https://") {
+	if isRemote(source) {
 		// Load from URL
-		data, err = d.loadFromURL(d.source)
+		data, err = loadFromURL(source)
 	} else {
 		// Load from local file
-		data, err = os.ReadFile(d.source)
+		data, err = os.ReadFile(source)
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Parse domain list
-	domains := d.parseDomainList(data)
-
-	// Update domain set with lock
-	d.mu.Lock()
-	d.domainSet = domains
-	d.loaded = true
-	d.mu.Unlock()
+	return parseDomainList(data), nil
+}
 
-	return nil
+// isRemote reports whether source is a remote URL rather than a local file.
+func isRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
 }
 
 // loadFromURL downloads domain list from remote URL
-func (d *DomainSet) loadFromURL(url string) ([]byte, error) {
+func loadFromURL(url string) ([]byte, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
 	return io.ReadAll(resp.Body)
 }
 
 // parseDomainList parses domain list, ignoring lines starting with #
-func (d *DomainSet) parseDomainList(data []byte) []string {
+func parseDomainList(data []byte) []string {
 	var domains []string
 	scanner := bufio.NewScanner(bytes.NewReader(data))
 
@@ -22,10 +22,10 @@ func (i *IPCIDR) Type() common.RuleType {
 }
 
 func (i *IPCIDR) Match(metadata *common.Metadata) bool {
-	if i.ipNet == nil || metadata.ConnLink == nil {
+	if i.ipNet == nil {
 		return false
 	}
-	ip := net.ParseIP(metadata.ConnLink.RIP())
+	ip := metadata.DestIP()
 	if ip == nil {
 		return false
 	}
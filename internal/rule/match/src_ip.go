@@ -22,10 +22,10 @@ func (s *SrcIP) Type() common.RuleType {
 }
 
 func (s *SrcIP) Match(metadata *common.Metadata) bool {
-	if s.ipNet == nil || metadata.ConnLink == nil {
+	if s.ipNet == nil {
 		return false
 	}
-	ip := net.ParseIP(metadata.ConnLink.LIP())
+	ip := metadata.SrcIP()
 	if ip == nil {
 		return false
 	}
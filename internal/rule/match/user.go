@@ -0,0 +1,84 @@
+package match
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/rule/action"
+	"github.com/sunbk201/ua3f/internal/statistics"
+)
+
+// User matches the username a client authenticated with to the proxy.
+type User struct {
+	action common.Action
+	users  map[string]struct{}
+	value  string
+}
+
+func (u *User) Type() common.RuleType {
+	return common.RuleTypeUser
+}
+
+func (u *User) Match(metadata *common.Metadata) bool {
+	user := metadata.User()
+	if user == "" {
+		return false
+	}
+	_, ok := u.users[user]
+	return ok
+}
+
+func (u *User) Action() common.Action {
+	return u.action
+}
+
+func (u *User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"type":   u.Type(),
+		"user":   u.value,
+		"action": u.action,
+	})
+}
+
+func (u *User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("type", string(u.Type())),
+		slog.String("user", u.value),
+		slog.Any("action", u.action),
+	)
+}
+
+func NewUser(rule *config.Rule, recorder *statistics.Recorder, target common.ActionTarget) *User {
+	var a common.Action
+	switch target {
+	case common.ActionTargetHeader:
+		a = action.NewHeaderAction(rule, recorder)
+	case common.ActionTargetBody:
+		a = action.NewBodyAction(rule, recorder)
+	case common.ActionTargetURL:
+		a = action.NewURLAction(rule, recorder)
+	default:
+		slog.Error("unknown target", "target", target)
+		return nil
+	}
+	if a == nil {
+		slog.Error("action.NewAction", "rule", rule)
+		return nil
+	}
+
+	users := make(map[string]struct{})
+	for _, name := range strings.Split(rule.MatchValue, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			users[name] = struct{}{}
+		}
+	}
+
+	return &User{
+		action: a,
+		users:  users,
+		value:  rule.MatchValue,
+	}
+}
@@ -8,12 +8,14 @@ import (
 	"hash/fnv"
 	"log/slog"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
 	nfq "github.com/florianl/go-nfqueue/v2"
 	"github.com/mdlayher/netlink"
 	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/metrics"
 )
 
 type NfqHandler func(a *common.Packet)
@@ -96,8 +98,9 @@ func (s *NfqueueServer) Start() error {
 			default:
 				// If worker channel is full, accept the packet to avoid blocking
 				slog.Warn("Worker channel full, accepting packet without processing")
+				metrics.NfqueueDropped.Inc(s.queueLabel())
 				if a.PacketID != nil {
-					_ = nf.SetVerdict(*a.PacketID, nfq.NfAccept)
+					_ = s.SetVerdict(*a.PacketID, nfq.NfAccept)
 				}
 			}
 			return 0
@@ -141,6 +144,42 @@ func (s *NfqueueServer) Close() {
 	}
 }
 
+// SetVerdict sets the verdict of a packet and counts it.
+func (s *NfqueueServer) SetVerdict(id uint32, verdict int) error {
+	err := s.Nf.SetVerdict(id, verdict)
+	if err == nil {
+		metrics.NfqueueVerdicts.Inc(s.queueLabel(), verdictName(verdict))
+	}
+	return err
+}
+
+// SetVerdictWithOption sets the verdict of a packet with options and counts it.
+func (s *NfqueueServer) SetVerdictWithOption(id uint32, verdict int, options ...nfq.VerdictOption) error {
+	err := s.Nf.SetVerdictWithOption(id, verdict, options...)
+	if err == nil {
+		metrics.NfqueueVerdicts.Inc(s.queueLabel(), verdictName(verdict))
+	}
+	return err
+}
+
+func (s *NfqueueServer) queueLabel() string {
+	return strconv.Itoa(int(s.QueueNum))
+}
+
+func verdictName(verdict int) string {
+	switch verdict {
+	case nfq.NfAccept:
+		return "accept"
+	case nfq.NfDrop:
+		return "drop"
+	case nfq.NfRepeat:
+		return "repeat"
+	case nfq.NfStolen:
+		return "stolen"
+	}
+	return strconv.Itoa(verdict)
+}
+
 // worker processes packets from its assigned channel
 func (s *NfqueueServer) worker(workerID int, aChan <-chan *nfq.Attribute) {
 	defer s.wg.Done()
@@ -148,7 +187,7 @@ func (s *NfqueueServer) worker(workerID int, aChan <-chan *nfq.Attribute) {
 	for a := range aChan {
 		if ok := attributeSanityCheck(a); !ok {
 			if a.PacketID != nil {
-				_ = s.Nf.SetVerdict(*a.PacketID, nfq.NfAccept)
+				_ = s.SetVerdict(*a.PacketID, nfq.NfAccept)
 			}
 			slog.Warn("Invalid nfq.Attribute received", slog.Int("workerID", workerID))
 			return
@@ -157,11 +196,11 @@ func (s *NfqueueServer) worker(workerID int, aChan <-chan *nfq.Attribute) {
 		if err != nil {
 			slog.Error("NewPacket", slog.Int("workerID", workerID), slog.Any("error", err))
 			if a.PacketID != nil {
-				_ = s.Nf.SetVerdict(*a.PacketID, nfq.NfAccept)
+				_ = s.SetVerdict(*a.PacketID, nfq.NfAccept)
 			}
 			continue
 		}
-		slog.Debug("Processing packet", slog.Int("workerID", workerID), slog.String("srcAddr", packet.SrcAddr), slog.String("dstAddr", packet.DstAddr))
+		slog.Debug("Processing packet", slog.Int("workerID", workerID), slog.String("src_addr", packet.SrcAddr), slog.String("dest_addr", packet.DstAddr))
 		s.HandlePacket(packet)
 	}
 }
@@ -0,0 +1,28 @@
+package base
+
+import (
+	"context"
+	"net"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/outbound"
+)
+
+// NewOutbound builds the outbounds of cfg. Direct connections and connections
+// to upstream proxies carry mark so they bypass interception.
+func NewOutbound(cfg *config.Config, mark int) (*outbound.Manager, error) {
+	return outbound.New(cfg, func(ctx context.Context, addr string) (net.Conn, error) {
+		return ConnectContext(ctx, addr, mark)
+	})
+}
+
+// Dial connects to c.RAddr through the outbound selected by the header rules.
+// Servers that were not started with an outbound manager dial directly.
+func (s *Server) Dial(ctx context.Context, c *common.ConnLink) (net.Conn, error) {
+	if s.Outbound == nil {
+		return ConnectContext(ctx, c.RAddr, SO_MARK)
+	}
+	ob := s.Outbound.Select(s.Rewriter.HeaderRules(), &common.Metadata{ConnLink: c})
+	return ob.DialContext(ctx, c.RAddr)
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package base
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	probeInterval = 100 * time.Millisecond
+	probeTimeout  = 6 * time.Second
+	// tcpEstablished is TCP_ESTABLISHED in tcpi_state
+	tcpEstablished = 1
+)
+
+// watchHandshake watches the remote socket of c until the TLS handshake
+// outcome is known: any byte received means the server answered, a reset or
+// silence until probeTimeout means the handshake was blocked. A connection
+// closed locally in the meantime is inconclusive.
+func (s *Server) watchHandshake(c *common.ConnLink, prober *tlsdesync.Prober, key string) {
+	handshakes.add(&pendingHandshake{
+		conn:     c.RConn,
+		prober:   prober,
+		key:      key,
+		deadline: time.Now().Add(probeTimeout),
+	})
+}
+
+type pendingHandshake struct {
+	conn     net.Conn
+	prober   *tlsdesync.Prober
+	key      string
+	deadline time.Time
+	done     bool
+}
+
+// check polls TCP_INFO of h, reporting its outcome once known.
+func (h *pendingHandshake) check(now time.Time) {
+	info, err := tcpInfo(h.conn)
+	switch {
+	case err != nil:
+	case info.Bytes_received > 0:
+		h.prober.Report(h.key, true)
+	case info.State != tcpEstablished || now.After(h.deadline):
+		h.prober.Report(h.key, false)
+	default:
+		return
+	}
+	h.done = true
+}
+
+// handshakeWatcher polls the pending handshakes of every server on a single
+// ticker, running only while some are pending.
+type handshakeWatcher struct {
+	mu      sync.Mutex
+	pending []*pendingHandshake
+}
+
+var handshakes handshakeWatcher
+
+func (w *handshakeWatcher) add(h *pendingHandshake) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, h)
+	if len(w.pending) == 1 {
+		go w.run()
+	}
+}
+
+func (w *handshakeWatcher) run() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		w.mu.Lock()
+		pending := slices.Clone(w.pending)
+		w.mu.Unlock()
+
+		for _, h := range pending {
+			h.check(now)
+		}
+
+		w.mu.Lock()
+		w.pending = slices.DeleteFunc(w.pending, func(h *pendingHandshake) bool { return h.done })
+		if len(w.pending) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+	}
+}
+
+func tcpInfo(conn net.Conn) (*unix.TCPInfo, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("conn type %T does not expose syscall.Conn", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		info    *unix.TCPInfo
+		infoErr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return nil, err
+	}
+	return info, infoErr
+}
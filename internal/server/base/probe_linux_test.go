@@ -0,0 +1,75 @@
+package base
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
+)
+
+func TestWatchHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	prober := tlsdesync.NewProber(filepath.Join(t.TempDir(), "probe.json"))
+	s := &Server{}
+	watch := func(serve func(net.Conn)) {
+		t.Helper()
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				serve(conn)
+			}
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		s.watchHandshake(&common.ConnLink{RConn: conn}, prober, "example.com")
+	}
+	result := func() tlsdesync.ProbeResult {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			handshakes.mu.Lock()
+			pending := len(handshakes.pending)
+			handshakes.mu.Unlock()
+			if pending == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		results := prober.Results()
+		if len(results) != 1 {
+			t.Fatalf("Results() = %+v, want one destination", results)
+		}
+		return results[0]
+	}
+
+	// A reset handshake starts probing the destination.
+	watch(func(conn net.Conn) {
+		time.Sleep(200 * time.Millisecond)
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	})
+	if r := result(); r.Attempts != 1 || r.Confirmed {
+		t.Fatalf("after a reset: %+v, want one unconfirmed attempt", r)
+	}
+
+	// Both handshakes share the watcher; the answered one confirms the strategy.
+	watch(func(conn net.Conn) {
+		_, _ = conn.Write([]byte{0x16})
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	if r := result(); r.Attempts != 2 || !r.Confirmed {
+		t.Fatalf("after an answer: %+v, want a confirmed second attempt", r)
+	}
+}
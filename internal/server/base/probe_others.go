@@ -0,0 +1,10 @@
+//go:build !linux
+
+package base
+
+import (
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
+)
+
+func (s *Server) watchHandshake(_ *common.ConnLink, _ *tlsdesync.Prober, _ string) {}
@@ -15,10 +15,13 @@ import (
 	"github.com/sunbk201/ua3f/internal/bpf/sockmap"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
 	"github.com/sunbk201/ua3f/internal/mitm"
+	"github.com/sunbk201/ua3f/internal/outbound"
 	"github.com/sunbk201/ua3f/internal/rule/action"
 	"github.com/sunbk201/ua3f/internal/sniff"
 	"github.com/sunbk201/ua3f/internal/statistics"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
 )
 
 type Server struct {
@@ -30,6 +33,10 @@ type Server struct {
 	BufioReaderPool sync.Pool
 	MiddleMan       *mitm.MiddleMan
 	Sockmap         *sockmap.Sockmap
+	Outbound        *outbound.Manager
+
+	tlsDesyncOnce sync.Once
+	tlsDesync     *tlsdesync.Selector
 }
 
 func (s *Server) GetRewriter() common.Rewriter {
@@ -47,11 +54,16 @@ func (s *Server) ServeConnLink(connLink *common.ConnLink) {
 		Protocol:  sniff.TCP,
 		SrcAddr:   connLink.LAddr,
 		DestAddr:  connLink.RAddr,
+		Host:      connLink.Host(),
 		StartTime: time.Now(),
+		Traffic:   &statistics.Traffic{},
 	}
 	s.Recorder.AddRecord(record)
 	defer s.Recorder.RemoveRecord(record)
 
+	connLink.Traffic = record.Traffic
+	connLink.CountTraffic()
+
 	// Ensure BPF Sockmap is cleaned up when connection closes
 	defer func() {
 		if connLink.Offloaded {
@@ -72,7 +84,7 @@ func (s *Server) ServeConnLink(connLink *common.ConnLink) {
 	case config.RewriteModeGlobal:
 		go connLink.CopyRL()
 		// Skip sniffing and rewriting for known non-HTTP upstreams
-		if s.Cache.Contains(connLink.RAddr) {
+		if s.LookupCache(connLink.RAddr) {
 			connLink.CopyLR()
 		} else {
 			_ = s.ProcessLR(connLink)
@@ -171,6 +183,19 @@ func (s *Server) ProcessLR(c *common.ConnLink) (err error) {
 			} else {
 				// MitM decided not to intercept, use the original sniffReader for transfer tls
 				transferReader = sniffReader
+				s.ProbeClientHello(c, sniffReader)
+				_, err = s.SplitClientHello(c, sniffReader)
+				return
+			}
+		}
+
+		if transferReader == nil {
+			s.ProbeClientHello(c, sniffReader)
+			var split bool
+			if split, err = s.SplitClientHello(c, sniffReader); err != nil {
+				return
+			} else if split {
+				s.TryOffload(c, sniffReader)
 				return
 			}
 		}
@@ -360,6 +385,13 @@ func (s *Server) ProcessRL(c *common.ConnLink) (err error) {
 	}
 }
 
+// LookupCache reports whether addr is a destination known not to carry HTTP.
+func (s *Server) LookupCache(addr string) bool {
+	hit := s.Cache.Contains(addr)
+	metrics.CacheLookup(metrics.CacheDestination, hit)
+	return hit
+}
+
 func (s *Server) TrySkip(c *common.ConnLink) {
 	if c.Skipped {
 		return
@@ -82,7 +82,17 @@ func (s *Server) DeleteOffload(c *common.ConnLink) {
 	if s.Sockmap == nil {
 		return
 	}
+	deleteOffload(s.Sockmap, c)
+}
+
+// offloadDeleter is the part of the sockmap DeleteOffload needs.
+type offloadDeleter interface {
+	Delete(lc, rc uint64) (lbytes, rbytes uint64)
+}
 
+// deleteOffload removes the pair of c from sm and counts the bytes relayed in
+// the kernel: those from the L socket are uploads, those from the R socket downloads.
+func deleteOffload(sm offloadDeleter, c *common.ConnLink) {
 	lcookie, err := c.LSOCookie()
 	if err != nil {
 		slog.Warn("BPF delete offload: LSOCookie error", "error", err, "ConnLink", c)
@@ -93,5 +103,6 @@ func (s *Server) DeleteOffload(c *common.ConnLink) {
 		slog.Warn("BPF delete offload: RSOCookie error", "error", err, "ConnLink", c)
 		return
 	}
-	s.Sockmap.Delete(lcookie, rcookie)
+	lbytes, rbytes := sm.Delete(lcookie, rcookie)
+	c.CountOffloaded(int64(lbytes), int64(rbytes))
 }
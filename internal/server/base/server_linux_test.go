@@ -0,0 +1,67 @@
+package base
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/statistics"
+)
+
+type fakeSockmap struct {
+	lc, rc         uint64
+	lbytes, rbytes uint64
+}
+
+func (f *fakeSockmap) Delete(lc, rc uint64) (uint64, uint64) {
+	f.lc, f.rc = lc, rc
+	return f.lbytes, f.rbytes
+}
+
+func TestDeleteOffloadCountsBytes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	lconn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer lconn.Close()
+	rconn, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	defer rconn.Close()
+
+	c := &common.ConnLink{LConn: lconn, RConn: rconn, Traffic: &statistics.Traffic{}}
+	c.CountTraffic()
+	if _, err := c.LConn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	sm := &fakeSockmap{lbytes: 1000, rbytes: 20000}
+	deleteOffload(sm, c)
+
+	lcookie, _ := c.LSOCookie()
+	rcookie, _ := c.RSOCookie()
+	if sm.lc != lcookie || sm.rc != rcookie {
+		t.Errorf("Delete(%d, %d), want Delete(%d, %d)", sm.lc, sm.rc, lcookie, rcookie)
+	}
+	if got := c.Traffic.Upload(); got != 1000 {
+		t.Errorf("Upload() = %d, want 1000", got)
+	}
+	if got := c.Traffic.Download(); got != 20000+5 {
+		t.Errorf("Download() = %d, want %d", got, 20000+5)
+	}
+}
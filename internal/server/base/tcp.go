@@ -3,15 +3,29 @@
 package base
 
 import (
+	"context"
 	"fmt"
 	"net"
+
+	"github.com/sunbk201/ua3f/internal/dns"
 )
 
 const SO_MARK = 0xc9
 
 func Connect(addr string, mark int) (target net.Conn, err error) {
-	if target, err = net.Dial("tcp", addr); err != nil {
-		return nil, fmt.Errorf("net.Dial: %v", err)
+	return ConnectContext(context.Background(), addr, mark)
+}
+
+func ConnectContext(ctx context.Context, addr string, mark int) (target net.Conn, err error) {
+	if realAddr, fake, err := dns.ResolveFakeAddr(ctx, addr); fake {
+		if err != nil {
+			return nil, fmt.Errorf("dns.ResolveFakeAddr: %w", err)
+		}
+		addr = realAddr
+	}
+	var dialer net.Dialer
+	if target, err = dialer.DialContext(ctx, "tcp", addr); err != nil {
+		return nil, fmt.Errorf("net.Dial: %w", err)
 	}
 	return target, nil
 }
@@ -3,6 +3,7 @@
 package base
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"syscall"
 	"unsafe"
 
+	"github.com/sunbk201/ua3f/internal/dns"
 	"golang.org/x/sys/unix"
 )
 
@@ -18,7 +20,20 @@ const SO_MARK = 0xc9
 const SO_INJECT_MARK = 0xc91
 
 // Connect dials the target address with SO_MARK set and returns the connection.
+// Fake IPs handed out by the built-in DNS server are translated to the real address first.
 func Connect(addr string, mark int) (target net.Conn, err error) {
+	return ConnectContext(context.Background(), addr, mark)
+}
+
+// ConnectContext is like Connect but honours the deadline and cancellation of ctx.
+func ConnectContext(ctx context.Context, addr string, mark int) (target net.Conn, err error) {
+	if realAddr, fake, err := dns.ResolveFakeAddr(ctx, addr); fake {
+		if err != nil {
+			return nil, fmt.Errorf("Connect dns.ResolveFakeAddr: %w", err)
+		}
+		addr = realAddr
+	}
+
 	dialer := net.Dialer{
 		Control: func(network, address string, c syscall.RawConn) error {
 			return c.Control(func(fd uintptr) {
@@ -27,9 +42,9 @@ func Connect(addr string, mark int) (target net.Conn, err error) {
 		},
 	}
 
-	conn, err := dialer.Dial("tcp", addr)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		return nil, fmt.Errorf("Connect dialer.Dial SO_MARK(%d): %v", mark, err)
+		return nil, fmt.Errorf("Connect dialer.Dial SO_MARK(%d): %w", mark, err)
 	}
 	return conn, nil
 }
@@ -0,0 +1,105 @@
+package base
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/sniff"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
+)
+
+// tlsDesyncSelector returns the TLS desync strategies of the config, built on first use.
+func (s *Server) tlsDesyncSelector() *tlsdesync.Selector {
+	s.tlsDesyncOnce.Do(func() {
+		if !tlsdesync.Enabled(&s.Cfg.Desync) {
+			return
+		}
+		selector, err := tlsdesync.NewSelector(&s.Cfg.Desync)
+		if err != nil {
+			slog.Error("tlsdesync.NewSelector", slog.Any("error", err))
+			return
+		}
+		s.tlsDesync = selector
+	})
+	return s.tlsDesync
+}
+
+// SplitClientHello forwards the ClientHello buffered in reader as several TLS
+// records when a RECORD-SPLIT strategy matches the connection.
+// It reports whether the ClientHello has been written to the remote.
+func (s *Server) SplitClientHello(c *common.ConnLink, reader *bufio.Reader) (bool, error) {
+	selector := s.tlsDesyncSelector()
+	if selector == nil {
+		return false, nil
+	}
+
+	header, err := reader.Peek(5)
+	if err != nil {
+		return false, nil
+	}
+	n := tlsdesync.RecordLen(header)
+	if n == 0 || n > reader.Size() {
+		return false, nil
+	}
+	record, err := reader.Peek(n)
+	if err != nil || !tlsdesync.IsClientHello(record) {
+		return false, nil
+	}
+
+	ip, port, ok := splitAddr(c.RAddr)
+	if !ok {
+		return false, nil
+	}
+	sni, _ := sniff.LocateTLSSNI(record)
+	st := selector.Select(ip, port, sni)
+	if st == nil || !st.RecordSplit {
+		return false, nil
+	}
+
+	split := tlsdesync.SplitRecord(record, st.RecordSegments)
+	if split == nil {
+		return false, nil
+	}
+	if _, err := c.RConn.Write(split); err != nil {
+		return false, fmt.Errorf("RConn.Write: %w", err)
+	}
+	if _, err := reader.Discard(n); err != nil {
+		return true, fmt.Errorf("reader.Discard: %w", err)
+	}
+	slog.Debug("Split ClientHello into TLS records", slog.String("sni", sni), slog.Int("segments", st.RecordSegments), slog.Any("ConnLink", c))
+	return true, nil
+}
+
+// ProbeClientHello watches whether the server answers the ClientHello buffered
+// in reader and reports the outcome to the desync prober.
+func (s *Server) ProbeClientHello(c *common.ConnLink, reader *bufio.Reader) {
+	prober := tlsdesync.ActiveProber()
+	if prober == nil {
+		return
+	}
+	ip, port, ok := splitAddr(c.RAddr)
+	if !ok || !s.tlsDesyncSelector().Probing(port) {
+		return
+	}
+	sni := ""
+	if info, err := sniff.SniffTLSClientHello(reader); err == nil && info != nil {
+		sni = info.ServerName
+	}
+	s.watchHandshake(c, prober, tlsdesync.ProbeKey(sni, ip))
+}
+
+func splitAddr(addr string) (string, uint16, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return host, uint16(port), true
+}
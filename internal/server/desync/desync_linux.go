@@ -6,13 +6,17 @@ import (
 	"crypto/rand"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/l3policy"
+	"github.com/sunbk201/ua3f/internal/log"
 	"github.com/sunbk201/ua3f/internal/netfilter"
 	"github.com/sunbk201/ua3f/internal/server/base"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
 	"sigs.k8s.io/knftables"
 )
 
@@ -31,6 +35,13 @@ type Server struct {
 	rawSocketFD4    int
 	rawSocketFD6    int
 	InjectMark      int
+
+	TLSNfqServer *base.NfqueueServer
+	TLSSelector  *tlsdesync.Selector
+	Prober       *tlsdesync.Prober
+
+	policy    *l3policy.Policy
+	policyErr error
 }
 
 func New(cfg *config.Config) *Server {
@@ -42,6 +53,9 @@ func New(cfg *config.Config) *Server {
 		InjectNfqServer: &base.NfqueueServer{
 			QueueNum: netfilter.DESYNC_INJECT_QUEUE,
 		},
+		TLSNfqServer: &base.NfqueueServer{
+			QueueNum: netfilter.DESYNC_TLS_QUEUE,
+		},
 		ReorderByte:    1500,
 		ReorderPackets: 2 + 3*2,
 		InjectTTL:      3,
@@ -49,12 +63,14 @@ func New(cfg *config.Config) *Server {
 	}
 	s.ReorderNfqServer.HandlePacket = s.ReorderPacket
 	s.InjectNfqServer.HandlePacket = s.InjectPacket
+	s.TLSNfqServer.HandlePacket = s.TLSPacket
 	s.Firewall = netfilter.Firewall{
 		Nftable: &knftables.Table{
 			Name:   "UA3F_DESYNC",
 			Family: knftables.InetFamily,
 		},
 		NftSetup:   s.nftSetup,
+		NftRuleset: s.nftRuleset,
 		NftCleanup: s.nftCleanup,
 		IptSetup:   s.iptSetup,
 		IptCleanup: s.iptCleanup,
@@ -77,55 +93,111 @@ func New(cfg *config.Config) *Server {
 			s.DesyncPorts = ports
 		}
 	}
+
+	s.policy, s.policyErr = l3policy.New(&s.cfg.L3Rewrite)
+
+	if tlsdesync.Enabled(&s.cfg.Desync) {
+		selector, err := tlsdesync.NewSelector(&s.cfg.Desync)
+		if err != nil {
+			slog.Error("tlsdesync.NewSelector", slog.Any("error", err))
+		} else {
+			s.TLSSelector = selector
+		}
+	}
 	return s
 }
 
+// tlsQueueNeeded reports whether ClientHello packets have to go through the TLS queue.
+func (s *Server) tlsQueueNeeded() bool {
+	if s.policy.Any((*l3policy.Rule).DesyncsTLS) {
+		return true
+	}
+	return tlsdesync.Enabled(&s.cfg.Desync) && s.TLSSelector != nil && s.TLSSelector.PacketLevel()
+}
+
+// reorderNeeded reports whether packets have to go through the reorder queue,
+// either for the global toggle or for an L3 rule.
+func (s *Server) reorderNeeded() bool {
+	return s.cfg.Desync.Reorder || s.policy.Any(func(r *l3policy.Rule) bool { return r.HasDesync(l3policy.DesyncReorder) })
+}
+
+// injectNeeded reports whether SYN-ACKs have to go through the inject queue,
+// either for the global toggle or for an L3 rule.
+func (s *Server) injectNeeded() bool {
+	return s.cfg.Desync.Inject || s.policy.Any(func(r *l3policy.Rule) bool { return r.HasDesync(l3policy.DesyncInject) })
+}
+
+// tlsPorts returns the destination ports whose ClientHello is queued.
+func (s *Server) tlsPorts() []uint16 {
+	var candidates []uint16
+	if s.TLSSelector != nil && s.TLSSelector.PacketLevel() {
+		candidates = append(candidates, s.TLSSelector.Ports()...)
+	}
+	candidates = append(candidates, s.policy.TLSPorts()...)
+	return uniquePorts(candidates)
+}
+
+// queuedPorts returns the destination ports queued for the desync method:
+// the desync-ports of its global toggle, when enabled, and the dst-ports of
+// the L3 rules enabling it. It is nil when every port is queued.
+func (s *Server) queuedPorts(method string, enabled bool) []uint16 {
+	if enabled && len(s.DesyncPorts) == 0 {
+		return nil
+	}
+	ports, all := s.policy.DesyncPorts(method)
+	if all {
+		return nil
+	}
+	if enabled {
+		ports = append(ports, s.DesyncPorts...)
+	}
+	return uniquePorts(ports)
+}
+
+// globalDesyncPort reports whether the global desync toggles apply to
+// packets to port, as desync-ports sets.
+func (s *Server) globalDesyncPort(port uint16) bool {
+	return len(s.DesyncPorts) == 0 || slices.Contains(s.DesyncPorts, port)
+}
+
+// uniquePorts returns ports without duplicates, in order.
+func uniquePorts(ports []uint16) []uint16 {
+	seen := make(map[uint16]struct{})
+	var unique []uint16
+	for _, p := range ports {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
+
 func (s *Server) Start() (err error) {
+	if s.policyErr != nil {
+		slog.Error("l3policy.New", slog.Any("error", s.policyErr))
+		return s.policyErr
+	}
 	err = s.Firewall.Setup(s.cfg)
 	if err != nil {
 		slog.Error("s.Firewall.Setup", slog.Any("error", err))
 		return err
 	}
 
-	if s.cfg.Desync.Reorder {
+	if s.reorderNeeded() {
 		err = s.ReorderNfqServer.Start()
 		if err != nil {
 			return err
 		}
 	}
 
-	if s.cfg.Desync.Inject {
-		s.rawSocketFD4, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
-		if err != nil {
-			return err
-		}
-		err = syscall.SetsockoptInt(s.rawSocketFD4, syscall.SOL_SOCKET, syscall.SO_MARK, s.InjectMark)
-		if err != nil {
+	if s.injectNeeded() || s.tlsQueueNeeded() {
+		if err = s.openRawSockets(); err != nil {
 			return err
 		}
-		err = syscall.SetsockoptInt(s.rawSocketFD4, syscall.SOL_SOCKET, syscall.SO_PRIORITY, 7)
-		if err != nil {
-			slog.Error("syscall.SetsockoptInt SO_PRIORITY", slog.Any("error", err))
-		}
-		err = syscall.SetsockoptInt(s.rawSocketFD4, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 128)
-		if err != nil {
-			slog.Error("syscall.SetsockoptInt SO_RCVBUF", slog.Any("error", err))
-		}
-		s.rawSocketFD6, _ = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
-		if s.rawSocketFD6 > 0 {
-			err = syscall.SetsockoptInt(s.rawSocketFD6, syscall.SOL_SOCKET, syscall.SO_MARK, s.InjectMark)
-			if err != nil {
-				return err
-			}
-			err = syscall.SetsockoptInt(s.rawSocketFD6, syscall.SOL_SOCKET, syscall.SO_PRIORITY, 7)
-			if err != nil {
-				slog.Error("syscall.SetsockoptInt SO_PRIORITY", slog.Any("error", err))
-			}
-			err = syscall.SetsockoptInt(s.rawSocketFD6, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 128)
-			if err != nil {
-				slog.Error("syscall.SetsockoptInt SO_RCVBUF", slog.Any("error", err))
-			}
-		}
+	}
+
+	if s.injectNeeded() {
 		if _, err := rand.Read(s.randomData[:]); err != nil {
 			slog.Error("rand.Read", slog.Any("error", err))
 		}
@@ -135,6 +207,22 @@ func (s *Server) Start() (err error) {
 		}
 	}
 
+	if s.tlsQueueNeeded() {
+		err = s.TLSNfqServer.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.Desync.AutoProbe {
+		path := s.cfg.Desync.ProbeFile
+		if path == "" {
+			path = log.GetStatsFilePath("desync_probe.json")
+		}
+		s.Prober = tlsdesync.NewProber(path)
+		s.Prober.Start()
+	}
+
 	slog.Info("TCP Desync server started", slog.Int("reorder_bytes", int(s.ReorderByte)), slog.Int("reorder_packets", int(s.ReorderPackets)), slog.Int("inject_ttl", int(s.InjectTTL)))
 
 	return
@@ -142,17 +230,64 @@ func (s *Server) Start() (err error) {
 
 func (s *Server) Close() error {
 	err := s.Firewall.Cleanup()
-	if s.cfg.Desync.Reorder {
+	if s.reorderNeeded() {
 		s.ReorderNfqServer.Close()
 	}
-	if s.cfg.Desync.Inject {
+	if s.injectNeeded() {
 		s.InjectNfqServer.Close()
+	}
+	if s.tlsQueueNeeded() {
+		s.TLSNfqServer.Close()
+	}
+	if s.injectNeeded() || s.tlsQueueNeeded() {
 		syscall.Close(s.rawSocketFD4)
 		syscall.Close(s.rawSocketFD6)
 	}
+	if s.Prober != nil {
+		if perr := s.Prober.Close(); perr != nil {
+			slog.Warn("Prober.Close", slog.Any("error", perr))
+		}
+	}
 	return err
 }
 
+// openRawSockets opens the raw sockets used to send crafted packets.
+// Packets sent through them carry InjectMark so they are not queued again.
+func (s *Server) openRawSockets() (err error) {
+	s.rawSocketFD4, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return err
+	}
+	err = syscall.SetsockoptInt(s.rawSocketFD4, syscall.SOL_SOCKET, syscall.SO_MARK, s.InjectMark)
+	if err != nil {
+		return err
+	}
+	err = syscall.SetsockoptInt(s.rawSocketFD4, syscall.SOL_SOCKET, syscall.SO_PRIORITY, 7)
+	if err != nil {
+		slog.Error("syscall.SetsockoptInt SO_PRIORITY", slog.Any("error", err))
+	}
+	err = syscall.SetsockoptInt(s.rawSocketFD4, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 128)
+	if err != nil {
+		slog.Error("syscall.SetsockoptInt SO_RCVBUF", slog.Any("error", err))
+	}
+	s.rawSocketFD6, _ = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if s.rawSocketFD6 > 0 {
+		err = syscall.SetsockoptInt(s.rawSocketFD6, syscall.SOL_SOCKET, syscall.SO_MARK, s.InjectMark)
+		if err != nil {
+			return err
+		}
+		err = syscall.SetsockoptInt(s.rawSocketFD6, syscall.SOL_SOCKET, syscall.SO_PRIORITY, 7)
+		if err != nil {
+			slog.Error("syscall.SetsockoptInt SO_PRIORITY", slog.Any("error", err))
+		}
+		err = syscall.SetsockoptInt(s.rawSocketFD6, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 128)
+		if err != nil {
+			slog.Error("syscall.SetsockoptInt SO_RCVBUF", slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
 func (s *Server) Restart(cfg *config.Config) (*Server, error) {
 	if err := s.Close(); err != nil {
 		return nil, err
@@ -11,13 +11,20 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/l3policy"
 )
 
 func (s *Server) InjectPacket(p *common.Packet) {
 	defer func() {
-		_ = s.InjectNfqServer.Nf.SetVerdict(*p.A.PacketID, nfq.NfAccept)
+		_ = s.InjectNfqServer.SetVerdict(*p.A.PacketID, nfq.NfAccept)
 	}()
 
+	// SYN-ACKs travel in reply direction: the server is the source and the device the destination
+	port := uint16(p.TCP.SrcPort)
+	if !s.policy.Desync(p.DstIP, p.SrcIP, port, l3policy.DesyncInject, s.cfg.Desync.Inject && s.globalDesyncPort(port)) {
+		return
+	}
+
 	if !s.checkTTL(p) {
 		slog.Debug("Packet TTL too high, skipping injection", slog.String("src", p.SrcAddr), slog.String("dst", p.DstAddr))
 		return
@@ -8,11 +8,13 @@ import (
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/sunbk201/ua3f/internal/l3policy"
 )
 
 const (
 	table           = "mangle"
 	reorderChain    = "UA3F_REORDER_DESYNC"
+	tlsChain        = "UA3F_TLS_DESYNC"
 	injectChain     = "UA3F_INJECT_DESYNC"
 	jumpPoint       = "POSTROUTING"
 	injectJumpPoint = "PREROUTING"
@@ -27,6 +29,10 @@ var (
 		"-p", "tcp",
 		"-j", injectChain,
 	}
+	JumpTLSChain = []string{
+		"-p", "tcp",
+		"-j", tlsChain,
+	}
 )
 
 func (s *Server) iptSetup() error {
@@ -35,7 +41,7 @@ func (s *Server) iptSetup() error {
 		return err
 	}
 
-	if s.cfg.Desync.Reorder {
+	if s.reorderNeeded() {
 		err = ipt.NewChain(table, reorderChain)
 		if err != nil {
 			return err
@@ -49,7 +55,21 @@ func (s *Server) iptSetup() error {
 			return err
 		}
 	}
-	if s.cfg.Desync.Inject {
+	if s.tlsQueueNeeded() {
+		err = ipt.NewChain(table, tlsChain)
+		if err != nil {
+			return err
+		}
+		err = ipt.Insert(table, jumpPoint, 1, JumpTLSChain...)
+		if err != nil {
+			return err
+		}
+		err = s.IptSetDesyncTLS(ipt)
+		if err != nil {
+			return err
+		}
+	}
+	if s.injectNeeded() {
 		err = ipt.NewChain(table, injectChain)
 		if err != nil {
 			return err
@@ -73,15 +93,17 @@ func (s *Server) iptCleanup() error {
 	}
 	ipt.Delete(table, jumpPoint, JumpReorderChain...)
 	ipt.Delete(table, injectJumpPoint, JumpInjectChain...)
+	ipt.Delete(table, jumpPoint, JumpTLSChain...)
+	ipt.ClearAndDeleteChain(table, tlsChain)
 	ipt.ClearAndDeleteChain(table, injectChain)
 	ipt.ClearAndDeleteChain(table, reorderChain)
 	return nil
 }
 
 func (s *Server) IptSetDesyncInject(ipt *iptables.IPTables) error {
-	if len(s.DesyncPorts) > 0 {
-		ports := make([]string, 0, len(s.DesyncPorts))
-		for _, p := range s.DesyncPorts {
+	if injectPorts := s.queuedPorts(l3policy.DesyncInject, s.cfg.Desync.Inject); len(injectPorts) > 0 {
+		ports := make([]string, 0, len(injectPorts))
+		for _, p := range injectPorts {
 			ports = append(ports, fmt.Sprintf("%d", p))
 		}
 		err := ipt.Append(table, injectChain, []string{
@@ -122,9 +144,9 @@ func (s *Server) IptSetDesyncReorder(ipt *iptables.IPTables) error {
 		return err
 	}
 
-	if len(s.DesyncPorts) > 0 {
-		ports := make([]string, 0, len(s.DesyncPorts))
-		for _, p := range s.DesyncPorts {
+	if reorderPorts := s.queuedPorts(l3policy.DesyncReorder, s.cfg.Desync.Reorder); len(reorderPorts) > 0 {
+		ports := make([]string, 0, len(reorderPorts))
+		for _, p := range reorderPorts {
 			ports = append(ports, fmt.Sprintf("%d", p))
 		}
 		err := ipt.Append(table, reorderChain, []string{
@@ -163,3 +185,40 @@ func (s *Server) IptSetDesyncReorder(ipt *iptables.IPTables) error {
 	}
 	return nil
 }
+
+func (s *Server) IptSetDesyncTLS(ipt *iptables.IPTables) error {
+	var RuleIgnoreSOMark = []string{
+		"-m", "mark",
+		"--mark", strconv.Itoa(s.InjectMark),
+		"-j", "RETURN",
+	}
+	err := ipt.Append(table, tlsChain, RuleIgnoreSOMark...)
+	if err != nil {
+		return err
+	}
+
+	ports := make([]string, 0)
+	for _, p := range s.tlsPorts() {
+		ports = append(ports, fmt.Sprintf("%d", p))
+	}
+	var RuleDesync = []string{
+		"-p", "tcp",
+		"-m", "multiport",
+		"--dports", strings.Join(ports, ","),
+		"-m", "conntrack",
+		"--ctdir", "ORIGINAL",
+		"--ctstate", "ESTABLISHED",
+		"-m", "connbytes",
+		"--connbytes-dir", "original",
+		"--connbytes-mode", "packets",
+		"--connbytes", "0:" + strconv.Itoa(tlsQueuePackets),
+		"-j", "NFQUEUE",
+		"--queue-num", strconv.Itoa(int(s.TLSNfqServer.QueueNum)),
+		"--queue-bypass",
+	}
+	err = ipt.Append(table, tlsChain, RuleDesync...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
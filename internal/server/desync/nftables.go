@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/sunbk201/ua3f/internal/l3policy"
 	"github.com/sunbk201/ua3f/internal/netfilter"
 	"sigs.k8s.io/knftables"
 )
@@ -19,20 +20,27 @@ func (s *Server) nftSetup() error {
 
 	tx := nft.NewTransaction()
 	tx.Add(s.Nftable)
+	s.nftRuleset(tx)
 
-	if s.cfg.Desync.Reorder {
+	if err := nft.Run(context.TODO(), tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nftRuleset adds the sets, chains and rules of the table to tx.
+func (s *Server) nftRuleset(tx *knftables.Transaction) {
+	if s.reorderNeeded() {
 		s.NftSetDesyncReorder(tx, s.Nftable)
 	}
-	if s.cfg.Desync.Inject {
+	if s.tlsQueueNeeded() {
+		s.NftSetDesyncTLS(tx, s.Nftable)
+	}
+	if s.injectNeeded() {
 		s.NftSetLanIP(tx, s.Nftable)
 		s.NftSetLanIP6(tx, s.Nftable)
 		s.NftSetDesyncInject(tx, s.Nftable)
 	}
-
-	if err := nft.Run(context.TODO(), tx); err != nil {
-		return err
-	}
-	return nil
 }
 
 func (s *Server) nftCleanup() error {
@@ -84,9 +92,9 @@ func (s *Server) NftSetDesyncInject(tx *knftables.Transaction, table *knftables.
 		),
 	})
 
-	if len(s.DesyncPorts) > 0 {
-		ports := make([]string, 0, len(s.DesyncPorts))
-		for _, p := range s.DesyncPorts {
+	if injectPorts := s.queuedPorts(l3policy.DesyncInject, s.cfg.Desync.Inject); len(injectPorts) > 0 {
+		ports := make([]string, 0, len(injectPorts))
+		for _, p := range injectPorts {
 			ports = append(ports, fmt.Sprintf("%d", p))
 		}
 		tx.Add(&knftables.Rule{
@@ -133,9 +141,9 @@ func (s *Server) NftSetDesyncReorder(tx *knftables.Transaction, table *knftables
 		),
 	})
 
-	if len(s.DesyncPorts) > 0 {
-		ports := make([]string, 0, len(s.DesyncPorts))
-		for _, p := range s.DesyncPorts {
+	if reorderPorts := s.queuedPorts(l3policy.DesyncReorder, s.cfg.Desync.Reorder); len(reorderPorts) > 0 {
+		ports := make([]string, 0, len(reorderPorts))
+		for _, p := range reorderPorts {
 			ports = append(ports, fmt.Sprintf("%d", p))
 		}
 		tx.Add(&knftables.Rule{
@@ -161,3 +169,38 @@ func (s *Server) NftSetDesyncReorder(tx *knftables.Transaction, table *knftables
 		),
 	})
 }
+
+func (s *Server) NftSetDesyncTLS(tx *knftables.Transaction, table *knftables.Table) {
+	chain := &knftables.Chain{
+		Name:     "DESYNC_TLS_QUEUE",
+		Table:    table.Name,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.PostroutingHook),
+		Priority: knftables.PtrTo(knftables.BaseChainPriority("mangle - 40")),
+	}
+	tx.Add(chain)
+
+	tx.Add(&knftables.Rule{
+		Chain: chain.Name,
+		Rule: knftables.Concat(
+			fmt.Sprintf("mark %d", s.InjectMark),
+			"counter return",
+		),
+	})
+
+	ports := make([]string, 0)
+	for _, p := range s.tlsPorts() {
+		ports = append(ports, fmt.Sprintf("%d", p))
+	}
+	tx.Add(&knftables.Rule{
+		Chain: chain.Name,
+		Rule: knftables.Concat(
+			"meta l4proto tcp",
+			fmt.Sprintf("tcp dport { %s }", strings.Join(ports, ",")),
+			"ct state established",
+			"ct direction original",
+			fmt.Sprintf("ct packets < %d", tlsQueuePackets),
+			fmt.Sprintf("counter queue num %d bypass", s.TLSNfqServer.QueueNum),
+		),
+	})
+}
@@ -7,10 +7,11 @@ import (
 
 	nfq "github.com/florianl/go-nfqueue/v2"
 	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/l3policy"
 )
 
 func (s *Server) ReorderPacket(frame *common.Packet) {
-	nf := s.ReorderNfqServer.Nf
+	nf := s.ReorderNfqServer
 	id := *frame.A.PacketID
 
 	if frame.TCP == nil || len(frame.TCP.Payload) <= 1 || frame.TCP.FIN {
@@ -18,6 +19,12 @@ func (s *Server) ReorderPacket(frame *common.Packet) {
 		return
 	}
 
+	port := uint16(frame.TCP.DstPort)
+	if !s.policy.Desync(frame.SrcIP, frame.DstIP, port, l3policy.DesyncReorder, s.cfg.Desync.Reorder && s.globalDesyncPort(port)) {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		return
+	}
+
 	newPacket, err := frame.SerializeWithDesync()
 	if err != nil {
 		_ = nf.SetVerdict(id, nfq.NfAccept)
@@ -0,0 +1,159 @@
+//go:build linux
+
+package desync
+
+import (
+	"errors"
+	"log/slog"
+	"syscall"
+
+	nfq "github.com/florianl/go-nfqueue/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/sniff"
+	"github.com/sunbk201/ua3f/internal/tlsdesync"
+)
+
+// tlsQueuePackets bounds how many packets of a connection are queued
+// looking for the ClientHello.
+const tlsQueuePackets = 6
+
+// TLSPacket applies the matching TLS strategy to an outgoing ClientHello.
+// A fake ClientHello is sent ahead of the real one, and with SNI-SPLIT the
+// real one is cut inside the SNI: the first part is sent through the raw
+// socket and the packet itself is shrunk to the second part.
+func (s *Server) TLSPacket(p *common.Packet) {
+	nf := s.TLSNfqServer
+	id := *p.A.PacketID
+
+	if p.TCP == nil || !tlsdesync.IsClientHello(p.TCP.Payload) {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		return
+	}
+
+	payload := p.TCP.Payload
+	sni, _ := sniff.LocateTLSSNI(payload)
+	st, ok := s.policy.TLSStrategy(p.SrcIP, p.DstIP, uint16(p.TCP.DstPort))
+	if !ok {
+		st = s.TLSSelector.Select(p.DstIP.String(), uint16(p.TCP.DstPort), sni)
+	}
+	if st == nil || !(st.SNISplit || st.FakeClientHello) {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		return
+	}
+
+	if st.FakeClientHello {
+		ttl, badsum := st.FakeTTL, false
+		if st.FakeFooling == tlsdesync.FoolingBadsum {
+			ttl, badsum = 0, true
+		}
+		if err := s.sendSegment(p, p.TCP.Seq, tlsdesync.FakeClientHello(st.FakeSNI), ttl, badsum); err != nil {
+			slog.Error("TLSPacket send fake ClientHello", slog.Any("error", err))
+		} else {
+			slog.Debug("Sent fake ClientHello", slog.String("dst", p.DstAddr), slog.String("sni", sni), slog.String("fake_sni", st.FakeSNI))
+		}
+	}
+
+	if !st.SNISplit {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		return
+	}
+
+	split := tlsdesync.SNISplitPoint(payload)
+	if split <= 0 || split >= len(payload) {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		return
+	}
+
+	seq := p.TCP.Seq
+	if err := s.sendSegment(p, seq, payload[:split], 0, false); err != nil {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		slog.Error("TLSPacket send first segment", slog.Any("error", err))
+		return
+	}
+
+	second := append([]byte(nil), payload[split:]...)
+	p.TCP.Seq = seq + uint32(split)
+	p.TCP.Payload = second
+	newPacket, err := p.Serialize()
+	if err != nil {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		slog.Error("packet.Serialize", slog.Any("error", err))
+		return
+	}
+	if err := nf.SetVerdictWithOption(id, nfq.NfAccept, nfq.WithAlteredPacket(newPacket)); err != nil {
+		_ = nf.SetVerdict(id, nfq.NfAccept)
+		slog.Error("nf.SetVerdictWithOption", slog.Any("error", err))
+		return
+	}
+	slog.Debug("Split ClientHello inside SNI", slog.String("dst", p.DstAddr), slog.String("sni", sni), slog.Int("split", split))
+}
+
+// sendSegment sends a copy of the packet's TCP segment with the given sequence
+// number and payload through the raw socket. A non-zero ttl overrides the
+// original TTL, and badsum corrupts the TCP checksum.
+func (s *Server) sendSegment(p *common.Packet, seq uint32, payload []byte, ttl uint8, badsum bool) error {
+	tcp := *p.TCP
+	tcp.Seq = seq
+	tcp.Checksum = 0
+	tcp.Payload = nil
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	var (
+		addr   syscall.Sockaddr
+		fd     int
+		hdrLen int
+	)
+	if p.IsIPv6 {
+		ip6 := *p.NetworkLayer.(*layers.IPv6)
+		ip6.NextHeader = layers.IPProtocolTCP
+		ip6.HopByHop = nil
+		if ttl > 0 {
+			ip6.HopLimit = ttl
+		}
+		if err := tcp.SetNetworkLayerForChecksum(&ip6); err != nil {
+			return err
+		}
+		if err := gopacket.SerializeLayers(buffer, opts, &ip6, &tcp, gopacket.Payload(payload)); err != nil {
+			return err
+		}
+		if s.rawSocketFD6 <= 0 {
+			return errors.New("no IPv6 raw socket")
+		}
+		addr = &syscall.SockaddrInet6{Addr: [16]byte(ip6.DstIP.To16())}
+		fd = s.rawSocketFD6
+		hdrLen = 40
+	} else {
+		ip4 := *p.NetworkLayer.(*layers.IPv4)
+		ip4.Checksum = 0
+		ip4.Options = nil
+		ip4.IHL = 5
+		if ttl > 0 {
+			ip4.TTL = ttl
+		}
+		if err := tcp.SetNetworkLayerForChecksum(&ip4); err != nil {
+			return err
+		}
+		if err := gopacket.SerializeLayers(buffer, opts, &ip4, &tcp, gopacket.Payload(payload)); err != nil {
+			return err
+		}
+		var ip4Bytes [4]byte
+		copy(ip4Bytes[:], ip4.DstIP.To4())
+		addr = &syscall.SockaddrInet4{Addr: ip4Bytes}
+		fd = s.rawSocketFD4
+		hdrLen = 20
+	}
+
+	packet := buffer.Bytes()
+	if badsum {
+		// TCP checksum lives at offset 16 of the TCP header
+		packet[hdrLen+16] ^= 0xff
+	}
+	return syscall.Sendto(fd, packet, 0, addr)
+}
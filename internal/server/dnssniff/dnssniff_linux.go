@@ -0,0 +1,130 @@
+//go:build linux
+
+package dnssniff
+
+import (
+	"log/slog"
+	"time"
+
+	nfq "github.com/florianl/go-nfqueue/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
+	"github.com/sunbk201/ua3f/internal/netfilter"
+	"github.com/sunbk201/ua3f/internal/server/base"
+	"sigs.k8s.io/knftables"
+)
+
+// Server passively observes DNS responses via NFQUEUE and fills dns.Default
+// so that IP-only flows can be mapped back to the domain they were resolved from.
+type Server struct {
+	netfilter.Firewall
+	cfg       *config.Config
+	nfqServer *base.NfqueueServer
+	cache     *dns.Cache
+	done      chan struct{}
+}
+
+func New(cfg *config.Config) *Server {
+	s := &Server{
+		cfg: cfg,
+		nfqServer: &base.NfqueueServer{
+			QueueNum: netfilter.DNS_SNIFF_QUEUE,
+		},
+		cache: dns.Default,
+		done:  make(chan struct{}),
+	}
+	s.nfqServer.HandlePacket = s.handlePacket
+	s.Firewall = netfilter.Firewall{
+		Nftable: &knftables.Table{
+			Name:   "UA3F_DNS_SNIFF",
+			Family: knftables.InetFamily,
+		},
+		NftSetup:   s.nftSetup,
+		NftRuleset: s.nftRuleset,
+		NftCleanup: s.nftCleanup,
+		IptSetup:   s.iptSetup,
+		IptCleanup: s.iptCleanup,
+	}
+	return s
+}
+
+func (s *Server) Start() error {
+	if !s.cfg.DNSSniff.Enabled {
+		return nil
+	}
+	if err := s.Firewall.Setup(s.cfg); err != nil {
+		slog.Error("s.Firewall.Setup", slog.Any("error", err))
+		return err
+	}
+	if err := s.nfqServer.Start(); err != nil {
+		_ = s.Firewall.Cleanup()
+		return err
+	}
+	go s.purgeLoop()
+	slog.Info("DNS sniffer started", slog.Int("queue", int(s.nfqServer.QueueNum)))
+	return nil
+}
+
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	err := s.Firewall.Cleanup()
+	s.nfqServer.Close()
+	return err
+}
+
+func (s *Server) Restart(cfg *config.Config) (*Server, error) {
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+
+	newServer := New(cfg)
+	if err := newServer.Start(); err != nil {
+		return nil, err
+	}
+	return newServer, nil
+}
+
+func (s *Server) purgeLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.cache.Purge()
+		}
+	}
+}
+
+// handlePacket records the answers of a DNS response. The packet is always accepted unmodified.
+func (s *Server) handlePacket(packet *common.Packet) {
+	defer func() {
+		_ = s.nfqServer.SetVerdict(*packet.A.PacketID, nfq.NfAccept)
+	}()
+
+	udp := &layers.UDP{}
+	if err := udp.DecodeFromBytes(packet.NetworkLayer.LayerPayload(), gopacket.NilDecodeFeedback); err != nil {
+		slog.Debug("udp.DecodeFromBytes", slog.Any("error", err))
+		return
+	}
+	if udp.SrcPort != 53 || len(udp.Payload) == 0 {
+		return
+	}
+
+	n, err := s.cache.Observe(udp.Payload)
+	if err != nil {
+		slog.Debug("dns.Observe", slog.Any("error", err))
+		return
+	}
+	if n > 0 {
+		slog.Debug("DNS response observed", slog.Int("records", n), slog.Int("cache_size", s.cache.Len()))
+	}
+}
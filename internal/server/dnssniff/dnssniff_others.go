@@ -0,0 +1,33 @@
+//go:build !linux
+
+package dnssniff
+
+import (
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+type Server struct {
+	cfg *config.Config
+}
+
+func New(cfg *config.Config) *Server {
+	s := &Server{
+		cfg: cfg,
+	}
+	return s
+}
+
+func (s *Server) Start() (err error) {
+	return nil
+}
+
+func (s *Server) Close() (err error) {
+	return nil
+}
+
+func (s *Server) Restart(cfg *config.Config) (*Server, error) {
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package dnssniff
+
+import (
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/sunbk201/ua3f/internal/netfilter"
+)
+
+const (
+	table       = "mangle"
+	chain       = "UA3F_DNS_SNIFF"
+	INPUT       = "INPUT"
+	POSTROUTING = "POSTROUTING"
+)
+
+var JumpChain = []string{
+	"-p", "udp",
+	"--sport", "53",
+	"-j", chain,
+}
+
+var RuleQueueDNS = []string{
+	"-p", "udp",
+	"--sport", "53",
+	"-j", "NFQUEUE",
+	"--queue-num", strconv.Itoa(netfilter.DNS_SNIFF_QUEUE),
+	"--queue-bypass",
+}
+
+func (s *Server) iptSetup() error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	if err := ipt.NewChain(table, chain); err != nil {
+		return err
+	}
+	if err := ipt.Append(table, chain, RuleQueueDNS...); err != nil {
+		return err
+	}
+	if err := ipt.Append(table, INPUT, JumpChain...); err != nil {
+		return err
+	}
+	if err := ipt.Append(table, POSTROUTING, JumpChain...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) iptCleanup() error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	_ = ipt.DeleteIfExists(table, INPUT, JumpChain...)
+	_ = ipt.DeleteIfExists(table, POSTROUTING, JumpChain...)
+	_ = ipt.ClearAndDeleteChain(table, chain)
+	return nil
+}
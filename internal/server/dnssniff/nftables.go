@@ -0,0 +1,70 @@
+//go:build linux
+
+package dnssniff
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/knftables"
+)
+
+func (s *Server) nftSetup() error {
+	nft, err := knftables.New(s.Nftable.Family, s.Nftable.Name)
+	if err != nil {
+		return err
+	}
+
+	tx := nft.NewTransaction()
+	tx.Add(s.Nftable)
+	s.nftRuleset(tx)
+
+	if err := nft.Run(context.TODO(), tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nftRuleset adds the sets, chains and rules of the table to tx.
+func (s *Server) nftRuleset(tx *knftables.Transaction) {
+	s.NftHookDNS(tx, s.Nftable, "DNS_SNIFF_INPUT", knftables.InputHook)
+	s.NftHookDNS(tx, s.Nftable, "DNS_SNIFF_POSTROUTING", knftables.PostroutingHook)
+}
+
+func (s *Server) nftCleanup() error {
+	nft, err := knftables.New(s.Nftable.Family, s.Nftable.Name)
+	if err != nil {
+		return err
+	}
+
+	tx := nft.NewTransaction()
+	tx.Delete(s.Nftable)
+
+	if err := nft.Run(context.TODO(), tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NftHookDNS queues DNS responses seen at the given hook.
+// INPUT catches answers to the router itself (e.g. dnsmasq upstream queries),
+// POSTROUTING catches answers forwarded or sent to LAN clients.
+func (s *Server) NftHookDNS(tx *knftables.Transaction, table *knftables.Table, name string, hook knftables.BaseChainHook) {
+	chain := &knftables.Chain{
+		Name:     name,
+		Table:    table.Name,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(hook),
+		Priority: knftables.PtrTo(knftables.ManglePriority),
+	}
+	tx.Add(chain)
+
+	tx.Add(&knftables.Rule{
+		Chain: chain.Name,
+		Rule: knftables.Concat(
+			"meta l4proto udp",
+			"udp sport 53",
+			fmt.Sprintf("counter queue num %d bypass", s.nfqServer.QueueNum),
+		),
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -12,6 +11,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/sunbk201/ua3f/internal/auth"
 	"github.com/sunbk201/ua3f/internal/bpf/sockmap"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
@@ -26,8 +26,11 @@ import (
 
 type Server struct {
 	base.Server
-	server  *http.Server
-	so_mark int
+	server    *http.Server
+	transport *http.Transport
+	so_mark   int
+	auth      *auth.Authenticator // nil when authentication is disabled
+	acl       *auth.ACL           // nil when every client is allowed
 }
 
 func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder, middleMan *mitm.MiddleMan, sm *sockmap.Sockmap) *Server {
@@ -50,6 +53,18 @@ func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder, middle
 }
 
 func (s *Server) Start() (err error) {
+	if s.auth, err = auth.New(&s.Cfg.HTTPProxy.Auth); err != nil {
+		return fmt.Errorf("auth.New: %w", err)
+	}
+	if s.acl, err = auth.NewACL(s.Cfg.HTTPProxy.Allow, s.Cfg.HTTPProxy.Deny); err != nil {
+		return fmt.Errorf("auth.NewACL: %w", err)
+	}
+
+	if s.Outbound, err = base.NewOutbound(s.Cfg, s.so_mark); err != nil {
+		return fmt.Errorf("base.NewOutbound: %w", err)
+	}
+	s.transport = newTransport(&s.Cfg.HTTPProxy.Upstream, s.so_mark)
+
 	var listener net.Listener
 	listenAddr := fmt.Sprintf("%s:%d", s.Cfg.BindAddress, s.Cfg.Port)
 	if listener, err = net.Listen("tcp", listenAddr); err != nil {
@@ -58,10 +73,14 @@ func (s *Server) Start() (err error) {
 
 	server := &http.Server{
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			user, ok := s.authorize(w, req)
+			if !ok {
+				return
+			}
 			if req.Method == http.MethodConnect {
-				s.handleTunneling(w, req)
+				s.handleTunneling(w, req, user)
 			} else {
-				s.handleHTTP(w, req)
+				s.handleHTTP(w, req, user)
 			}
 		}),
 	}
@@ -69,7 +88,7 @@ func (s *Server) Start() (err error) {
 
 	s.Recorder.Start()
 	go func() {
-		if err := server.Serve(listener); err != nil {
+		if err := server.Serve(common.CountingListener(listener)); err != nil {
 			if err == http.ErrServerClosed {
 				return
 			} else {
@@ -90,7 +109,9 @@ func (s *Server) Close() (err error) {
 
 	s.Sockmap.Close()
 
-	return s.server.Shutdown(ctx)
+	err = s.server.Shutdown(ctx)
+	s.transport.CloseIdleConnections()
+	return err
 }
 
 func (s *Server) Restart(cfg *config.Config) (common.Server, error) {
@@ -119,20 +140,62 @@ func (s *Server) Restart(cfg *config.Config) (common.Server, error) {
 	return newServer, nil
 }
 
-func (s *Server) handleHTTP(w http.ResponseWriter, req *http.Request) {
+// authorize applies the client ACL and proxy authentication. It writes the
+// error response itself and returns the authenticated username, if any.
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if s.acl != nil {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if !s.acl.Allowed(net.ParseIP(host)) {
+			slog.Info("HTTP proxy client denied by ACL", slog.String("src_addr", req.RemoteAddr))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return "", false
+		}
+	}
+
+	if s.auth == nil {
+		return "", true
+	}
+	user, pass, ok := proxyBasicAuth(req)
+	req.Header.Del("Proxy-Authorization")
+	if !ok || !s.auth.Verify(user, pass) {
+		if ok {
+			slog.Info("HTTP proxy authentication failed", slog.String("src_addr", req.RemoteAddr), slog.String("user", user))
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="UA3F"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return "", false
+	}
+	return user, true
+}
+
+// proxyBasicAuth parses the Basic credentials of the Proxy-Authorization header.
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	return r.BasicAuth()
+}
+
+func (s *Server) handleHTTP(w http.ResponseWriter, req *http.Request, user string) {
 	metadata := &common.Metadata{}
 	metadata.UpdateRequest(req)
+	metadata.SetUser(user)
 
 	record := &statistics.ConnectionRecord{
 		Protocol:  sniff.HTTP,
 		SrcAddr:   metadata.SrcAddr(),
 		DestAddr:  metadata.DestAddr(),
+		Host:      metadata.Host(),
 		StartTime: time.Now(),
+		Traffic:   &statistics.Traffic{},
 	}
 	s.Recorder.AddRecord(record)
 	defer s.Recorder.RemoveRecord(record)
 
-	slog.Info("HTTP proxy request", slog.String("srcAddr", metadata.SrcAddr()), slog.String("destAddr", metadata.DestAddr()))
+	slog.Info("HTTP proxy request", slog.String("src_addr", metadata.SrcAddr()), slog.String("dest_addr", metadata.DestAddr()))
+
+	// Hop-by-hop headers describe the client connection; dropping them lets
+	// the transport keep its own upstream connections alive.
+	removeHopHeaders(req.Header)
+	req.Close = false
 
 	req, err := s.rewriteRequest(metadata)
 	if err != nil {
@@ -142,9 +205,20 @@ func (s *Server) handleHTTP(w http.ResponseWriter, req *http.Request) {
 	if req == nil {
 		return // Redirected
 	}
+	req = withOutbound(req, s.Outbound.Select(s.Rewriter.HeaderRules(), metadata))
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = countingBody{req.Body, record.Traffic.AddUpload}
+	}
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := s.transport.RoundTrip(req)
 	if err != nil {
+		status := upstreamErrorStatus(err)
+		slog.Warn("HTTP upstream request failed",
+			slog.String("src_addr", metadata.SrcAddr()),
+			slog.String("dest_addr", metadata.DestAddr()),
+			slog.Int("status", status),
+			slog.Any("error", err))
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 	defer func() {
@@ -157,13 +231,16 @@ func (s *Server) handleHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	removeHopHeaders(resp.Header)
 	for k, v := range resp.Header {
 		for _, vv := range v {
 			w.Header().Add(k, vv)
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	if err := copyResponse(w, countingBody{resp.Body, record.Traffic.AddDownload}, resp.ContentLength < 0); err != nil {
+		slog.Debug("copyResponse", slog.String("src_addr", metadata.SrcAddr()), slog.Any("error", err))
+	}
 }
 
 func (s *Server) rewriteRequest(metadata *common.Metadata) (*http.Request, error) {
@@ -195,10 +272,15 @@ func (s *Server) rewriteResponse(metadata *common.Metadata) (*http.Response, err
 	return metadata.Response, nil
 }
 
-func (s *Server) handleTunneling(w http.ResponseWriter, req *http.Request) {
+func (s *Server) handleTunneling(w http.ResponseWriter, req *http.Request, user string) {
 	slog.Info("HTTP CONNECT request", slog.String("host", req.Host))
-	destAddr := req.Host
-	dest, err := base.Connect(destAddr, s.so_mark)
+	link := &common.ConnLink{
+		LAddr:    req.RemoteAddr,
+		RAddr:    req.Host,
+		User:     user,
+		Protocol: sniff.TCP,
+	}
+	dest, err := s.Dial(req.Context(), link)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
@@ -219,11 +301,7 @@ func (s *Server) handleTunneling(w http.ResponseWriter, req *http.Request) {
 		_ = dest.Close()
 		return
 	}
-	s.ServeConnLink(&common.ConnLink{
-		LConn:    src,
-		RConn:    dest,
-		LAddr:    req.RemoteAddr,
-		RAddr:    destAddr,
-		Protocol: sniff.TCP,
-	})
+	link.LConn = src
+	link.RConn = dest
+	s.ServeConnLink(link)
 }
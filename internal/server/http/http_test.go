@@ -575,3 +575,187 @@ func TestServerNew(t *testing.T) {
 		t.Error("cache not initialized")
 	}
 }
+
+func TestHTTPProxyAuth(t *testing.T) {
+	echoSrv := NewEchoServer(t)
+	defer echoSrv.close()
+
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeHTTP,
+		BindAddress: "127.0.0.1",
+		Port:        0,
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeRule,
+		HTTPProxy: config.HTTPProxyConfig{
+			Auth: config.AuthConfig{
+				Users: []config.AuthUser{
+					{Username: "alice", Password: "alicepass"},
+					{Username: "bob", Password: "bobpass"},
+				},
+			},
+		},
+		HeaderRules: []config.Rule{
+			{
+				Enabled:       true,
+				Type:          "USER",
+				MatchValue:    "alice",
+				Action:        "REPLACE",
+				RewriteHeader: "User-Agent",
+				RewriteValue:  "Alice-UA",
+			},
+		},
+	}
+
+	recorder := mockRecorder()
+	rw, err := rewrite.New(cfg, recorder)
+	if err != nil {
+		t.Fatalf("failed to create rewriter: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find available port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	cfg.Port = port
+	server := New(cfg, rw, recorder, nil, nil)
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name       string
+		userinfo   *url.Userinfo
+		wantStatus int
+		wantUA     string
+	}{
+		{name: "user matched by rule", userinfo: url.UserPassword("alice", "alicepass"), wantStatus: http.StatusOK, wantUA: "Alice-UA"},
+		{name: "user without rule", userinfo: url.UserPassword("bob", "bobpass"), wantStatus: http.StatusOK, wantUA: "Original-UA"},
+		{name: "wrong password", userinfo: url.UserPassword("alice", "wrong"), wantStatus: http.StatusProxyAuthRequired},
+		{name: "no credentials", userinfo: nil, wantStatus: http.StatusProxyAuthRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", port))
+			proxyURL.User = tt.userinfo
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyURL(proxyURL),
+				},
+				Timeout: 5 * time.Second,
+			}
+
+			req, err := http.NewRequest("GET", echoSrv.URL("/echo-ua"), nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("User-Agent", "Original-UA")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request through proxy: %v", err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusProxyAuthRequired {
+				if resp.Header.Get("Proxy-Authenticate") == "" {
+					t.Error("missing Proxy-Authenticate header")
+				}
+				return
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read response body: %v", err)
+			}
+			if string(body) != tt.wantUA {
+				t.Errorf("User-Agent mismatch: got %q, want %q", body, tt.wantUA)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyACL(t *testing.T) {
+	echoSrv := NewEchoServer(t)
+	defer echoSrv.close()
+
+	tests := []struct {
+		name       string
+		allow      []string
+		deny       []string
+		wantStatus int
+	}{
+		{name: "no lists", wantStatus: http.StatusOK},
+		{name: "allowed", allow: []string{"127.0.0.0/8"}, wantStatus: http.StatusOK},
+		{name: "not in allow list", allow: []string{"10.0.0.0/8"}, wantStatus: http.StatusForbidden},
+		{name: "denied", deny: []string{"127.0.0.1"}, wantStatus: http.StatusForbidden},
+		{name: "deny wins over allow", allow: []string{"127.0.0.0/8"}, deny: []string{"127.0.0.1/32"}, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				ServerMode:  config.ServerModeHTTP,
+				BindAddress: "127.0.0.1",
+				Port:        0,
+				LogLevel:    "error",
+				RewriteMode: config.RewriteModeDirect,
+				HTTPProxy: config.HTTPProxyConfig{
+					Allow: tt.allow,
+					Deny:  tt.deny,
+				},
+			}
+
+			recorder := mockRecorder()
+			rw, err := rewrite.New(cfg, recorder)
+			if err != nil {
+				t.Fatalf("failed to create rewriter: %v", err)
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to find available port: %v", err)
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			_ = listener.Close()
+
+			cfg.Port = port
+			server := New(cfg, rw, recorder, nil, nil)
+
+			if err := server.Start(); err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer func() { _ = server.Close() }()
+
+			time.Sleep(100 * time.Millisecond)
+
+			proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", port))
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyURL(proxyURL),
+				},
+				Timeout: 5 * time.Second,
+			}
+
+			resp, err := client.Get(echoSrv.URL("/echo-ua"))
+			if err != nil {
+				t.Fatalf("failed to send request through proxy: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
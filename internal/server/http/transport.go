@@ -0,0 +1,142 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/outbound"
+	"github.com/sunbk201/ua3f/internal/server/base"
+)
+
+type outboundKey struct{}
+
+// withOutbound attaches the outbound selected for req.
+func withOutbound(req *http.Request, ob outbound.Outbound) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), outboundKey{}, ob))
+}
+
+// outboundProxy routes a request through the upstream proxy of its outbound.
+// The transport keeps a separate connection pool per proxy URL.
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	if ob, ok := req.Context().Value(outboundKey{}).(outbound.Outbound); ok {
+		return ob.URL(), nil
+	}
+	return nil, nil
+}
+
+// hopHeaders are connection-scoped and must not be forwarded (RFC 9110 §7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// newTransport returns the transport of plain HTTP requests. With HTTP2 it
+// negotiates HTTP/2 through ALPN with the origins of absolute https:// request
+// URLs; http:// origins stay on HTTP/1.1, as h2c needs prior knowledge of the
+// origin.
+func newTransport(cfg *config.UpstreamConfig, mark int) *http.Transport {
+	seconds := func(v, def int) time.Duration {
+		if v <= 0 {
+			v = def
+		}
+		return time.Duration(v) * time.Second
+	}
+	orDefault := func(v, def int) int {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+
+	dialTimeout := seconds(cfg.DialTimeout, config.DefaultUpstreamDialTimeout)
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			return base.ConnectContext(ctx, addr, mark)
+		},
+		Proxy:                 outboundProxy,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          orDefault(cfg.MaxIdleConns, config.DefaultUpstreamMaxIdleConns),
+		MaxIdleConnsPerHost:   orDefault(cfg.MaxIdleConnsPerHost, config.DefaultUpstreamMaxIdleConnsPerHost),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       seconds(cfg.IdleConnTimeout, config.DefaultUpstreamIdleConnTimeout),
+		ResponseHeaderTimeout: seconds(cfg.ResponseHeaderTimeout, config.DefaultUpstreamResponseHeaderTimeout),
+		TLSHandshakeTimeout:   dialTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range h.Values("Connection") {
+		h.Del(k)
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// upstreamErrorStatus maps a transport error to 504 for timeouts and 502 otherwise.
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// countingBody counts the bytes read from a request or response body. Only
+// bodies are counted in proxy mode, as headers are rewritten and re-encoded.
+type countingBody struct {
+	io.ReadCloser
+	count func(int64)
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.count(int64(n))
+	return n, err
+}
+
+// copyResponse streams body to w, flushing after every write when the
+// response has no known length so that chunked and event streams are not held back.
+func copyResponse(w http.ResponseWriter, body io.Reader, flush bool) error {
+	if !flush {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
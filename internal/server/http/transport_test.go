@@ -0,0 +1,267 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/rewrite"
+)
+
+func startTestProxy(t *testing.T, cfg *config.Config) *url.URL {
+	t.Helper()
+
+	recorder := mockRecorder()
+	rw, err := rewrite.New(cfg, recorder)
+	if err != nil {
+		t.Fatalf("failed to create rewriter: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find available port: %v", err)
+	}
+	cfg.Port = listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	server := New(cfg, rw, recorder, nil, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	time.Sleep(100 * time.Millisecond)
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", cfg.Port))
+	return proxyURL
+}
+
+func newProxyClient(proxyURL *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+func TestHTTPProxyUpstreamErrors(t *testing.T) {
+	// A listener that accepts connections but never answers.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = silent.Close() }()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	// An address with nothing listening.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	proxyURL := startTestProxy(t, &config.Config{
+		ServerMode:  config.ServerModeHTTP,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeDirect,
+		HTTPProxy: config.HTTPProxyConfig{
+			Upstream: config.UpstreamConfig{ResponseHeaderTimeout: 1},
+		},
+	})
+	client := newProxyClient(proxyURL)
+
+	tests := []struct {
+		name       string
+		addr       string
+		wantStatus int
+	}{
+		{name: "connection refused", addr: closedAddr, wantStatus: http.StatusBadGateway},
+		{name: "response header timeout", addr: silent.Addr().String(), wantStatus: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Get("http://" + tt.addr + "/")
+			if err != nil {
+				t.Fatalf("failed to send request through proxy: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyKeepAlive(t *testing.T) {
+	var newConns atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})
+	upstream := &http.Server{
+		Handler: mux,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns.Add(1)
+			}
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = upstream.Serve(listener) }()
+	defer func() { _ = upstream.Close() }()
+
+	proxyURL := startTestProxy(t, &config.Config{
+		ServerMode:  config.ServerModeHTTP,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeDirect,
+	})
+
+	for i := 0; i < 5; i++ {
+		// A fresh client per request with Connection: close, so only the
+		// proxy's upstream transport can reuse connections.
+		req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+		req.Close = true
+		resp, err := newProxyClient(proxyURL).Do(req)
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	if got := newConns.Load(); got != 1 {
+		t.Errorf("upstream saw %d connections, want 1", got)
+	}
+}
+
+func TestHTTPProxyStreamingResponse(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: first\n\n"))
+		http.NewResponseController(w).Flush()
+		<-release
+		_, _ = w.Write([]byte("data: second\n\n"))
+	})
+	upstream := &http.Server{Handler: mux}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = upstream.Serve(listener) }()
+	defer func() { _ = upstream.Close() }()
+
+	proxyURL := startTestProxy(t, &config.Config{
+		ServerMode:  config.ServerModeHTTP,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeGlobal,
+		UserAgent:   "UA3F",
+	})
+
+	resp, err := newProxyClient(proxyURL).Get("http://" + listener.Addr().String() + "/stream")
+	if err != nil {
+		close(release)
+		t.Fatalf("failed to send request through proxy: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// The first event must arrive while the upstream is still holding the response open.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	close(release)
+	if err != nil {
+		t.Fatalf("failed to read first event: %v", err)
+	}
+	if line != "data: first\n" {
+		t.Errorf("got %q, want %q", line, "data: first\n")
+	}
+}
+
+func TestHTTPProxyOutbound(t *testing.T) {
+	echo := NewEchoServer(t)
+	defer echo.close()
+
+	// The upstream is a second proxy that rewrites every User-Agent, which
+	// shows whether a request passed through it.
+	upstream := startTestProxy(t, &config.Config{
+		ServerMode:  config.ServerModeHTTP,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeGlobal,
+		UserAgent:   "UPSTREAM",
+	})
+
+	proxyURL := startTestProxy(t, &config.Config{
+		ServerMode:  config.ServerModeHTTP,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeDirect,
+		Outbounds: []config.Outbound{
+			{Name: "upstream", Type: config.OutboundTypeHTTP, Address: upstream.Host},
+		},
+		DefaultOutbound: "upstream",
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, echo.URL("/echo-ua"), nil)
+	req.Header.Set("User-Agent", "client")
+	resp, err := newProxyClient(proxyURL).Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request through proxy: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "UPSTREAM" {
+		t.Errorf("User-Agent = %q, want %q", body, "UPSTREAM")
+	}
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	for _, tt := range []struct {
+		http2 bool
+		want  int
+	}{{false, 1}, {true, 2}} {
+		transport := newTransport(&config.UpstreamConfig{HTTP2: tt.http2}, 0)
+		transport.TLSClientConfig = origin.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("http2 %v: RoundTrip: %v", tt.http2, err)
+		}
+		_ = resp.Body.Close()
+		transport.CloseIdleConnections()
+		if resp.ProtoMajor != tt.want {
+			t.Errorf("http2 %v: origin answered over %s, want HTTP/%d", tt.http2, resp.Proto, tt.want)
+		}
+	}
+}
@@ -43,6 +43,24 @@ var RuleIP = []string{
 	"--queue-bypass",
 }
 
+var RuleHookRules = []string{
+	"-p", "tcp",
+	"-m", "mark",
+	"!", "--mark", strconv.Itoa(base.SO_INJECT_MARK),
+	"-j", "NFQUEUE",
+	"--queue-num", strconv.Itoa(netfilter.HELPER_QUEUE),
+	"--queue-bypass",
+}
+
+var RuleHookRulesUDP = []string{
+	"-p", "udp",
+	"-m", "mark",
+	"!", "--mark", strconv.Itoa(base.SO_INJECT_MARK),
+	"-j", "NFQUEUE",
+	"--queue-num", strconv.Itoa(netfilter.HELPER_QUEUE),
+	"--queue-bypass",
+}
+
 var RuleRstTimestamp = []string{
 	"-p", "tcp",
 	"--tcp-option", "8",
@@ -73,16 +91,23 @@ func (s *Server) iptSetup() error {
 			}
 		}
 	}
-	if (s.cfg.TCPTS || s.cfg.TCPWIN) && !s.cfg.IPID {
-		err = s.IptHookTCPSyn(ipt)
+	if s.queueAll() {
+		err = s.IptHookRules(ipt)
 		if err != nil {
 			return err
 		}
-	}
-	if s.cfg.IPID {
-		err = s.IptSetIP(ipt)
-		if err != nil {
-			return err
+	} else {
+		if s.queueSYN() && !s.cfg.IPID {
+			err = s.IptHookTCPSyn(ipt)
+			if err != nil {
+				return err
+			}
+		}
+		if s.cfg.IPID {
+			err = s.IptSetIP(ipt)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	if s.cfg.BLOCKQUIC {
@@ -102,6 +127,8 @@ func (s *Server) iptCleanup() error {
 	_ = ipt.DeleteIfExists(table, POSTROUTING, ruleTTL(s.cfg.TTLValue)...)
 	_ = ipt.DeleteIfExists(table, POSTROUTING, RuleIP...)
 	_ = ipt.DeleteIfExists(table, POSTROUTING, RuleHookTCPSyn...)
+	_ = ipt.DeleteIfExists(table, POSTROUTING, RuleHookRules...)
+	_ = ipt.DeleteIfExists(table, POSTROUTING, RuleHookRulesUDP...)
 	_ = ipt.DeleteIfExists(table, POSTROUTING, RuleBlockQuic...)
 	if s.cfg.TTL {
 		_ = s.NftCleanup()
@@ -133,6 +160,20 @@ func (s *Server) IptSetIP(ipt *iptables.IPTables) error {
 	return nil
 }
 
+// IptHookRules queues every TCP and UDP packet for the L3 rules. It is
+// appended after the TTL rule so a rule TTL overrides the global one.
+func (s *Server) IptHookRules(ipt *iptables.IPTables) error {
+	err := ipt.Append(table, POSTROUTING, RuleHookRules...)
+	if err != nil {
+		return err
+	}
+	err = ipt.Append(table, POSTROUTING, RuleHookRulesUDP...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func (s *Server) IptSetTTLIngress(ipt *iptables.IPTables) error {
 	if !daemon.IsCommandAvailable("nft") {
 		return errors.New("nft command not available")
@@ -4,12 +4,14 @@ package netlink
 
 import (
 	"log/slog"
+	"math/rand/v2"
 
 	nfq "github.com/florianl/go-nfqueue/v2"
 	"github.com/google/gopacket/layers"
 	"github.com/sunbk201/ua3f/internal/bpf/tc"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/l3policy"
 	"github.com/sunbk201/ua3f/internal/netfilter"
 	"github.com/sunbk201/ua3f/internal/server/base"
 	"sigs.k8s.io/knftables"
@@ -21,6 +23,8 @@ type Server struct {
 	mainCfg   *config.Config
 	nfqServer *base.NfqueueServer
 	tc        *tc.TC
+	policy    *l3policy.Policy
+	policyErr error
 }
 
 func New(cfg *config.Config) *Server {
@@ -32,12 +36,14 @@ func New(cfg *config.Config) *Server {
 		},
 	}
 	s.nfqServer.HandlePacket = s.handlePacket
+	s.policy, s.policyErr = l3policy.New(s.cfg)
 	s.Firewall = netfilter.Firewall{
 		Nftable: &knftables.Table{
 			Name:   "UA3F_HELPER",
 			Family: knftables.InetFamily,
 		},
 		NftSetup:   s.nftSetup,
+		NftRuleset: s.nftRuleset,
 		NftCleanup: s.nftCleanup,
 		IptSetup:   s.iptSetup,
 		IptCleanup: s.iptCleanup,
@@ -46,12 +52,17 @@ func New(cfg *config.Config) *Server {
 }
 
 func (s *Server) Start() (err error) {
-	enableL3Rewrite := s.cfg.TTL || s.cfg.TCPTS || s.cfg.TCPWIN || s.cfg.IPID || s.cfg.BLOCKQUIC
-	if !enableL3Rewrite {
+	if s.policyErr != nil {
+		slog.Error("l3policy.New", slog.Any("error", s.policyErr))
+		return s.policyErr
+	}
+	if !s.l3RewriteEnabled() {
 		return nil
 	}
 
-	if s.cfg.BPFOffload {
+	if s.cfg.BPFOffload && s.policy.Len() > 0 {
+		slog.Warn("BPF offload does not support L3 rules, falling back to netfilter", slog.Int("rules", s.policy.Len()))
+	} else if s.cfg.BPFOffload {
 		if s.tc, err = tc.NewTC(s.cfg); err != nil {
 			slog.Error("initialize BPF TC failed, please try disable BPF offload", slog.Any("error", err))
 			return err
@@ -66,8 +77,8 @@ func (s *Server) Start() (err error) {
 		slog.Error("s.Firewall.Setup", slog.Any("error", err))
 		return err
 	}
-	slog.Info("Packet modification configuration", slog.Bool("ttl", s.cfg.TTL), slog.Uint64("ttl_value", uint64(s.cfg.TTLValue)), slog.Bool("tcpts", s.cfg.TCPTS), slog.Bool("ipid", s.cfg.IPID), slog.Bool("tcp_init_window", s.cfg.TCPWIN), slog.Bool("block_quic", s.cfg.BLOCKQUIC))
-	if s.cfg.TCPTS || s.cfg.TCPWIN || s.cfg.IPID {
+	slog.Info("Packet modification configuration", slog.Bool("ttl", s.cfg.TTL), slog.Uint64("ttl_value", uint64(s.cfg.TTLValue)), slog.Bool("tcpts", s.cfg.TCPTS), slog.Bool("ipid", s.cfg.IPID), slog.Bool("tcp_init_window", s.cfg.TCPWIN), slog.Bool("block_quic", s.cfg.BLOCKQUIC), slog.Int("rules", s.policy.Len()))
+	if s.nfqueueNeeded() {
 		return s.nfqServer.Start()
 	}
 	return nil
@@ -92,21 +103,66 @@ func (s *Server) Restart(cfg *config.Config) (*Server, error) {
 	return newServer, nil
 }
 
+// l3RewriteEnabled reports whether any packet is to be rewritten.
+func (s *Server) l3RewriteEnabled() bool {
+	return s.cfg.TTL || s.cfg.TCPTS || s.cfg.TCPWIN || s.cfg.IPID || s.cfg.BLOCKQUIC || s.policy.Len() > 0
+}
+
+// FirewallNeeded reports whether Start sets up the firewall: L3 rewriting is
+// enabled and not offloaded to BPF.
+func (s *Server) FirewallNeeded() bool {
+	return s.policyErr == nil && s.l3RewriteEnabled() && (!s.cfg.BPFOffload || s.policy.Len() > 0)
+}
+
+// queueAll reports whether every TCP packet has to be queued because a rule sets the TTL or IP ID.
+func (s *Server) queueAll() bool {
+	return s.policy.Any((*l3policy.Rule).RewritesEveryPacket)
+}
+
+// queueSYN reports whether SYN packets have to be queued to rewrite their options or window.
+func (s *Server) queueSYN() bool {
+	return s.cfg.TCPTS || s.cfg.TCPWIN || s.policy.Any((*l3policy.Rule).RewritesSYN)
+}
+
+func (s *Server) nfqueueNeeded() bool {
+	return s.queueAll() || s.queueSYN() || s.cfg.IPID
+}
+
 // handlePacket processes a single NFQUEUE packet
 func (s *Server) handlePacket(packet *common.Packet) {
-	nf := s.nfqServer.Nf
+	nf := s.nfqServer
 
 	modified := false
-	if packet.TCP != nil {
-		if s.cfg.TCPTS {
+	var port uint16
+	switch {
+	case packet.UDP != nil:
+		// UDP is only queued for the rules: the global settings keep
+		// applying to TCP alone.
+		port = uint16(packet.UDP.DstPort)
+		if s.policy.Match(packet.SrcIP, packet.DstIP, port) == nil {
+			_ = nf.SetVerdict(*packet.A.PacketID, nfq.NfAccept)
+			return
+		}
+	case packet.TCP != nil:
+		port = uint16(packet.TCP.DstPort)
+	}
+	actions := s.policy.Actions(packet.SrcIP, packet.DstIP, port)
+	if packet.TCP != nil && packet.UDP == nil {
+		if actions.TCPTS {
 			modified = s.clearTCPTimestamp(packet.TCP) || modified
 		}
-		if s.cfg.TCPWIN {
-			modified = s.setInitialTCPWindow(packet.TCP) || modified
+		if actions.TCPWIN != 0 {
+			modified = s.setInitialTCPWindow(packet.TCP, actions.TCPWIN) || modified
 		}
 	}
-	if s.cfg.IPID {
+	switch actions.IPID {
+	case l3policy.IPIDZero:
 		modified = s.zeroIPID(packet) || modified
+	case l3policy.IPIDRandom:
+		modified = s.randomIPID(packet) || modified
+	}
+	if actions.TTL != 0 {
+		modified = s.setTTL(packet, actions.TTL) || modified
 	}
 
 	if modified {
@@ -151,15 +207,15 @@ func (s *Server) clearTCPTimestamp(tcp *layers.TCP) bool {
 	return modified
 }
 
-// setInitialTCPWindow sets the TCP initial window size to 65535 for SYN packets
-func (s *Server) setInitialTCPWindow(tcp *layers.TCP) bool {
+// setInitialTCPWindow sets the TCP initial window size of SYN packets
+func (s *Server) setInitialTCPWindow(tcp *layers.TCP, window uint16) bool {
 	if !(tcp.SYN && !tcp.ACK) {
 		return false
 	}
-	if tcp.Window == uint16(65535) {
+	if tcp.Window == window {
 		return false
 	}
-	tcp.Window = uint16(65535)
+	tcp.Window = window
 	return true
 }
 
@@ -176,3 +232,27 @@ func (s *Server) zeroIPID(packet *common.Packet) bool {
 	ip4.Id = 0
 	return true
 }
+
+// randomIPID sets the IP ID field to a random value for IPv4 packets
+func (s *Server) randomIPID(packet *common.Packet) bool {
+	if packet.IsIPv6 {
+		return false
+	}
+	ip4 := packet.NetworkLayer.(*layers.IPv4)
+	ip4.Id = uint16(rand.Uint32())
+	return true
+}
+
+// setTTL sets the TTL of IPv4 packets
+// Returns true if the packet was modified
+func (s *Server) setTTL(packet *common.Packet, ttl uint8) bool {
+	if packet.IsIPv6 {
+		return false
+	}
+	ip4 := packet.NetworkLayer.(*layers.IPv4)
+	if ip4.TTL == ttl {
+		return false
+	}
+	ip4.TTL = ttl
+	return true
+}
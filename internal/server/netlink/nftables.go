@@ -20,19 +20,7 @@ func (s *Server) nftSetup() error {
 
 	tx := nft.NewTransaction()
 	tx.Add(s.Nftable)
-
-	if s.cfg.TTL {
-		s.NftSetTTL(tx, s.Nftable)
-	}
-	if (s.cfg.TCPTS || s.cfg.TCPWIN) && !s.cfg.IPID {
-		s.NftHookTCPSyn(tx, s.Nftable)
-	}
-	if s.cfg.IPID {
-		s.NftHookIP(tx, s.Nftable)
-	}
-	if s.cfg.BLOCKQUIC {
-		s.NftBlockQUIC(tx, s.Nftable)
-	}
+	s.nftRuleset(tx)
 
 	if err := nft.Run(context.TODO(), tx); err != nil {
 		return err
@@ -52,6 +40,26 @@ func (s *Server) nftSetup() error {
 	return nil
 }
 
+// nftRuleset adds the sets, chains and rules of the table to tx.
+func (s *Server) nftRuleset(tx *knftables.Transaction) {
+	if s.cfg.TTL {
+		s.NftSetTTL(tx, s.Nftable)
+	}
+	if s.queueAll() {
+		s.NftHookRules(tx, s.Nftable)
+	} else {
+		if s.queueSYN() && !s.cfg.IPID {
+			s.NftHookTCPSyn(tx, s.Nftable)
+		}
+		if s.cfg.IPID {
+			s.NftHookIP(tx, s.Nftable)
+		}
+	}
+	if s.cfg.BLOCKQUIC {
+		s.NftBlockQUIC(tx, s.Nftable)
+	}
+}
+
 func (s *Server) nftCleanup() error {
 	nft, err := knftables.New(s.Nftable.Family, s.Nftable.Name)
 	if err != nil {
@@ -161,7 +169,7 @@ func (s *Server) NftHookIP(tx *knftables.Transaction, table *knftables.Table) {
 	}
 	tx.Add(chain)
 
-	if s.cfg.TCPWIN || s.cfg.TCPTS {
+	if s.queueSYN() {
 		tx.Add(&knftables.Rule{
 			Chain: chain.Name,
 			Rule: knftables.Concat(
@@ -180,6 +188,38 @@ func (s *Server) NftHookIP(tx *knftables.Transaction, table *knftables.Table) {
 	})
 }
 
+// NftHookRules queues every TCP and UDP packet for the L3 rules. It runs
+// after the TTL chain so a rule TTL overrides the global one.
+func (s *Server) NftHookRules(tx *knftables.Transaction, table *knftables.Table) {
+	chain := &knftables.Chain{
+		Name:     "HELPER_RULES_QUEUE",
+		Table:    table.Name,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.PostroutingHook),
+		Priority: knftables.PtrTo(knftables.BaseChainPriority("mangle + 10")),
+	}
+	tx.Add(chain)
+
+	tx.Add(&knftables.Rule{
+		Chain: chain.Name,
+		Rule: knftables.Concat(
+			fmt.Sprintf("mark %d", base.SO_INJECT_MARK),
+			"counter return",
+		),
+	})
+	tx.Add(&knftables.Rule{
+		Chain: chain.Name,
+		Rule:  netfilter.NftRuleIgnorePorts,
+	})
+	tx.Add(&knftables.Rule{
+		Chain: chain.Name,
+		Rule: knftables.Concat(
+			"meta l4proto { tcp, udp }",
+			fmt.Sprintf("counter queue num %d bypass", s.nfqServer.QueueNum),
+		),
+	})
+}
+
 func (s *Server) NftBlockQUIC(tx *knftables.Transaction, table *knftables.Table) {
 	chain := &knftables.Chain{
 		Name:     "BLOCK_QUIC",
@@ -55,6 +55,7 @@ func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder) *Serve
 			Family: knftables.InetFamily,
 		},
 		NftSetup:   s.nftSetup,
+		NftRuleset: s.nftRuleset,
 		NftCleanup: s.nftCleanup,
 		NftWatch:   s.nftWatch,
 		IptSetup:   s.iptSetup,
@@ -101,10 +102,10 @@ func (s *Server) Restart(cfg *config.Config) (common.Server, error) {
 // handlePacket processes a single NFQUEUE packet
 func (s *Server) handlePacket(packet *common.Packet) {
 	if s.Cfg.RewriteMode == config.RewriteModeDirect || packet.TCP == nil {
-		_ = s.nfqServer.Nf.SetVerdict(*packet.A.PacketID, nfq.NfAccept)
+		_ = s.nfqServer.SetVerdict(*packet.A.PacketID, nfq.NfAccept)
 		return
 	}
-	if s.Cache.Contains(packet.DstAddr) {
+	if s.LookupCache(packet.DstAddr) {
 		s.sendVerdict(packet, &common.RewriteDecision{Modified: false, NeedCache: true})
 		log.LogDebugWithAddr(packet.SrcAddr, packet.DstAddr, "Destination in cache, direct forwrard")
 		return
@@ -122,7 +123,7 @@ func (s *Server) handlePacket(packet *common.Packet) {
 }
 
 func (s *Server) sendVerdict(packet *common.Packet, result *common.RewriteDecision) {
-	nf := s.nfqServer.Nf
+	nf := s.nfqServer
 	id := *packet.A.PacketID
 	setMark, nextMark := s.getNextMark(packet, result)
 
@@ -193,7 +194,7 @@ func (s *Server) getNextMark(packet *common.Packet, result *common.RewriteDecisi
 	}
 
 	if mark == s.SniffCtMarkUpper {
-		slog.Debug("Connmark reached upper limit, marking as NotHTTP", slog.String("SrcAddr", packet.SrcAddr), slog.String("DstAddr", packet.DstAddr))
+		slog.Debug("Connmark reached upper limit, marking as NotHTTP", slog.String("src_addr", packet.SrcAddr), slog.String("dest_addr", packet.DstAddr))
 		s.Cache.Add(packet.DstAddr, struct{}{})
 		return true, s.NotHTTPCtMark
 	}
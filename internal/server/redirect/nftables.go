@@ -19,17 +19,21 @@ func (s *Server) nftSetup() error {
 
 	tx := nft.NewTransaction()
 	tx.Add(s.Nftable)
+	s.nftRuleset(tx)
 
+	if err := nft.Run(context.TODO(), tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nftRuleset adds the sets, chains and rules of the table to tx.
+func (s *Server) nftRuleset(tx *knftables.Transaction) {
 	s.NftSetLanIP(tx, s.Nftable)
 	s.NftSetLanIP6(tx, s.Nftable)
 	s.NftSetSkipIP(tx, s.Nftable)
 	s.NftSetSkipIP6(tx, s.Nftable)
 	s.NftSetRedirect(tx, s.Nftable)
-
-	if err := nft.Run(context.TODO(), tx); err != nil {
-		return err
-	}
-	return nil
 }
 
 func (s *Server) nftCleanup() error {
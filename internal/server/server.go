@@ -1,12 +1,16 @@
 package server
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/sunbk201/ua3f/internal/bpf/sockmap"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/log"
 	"github.com/sunbk201/ua3f/internal/mitm"
 	"github.com/sunbk201/ua3f/internal/rewrite"
 	"github.com/sunbk201/ua3f/internal/server/http"
@@ -17,20 +21,172 @@ import (
 	"github.com/sunbk201/ua3f/internal/statistics"
 )
 
+// Group runs a server for every configured listener. The servers share one
+// Rewriter, Recorder, MiddleMan and Sockmap; NFQUEUE rewrites packets rather
+// than streams, so it gets its own packet rewriter sharing the same Recorder.
+type Group struct {
+	servers   []common.Server
+	listeners []config.Listener
+	shared    *shared
+	recorder  *statistics.Recorder
+	storeCfg  config.StatsStoreConfig // settings of the recorder's store
+}
+
+// shared holds the components built once per configuration and handed to every
+// server. The rewriters and the MitM hostname filter can be swapped by Reload.
+type shared struct {
+	rewriter       *rewrite.Reloadable
+	packetRewriter *rewrite.Reloadable
+	middleMan      *mitm.MiddleMan
+}
+
 func NewServer(cfg *config.Config) (common.Server, error) {
 	rc := statistics.New()
 
-	rw, err := rewrite.New(cfg, rc)
+	sh, err := newShared(cfg, rc)
 	if err != nil {
-		slog.Error("rewrite.New", slog.Any("error", err))
 		return nil, err
 	}
 
-	middleMan, err := mitm.NewMiddleMan(cfg)
+	sm, err := sockmap.NewSockmap(cfg)
+	if err != nil {
+		slog.Error("sockmap.NewSockmap", slog.Any("error", err))
+		return nil, err
+	}
+
+	g, err := newGroup(cfg, sh, rc, sm)
+	if err != nil {
+		_ = sm.Close()
+		return nil, err
+	}
+	if err := g.setStatsStore(cfg.StatsStore); err != nil {
+		_ = sm.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+func newShared(cfg *config.Config, rc *statistics.Recorder) (*shared, error) {
+	rw, packetRw, err := newRewriters(cfg, rc)
 	if err != nil {
-		slog.Error("mitm.NewMiddleMan", slog.Any("error", err))
 		return nil, err
 	}
+	sh := &shared{}
+	if rw != nil {
+		middleMan, err := mitm.NewMiddleMan(cfg)
+		if err != nil {
+			slog.Error("mitm.NewMiddleMan", slog.Any("error", err))
+			return nil, err
+		}
+		sh.rewriter, sh.middleMan = rewrite.NewReloadable(rw), middleMan
+	}
+	if packetRw != nil {
+		sh.packetRewriter = rewrite.NewReloadable(packetRw)
+	}
+	return sh, nil
+}
+
+// newRewriters builds the stream rewriter and the NFQUEUE packet rewriter for
+// cfg. Either is nil when no listener needs it.
+func newRewriters(cfg *config.Config, rc *statistics.Recorder) (rw, packetRw common.Rewriter, err error) {
+	for _, l := range cfg.ServerListeners() {
+		if l.ServerMode == config.ServerModeNFQueue {
+			if packetRw != nil {
+				continue
+			}
+			if packetRw, err = rewrite.New(cfg.ForListener(l), rc); err != nil {
+				slog.Error("rewrite.New", slog.Any("error", err))
+				return nil, nil, err
+			}
+			continue
+		}
+		if rw != nil {
+			continue
+		}
+		if rw, err = rewrite.New(cfg.ForListener(l), rc); err != nil {
+			slog.Error("rewrite.New", slog.Any("error", err))
+			return nil, nil, err
+		}
+	}
+	return rw, packetRw, nil
+}
+
+func newGroup(cfg *config.Config, sh *shared, rc *statistics.Recorder, sm *sockmap.Sockmap) (*Group, error) {
+	g := &Group{
+		listeners: cfg.ServerListeners(),
+		shared:    sh,
+		recorder:  rc,
+	}
+	for _, l := range g.listeners {
+		lcfg := cfg.ForListener(l)
+		var srv common.Server
+		switch l.ServerMode {
+		case config.ServerModeHTTP:
+			srv = http.New(lcfg, sh.rewriter, rc, sh.middleMan, sm)
+		case config.ServerModeSocks5:
+			srv = socks5.New(lcfg, sh.rewriter, rc, sh.middleMan, sm)
+		case config.ServerModeTProxy:
+			srv = tproxy.New(lcfg, sh.rewriter, rc, sh.middleMan, sm)
+		case config.ServerModeRedirect:
+			srv = redirect.New(lcfg, sh.rewriter, rc, sh.middleMan, sm)
+		case config.ServerModeNFQueue:
+			srv = nfqueue.New(lcfg, sh.packetRewriter, rc)
+		default:
+			return nil, fmt.Errorf("NewServer unknown server mode: %s", l.ServerMode)
+		}
+		g.servers = append(g.servers, srv)
+	}
+	return g, nil
+}
+
+// Start starts every server. If one fails, the servers up to and including it
+// are closed and the group is left empty, so a later Close is a no-op.
+func (g *Group) Start() error {
+	for i, srv := range g.servers {
+		l := g.listeners[i]
+		if err := srv.Start(); err != nil {
+			if err := g.closeServers(i + 1); err != nil {
+				slog.Error("g.closeServers", slog.Any("error", err))
+			}
+			g.servers, g.listeners = nil, nil
+			return fmt.Errorf("start %s server: %w", l.ServerMode, err)
+		}
+		slog.Info("Server started", slog.String("mode", string(l.ServerMode)), slog.String("bind", l.BindAddress), slog.Int("port", l.Port))
+	}
+	return nil
+}
+
+// Close closes every server and the statistics store.
+func (g *Group) Close() error {
+	err := g.closeServers(len(g.servers))
+	if store := g.recorder.SetStore(nil); store != nil {
+		err = errors.Join(err, store.Close())
+	}
+	return err
+}
+
+// closeServers closes the first n servers in reverse start order.
+func (g *Group) closeServers(n int) error {
+	var errs []error
+	for i := n - 1; i >= 0; i-- {
+		if err := g.servers[i].Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close %s server: %w", g.listeners[i].ServerMode, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Restart replaces every server with the listeners of cfg. The Recorder is kept
+// so statistics survive; the servers close the old Sockmap, so a new one is attached.
+func (g *Group) Restart(cfg *config.Config) (common.Server, error) {
+	sh, err := newShared(cfg, g.recorder)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.closeServers(len(g.servers)); err != nil {
+		slog.Error("old server shutdown error", slog.Any("error", err))
+	}
 
 	sm, err := sockmap.NewSockmap(cfg)
 	if err != nil {
@@ -38,18 +194,93 @@ func NewServer(cfg *config.Config) (common.Server, error) {
 		return nil, err
 	}
 
-	switch cfg.ServerMode {
-	case config.ServerModeHTTP:
-		return http.New(cfg, rw, rc, middleMan, sm), nil
-	case config.ServerModeSocks5:
-		return socks5.New(cfg, rw, rc, middleMan, sm), nil
-	case config.ServerModeTProxy:
-		return tproxy.New(cfg, rw, rc, middleMan, sm), nil
-	case config.ServerModeRedirect:
-		return redirect.New(cfg, rw, rc, middleMan, sm), nil
-	case config.ServerModeNFQueue:
-		return nfqueue.New(cfg, rw, rc), nil
-	default:
-		return nil, fmt.Errorf("NewServer unknown server mode: %s", cfg.ServerMode)
+	newGroup, err := newGroup(cfg, sh, g.recorder, sm)
+	if err != nil {
+		_ = sm.Close()
+		return nil, err
+	}
+	newGroup.storeCfg = g.storeCfg
+	if cfg.StatsStore != g.storeCfg {
+		if err := newGroup.setStatsStore(cfg.StatsStore); err != nil {
+			_ = sm.Close()
+			return nil, err
+		}
+	}
+	if err := newGroup.Start(); err != nil {
+		_ = sm.Close()
+		return nil, err
+	}
+	return newGroup, nil
+}
+
+// Reload swaps the rewriters and MitM hostname filter built from cfg into the
+// running servers without closing listeners or connections. cfg must differ
+// from the running configuration only in hot-reloadable settings, see
+// config.Config.HotReloadable. Nothing is swapped if any part fails to build.
+func (g *Group) Reload(cfg *config.Config) error {
+	rw, packetRw, err := newRewriters(cfg, g.recorder)
+	if err != nil {
+		return err
+	}
+	var filter *mitm.HostnameFilter
+	if g.shared.middleMan != nil {
+		if filter, err = mitm.NewHostnameFilter(cfg.MitM.Hostname); err != nil {
+			return fmt.Errorf("mitm.NewHostnameFilter: %w", err)
+		}
+	}
+
+	if rw != nil {
+		g.shared.rewriter.Store(rw)
+	}
+	if packetRw != nil {
+		g.shared.packetRewriter.Store(packetRw)
+	}
+	if filter != nil {
+		g.shared.middleMan.SetHostnameFilter(filter)
+	}
+	return nil
+}
+
+// setStatsStore opens the statistics store configured by sc, if enabled, and
+// closes the recorder's previous store.
+func (g *Group) setStatsStore(sc config.StatsStoreConfig) error {
+	var store *statistics.Store
+	if sc.Enabled {
+		path := sc.Path
+		if path == "" {
+			path = log.GetStatsFilePath("stats_store.jsonl")
+		}
+		hourly := cmp.Or(sc.HourlyRetention, config.DefaultStatsHourlyRetention)
+		daily := cmp.Or(sc.DailyRetention, config.DefaultStatsDailyRetention)
+		maxSize := cmp.Or(sc.MaxSize, config.DefaultStatsMaxSize)
+
+		var err error
+		store, err = statistics.OpenStore(path, time.Duration(hourly)*time.Hour, time.Duration(daily)*24*time.Hour, int64(maxSize)<<10)
+		if err != nil {
+			slog.Error("statistics.OpenStore", slog.Any("error", err))
+			return err
+		}
+		store.Run()
+	}
+	if old := g.recorder.SetStore(store); old != nil {
+		if err := old.Close(); err != nil {
+			slog.Error("old statistics store close error", slog.Any("error", err))
+		}
+	}
+	g.storeCfg = sc
+	return nil
+}
+
+func (g *Group) Recorder() *statistics.Recorder {
+	return g.recorder
+}
+
+func (g *Group) GetRewriter() common.Rewriter {
+	if g.shared.rewriter != nil {
+		return g.shared.rewriter
+	}
+	if g.shared.packetRewriter != nil {
+		return g.shared.packetRewriter
 	}
+	return nil
 }
@@ -2,7 +2,7 @@ package socks5
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -13,6 +13,7 @@ import (
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/luyuhuang/subsocks/socks"
+	"github.com/sunbk201/ua3f/internal/auth"
 	"github.com/sunbk201/ua3f/internal/bpf/sockmap"
 	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
@@ -28,6 +29,10 @@ type Server struct {
 	listener net.Listener
 	done     chan struct{}
 	so_mark  int
+	auth     *auth.Authenticator // nil when authentication is disabled
+
+	// lookupIP resolves the domain targets of UDP datagrams, net.DefaultResolver when nil.
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
 }
 
 func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder, middleMan *mitm.MiddleMan, sm *sockmap.Sockmap) *Server {
@@ -51,6 +56,13 @@ func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder, middle
 }
 
 func (s *Server) Start() (err error) {
+	if s.auth, err = auth.New(&s.Cfg.Socks5.Auth); err != nil {
+		return fmt.Errorf("auth.New: %w", err)
+	}
+	if s.Outbound, err = base.NewOutbound(s.Cfg, s.so_mark); err != nil {
+		return fmt.Errorf("base.NewOutbound: %w", err)
+	}
+
 	if s.listener == nil {
 		// first time start, create listener
 		listenAddr := fmt.Sprintf("%s:%d", s.Cfg.BindAddress, s.Cfg.Port)
@@ -142,32 +154,33 @@ func (s *Server) HandleClient(conn net.Conn) {
 
 	srcAddr := conn.RemoteAddr().String()
 
-	slog.Info("New socks5 connection", slog.String("srcAddr", srcAddr))
+	slog.Info("New socks5 connection", slog.String("src_addr", srcAddr))
 
-	if err := s.handShake(conn); err != nil {
-		slog.Error("s.handShake", slog.String("srcAddr", srcAddr), slog.Any("error", err))
+	user, err := s.handShake(conn)
+	if err != nil {
+		slog.Error("s.handShake", slog.String("src_addr", srcAddr), slog.Any("error", err))
 		return
 	}
 
 	request, err := socks.ReadRequest(conn)
 	if err != nil {
-		slog.Error("socks.ReadRequest", slog.String("srcAddr", srcAddr), slog.Any("error", err))
+		slog.Error("socks.ReadRequest", slog.String("src_addr", srcAddr), slog.Any("error", err))
 		return
 	}
 
 	switch request.Cmd {
 	case socks.CmdConnect:
-		err = s.handleConnect(conn, request)
+		err = s.handleConnect(conn, request, user)
 		if err != nil {
 			err = fmt.Errorf("s.handleConnect: %w", err)
 		}
 	case socks.CmdBind:
-		err = s.handleBind(conn)
+		err = s.handleBind(conn, user)
 		if err != nil {
 			err = fmt.Errorf("s.handleBind: %w", err)
 		}
 	case socks.CmdUDP:
-		err = s.handleUDPAssociate(conn)
+		err = s.handleUDPAssociate(conn, user)
 		if err != nil {
 			err = fmt.Errorf("s.handleUDPAssociate: %w", err)
 		}
@@ -175,66 +188,91 @@ func (s *Server) HandleClient(conn net.Conn) {
 		err = fmt.Errorf("socks5 unsupported command %d", request.Cmd)
 	}
 	if err != nil {
-		slog.Error("HandleClient", slog.String("srcAddr", srcAddr), slog.Any("error", err))
+		slog.Error("HandleClient", slog.String("src_addr", srcAddr), slog.Any("error", err))
 		return
 	}
 }
 
-func (s *Server) handShake(conn net.Conn) error {
+// handShake negotiates the authentication method and returns the authenticated
+// username, which is empty when authentication is disabled.
+func (s *Server) handShake(conn net.Conn) (string, error) {
 	methods, err := socks.ReadMethods(conn)
 	if err != nil {
-		return fmt.Errorf("socks.ReadMethods: %w", err)
+		return "", fmt.Errorf("socks.ReadMethods: %w", err)
+	}
+	want := socks.MethodNoAuth
+	if s.auth != nil {
+		want = socks.MethodUserPass
 	}
 	method := socks.MethodNoAcceptable
 	for _, m := range methods {
-		if m == socks.MethodNoAuth {
+		if m == want {
 			method = m
 		}
 	}
-	if err := socks.WriteMethod(socks.MethodNoAuth, conn); err != nil || method == socks.MethodNoAcceptable {
-		if err != nil {
-			return fmt.Errorf("socks.WriteMethod: %w", err)
-		} else {
-			return fmt.Errorf("socks5 methods is not acceptable")
+	if err := socks.WriteMethod(method, conn); err != nil {
+		return "", fmt.Errorf("socks.WriteMethod: %w", err)
+	}
+	switch method {
+	case socks.MethodNoAcceptable:
+		return "", fmt.Errorf("socks5 methods is not acceptable")
+	case socks.MethodNoAuth:
+		return "", nil
+	}
+
+	// RFC 1929 username/password sub-negotiation
+	req, err := socks.ReadUserPassRequest(conn)
+	if err != nil {
+		return "", fmt.Errorf("socks.ReadUserPassRequest: %w", err)
+	}
+	if !s.auth.Verify(req.Username, req.Password) {
+		if err := socks.NewUserPassResponse(socks.UserPassVer, socks.Failure).Write(conn); err != nil {
+			slog.Debug("socks.NewUserPassResponse.Write", slog.Any("error", err))
 		}
+		return "", fmt.Errorf("socks5 authentication failed for user %q", req.Username)
 	}
-	return nil
+	if err := socks.NewUserPassResponse(socks.UserPassVer, socks.Succeeded).Write(conn); err != nil {
+		return "", fmt.Errorf("socks.NewUserPassResponse.Write: %w", err)
+	}
+	return req.Username, nil
 }
 
-func (s *Server) handleConnect(src net.Conn, req *socks.Request) error {
+func (s *Server) handleConnect(src net.Conn, req *socks.Request, user string) error {
 	srcAddr := src.RemoteAddr().String()
 	destAddr := req.Addr.String()
 
-	dest, err := base.Connect(destAddr, s.so_mark)
+	link := &common.ConnLink{
+		LConn:    src,
+		LAddr:    srcAddr,
+		RAddr:    destAddr,
+		User:     user,
+		Protocol: sniff.TCP,
+	}
+	dest, err := s.Dial(context.Background(), link)
 	if err != nil {
 		if err := socks.NewReply(socks.HostUnreachable, nil).Write(src); err != nil {
-			slog.Error("socks.NewReply.Write", slog.String("srcAddr", srcAddr), slog.Any("error", err))
+			slog.Error("socks.NewReply.Write", slog.String("src_addr", srcAddr), slog.Any("error", err))
 		}
-		return fmt.Errorf("base.Connect: %w, dest: %s", err, destAddr)
+		return fmt.Errorf("s.Dial: %w, dest: %s", err, destAddr)
 	}
+	link.RConn = dest
 
 	if err := socks.NewReply(socks.Succeeded, nil).Write(src); err != nil {
 		_ = dest.Close()
 		return fmt.Errorf("socks.NewReply.Write: %w", err)
 	}
 
-	s.ServeConnLink(&common.ConnLink{
-		LConn:    src,
-		RConn:    dest,
-		LAddr:    srcAddr,
-		RAddr:    destAddr,
-		Protocol: sniff.TCP,
-	})
+	s.ServeConnLink(link)
 
 	return nil
 }
 
-func (s *Server) handleBind(conn net.Conn) error {
+func (s *Server) handleBind(conn net.Conn, user string) error {
 	srcAddr := conn.RemoteAddr().String()
 	listener, err := net.ListenTCP("tcp", nil)
 	if err != nil {
 		if err := socks.NewReply(socks.Failure, nil).Write(conn); err != nil {
-			slog.Error("socks.NewReply.Write", slog.String("srcAddr", srcAddr), slog.Any("error", err))
+			slog.Error("socks.NewReply.Write", slog.String("src_addr", srcAddr), slog.Any("error", err))
 		}
 		return fmt.Errorf("net.ListenTCP: %w", err)
 	}
@@ -249,7 +287,7 @@ func (s *Server) handleBind(conn net.Conn) error {
 	_ = listener.Close()
 	if err != nil {
 		if err := socks.NewReply(socks.Failure, nil).Write(conn); err != nil {
-			slog.Error("socks.NewReply.Write", slog.String("srcAddr", srcAddr), slog.Any("error", err))
+			slog.Error("socks.NewReply.Write", slog.String("src_addr", srcAddr), slog.Any("error", err))
 		}
 		return fmt.Errorf("listener.AcceptTCP: %w", err)
 	}
@@ -267,142 +305,8 @@ func (s *Server) handleBind(conn net.Conn) error {
 		RConn:    newConn,
 		LAddr:    srcAddr,
 		RAddr:    newConn.RemoteAddr().String(),
+		User:     user,
 		Protocol: sniff.TCP,
 	})
 	return nil
 }
-
-func (s *Server) handleUDPAssociate(conn net.Conn) error {
-	srcAddr := conn.RemoteAddr().String()
-
-	udp, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		if err := socks.NewReply(socks.Failure, nil).Write(conn); err != nil {
-			slog.Error("socks.NewReply.Write", slog.String("srcAddr", srcAddr), slog.Any("error", err))
-		}
-		return fmt.Errorf("net.ListenUDP: %w", err)
-	}
-
-	addr, _ := socks.NewAddrFromAddr(udp.LocalAddr(), conn.LocalAddr())
-	if err := socks.NewReply(socks.Succeeded, addr).Write(conn); err != nil {
-		_ = udp.Close()
-		return fmt.Errorf("socks.NewReply.Write: %w", err)
-	}
-
-	slog.Info("UDP associate established", slog.String("srcAddr", srcAddr), slog.String("udpAddr", udp.LocalAddr().String()))
-
-	s.tunnelUDP(conn, udp)
-	return nil
-}
-
-func (s *Server) tunnelUDP(conn net.Conn, udp *net.UDPConn) {
-	srcAddr := conn.RemoteAddr().String()
-	tcpRemote := conn.RemoteAddr().(*net.TCPAddr)
-
-	var clientUDPAddr *net.UDPAddr
-
-	done := make(chan struct{})
-
-	go func() {
-		defer func() {
-			_ = udp.Close()
-		}()
-
-		b := make([]byte, 64*1024)
-
-		for {
-			select {
-			case <-done:
-				return
-			default:
-			}
-
-			_ = udp.SetReadDeadline(time.Now().Add(time.Second * 30))
-			n, addr, err := udp.ReadFrom(b)
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
-				}
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				slog.Error("udp.ReadFrom", slog.String("srcAddr", srcAddr), slog.Any("error", err))
-				continue
-			}
-
-			udpAddr, ok := addr.(*net.UDPAddr)
-			if !ok {
-				continue
-			}
-
-			isFromClient := udpAddr.IP.Equal(tcpRemote.IP)
-			if isFromClient {
-				clientUDPAddr = udpAddr
-
-				dgram, err := socks.ReadUDPDatagram(bytes.NewReader(b[:n]))
-				if err != nil {
-					slog.Error("socks.ReadUDPDatagram error", slog.String("srcAddr", srcAddr), slog.Any("error", err))
-					continue
-				}
-
-				destAddr, err := net.ResolveUDPAddr("udp", dgram.Header.Addr.String())
-				if err != nil {
-					slog.Error("net.ResolveUDPAddr error",
-						slog.String("srcAddr", srcAddr),
-						slog.String("destAddr", dgram.Header.Addr.String()),
-						slog.Any("error", err))
-					continue
-				}
-
-				if _, err := udp.WriteTo(dgram.Data, destAddr); err != nil {
-					slog.Error("udp.WriteTo dest error",
-						slog.String("srcAddr", srcAddr),
-						slog.String("destAddr", destAddr.String()),
-						slog.Any("error", err))
-					continue
-				}
-
-				slog.Debug("UDP relay request",
-					slog.String("from", addr.String()),
-					slog.String("to", destAddr.String()),
-					slog.Int("bytes", len(dgram.Data)))
-
-			} else {
-				if clientUDPAddr == nil {
-					continue
-				}
-
-				saddr, _ := socks.NewAddr(addr.String())
-				dgram := socks.NewUDPDatagram(
-					socks.NewUDPHeader(0, 0, saddr), b[:n])
-
-				var writer bytes.Buffer
-				if err := dgram.Write(&writer); err != nil {
-					slog.Debug("dgram.Write error", slog.String("srcAddr", srcAddr), slog.Any("error", err))
-					continue
-				}
-
-				if _, err := udp.WriteTo(writer.Bytes(), clientUDPAddr); err != nil {
-					slog.Debug("udp.WriteTo client error", slog.String("srcAddr", srcAddr), slog.Any("error", err))
-					continue
-				}
-
-				slog.Debug("UDP relay response",
-					slog.String("from", addr.String()),
-					slog.String("to", clientUDPAddr.String()),
-					slog.Int("bytes", n))
-			}
-		}
-	}()
-
-	// tcp connection monitor
-	b := make([]byte, 1)
-	for {
-		_ = conn.SetReadDeadline(time.Now().Add(time.Minute))
-		if _, err := conn.Read(b); err != nil {
-			slog.Info("TCP connection closed, stopping UDP relay", slog.String("srcAddr", srcAddr), slog.String("udpAddr", udp.LocalAddr().String()))
-			close(done)
-			return
-		}
-	}
-}
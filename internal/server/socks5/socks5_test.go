@@ -11,8 +11,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sunbk201/ua3f/internal/common"
 	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
 	"github.com/sunbk201/ua3f/internal/rewrite"
+	"github.com/sunbk201/ua3f/internal/sniff"
 	"github.com/sunbk201/ua3f/internal/statistics"
 	"golang.org/x/net/proxy"
 )
@@ -670,6 +673,112 @@ func TestSocks5Handshake(t *testing.T) {
 	})
 }
 
+func TestSocks5UserPassAuth(t *testing.T) {
+	echoSrv := NewEchoServer(t)
+	defer echoSrv.close()
+
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeSocks5,
+		BindAddress: "127.0.0.1",
+		Port:        0,
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeRule,
+		Socks5: config.Socks5Config{
+			Auth: config.AuthConfig{
+				Users: []config.AuthUser{
+					{Username: "alice", Password: "alicepass"},
+					{Username: "bob", Password: "bobpass"},
+				},
+			},
+		},
+		HeaderRules: []config.Rule{
+			{
+				Enabled:       true,
+				Type:          "USER",
+				MatchValue:    "alice",
+				Action:        "REPLACE",
+				RewriteHeader: "User-Agent",
+				RewriteValue:  "Alice-UA",
+			},
+		},
+	}
+
+	recorder := mockRecorder()
+	rw, err := rewrite.New(cfg, recorder)
+	if err != nil {
+		t.Fatalf("failed to create rewriter: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find available port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	cfg.Port = port
+	server := New(cfg, rw, recorder, nil, nil)
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	fetchUA := func(auth *proxy.Auth) (string, error) {
+		dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", port), auth, proxy.Direct)
+		if err != nil {
+			return "", err
+		}
+		client := &http.Client{
+			Transport: &http.Transport{Dial: dialer.Dial},
+			Timeout:   5 * time.Second,
+		}
+		req, err := http.NewRequest("GET", echoSrv.URL("/echo-ua"), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("User-Agent", "Original-UA")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	tests := []struct {
+		name    string
+		auth    *proxy.Auth
+		wantUA  string
+		wantErr bool
+	}{
+		{"USER rule matches alice", &proxy.Auth{User: "alice", Password: "alicepass"}, "Alice-UA", false},
+		{"USER rule skips bob", &proxy.Auth{User: "bob", Password: "bobpass"}, "Original-UA", false},
+		{"wrong password", &proxy.Auth{User: "alice", Password: "wrong"}, "", true},
+		{"no credentials", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ua, err := fetchUA(tt.auth)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected request to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if ua != tt.wantUA {
+				t.Errorf("User-Agent = %q, want %q", ua, tt.wantUA)
+			}
+		})
+	}
+}
+
 func TestSocks5ServerClose(t *testing.T) {
 	cfg := &config.Config{
 		ServerMode:  config.ServerModeSocks5,
@@ -1357,3 +1466,168 @@ func TestSocks5RestartRaceConditions(t *testing.T) {
 
 	t.Logf("Successfully completed %d rapid restarts with zero connection failures", numRestarts)
 }
+
+func TestSocks5HotReload(t *testing.T) {
+	echoSrv := NewEchoServer(t)
+	defer echoSrv.close()
+
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeSocks5,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeGlobal,
+		UserAgent:   "Before",
+	}
+
+	recorder := mockRecorder()
+	newRewriter := func(ua string) common.Rewriter {
+		cfg := *cfg
+		cfg.UserAgent = ua
+		rw, err := rewrite.New(&cfg, recorder)
+		if err != nil {
+			t.Fatalf("failed to create rewriter: %v", err)
+		}
+		return rw
+	}
+	rw := rewrite.NewReloadable(newRewriter("Before"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find available port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	cfg.Port = port
+	server := New(cfg, rw, recorder, nil, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var dials atomic.Int32
+	dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", port), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("failed to create SOCKS5 dialer: %v", err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				return dialer.Dial(network, addr)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	get := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, echoSrv.URL("/echo-ua"), nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to send request through proxy: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if ua := get(); ua != "Before" {
+		t.Fatalf("User-Agent before reload = %q, want %q", ua, "Before")
+	}
+	rw.Store(newRewriter("After"))
+	if ua := get(); ua != "After" {
+		t.Errorf("User-Agent after reload = %q, want %q", ua, "After")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("client dialed %d connections, want the first one kept across the reload", n)
+	}
+}
+
+func TestSocks5Metrics(t *testing.T) {
+	echoSrv := NewEchoServer(t)
+	defer echoSrv.close()
+
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeSocks5,
+		BindAddress: "127.0.0.1",
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeDirect,
+	}
+	recorder := mockRecorder()
+	recorder.Traffic = statistics.NewTrafficStats()
+	rw, err := rewrite.New(cfg, recorder)
+	if err != nil {
+		t.Fatalf("failed to create rewriter: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find available port: %v", err)
+	}
+	cfg.Port = listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	server := New(cfg, rw, recorder, nil, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() { _ = server.Close() }()
+	time.Sleep(100 * time.Millisecond)
+
+	active := metrics.ConnectionsActive.With(string(sniff.TCP))
+	activeBefore := active.Load()
+	upBefore, downBefore := metrics.UploadBytes.Load(), metrics.DownloadBytes.Load()
+
+	dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", cfg.Port), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("failed to create SOCKS5 dialer: %v", err)
+	}
+	conn, err := dialer.Dial("tcp", echoSrv.addr)
+	if err != nil {
+		t.Fatalf("failed to dial through SOCKS5: %v", err)
+	}
+
+	httpReq := "GET / HTTP/1.1\r\nHost: " + echoSrv.addr + "\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(httpReq)); err != nil {
+		t.Fatalf("failed to send HTTP request: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if n := active.Load() - activeBefore; n != 1 {
+		t.Errorf("active TCP connections grew by %d, want 1", n)
+	}
+	_ = conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for active.Load() != activeBefore && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if active.Load() != activeBefore {
+		t.Errorf("active TCP connections = %d after close, want %d", active.Load(), activeBefore)
+	}
+	if up := metrics.UploadBytes.Load() - upBefore; up != int64(len(httpReq)) {
+		t.Errorf("uploaded %d bytes, want %d", up, len(httpReq))
+	}
+	if down := metrics.DownloadBytes.Load() - downBefore; down != int64(len(resp)) {
+		t.Errorf("downloaded %d bytes, want %d", down, len(resp))
+	}
+
+	history := recorder.Traffic.History()
+	if len(history) != 1 {
+		t.Fatalf("traffic history has %d connections, want 1", len(history))
+	}
+	if c := history[0]; c.Upload != int64(len(httpReq)) || c.Download != int64(len(resp)) || c.EndTime == nil {
+		t.Errorf("closed connection = %+v, want %d bytes up and %d down", c, len(httpReq), len(resp))
+	}
+	devices := recorder.Traffic.Devices()
+	if len(devices) != 1 || devices[0].Name != "127.0.0.1" || devices[0].Download != int64(len(resp)) || devices[0].Active != 0 {
+		t.Errorf("devices = %+v, want 127.0.0.1 with %d bytes down", devices, len(resp))
+	}
+}
@@ -0,0 +1,466 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/sunbk201/ua3f/internal/common"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/metrics"
+	"github.com/sunbk201/ua3f/internal/rule"
+	"github.com/sunbk201/ua3f/internal/sniff"
+	"github.com/sunbk201/ua3f/internal/statistics"
+)
+
+const (
+	udpBufferSize    = 64 * 1024
+	udpSweepInterval = 5 * time.Second
+	// RFC 1928 §7 requires a reassembly timer of at least 5 seconds.
+	udpFragTimeout = 5 * time.Second
+	udpFragMaxSize = 64 * 1024
+	// Domain targets are resolved off the relay goroutine, queueing at most
+	// udpResolveQueue datagrams meanwhile.
+	udpResolveTimeout = 5 * time.Second
+	udpResolveQueue   = 16
+)
+
+// udpSession is one client-requested destination within a UDP association.
+type udpSession struct {
+	target     string       // DST.ADDR:DST.PORT as sent by the client
+	dest       *net.UDPAddr // nil while a domain target is resolving
+	queue      [][]byte     // datagrams received while resolving
+	blocked    bool         // blocked by a rule, or the target did not resolve
+	record     *statistics.ConnectionRecord
+	lastActive time.Time
+}
+
+// udpAssociation relays datagrams for a single UDP ASSOCIATE request.
+type udpAssociation struct {
+	s           *Server
+	udp         *net.UDPConn
+	srcAddr     string // remote address of the TCP control connection
+	clientIP    net.IP
+	client      *net.UDPAddr // learned from the first datagram
+	user        string
+	idleTimeout time.Duration
+
+	sessions map[string]*udpSession // keyed by target
+	peers    map[string]*udpSession // keyed by resolved destination
+	frags    udpReassembler
+	resolved chan udpResolved // results of the domain targets resolved by resolve
+	closed   chan struct{}    // closed once the relay has stopped
+}
+
+// udpResolved is the result of resolving the domain target of a session.
+type udpResolved struct {
+	sess *udpSession
+	addr *socks.Addr
+	dest *net.UDPAddr
+	err  error
+}
+
+func (s *Server) handleUDPAssociate(conn net.Conn, user string) error {
+	srcAddr := conn.RemoteAddr().String()
+
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		if err := socks.NewReply(socks.Failure, nil).Write(conn); err != nil {
+			slog.Error("socks.NewReply.Write", slog.String("src_addr", srcAddr), slog.Any("error", err))
+		}
+		return fmt.Errorf("net.ListenUDP: %w", err)
+	}
+
+	addr, _ := socks.NewAddrFromAddr(udp.LocalAddr(), conn.LocalAddr())
+	if err := socks.NewReply(socks.Succeeded, addr).Write(conn); err != nil {
+		_ = udp.Close()
+		return fmt.Errorf("socks.NewReply.Write: %w", err)
+	}
+
+	slog.Info("UDP associate established", slog.String("src_addr", srcAddr), slog.String("udpAddr", udp.LocalAddr().String()))
+
+	idleTimeout := time.Duration(s.Cfg.Socks5.UDPIdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = config.DefaultUDPIdleTimeout * time.Second
+	}
+
+	a := &udpAssociation{
+		s:           s,
+		udp:         udp,
+		srcAddr:     srcAddr,
+		clientIP:    conn.RemoteAddr().(*net.TCPAddr).IP,
+		user:        user,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*udpSession),
+		peers:       make(map[string]*udpSession),
+		resolved:    make(chan udpResolved, udpResolveQueue),
+		closed:      make(chan struct{}),
+	}
+
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		a.relay()
+	}()
+
+	// The association lives as long as the TCP control connection.
+	b := make([]byte, 1)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Minute))
+		if _, err := conn.Read(b); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			break
+		}
+	}
+
+	slog.Info("TCP connection closed, stopping UDP relay", slog.String("src_addr", srcAddr), slog.String("udpAddr", udp.LocalAddr().String()))
+	_ = udp.Close()
+	<-relayDone
+	close(a.closed)
+	a.closeSessions()
+	return nil
+}
+
+func (a *udpAssociation) relay() {
+	b := make([]byte, udpBufferSize)
+	lastSweep := time.Now()
+
+	for {
+		// resolve interrupts the read once a result is queued. Results are
+		// drained after the deadline is set so that none waits for the next read.
+		_ = a.udp.SetReadDeadline(time.Now().Add(udpSweepInterval))
+		a.drainResolved()
+		n, addr, err := a.udp.ReadFromUDP(b)
+
+		now := time.Now()
+		if now.Sub(lastSweep) >= udpSweepInterval {
+			a.sweep(now)
+			lastSweep = now
+		}
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			slog.Error("udp.ReadFromUDP", slog.String("src_addr", a.srcAddr), slog.Any("error", err))
+			continue
+		}
+
+		// Peers are checked before the client IP so that destinations on the
+		// client host are still recognised as replies.
+		switch {
+		case a.client != nil && a.client.IP.Equal(addr.IP) && a.client.Port == addr.Port:
+			a.handleRequest(b[:n], now)
+		case a.peers[addr.String()] != nil:
+			a.handleReply(a.peers[addr.String()], b[:n], addr, now)
+		case a.client == nil && a.clientIP.Equal(addr.IP):
+			a.client = addr
+			a.handleRequest(b[:n], now)
+		default:
+			slog.Debug("UDP datagram from unknown peer dropped", slog.String("src_addr", a.srcAddr), slog.String("from", addr.String()))
+		}
+	}
+}
+
+func (a *udpAssociation) handleRequest(b []byte, now time.Time) {
+	dgram, err := socks.ReadUDPDatagram(bytes.NewReader(b))
+	if err != nil {
+		slog.Error("socks.ReadUDPDatagram", slog.String("src_addr", a.srcAddr), slog.Any("error", err))
+		return
+	}
+
+	data, ok := a.frags.push(dgram.Header.Frag, dgram.Header.Addr.String(), dgram.Data, now)
+	if !ok {
+		return
+	}
+
+	sess := a.session(dgram.Header.Addr, now)
+	sess.lastActive = now
+	if sess.blocked {
+		return
+	}
+	if sess.dest == nil {
+		if len(sess.queue) < udpResolveQueue {
+			sess.queue = append(sess.queue, bytes.Clone(data))
+		}
+		return
+	}
+	a.forward(sess, data)
+}
+
+func (a *udpAssociation) forward(sess *udpSession, data []byte) {
+	if _, err := a.udp.WriteToUDP(data, sess.dest); err != nil {
+		slog.Error("udp.WriteToUDP dest",
+			slog.String("src_addr", a.srcAddr),
+			slog.String("dest_addr", sess.dest.String()),
+			slog.Any("error", err))
+		return
+	}
+	metrics.UploadBytes.Add(int64(len(data)))
+	sess.record.Traffic.AddUpload(int64(len(data)))
+
+	slog.Debug("UDP relay request",
+		slog.String("from", a.client.String()),
+		slog.String("to", sess.dest.String()),
+		slog.Int("bytes", len(data)))
+}
+
+func (a *udpAssociation) handleReply(sess *udpSession, b []byte, from *net.UDPAddr, now time.Time) {
+	sess.lastActive = now
+
+	saddr, _ := socks.NewAddr(from.String())
+	dgram := socks.NewUDPDatagram(socks.NewUDPHeader(0, 0, saddr), b)
+
+	var writer bytes.Buffer
+	if err := dgram.Write(&writer); err != nil {
+		slog.Debug("dgram.Write", slog.String("src_addr", a.srcAddr), slog.Any("error", err))
+		return
+	}
+
+	if _, err := a.udp.WriteToUDP(writer.Bytes(), a.client); err != nil {
+		slog.Debug("udp.WriteToUDP client", slog.String("src_addr", a.srcAddr), slog.Any("error", err))
+		return
+	}
+	metrics.DownloadBytes.Add(int64(len(b)))
+	sess.record.Traffic.AddDownload(int64(len(b)))
+
+	slog.Debug("UDP relay response",
+		slog.String("from", from.String()),
+		slog.String("to", a.client.String()),
+		slog.Int("bytes", len(b)))
+}
+
+// session returns the session for addr, creating it on the first datagram
+// to that destination. A domain target is resolved in the background; its
+// session has no dest until the result is handled by drainResolved.
+func (a *udpAssociation) session(addr *socks.Addr, now time.Time) *udpSession {
+	target := addr.String()
+	if sess, ok := a.sessions[target]; ok {
+		return sess
+	}
+
+	sess := &udpSession{
+		target:     target,
+		lastActive: now,
+	}
+	a.sessions[target] = sess
+	if addr.Type == socks.AddrDomain {
+		go a.resolve(sess, addr)
+		return sess
+	}
+	a.open(sess, addr, &net.UDPAddr{IP: net.ParseIP(addr.Host), Port: int(addr.Port)})
+	return sess
+}
+
+// resolve looks up the domain target of sess and hands the result to the relay.
+func (a *udpAssociation) resolve(sess *udpSession, addr *socks.Addr) {
+	lookupIP := a.s.lookupIP
+	if lookupIP == nil {
+		lookupIP = net.DefaultResolver.LookupIP
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), udpResolveTimeout)
+	defer cancel()
+
+	r := udpResolved{sess: sess, addr: addr}
+	ips, err := lookupIP(ctx, "ip", addr.Host)
+	switch {
+	case err != nil:
+		r.err = err
+	case len(ips) == 0:
+		r.err = fmt.Errorf("no addresses for %s", addr.Host)
+	default:
+		// Prefer IPv4 like net.ResolveUDPAddr.
+		ip := ips[0]
+		for _, candidate := range ips {
+			if candidate.To4() != nil {
+				ip = candidate
+				break
+			}
+		}
+		r.dest = &net.UDPAddr{IP: ip, Port: int(addr.Port)}
+	}
+
+	select {
+	case a.resolved <- r:
+		_ = a.udp.SetReadDeadline(time.Now())
+	case <-a.closed:
+	}
+}
+
+// drainResolved opens the sessions whose domain target has been resolved and
+// relays the datagrams queued meanwhile.
+func (a *udpAssociation) drainResolved() {
+	for {
+		select {
+		case r := <-a.resolved:
+			a.handleResolved(r)
+		default:
+			return
+		}
+	}
+}
+
+func (a *udpAssociation) handleResolved(r udpResolved) {
+	sess := r.sess
+	if a.sessions[sess.target] != sess {
+		return // expired while resolving
+	}
+	queue := sess.queue
+	sess.queue = nil
+	if r.err != nil {
+		slog.Error("UDP session setup failed",
+			slog.String("src_addr", a.srcAddr),
+			slog.String("dest_addr", sess.target),
+			slog.Any("error", r.err))
+		sess.blocked = true
+		return
+	}
+	a.open(sess, r.addr, r.dest)
+	if sess.blocked {
+		return
+	}
+	for _, data := range queue {
+		a.forward(sess, data)
+	}
+}
+
+// open sets the destination of sess and evaluates the rules against it.
+func (a *udpAssociation) open(sess *udpSession, addr *socks.Addr, dest *net.UDPAddr) {
+	sess.dest = dest
+	target := sess.target
+
+	datagram := &common.Datagram{
+		SrcAddr: a.client.String(),
+		DstAddr: target,
+		SrcIP:   a.client.IP,
+		DstIP:   dest.IP,
+		DstPort: uint16(dest.Port),
+	}
+	if addr.Type == socks.AddrDomain {
+		datagram.Host = addr.Host
+	}
+	metadata := &common.Metadata{Datagram: datagram}
+	metadata.SetUser(a.user)
+
+	if r := rule.MatchConnection(a.s.Rewriter.HeaderRules(), metadata); r != nil {
+		switch r.Action().Type() {
+		case common.ActionDrop, common.ActionReject:
+			_, _ = r.Action().Execute(metadata)
+			sess.blocked = true
+		}
+	}
+
+	if sess.blocked {
+		slog.Info("UDP session blocked by rule", slog.Any("metadata", metadata))
+		return
+	}
+
+	sess.record = &statistics.ConnectionRecord{
+		Protocol:  sniff.UDP,
+		SrcAddr:   datagram.SrcAddr,
+		DestAddr:  target,
+		Host:      datagram.Host,
+		StartTime: time.Now(),
+		Traffic:   &statistics.Traffic{},
+	}
+	a.s.Recorder.AddRecord(sess.record)
+	a.peers[dest.String()] = sess
+
+	slog.Info("UDP session created", slog.Any("metadata", metadata), slog.String("dest", dest.String()))
+}
+
+// sweep removes sessions that have been idle longer than the idle timeout.
+func (a *udpAssociation) sweep(now time.Time) {
+	for target, sess := range a.sessions {
+		if now.Sub(sess.lastActive) < a.idleTimeout {
+			continue
+		}
+		slog.Debug("UDP session expired", slog.String("src_addr", a.srcAddr), slog.String("target", target))
+		a.removeSession(sess)
+	}
+}
+
+func (a *udpAssociation) closeSessions() {
+	for _, sess := range a.sessions {
+		a.removeSession(sess)
+	}
+}
+
+func (a *udpAssociation) removeSession(sess *udpSession) {
+	delete(a.sessions, sess.target)
+	if sess.dest != nil && a.peers[sess.dest.String()] == sess {
+		delete(a.peers, sess.dest.String())
+	}
+	if sess.record != nil {
+		a.s.Recorder.RemoveRecord(sess.record)
+	}
+}
+
+// udpReassembler implements the SOCKS5 UDP fragmentation scheme from RFC 1928 §7.
+// Fragments must arrive in order starting at position 1; anything else resets
+// the queue and the partial datagram is dropped.
+type udpReassembler struct {
+	target   string
+	next     uint8 // expected fragment position, 0 when the queue is empty
+	data     []byte
+	deadline time.Time
+}
+
+// push adds a datagram with the given FRAG field and returns the payload to
+// relay once a complete datagram is available.
+func (r *udpReassembler) push(frag uint8, target string, data []byte, now time.Time) ([]byte, bool) {
+	if frag == 0 {
+		r.reset()
+		return data, true
+	}
+
+	pos := frag & 0x7f
+	last := frag&0x80 != 0
+
+	if r.next != 0 && (now.After(r.deadline) || target != r.target) {
+		r.reset()
+	}
+	if r.next == 0 {
+		if pos != 1 {
+			return nil, false
+		}
+		r.target = target
+		r.deadline = now.Add(udpFragTimeout)
+		r.next = 1
+	}
+	if pos != r.next || len(r.data)+len(data) > udpFragMaxSize {
+		r.reset()
+		return nil, false
+	}
+
+	r.data = append(r.data, data...)
+	r.next++
+
+	if last {
+		out := r.data
+		r.reset()
+		return out, true
+	}
+	if r.next > 0x7f {
+		r.reset()
+	}
+	return nil, false
+}
+
+func (r *udpReassembler) reset() {
+	r.target = ""
+	r.next = 0
+	r.data = nil
+}
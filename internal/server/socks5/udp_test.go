@@ -0,0 +1,293 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/rewrite"
+)
+
+func TestUDPReassembler(t *testing.T) {
+	type frag struct {
+		frag   uint8
+		target string
+		data   string
+		delay  time.Duration
+	}
+	tests := []struct {
+		name  string
+		frags []frag
+		want  []string
+	}{
+		{
+			name:  "standalone",
+			frags: []frag{{0, "a:1", "hello", 0}},
+			want:  []string{"hello"},
+		},
+		{
+			name:  "in order",
+			frags: []frag{{1, "a:1", "he", 0}, {2, "a:1", "ll", 0}, {0x83, "a:1", "o", 0}},
+			want:  []string{"hello"},
+		},
+		{
+			name:  "out of order resets",
+			frags: []frag{{1, "a:1", "he", 0}, {3, "a:1", "ll", 0}, {0x82, "a:1", "o", 0}},
+			want:  nil,
+		},
+		{
+			name:  "not starting at one",
+			frags: []frag{{2, "a:1", "he", 0}, {0x83, "a:1", "o", 0}},
+			want:  nil,
+		},
+		{
+			name:  "standalone discards queue",
+			frags: []frag{{1, "a:1", "he", 0}, {0, "a:1", "x", 0}, {0x82, "a:1", "o", 0}},
+			want:  []string{"x"},
+		},
+		{
+			name:  "target change resets",
+			frags: []frag{{1, "a:1", "he", 0}, {1, "b:1", "ab", 0}, {0x82, "b:1", "c", 0}},
+			want:  []string{"abc"},
+		},
+		{
+			name:  "timeout resets",
+			frags: []frag{{1, "a:1", "he", 0}, {0x82, "a:1", "o", udpFragTimeout + time.Second}},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r udpReassembler
+			now := time.Now()
+			var got []string
+			for _, f := range tt.frags {
+				now = now.Add(f.delay)
+				if data, ok := r.push(f.frag, f.target, []byte(f.data), now); ok {
+					got = append(got, string(data))
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func newUDPEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to listen udp: %v", err)
+	}
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestSocks5UDPRelay(t *testing.T) {
+	allowed := newUDPEchoServer(t)
+	defer func() { _ = allowed.Close() }()
+	blocked := newUDPEchoServer(t)
+	defer func() { _ = blocked.Close() }()
+
+	blockedPort := blocked.LocalAddr().(*net.UDPAddr).Port
+
+	cfg := &config.Config{
+		ServerMode:  config.ServerModeSocks5,
+		BindAddress: "127.0.0.1",
+		Port:        0,
+		LogLevel:    "error",
+		RewriteMode: config.RewriteModeRule,
+		HeaderRules: []config.Rule{
+			{
+				Enabled:          true,
+				Type:             "DEST-PORT",
+				MatchValue:       strconv.Itoa(blockedPort),
+				Action:           "DROP",
+				RewriteDirection: "REQUEST",
+			},
+		},
+	}
+
+	recorder := mockRecorder()
+	rw, err := rewrite.New(cfg, recorder)
+	if err != nil {
+		t.Fatalf("failed to create rewriter: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find available port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	cfg.Port = port
+	server := New(cfg, rw, recorder, nil, nil)
+	release := make(chan struct{})
+	server.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if host != "slow.example" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		select {
+		case <-release:
+			return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("failed to send greeting: %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read method selection: %v", err)
+	}
+	if err := socks.NewRequest(socks.CmdUDP, &socks.Addr{Type: socks.AddrIPv4, Host: "0.0.0.0"}).Write(conn); err != nil {
+		t.Fatalf("failed to send UDP ASSOCIATE request: %v", err)
+	}
+	reply, err := socks.ReadReply(conn)
+	if err != nil {
+		t.Fatalf("failed to read UDP ASSOCIATE reply: %v", err)
+	}
+	if reply.Rep != socks.Succeeded {
+		t.Fatalf("UDP ASSOCIATE failed with reply code: %d", reply.Rep)
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", reply.Addr.String())
+	if err != nil {
+		t.Fatalf("failed to resolve relay address: %v", err)
+	}
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	sendTo := func(frag uint8, target string, data string) {
+		t.Helper()
+		addr, err := socks.NewAddr(target)
+		if err != nil {
+			t.Fatalf("failed to parse target: %v", err)
+		}
+		var b bytes.Buffer
+		if err := socks.NewUDPDatagram(socks.NewUDPHeader(0, frag, addr), []byte(data)).Write(&b); err != nil {
+			t.Fatalf("failed to encode datagram: %v", err)
+		}
+		if _, err := client.Write(b.Bytes()); err != nil {
+			t.Fatalf("failed to send datagram: %v", err)
+		}
+	}
+	send := func(frag uint8, dest net.Addr, data string) {
+		t.Helper()
+		sendTo(frag, dest.String(), data)
+	}
+	recv := func(timeout time.Duration) (*socks.UDPDatagram, error) {
+		b := make([]byte, 64*1024)
+		_ = client.SetReadDeadline(time.Now().Add(timeout))
+		n, err := client.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return socks.ReadUDPDatagram(bytes.NewReader(b[:n]))
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		send(0, allowed.LocalAddr(), "ping")
+		dgram, err := recv(2 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive echo: %v", err)
+		}
+		if string(dgram.Data) != "ping" {
+			t.Errorf("got %q, want %q", dgram.Data, "ping")
+		}
+		if dgram.Header.Addr.String() != allowed.LocalAddr().String() {
+			t.Errorf("reply addr = %s, want %s", dgram.Header.Addr, allowed.LocalAddr())
+		}
+	})
+
+	t.Run("fragmented", func(t *testing.T) {
+		send(1, allowed.LocalAddr(), "frag")
+		send(0x82, allowed.LocalAddr(), "mented")
+		dgram, err := recv(2 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive echo: %v", err)
+		}
+		if string(dgram.Data) != "fragmented" {
+			t.Errorf("got %q, want %q", dgram.Data, "fragmented")
+		}
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		send(0, blocked.LocalAddr(), "ping")
+		if dgram, err := recv(500 * time.Millisecond); err == nil {
+			t.Errorf("expected no reply from blocked destination, got %q", dgram.Data)
+		}
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		allowedPort := strconv.Itoa(allowed.LocalAddr().(*net.UDPAddr).Port)
+		sendTo(0, net.JoinHostPort("slow.example", allowedPort), "queued")
+
+		// The relay keeps serving other destinations while the domain resolves.
+		send(0, allowed.LocalAddr(), "direct")
+		dgram, err := recv(2 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive echo while resolving: %v", err)
+		}
+		if string(dgram.Data) != "direct" {
+			t.Fatalf("got %q, want %q", dgram.Data, "direct")
+		}
+
+		close(release)
+		dgram, err = recv(2 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive echo of the queued datagram: %v", err)
+		}
+		if string(dgram.Data) != "queued" {
+			t.Errorf("got %q, want %q", dgram.Data, "queued")
+		}
+		if dgram.Header.Addr.String() != allowed.LocalAddr().String() {
+			t.Errorf("reply addr = %s, want %s", dgram.Header.Addr, allowed.LocalAddr())
+		}
+
+		sendTo(0, net.JoinHostPort("missing.example", allowedPort), "ping")
+		if dgram, err := recv(500 * time.Millisecond); err == nil {
+			t.Errorf("expected no reply for an unresolvable target, got %q", dgram.Data)
+		} else if netErr := (net.Error)(nil); !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("recv() error = %v, want a timeout", err)
+		}
+	})
+}
@@ -156,6 +156,23 @@ func (s *Server) IptSetTproxy(ipt *iptables.IPTables) error {
 	if err != nil {
 		return err
 	}
+	if s.Cfg.DNS.Enabled && s.Cfg.DNS.FakeIP {
+		// fake ip handed out by the built-in dns server
+		var RuleTproxyFakeIP = []string{
+			"-p", "tcp",
+			"-d", s.Cfg.DNS.FakeIPRange,
+			"-m", "mark",
+			"!", "--mark", strconv.Itoa(s.so_mark),
+			"-j", "TPROXY",
+			"--on-ip", "127.0.0.1",
+			"--on-port", strconv.Itoa(s.Cfg.Port),
+			"--tproxy-mark", s.tproxyFwMark,
+		}
+		err = ipt.Append(table, chainPre, RuleTproxyFakeIP...)
+		if err != nil {
+			return err
+		}
+	}
 	if !s.includeLanRoutes {
 		err = ipt.Append(table, chainPre, netfilter.IptRuleIgnoreLAN...)
 		if err != nil {
@@ -234,6 +251,28 @@ func (s *Server) IptSetTproxy(ipt *iptables.IPTables) error {
 	if err != nil {
 		return err
 	}
+	if s.Cfg.DNS.Enabled && s.Cfg.DNS.FakeIP {
+		var RuleMarkFakeIP = []string{
+			"-p", "tcp",
+			"-d", s.Cfg.DNS.FakeIPRange,
+			"-m", "mark",
+			"!", "--mark", strconv.Itoa(s.so_mark),
+			"-j", "MARK",
+			"--set-mark", s.tproxyFwMark,
+		}
+		err = ipt.Append(table, chainOut, RuleMarkFakeIP...)
+		if err != nil {
+			return err
+		}
+		var RuleReturnFakeIP = []string{
+			"-d", s.Cfg.DNS.FakeIPRange,
+			"-j", "RETURN",
+		}
+		err = ipt.Append(table, chainOut, RuleReturnFakeIP...)
+		if err != nil {
+			return err
+		}
+	}
 	if !s.includeLanRoutes {
 		err = ipt.Append(table, chainOut, netfilter.IptRuleIgnoreLAN...)
 		if err != nil {
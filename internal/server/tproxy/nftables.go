@@ -26,17 +26,21 @@ func (s *Server) nftSetup() error {
 
 	tx := nft.NewTransaction()
 	tx.Add(s.Nftable)
+	s.nftRuleset(tx)
 
+	if err := nft.Run(context.TODO(), tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nftRuleset adds the sets, chains and rules of the table to tx.
+func (s *Server) nftRuleset(tx *knftables.Transaction) {
 	s.NftSetLanIP(tx, s.Nftable)
 	s.NftSetLanIP6(tx, s.Nftable)
 	s.NftSetSkipIP(tx, s.Nftable)
 	s.NftSetSkipIP6(tx, s.Nftable)
 	s.NftSetTproxy(tx, s.Nftable)
-
-	if err := nft.Run(context.TODO(), tx); err != nil {
-		return err
-	}
-	return nil
 }
 
 func (s *Server) nftCleanup() error {
@@ -128,6 +132,21 @@ func (s *Server) NftSetTproxy(tx *knftables.Transaction, table *knftables.Table)
 		Rule:  netfilter.NftRuleIgnoreReply,
 	})
 
+	if s.Cfg.DNS.Enabled && s.Cfg.DNS.FakeIP {
+		// fake ip handed out by the built-in dns server
+		tx.Add(&knftables.Rule{
+			Chain: prerouting.Name,
+			Rule: knftables.Concat(
+				"ip daddr", s.Cfg.DNS.FakeIPRange,
+				"meta l4proto tcp",
+				fmt.Sprintf("mark != %d", s.so_mark),
+				"mark set", s.tproxyFwMark,
+				fmt.Sprintf("tproxy ip to 127.0.0.1:%d", s.Cfg.Port),
+				"counter accept",
+			),
+		})
+	}
+
 	tx.Add(&knftables.Rule{
 		Chain: prerouting.Name,
 		Rule:  netfilter.NftRuleIgnoreFakeIP,
@@ -237,6 +256,19 @@ func (s *Server) NftSetTproxy(tx *knftables.Transaction, table *knftables.Table)
 		Rule:  netfilter.NftRuleIgnoreReply,
 	})
 
+	if s.Cfg.DNS.Enabled && s.Cfg.DNS.FakeIP {
+		tx.Add(&knftables.Rule{
+			Chain: output.Name,
+			Rule: knftables.Concat(
+				"ip daddr", s.Cfg.DNS.FakeIPRange,
+				"meta l4proto tcp",
+				fmt.Sprintf("mark != %d", s.so_mark),
+				"mark set", s.tproxyFwMark,
+				"counter accept",
+			),
+		})
+	}
+
 	tx.Add(&knftables.Rule{
 		Chain: output.Name,
 		Rule:  netfilter.NftRuleIgnoreFakeIP,
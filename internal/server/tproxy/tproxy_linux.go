@@ -72,6 +72,7 @@ func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder, middle
 			Family: knftables.InetFamily,
 		},
 		NftSetup:   s.nftSetup,
+		NftRuleset: s.nftRuleset,
 		NftCleanup: s.nftCleanup,
 		NftWatch:   s.nftWatch,
 		IptSetup:   s.iptSetup,
@@ -84,6 +85,11 @@ func New(cfg *config.Config, rw common.Rewriter, rc *statistics.Recorder, middle
 func (s *Server) Start() error {
 	var err error
 
+	if s.Outbound, err = base.NewOutbound(s.Cfg, s.so_mark); err != nil {
+		slog.Error("base.NewOutbound", slog.Any("error", err))
+		return err
+	}
+
 	err = s.Firewall.Setup(s.Cfg)
 	if err != nil {
 		slog.Error("s.Firewall.Setup", slog.Any("error", err))
@@ -213,17 +219,18 @@ func (s *Server) HandleClient(client net.Conn) {
 		return
 	}
 
-	target, err := base.Connect(addr, s.so_mark)
+	link := &common.ConnLink{
+		LConn: client,
+		LAddr: client.RemoteAddr().String(),
+		RAddr: addr,
+	}
+	target, err := s.Dial(context.Background(), link)
 	if err != nil {
 		_ = client.Close()
-		slog.Warn("base.Connect", slog.String("addr", addr), slog.Any("error", err))
+		slog.Warn("s.Dial", slog.String("addr", addr), slog.Any("error", err))
 		return
 	}
+	link.RConn = target
 
-	s.ServeConnLink(&common.ConnLink{
-		LConn: client,
-		RConn: target,
-		LAddr: client.RemoteAddr().String(),
-		RAddr: addr,
-	})
+	s.ServeConnLink(link)
 }
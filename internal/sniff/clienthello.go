@@ -68,13 +68,33 @@ func SniffTLSClientHello(reader *bufio.Reader) (*TLSInfo, error) {
 
 // extractSNI parses the handshake message to find SNI extension.
 func extractSNI(data []byte) string {
+	sni, _ := locateSNI(data)
+	return sni
+}
+
+// LocateTLSSNI finds the SNI hostname in a TLS record carrying a ClientHello.
+// The returned offset is relative to the start of the record; it is -1 if no SNI was found.
+func LocateTLSSNI(record []byte) (serverName string, offset int) {
+	if len(record) < 5 || record[0] != 0x16 || record[1] != 0x03 {
+		return "", -1
+	}
+	sni, off := locateSNI(record[5:])
+	if off < 0 {
+		return "", -1
+	}
+	return sni, 5 + off
+}
+
+// locateSNI parses the handshake message to find SNI extension,
+// returning the hostname and its offset within data.
+func locateSNI(data []byte) (string, int) {
 	if len(data) < 39 {
-		return ""
+		return "", -1
 	}
 
 	// Handshake type: ClientHello = 0x01
 	if data[0] != 0x01 {
-		return ""
+		return "", -1
 	}
 
 	// Handshake length (3 bytes)
@@ -82,47 +102,48 @@ func extractSNI(data []byte) string {
 	if hsLen > len(data)-4 {
 		hsLen = len(data) - 4
 	}
+	base := 4
 	data = data[4 : 4+hsLen]
 
 	// Client version (2 bytes) + Random (32 bytes) = 34 bytes
 	if len(data) < 34 {
-		return ""
+		return "", -1
 	}
 	pos := 34
 
 	// Session ID
 	if pos >= len(data) {
-		return ""
+		return "", -1
 	}
 	sessionIDLen := int(data[pos])
 	pos += 1 + sessionIDLen
 	if pos >= len(data) {
-		return ""
+		return "", -1
 	}
 
 	// Cipher suites
 	if pos+2 > len(data) {
-		return ""
+		return "", -1
 	}
 	cipherSuitesLen := int(binary.BigEndian.Uint16(data[pos : pos+2]))
 	pos += 2 + cipherSuitesLen
 	if pos >= len(data) {
-		return ""
+		return "", -1
 	}
 
 	// Compression methods
 	if pos >= len(data) {
-		return ""
+		return "", -1
 	}
 	compressionLen := int(data[pos])
 	pos += 1 + compressionLen
 	if pos >= len(data) {
-		return ""
+		return "", -1
 	}
 
 	// Extensions
 	if pos+2 > len(data) {
-		return ""
+		return "", -1
 	}
 	extensionsLen := int(binary.BigEndian.Uint16(data[pos : pos+2]))
 	pos += 2
@@ -142,19 +163,24 @@ func extractSNI(data []byte) string {
 
 		// SNI extension type = 0x0000
 		if extType == 0x0000 {
-			return parseSNIExtension(data[pos : pos+extLen])
+			sni, off := parseSNIExtension(data[pos : pos+extLen])
+			if off < 0 {
+				return "", -1
+			}
+			return sni, base + pos + off
 		}
 
 		pos += extLen
 	}
 
-	return ""
+	return "", -1
 }
 
-// parseSNIExtension parses the SNI extension data to extract the hostname.
-func parseSNIExtension(data []byte) string {
+// parseSNIExtension parses the SNI extension data to extract the hostname
+// and its offset within data.
+func parseSNIExtension(data []byte) (string, int) {
 	if len(data) < 5 {
-		return ""
+		return "", -1
 	}
 
 	// Server name list length (2 bytes)
@@ -179,14 +205,14 @@ func parseSNIExtension(data []byte) string {
 		if nameType == 0 {
 			name := string(data[pos : pos+nameLen])
 			if isValidHostname(name) {
-				return name
+				return name, pos
 			}
 		}
 
 		pos += nameLen
 	}
 
-	return ""
+	return "", -1
 }
 
 // isValidHostname performs basic hostname validation.
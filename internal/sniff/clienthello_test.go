@@ -145,3 +145,18 @@ func TestSniffTLSClientHello_NoSNI(t *testing.T) {
 		t.Fatalf("expected empty SNI, got '%s'", info.ServerName)
 	}
 }
+
+func TestLocateTLSSNI(t *testing.T) {
+	data := buildClientHello("example.com")
+	sni, off := LocateTLSSNI(data)
+	if sni != "example.com" {
+		t.Fatalf("expected SNI 'example.com', got '%s'", sni)
+	}
+	if string(data[off:off+len(sni)]) != sni {
+		t.Fatalf("offset %d does not point at the SNI", off)
+	}
+
+	if _, off := LocateTLSSNI([]byte("GET / HTTP/1.1\r\n\r\n")); off != -1 {
+		t.Fatalf("expected -1 for non-TLS data, got %d", off)
+	}
+}
@@ -17,6 +17,7 @@ const (
 	TLS       Protocol = "TLS"
 	WebSocket Protocol = "WebSocket"
 	SSH       Protocol = "SSH"
+	UDP       Protocol = "UDP"
 )
 
 var ErrPeekTimeout = errors.New("peek timeout")
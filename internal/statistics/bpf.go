@@ -0,0 +1,96 @@
+package statistics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/bpf/bpfstats"
+)
+
+// BPFStats periodically dumps the counters of the running BPF programs.
+type BPFStats struct {
+	dumpFile     string
+	dumpWriter   *bufio.Writer
+	dumpInterval time.Duration
+}
+
+func NewBPFStats(dumpFile string) *BPFStats {
+	return &BPFStats{
+		dumpFile:     dumpFile,
+		dumpWriter:   bufio.NewWriter(nil),
+		dumpInterval: 5 * time.Second,
+	}
+}
+
+func (b *BPFStats) Run() {
+	go func() {
+		dumpTicker := time.NewTicker(b.dumpInterval)
+		defer dumpTicker.Stop()
+
+		for range dumpTicker.C {
+			b.Dump()
+		}
+	}()
+}
+
+// Dump writes the counters as "name value" lines. Nothing is written while no BPF offload runs.
+func (b *BPFStats) Dump() {
+	snap := bpfstats.Read()
+	if !snap.Active() {
+		return
+	}
+
+	f, err := createDumpFile(b.dumpFile)
+	if err != nil {
+		slog.Error("createDumpFile", slog.Any("error", err))
+		return
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Error("dumpFile.Close", slog.Any("error", err))
+		}
+	}()
+
+	b.dumpWriter.Reset(f)
+	defer func() {
+		if err := b.dumpWriter.Flush(); err != nil {
+			slog.Error("bufio.Writer.Flush", slog.Any("error", err))
+		}
+	}()
+
+	if err := WriteBPFStats(b.dumpWriter, snap); err != nil {
+		slog.Error("Dump WriteBPFStats", slog.Any("error", err))
+	}
+}
+
+// WriteBPFStats writes the counters of snap as "name value" lines.
+func WriteBPFStats(w io.Writer, snap bpfstats.Snapshot) error {
+	boolValue := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	if tc := snap.TC; tc != nil {
+		if _, err := fmt.Fprintf(w, "tc.available %d\n", boolValue(tc.Available)); err != nil {
+			return err
+		}
+		for _, name := range tc.FeatureNames() {
+			f := tc.Features[name]
+			if _, err := fmt.Fprintf(w, "tc.%s.seen %d\ntc.%s.rewritten %d\n", name, f.Seen, name, f.Rewritten); err != nil {
+				return err
+			}
+		}
+	}
+	if sm := snap.Sockmap; sm != nil {
+		_, err := fmt.Fprintf(w, "sockmap.available %d\nsockmap.redirected_packets %d\nsockmap.redirected_bytes %d\nsockmap.passed_packets %d\nsockmap.failed_redirects %d\n",
+			boolValue(sm.Available), sm.RedirectedPackets, sm.RedirectedBytes, sm.PassedPackets, sm.FailedRedirects)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
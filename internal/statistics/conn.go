@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"log/slog"
-	"os"
 	"sort"
 	"sync"
 	"time"
@@ -26,9 +25,12 @@ type ConnectionRecordList struct {
 
 type ConnectionRecord struct {
 	StartTime time.Time
+	EndTime   time.Time // zero while the connection is open
 	Protocol  sniff.Protocol
 	SrcAddr   string
 	DestAddr  string
+	Host      string   // destination domain, if known
+	Traffic   *Traffic // nil for records that only update the protocol
 }
 
 func NewConnectionRecordList(dumpFile string) *ConnectionRecordList {
@@ -83,6 +85,8 @@ func (l *ConnectionRecordList) Add(record *ConnectionRecord) {
 			Protocol:  record.Protocol,
 			SrcAddr:   record.SrcAddr,
 			DestAddr:  record.DestAddr,
+			Host:      record.Host,
+			Traffic:   record.Traffic,
 			StartTime: startTime,
 		}
 	}
@@ -96,6 +100,23 @@ func (l *ConnectionRecordList) Remove(record *ConnectionRecord) {
 	delete(l.records, key)
 }
 
+// Connections returns the traffic of the open connections, newest first.
+func (l *ConnectionRecordList) Connections() []ConnectionTraffic {
+	now := time.Now()
+
+	l.mu.RLock()
+	conns := make([]ConnectionTraffic, 0, len(l.records))
+	for _, r := range l.records {
+		conns = append(conns, r.traffic(now))
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].StartTime.After(conns[j].StartTime)
+	})
+	return conns
+}
+
 func (l *ConnectionRecordList) Cleanup() {
 	cutoff := time.Now().Add(-l.cleanupInterval)
 
@@ -110,14 +131,14 @@ func (l *ConnectionRecordList) Cleanup() {
 }
 
 func (l *ConnectionRecordList) Dump() {
-	f, err := os.Create(l.dumpFile)
+	f, err := createDumpFile(l.dumpFile)
 	if err != nil {
-		slog.Error("os.Create", slog.Any("error", err))
+		slog.Error("createDumpFile", slog.Any("error", err))
 		return
 	}
 	defer func() {
 		if err := f.Close(); err != nil {
-			slog.Error("os.File.Close", slog.Any("error", err))
+			slog.Error("dumpFile.Close", slog.Any("error", err))
 		}
 	}()
 
@@ -143,8 +164,9 @@ func (l *ConnectionRecordList) Dump() {
 	now := time.Now()
 	for _, record := range l.dumpRecords {
 		duration := now.Sub(record.StartTime)
-		_, err := fmt.Fprintf(l.dumpWriter, "%s %s %s %d\n",
-			record.Protocol, record.SrcAddr, record.DestAddr, int(duration.Seconds()))
+		_, err := fmt.Fprintf(l.dumpWriter, "%s %s %s %d %d %d\n",
+			record.Protocol, record.SrcAddr, record.DestAddr, int(duration.Seconds()),
+			record.Traffic.Upload(), record.Traffic.Download())
 		if err != nil {
 			slog.Error("Dump fmt.Fprintf", slog.Any("error", err))
 		}
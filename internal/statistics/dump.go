@@ -0,0 +1,47 @@
+package statistics
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// dumpFile is written under a temporary name and renamed over the dump file
+// on Close, so readers such as LuCI never see a partially written dump.
+// Paths that are not regular files, like /dev/null, are written in place.
+type dumpFile struct {
+	*os.File
+	path string // empty when written in place
+}
+
+func createDumpFile(path string) (*dumpFile, error) {
+	if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		return &dumpFile{File: f}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &dumpFile{File: f, path: path}, nil
+}
+
+func (f *dumpFile) Close() error {
+	if err := f.File.Close(); err != nil || f.path == "" {
+		if f.path != "" {
+			_ = os.Remove(f.Name())
+		}
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
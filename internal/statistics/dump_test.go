@@ -0,0 +1,48 @@
+package statistics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conn_stats")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := createDumpFile(path)
+	if err != nil {
+		t.Fatalf("createDumpFile: %v", err)
+	}
+	if _, err := f.WriteString("new\n"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old\n" {
+		t.Errorf("dump file changed before Close: %q", data)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("dump file = %q, want %q", data, "new\n")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	// Device files are written in place rather than replaced.
+	f, err = createDumpFile(os.DevNull)
+	if err != nil {
+		t.Fatalf("createDumpFile(%s): %v", os.DevNull, err)
+	}
+	if f.Name() != os.DevNull {
+		t.Errorf("createDumpFile(%s) writes %s", os.DevNull, f.Name())
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
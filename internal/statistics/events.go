@@ -0,0 +1,62 @@
+package statistics
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of ConnectionEvent.
+const (
+	ConnectionOpened = "open"
+	ConnectionClosed = "close"
+)
+
+// ConnectionEvent tells subscribers that a connection opened or closed.
+type ConnectionEvent struct {
+	Type       string            `json:"type"`
+	Connection ConnectionTraffic `json:"connection"`
+}
+
+// connectionEvents fans out connection events to subscribers. Like the log
+// broadcaster, it drops events for subscribers that fall behind.
+type connectionEvents struct {
+	subscribers map[chan ConnectionEvent]struct{}
+	mu          sync.RWMutex
+}
+
+// SubscribeConnections returns a channel receiving an event whenever a
+// connection opens or closes. Call UnsubscribeConnections when done.
+func (r *Recorder) SubscribeConnections() chan ConnectionEvent {
+	ch := make(chan ConnectionEvent, 256)
+	r.events.mu.Lock()
+	if r.events.subscribers == nil {
+		r.events.subscribers = make(map[chan ConnectionEvent]struct{})
+	}
+	r.events.subscribers[ch] = struct{}{}
+	r.events.mu.Unlock()
+	return ch
+}
+
+// UnsubscribeConnections removes a subscriber channel and closes it.
+func (r *Recorder) UnsubscribeConnections(ch chan ConnectionEvent) {
+	r.events.mu.Lock()
+	delete(r.events.subscribers, ch)
+	r.events.mu.Unlock()
+	close(ch)
+}
+
+func (e *connectionEvents) publish(typ string, rec *ConnectionRecord) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if len(e.subscribers) == 0 {
+		return
+	}
+	ev := ConnectionEvent{Type: typ, Connection: rec.traffic(time.Now())}
+	for ch := range e.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
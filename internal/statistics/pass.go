@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"log/slog"
-	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -23,11 +22,11 @@ type PassThroughRecordList struct {
 }
 
 type PassThroughRecord struct {
-	LastSeen time.Time
-	SrcAddr  string
-	DestAddr string
-	UA       string
-	Count    int
+	LastSeen time.Time `json:"last_seen"`
+	SrcAddr  string    `json:"src_addr"`
+	DestAddr string    `json:"dest_addr"`
+	UA       string    `json:"ua"`
+	Count    int       `json:"count"`
 }
 
 func NewPassThroughRecordList(dumpFile string) *PassThroughRecordList {
@@ -93,6 +92,18 @@ func (l *PassThroughRecordList) Add(record *PassThroughRecord) {
 	}
 }
 
+// Records returns a copy of the records.
+func (l *PassThroughRecordList) Records() []PassThroughRecord {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	records := make([]PassThroughRecord, 0, len(l.records))
+	for _, r := range l.records {
+		records = append(records, *r)
+	}
+	return records
+}
+
 func (l *PassThroughRecordList) Cleanup() {
 	cutoff := time.Now().Add(-l.cleanupInterval)
 
@@ -107,14 +118,14 @@ func (l *PassThroughRecordList) Cleanup() {
 }
 
 func (l *PassThroughRecordList) Dump() {
-	f, err := os.Create(l.dumpFile)
+	f, err := createDumpFile(l.dumpFile)
 	if err != nil {
-		slog.Error("os.Create", slog.Any("error", err))
+		slog.Error("createDumpFile", slog.Any("error", err))
 		return
 	}
 	defer func() {
 		if err := f.Close(); err != nil {
-			slog.Error("os.File.Close", slog.Any("error", err))
+			slog.Error("dumpFile.Close", slog.Any("error", err))
 		}
 	}()
 
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"log/slog"
-	"os"
 	"sort"
 	"sync"
 	"time"
@@ -22,11 +21,11 @@ type RewriteRecordList struct {
 }
 
 type RewriteRecord struct {
-	LastSeen   time.Time
-	Host       string
-	OriginalUA string
-	MockedUA   string
-	Count      int
+	LastSeen   time.Time `json:"last_seen"`
+	Host       string    `json:"host"`
+	OriginalUA string    `json:"original_ua"`
+	MockedUA   string    `json:"mocked_ua"`
+	Count      int       `json:"count"`
 }
 
 func NewRewriteRecordList(dumpFile string) *RewriteRecordList {
@@ -84,6 +83,18 @@ func (l *RewriteRecordList) Add(record *RewriteRecord) {
 	}
 }
 
+// Records returns a copy of the records.
+func (l *RewriteRecordList) Records() []RewriteRecord {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	records := make([]RewriteRecord, 0, len(l.records))
+	for _, r := range l.records {
+		records = append(records, *r)
+	}
+	return records
+}
+
 func (l *RewriteRecordList) Cleanup() {
 	cutoff := time.Now().Add(-l.cleanupInterval)
 
@@ -98,14 +109,14 @@ func (l *RewriteRecordList) Cleanup() {
 }
 
 func (l *RewriteRecordList) Dump() {
-	f, err := os.Create(l.dumpFile)
+	f, err := createDumpFile(l.dumpFile)
 	if err != nil {
-		slog.Error("os.Create", slog.Any("error", err))
+		slog.Error("createDumpFile", slog.Any("error", err))
 		return
 	}
 	defer func() {
 		if err := f.Close(); err != nil {
-			slog.Error("os.File.Close", slog.Any("error", err))
+			slog.Error("dumpFile.Close", slog.Any("error", err))
 		}
 	}()
 
@@ -1,16 +1,33 @@
 package statistics
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sunbk201/ua3f/internal/log"
+	"github.com/sunbk201/ua3f/internal/metrics"
+	"github.com/sunbk201/ua3f/internal/sniff"
 )
 
 type Recorder struct {
 	RewriteRecordList     *RewriteRecordList
 	PassThroughRecordList *PassThroughRecordList
 	ConnectionRecordList  *ConnectionRecordList
+	BPFStats              *BPFStats
+	Traffic               *TrafficStats
 	once                  sync.Once
+
+	// protocols holds the protocol of every open connection for the
+	// active connection gauge. Unlike the record lists it is updated
+	// synchronously, so no update is lost when their channels are full.
+	protocols   map[string]sniff.Protocol
+	protocolsMu sync.Mutex
+
+	events connectionEvents
+
+	store atomic.Pointer[Store] // nil unless rollups are persisted
 }
 
 func New() *Recorder {
@@ -18,6 +35,8 @@ func New() *Recorder {
 		RewriteRecordList:     NewRewriteRecordList(log.GetStatsFilePath("rewrite_stats")),
 		PassThroughRecordList: NewPassThroughRecordList(log.GetStatsFilePath("pass_stats")),
 		ConnectionRecordList:  NewConnectionRecordList(log.GetStatsFilePath("conn_stats")),
+		BPFStats:              NewBPFStats(log.GetStatsFilePath("bpf_stats")),
+		Traffic:               NewTrafficStats(),
 	}
 }
 
@@ -26,12 +45,33 @@ func (r *Recorder) Start() {
 		r.RewriteRecordList.Run()
 		r.PassThroughRecordList.Run()
 		r.ConnectionRecordList.Run()
+		if r.BPFStats != nil {
+			r.BPFStats.Run()
+		}
+		if r.Traffic != nil {
+			r.Traffic.Run()
+		}
 	})
 }
 
+// Store returns the store rollups are persisted to, or nil.
+func (r *Recorder) Store() *Store {
+	return r.store.Load()
+}
+
+// SetStore replaces the store rollups are persisted to, returning the
+// previous one for the caller to close.
+func (r *Recorder) SetStore(s *Store) *Store {
+	return r.store.Swap(s)
+}
+
 func (r *Recorder) AddRecord(record any) {
 	switch rec := record.(type) {
 	case *RewriteRecord:
+		metrics.Rewrites.Inc()
+		if st := r.store.Load(); st != nil {
+			st.RecordRewrite(rec, time.Now())
+		}
 		select {
 		case r.RewriteRecordList.recordAddChan <- rec:
 		default:
@@ -42,6 +82,13 @@ func (r *Recorder) AddRecord(record any) {
 		default:
 		}
 	case *ConnectionRecord:
+		opened := r.trackConnection(rec)
+		if rec.Traffic != nil && r.Traffic != nil {
+			r.Traffic.open(rec)
+		}
+		if opened {
+			r.events.publish(ConnectionOpened, rec)
+		}
 		select {
 		case r.ConnectionRecordList.recordAddChan <- rec:
 		default:
@@ -52,9 +99,65 @@ func (r *Recorder) AddRecord(record any) {
 func (r *Recorder) RemoveRecord(record any) {
 	switch rec := record.(type) {
 	case *ConnectionRecord:
+		protocol, ok := r.untrackConnection(rec)
+		closed := *rec
+		closed.EndTime = time.Now()
+		if protocol != "" {
+			closed.Protocol = protocol
+		}
+		if rec.Traffic != nil && r.Traffic != nil {
+			r.Traffic.close(&closed)
+		}
+		if ok {
+			r.events.publish(ConnectionClosed, &closed)
+			if st := r.store.Load(); st != nil {
+				st.RecordConnection(&closed)
+			}
+		}
 		select {
 		case r.ConnectionRecordList.recordRemoveChan <- rec:
 		default:
 		}
 	}
 }
+
+// trackConnection counts a new connection or moves an open one to the
+// protocol sniffed since. It reports whether the connection is new.
+func (r *Recorder) trackConnection(rec *ConnectionRecord) bool {
+	key := fmt.Sprintf("%s-%s", rec.SrcAddr, rec.DestAddr)
+
+	r.protocolsMu.Lock()
+	defer r.protocolsMu.Unlock()
+
+	if r.protocols == nil {
+		r.protocols = make(map[string]sniff.Protocol)
+	}
+	old, ok := r.protocols[key]
+	if ok {
+		if old == rec.Protocol {
+			return false
+		}
+		metrics.ConnectionsActive.Dec(string(old))
+	} else {
+		metrics.Connections.Inc()
+	}
+	r.protocols[key] = rec.Protocol
+	metrics.ConnectionsActive.Inc(string(rec.Protocol))
+	return !ok
+}
+
+// untrackConnection removes an open connection and returns its last
+// protocol, reporting whether it was open.
+func (r *Recorder) untrackConnection(rec *ConnectionRecord) (sniff.Protocol, bool) {
+	key := fmt.Sprintf("%s-%s", rec.SrcAddr, rec.DestAddr)
+
+	r.protocolsMu.Lock()
+	defer r.protocolsMu.Unlock()
+
+	old, ok := r.protocols[key]
+	if ok {
+		delete(r.protocols, key)
+		metrics.ConnectionsActive.Dec(string(old))
+	}
+	return old, ok
+}
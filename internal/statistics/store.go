@@ -0,0 +1,406 @@
+package statistics
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RollupPeriod is the length of the time buckets statistics are rolled up into.
+type RollupPeriod string
+
+const (
+	PeriodHour RollupPeriod = "hour"
+	PeriodDay  RollupPeriod = "day"
+	PeriodWeek RollupPeriod = "week" // summed from the daily rollups when queried
+)
+
+// RollupKind is what a rollup counts statistics for.
+type RollupKind string
+
+const (
+	RollupHost   RollupKind = "host"   // rewrites and traffic per destination host
+	RollupUA     RollupKind = "ua"     // rewrites per original User-Agent
+	RollupDevice RollupKind = "device" // traffic per source IP
+)
+
+// Rollup holds the statistics of one host, User-Agent or device in one
+// time bucket. Zero counts are left out of the store to keep it small.
+type Rollup struct {
+	Period      RollupPeriod `json:"period"`
+	Start       time.Time    `json:"start"`
+	Kind        RollupKind   `json:"kind"`
+	Name        string       `json:"name"`
+	Rewrites    int64        `json:"rewrites,omitempty"`
+	Connections int64        `json:"connections,omitempty"`
+	Upload      int64        `json:"upload,omitempty"`
+	Download    int64        `json:"download,omitempty"`
+}
+
+type rollupKey struct {
+	period RollupPeriod
+	start  int64
+	kind   RollupKind
+	name   string
+}
+
+func (r *Rollup) key() rollupKey {
+	return rollupKey{r.Period, r.Start.Unix(), r.Kind, r.Name}
+}
+
+func (r *Rollup) add(o *Rollup) {
+	r.Rewrites += o.Rewrites
+	r.Connections += o.Connections
+	r.Upload += o.Upload
+	r.Download += o.Download
+}
+
+const (
+	storeFlushInterval = 5 * time.Minute
+	maxRollupLine      = 64 * 1024
+)
+
+// Store persists hourly and daily rollups to an append-only JSON lines file.
+// Rollups are appended once their bucket has ended, and on Close. The file
+// is compacted once a day, dropping rollups older than their retention, and
+// whenever it grows beyond its maximum size, in which case the oldest hourly
+// rollups and then the oldest daily ones are dropped until it is back under
+// three quarters of the limit. Rows of the same bucket are summed on load.
+type Store struct {
+	path            string
+	hourlyRetention time.Duration
+	dailyRetention  time.Duration
+	maxSize         int64
+
+	mu        sync.Mutex
+	saved     map[rollupKey]*Rollup // written to the file
+	open      map[rollupKey]*Rollup // counted since the last write
+	size      int64
+	compacted time.Time // start of the day the file was last compacted
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenStore loads the rollups saved at path. maxSize is in bytes.
+func OpenStore(path string, hourlyRetention, dailyRetention time.Duration, maxSize int64) (*Store, error) {
+	s := &Store{
+		path:            path,
+		hourlyRetention: hourlyRetention,
+		dailyRetention:  dailyRetention,
+		maxSize:         maxSize,
+		saved:           make(map[rollupKey]*Rollup),
+		open:            make(map[rollupKey]*Rollup),
+		done:            make(chan struct{}),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	skipped := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), maxRollupLine)
+	for scanner.Scan() {
+		var r Rollup
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || (r.Period != PeriodHour && r.Period != PeriodDay) {
+			skipped++
+			continue
+		}
+		r.Start = r.Start.Local()
+		merge(s.saved, &r)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", s.path, err)
+	}
+	if fi, err := f.Stat(); err == nil {
+		s.size = fi.Size()
+	}
+	if skipped > 0 {
+		// Lines cut short by a power loss are dropped by the compaction
+		// following the first flush.
+		slog.Warn("Skipped invalid statistics rollups", slog.String("path", s.path), slog.Int("lines", skipped))
+	}
+	return nil
+}
+
+func merge(rollups map[rollupKey]*Rollup, r *Rollup) {
+	k := r.key()
+	if cur, ok := rollups[k]; ok {
+		cur.add(r)
+		return
+	}
+	rollups[k] = r
+}
+
+func (s *Store) Run() {
+	go func() {
+		ticker := time.NewTicker(storeFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case now := <-ticker.C:
+				if err := s.flush(now, false); err != nil {
+					slog.Warn("Failed to save statistics rollups", slog.String("path", s.path), slog.Any("error", err))
+				}
+			}
+		}
+	}()
+}
+
+// Close saves the rollups of the buckets in progress and stops the store.
+func (s *Store) Close() error {
+	err := fs.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.flush(time.Now(), true)
+	})
+	return err
+}
+
+// RecordRewrite counts a User-Agent rewrite for its host and original User-Agent.
+func (s *Store) RecordRewrite(rec *RewriteRecord, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, period := range []RollupPeriod{PeriodHour, PeriodDay} {
+		start := bucketStart(period, at)
+		merge(s.open, &Rollup{Period: period, Start: start, Kind: RollupHost, Name: rec.Host, Rewrites: 1})
+		merge(s.open, &Rollup{Period: period, Start: start, Kind: RollupUA, Name: rec.OriginalUA, Rewrites: 1})
+	}
+}
+
+// RecordConnection counts a closed connection and its bytes for its device
+// and host, in the buckets it closed in.
+func (s *Store) RecordConnection(closed *ConnectionRecord) {
+	upload, download := closed.Traffic.Upload(), closed.Traffic.Download()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, period := range []RollupPeriod{PeriodHour, PeriodDay} {
+		start := bucketStart(period, closed.EndTime)
+		merge(s.open, &Rollup{Period: period, Start: start, Kind: RollupDevice, Name: deviceName(closed.SrcAddr),
+			Connections: 1, Upload: upload, Download: download})
+		merge(s.open, &Rollup{Period: period, Start: start, Kind: RollupHost, Name: hostName(closed),
+			Connections: 1, Upload: upload, Download: download})
+	}
+}
+
+// flush appends the rollups of the buckets ended by now, or all of them, and
+// compacts the file when due.
+func (s *Store) flush(now time.Time, all bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rows []*Rollup
+	for k, r := range s.open {
+		if all || !bucketEnd(r.Period, r.Start).After(now) {
+			rows = append(rows, r)
+			delete(s.open, k)
+		}
+	}
+	if len(rows) > 0 {
+		err := s.append(rows)
+		for _, r := range rows {
+			merge(s.saved, r)
+		}
+		if err != nil {
+			s.compacted = time.Time{} // rewrite the rows lost from the file
+			return err
+		}
+	}
+	if s.size > s.maxSize || bucketStart(PeriodDay, now).After(s.compacted) {
+		return s.compact(now)
+	}
+	return nil
+}
+
+func (s *Store) append(rows []*Rollup) error {
+	sortRollups(rows)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for _, r := range rows {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(buf.Bytes())
+	s.size += int64(n)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// compact rewrites the file with the saved rollups still within their
+// retention, trimming the oldest when over the size limit.
+func (s *Store) compact(now time.Time) error {
+	rows := make([]*Rollup, 0, len(s.saved))
+	for k, r := range s.saved {
+		retention := s.hourlyRetention
+		if r.Period == PeriodDay {
+			retention = s.dailyRetention
+		}
+		if bucketEnd(r.Period, r.Start).Before(now.Add(-retention)) {
+			delete(s.saved, k)
+			continue
+		}
+		rows = append(rows, r)
+	}
+	// Hourly rollups go first so they are trimmed before the daily ones.
+	slices.SortFunc(rows, func(a, b *Rollup) int {
+		if a.Period != b.Period {
+			if a.Period == PeriodHour {
+				return -1
+			}
+			return 1
+		}
+		return compareRollups(a, b)
+	})
+
+	lines := make([][]byte, len(rows))
+	var size int64
+	for i, r := range rows {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(line, '\n')
+		size += int64(len(lines[i]))
+	}
+	trimmed := 0
+	if size > s.maxSize {
+		for trimmed < len(rows) && size > s.maxSize/4*3 {
+			size -= int64(len(lines[trimmed]))
+			delete(s.saved, rows[trimmed].key())
+			trimmed++
+		}
+		slog.Info("Trimmed statistics rollups over the store size limit", slog.String("path", s.path), slog.Int("rollups", trimmed))
+	}
+
+	f, err := createDumpFile(s.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines[trimmed:] {
+		_, _ = w.Write(line)
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.size = size
+	s.compacted = bucketStart(PeriodDay, now)
+	return nil
+}
+
+// Rollups returns the rollups of period whose bucket starts in [since,
+// until), including the buckets in progress. Zero times leave the range
+// open. Weekly rollups are summed from the daily ones, weeks starting on
+// Monday.
+func (s *Store) Rollups(period RollupPeriod, since, until time.Time) []Rollup {
+	from := period
+	if period == PeriodWeek {
+		from = PeriodDay
+	}
+
+	rollups := make(map[rollupKey]*Rollup)
+	s.mu.Lock()
+	for _, rows := range []map[rollupKey]*Rollup{s.saved, s.open} {
+		for _, r := range rows {
+			if r.Period != from {
+				continue
+			}
+			row := *r
+			row.Period, row.Start = period, bucketStart(period, r.Start)
+			if (!since.IsZero() && row.Start.Before(since)) || (!until.IsZero() && !row.Start.Before(until)) {
+				continue
+			}
+			merge(rollups, &row)
+		}
+	}
+	s.mu.Unlock()
+
+	rows := make([]*Rollup, 0, len(rollups))
+	for _, r := range rollups {
+		rows = append(rows, r)
+	}
+	sortRollups(rows)
+	result := make([]Rollup, len(rows))
+	for i, r := range rows {
+		result[i] = *r
+	}
+	return result
+}
+
+func sortRollups(rows []*Rollup) {
+	slices.SortFunc(rows, compareRollups)
+}
+
+func compareRollups(a, b *Rollup) int {
+	return cmp.Or(
+		a.Start.Compare(b.Start),
+		cmp.Compare(a.Kind, b.Kind),
+		cmp.Compare(a.Name, b.Name),
+	)
+}
+
+// bucketStart returns the start of the bucket of period containing t, in the
+// time zone of t.
+func bucketStart(period RollupPeriod, t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case PeriodHour:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case PeriodWeek:
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func bucketEnd(period RollupPeriod, start time.Time) time.Time {
+	switch period {
+	case PeriodHour:
+		return start.Add(time.Hour)
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,117 @@
+package statistics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	st, err := OpenStore(path, 10*24*time.Hour, 35*24*time.Hour, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday 2026-10-05 to Tuesday 2026-10-13, two weeks.
+	monday := time.Date(2026, 10, 5, 10, 30, 0, 0, time.Local)
+	for _, at := range []time.Time{monday, monday.Add(time.Hour), monday.AddDate(0, 0, 8)} {
+		st.RecordRewrite(&RewriteRecord{Host: "example.com", OriginalUA: "curl/8.0"}, at)
+	}
+	closed := &ConnectionRecord{SrcAddr: "192.168.1.2:5000", DestAddr: "1.1.1.1:443", EndTime: monday, Traffic: &Traffic{}}
+	closed.Traffic.AddUpload(10)
+	closed.Traffic.AddDownload(100)
+	st.RecordConnection(closed)
+
+	// Only the buckets ended by now are written.
+	now := monday.AddDate(0, 0, 8).Add(10 * time.Minute)
+	if err := st.flush(now, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.open) != 4 {
+		t.Errorf("%d rollups in progress, want the hour and day of the last rewrite", len(st.open))
+	}
+	if err := st.flush(now, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// A line cut short by a power loss is skipped on load.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"period":"day","sta`)
+	_ = f.Close()
+
+	st, err = OpenStore(path, 10*24*time.Hour, 35*24*time.Hour, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.RecordRewrite(&RewriteRecord{Host: "example.com", OriginalUA: "curl/8.0"}, monday.AddDate(0, 0, 8))
+
+	weeks := st.Rollups(PeriodWeek, time.Time{}, time.Time{})
+	var ua []Rollup
+	for _, r := range weeks {
+		if r.Kind == RollupUA {
+			ua = append(ua, r)
+		}
+	}
+	weekStart := time.Date(2026, 10, 5, 0, 0, 0, 0, time.Local)
+	if len(ua) != 2 || ua[0].Rewrites != 2 || ua[1].Rewrites != 2 || !ua[0].Start.Equal(weekStart) || !ua[1].Start.Equal(weekStart.AddDate(0, 0, 7)) {
+		t.Errorf("weekly UA rollups = %+v, want 2 rewrites in each week", ua)
+	}
+
+	hours := st.Rollups(PeriodHour, monday.Add(-time.Hour), monday.Add(30*time.Minute))
+	want := map[RollupKind]Rollup{
+		RollupDevice: {Name: "192.168.1.2", Connections: 1, Upload: 10, Download: 100},
+		RollupHost:   {Name: "example.com", Rewrites: 1},
+		RollupUA:     {Name: "curl/8.0", Rewrites: 1},
+	}
+	if len(hours) != 4 {
+		t.Errorf("hourly rollups = %+v, want 4", hours)
+	}
+	for _, r := range hours {
+		if w, ok := want[r.Kind]; ok && r.Name == w.Name && (r.Rewrites != w.Rewrites || r.Upload != w.Upload) {
+			t.Errorf("hourly %s rollup = %+v, want %+v", r.Kind, r, w)
+		}
+	}
+
+	// Compaction drops what is past its retention.
+	if err := st.flush(monday.AddDate(0, 0, 50), true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 0 {
+		t.Errorf("store has %d lines after the retention, want none:\n%s", lines, data)
+	}
+}
+
+func TestStoreMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	st, err := OpenStore(path, 48*time.Hour, 35*24*time.Hour, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 5, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 40; i++ {
+		st.RecordRewrite(&RewriteRecord{Host: "example.com", OriginalUA: "curl/8.0"}, start.Add(time.Duration(i)*time.Hour))
+	}
+	if err := st.flush(start.AddDate(0, 0, 2), true); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 2048/4*3 {
+		t.Errorf("store is %d bytes, want at most %d", fi.Size(), 2048/4*3)
+	}
+	if days := st.Rollups(PeriodDay, time.Time{}, time.Time{}); len(days) != 4 {
+		t.Errorf("daily rollups = %+v, want the 2 days kept over hourly ones", days)
+	}
+}
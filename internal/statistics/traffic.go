@@ -0,0 +1,271 @@
+package statistics
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/sniff"
+)
+
+// Traffic counts the bytes relayed for one connection: uploads are sent by
+// the client and downloads received by it. Once the connection is recorded,
+// the bytes are also added to the totals of its device and host.
+type Traffic struct {
+	upload   atomic.Int64
+	download atomic.Int64
+	totals   []*trafficTotal // set by TrafficStats.open before any byte is counted
+}
+
+func (t *Traffic) AddUpload(n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+	t.upload.Add(n)
+	for _, total := range t.totals {
+		total.upload.Add(n)
+	}
+}
+
+func (t *Traffic) AddDownload(n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+	t.download.Add(n)
+	for _, total := range t.totals {
+		total.download.Add(n)
+	}
+}
+
+func (t *Traffic) Upload() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.upload.Load()
+}
+
+func (t *Traffic) Download() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.download.Load()
+}
+
+type trafficTotal struct {
+	upload      atomic.Int64
+	download    atomic.Int64
+	connections int64 // guarded by TrafficStats.mu, as are active and lastSeen
+	active      int64
+	lastSeen    time.Time
+}
+
+// TrafficSummary is the traffic of a device or host.
+type TrafficSummary struct {
+	Name        string    `json:"name"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	Connections int64     `json:"connections"`
+	Active      int64     `json:"active"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// ConnectionTraffic is the traffic of an open or closed connection.
+type ConnectionTraffic struct {
+	Protocol  sniff.Protocol `json:"protocol"`
+	SrcAddr   string         `json:"src_addr"`
+	DestAddr  string         `json:"dest_addr"`
+	Host      string         `json:"host,omitempty"`
+	StartTime time.Time      `json:"start_time"`
+	EndTime   *time.Time     `json:"end_time,omitempty"`
+	Duration  float64        `json:"duration"` // seconds
+	Upload    int64          `json:"upload"`
+	Download  int64          `json:"download"`
+}
+
+// TrafficStats aggregates the traffic of connections per source device and
+// destination host, and keeps the last closed connections in a rolling
+// history. Totals are dropped once idle for longer than the retention.
+type TrafficStats struct {
+	mu        sync.Mutex
+	devices   map[string]*trafficTotal
+	hosts     map[string]*trafficTotal
+	history   []*ConnectionRecord // ring buffer of closed connections
+	next      int
+	retention time.Duration
+}
+
+const (
+	trafficHistorySize = 1000
+	trafficRetention   = 24 * time.Hour
+)
+
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		devices:   make(map[string]*trafficTotal),
+		hosts:     make(map[string]*trafficTotal),
+		history:   make([]*ConnectionRecord, 0, trafficHistorySize),
+		retention: trafficRetention,
+	}
+}
+
+func (t *TrafficStats) Run() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.Cleanup()
+		}
+	}()
+}
+
+// open binds the traffic of a new connection to its device and host totals.
+func (t *TrafficStats) open(rec *ConnectionRecord) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rec.Traffic.totals != nil {
+		return
+	}
+	rec.Traffic.totals = []*trafficTotal{
+		t.total(t.devices, deviceName(rec.SrcAddr), now),
+		t.total(t.hosts, hostName(rec), now),
+	}
+	for _, total := range rec.Traffic.totals {
+		total.connections++
+		total.active++
+	}
+}
+
+func (t *TrafficStats) total(totals map[string]*trafficTotal, name string, now time.Time) *trafficTotal {
+	total, ok := totals[name]
+	if !ok {
+		total = &trafficTotal{}
+		totals[name] = total
+	}
+	total.lastSeen = now
+	return total
+}
+
+// close moves a connection to the history. closed is a copy of its record
+// with the end time and the last protocol sniffed.
+func (t *TrafficStats) close(closed *ConnectionRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, total := range closed.Traffic.totals {
+		total.active--
+		total.lastSeen = closed.EndTime
+	}
+	if len(t.history) < cap(t.history) {
+		t.history = append(t.history, closed)
+	} else {
+		t.history[t.next] = closed
+	}
+	t.next = (t.next + 1) % cap(t.history)
+}
+
+// Cleanup drops the totals of devices and hosts idle for longer than the retention.
+func (t *TrafficStats) Cleanup() {
+	cutoff := time.Now().Add(-t.retention)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, totals := range []map[string]*trafficTotal{t.devices, t.hosts} {
+		for name, total := range totals {
+			if total.active == 0 && total.lastSeen.Before(cutoff) {
+				delete(totals, name)
+			}
+		}
+	}
+}
+
+// Devices returns the traffic per source IP, highest first.
+func (t *TrafficStats) Devices() []TrafficSummary {
+	return t.summaries(t.devices)
+}
+
+// Hosts returns the traffic per destination host, highest first. Hosts are
+// domains when known and IPs otherwise.
+func (t *TrafficStats) Hosts() []TrafficSummary {
+	return t.summaries(t.hosts)
+}
+
+func (t *TrafficStats) summaries(totals map[string]*trafficTotal) []TrafficSummary {
+	t.mu.Lock()
+	summaries := make([]TrafficSummary, 0, len(totals))
+	for name, total := range totals {
+		summaries = append(summaries, TrafficSummary{
+			Name:        name,
+			Upload:      total.upload.Load(),
+			Download:    total.download.Load(),
+			Connections: total.connections,
+			Active:      total.active,
+			LastSeen:    total.lastSeen,
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Upload+a.Download != b.Upload+b.Download {
+			return a.Upload+a.Download > b.Upload+b.Download
+		}
+		return a.Name < b.Name
+	})
+	return summaries
+}
+
+// History returns the closed connections kept, newest first.
+func (t *TrafficStats) History() []ConnectionTraffic {
+	t.mu.Lock()
+	records := make([]*ConnectionRecord, 0, len(t.history))
+	for i := 1; i <= len(t.history); i++ {
+		records = append(records, t.history[(t.next-i+len(t.history))%len(t.history)])
+	}
+	t.mu.Unlock()
+
+	history := make([]ConnectionTraffic, len(records))
+	for i, r := range records {
+		history[i] = r.traffic(r.EndTime)
+	}
+	return history
+}
+
+// traffic returns the traffic of the record, as of now for open connections.
+func (r *ConnectionRecord) traffic(now time.Time) ConnectionTraffic {
+	c := ConnectionTraffic{
+		Protocol:  r.Protocol,
+		SrcAddr:   r.SrcAddr,
+		DestAddr:  r.DestAddr,
+		Host:      r.Host,
+		StartTime: r.StartTime,
+		Upload:    r.Traffic.Upload(),
+		Download:  r.Traffic.Download(),
+	}
+	if !r.EndTime.IsZero() {
+		end := r.EndTime
+		c.EndTime = &end
+		now = end
+	}
+	c.Duration = now.Sub(r.StartTime).Seconds()
+	return c
+}
+
+func deviceName(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func hostName(rec *ConnectionRecord) string {
+	if rec.Host != "" {
+		return rec.Host
+	}
+	return deviceName(rec.DestAddr)
+}
@@ -0,0 +1,69 @@
+package statistics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sunbk201/ua3f/internal/sniff"
+)
+
+func TestTrafficStats(t *testing.T) {
+	ts := NewTrafficStats()
+	ts.history = make([]*ConnectionRecord, 0, 3)
+
+	for i := 0; i < 5; i++ {
+		rec := &ConnectionRecord{
+			Protocol:  sniff.TCP,
+			SrcAddr:   fmt.Sprintf("192.168.1.%d:5000", i%2+1),
+			DestAddr:  "1.1.1.1:443",
+			Host:      "example.com",
+			StartTime: time.Now(),
+			Traffic:   &Traffic{},
+		}
+		ts.open(rec)
+		ts.open(rec) // opening twice must not count twice
+		rec.Traffic.AddUpload(int64(10 * (i + 1)))
+		rec.Traffic.AddDownload(100)
+		if i < 4 {
+			closed := *rec
+			closed.EndTime, closed.Protocol = time.Now(), sniff.HTTPS
+			ts.close(&closed)
+		}
+	}
+
+	history := ts.History()
+	if len(history) != 3 {
+		t.Fatalf("history has %d connections, want 3", len(history))
+	}
+	for i, want := range []int64{40, 30, 20} {
+		if history[i].Upload != want || history[i].Protocol != sniff.HTTPS {
+			t.Errorf("history[%d] = %+v, want %d bytes up over HTTPS", i, history[i], want)
+		}
+	}
+
+	devices := ts.Devices()
+	want := []TrafficSummary{
+		{Name: "192.168.1.1", Upload: 90, Download: 300, Connections: 3, Active: 1},
+		{Name: "192.168.1.2", Upload: 60, Download: 200, Connections: 2, Active: 0},
+	}
+	if len(devices) != len(want) {
+		t.Fatalf("devices = %+v, want %+v", devices, want)
+	}
+	for i := range want {
+		got := devices[i]
+		got.LastSeen = time.Time{}
+		if got != want[i] {
+			t.Errorf("devices[%d] = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if hosts := ts.Hosts(); len(hosts) != 1 || hosts[0].Name != "example.com" || hosts[0].Upload != 150 {
+		t.Errorf("hosts = %+v, want example.com with 150 bytes up", hosts)
+	}
+
+	ts.retention = 0
+	ts.Cleanup()
+	if devices := ts.Devices(); len(devices) != 1 || devices[0].Name != "192.168.1.1" {
+		t.Errorf("after cleanup devices = %+v, want only the active 192.168.1.1", devices)
+	}
+}
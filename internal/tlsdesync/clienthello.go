@@ -0,0 +1,149 @@
+package tlsdesync
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/sunbk201/ua3f/internal/sniff"
+)
+
+const (
+	recordHeaderLen = 5
+	maxRecordLen    = 16384
+)
+
+// RecordLen returns the length of the TLS handshake record at the start of data,
+// header included, or 0 if data does not start with a handshake record.
+func RecordLen(data []byte) int {
+	if len(data) < recordHeaderLen || data[0] != 0x16 || data[1] != 0x03 {
+		return 0
+	}
+	n := int(binary.BigEndian.Uint16(data[3:5]))
+	if n == 0 || n > maxRecordLen {
+		return 0
+	}
+	return recordHeaderLen + n
+}
+
+// IsClientHello reports whether payload starts with a TLS record carrying a ClientHello.
+func IsClientHello(payload []byte) bool {
+	return RecordLen(payload) > 0 && len(payload) > recordHeaderLen && payload[recordHeaderLen] == 0x01
+}
+
+// SNISplitPoint returns the offset in the middle of the SNI hostname of payload,
+// suitable for cutting the TCP segment, or -1 if no SNI was found.
+func SNISplitPoint(payload []byte) int {
+	sni, off := sniff.LocateTLSSNI(payload)
+	if off < 0 || len(sni) == 0 {
+		return -1
+	}
+	return off + len(sni)/2
+}
+
+// SplitRecord re-frames a complete TLS handshake record into segments records.
+// The first cut is placed inside the SNI when present, the rest of the
+// handshake is divided evenly. It returns nil if record cannot be split.
+func SplitRecord(record []byte, segments int) []byte {
+	n := RecordLen(record)
+	if n == 0 || n != len(record) || segments < 2 {
+		return nil
+	}
+	body := record[recordHeaderLen:]
+
+	var cuts []int
+	rest := 0
+	if p := SNISplitPoint(record); p > recordHeaderLen {
+		cuts = append(cuts, p-recordHeaderLen)
+		rest = p - recordHeaderLen
+		segments--
+	}
+	step := (len(body) - rest) / segments
+	if step == 0 {
+		step = 1
+	}
+	for i := 1; i < segments; i++ {
+		if c := rest + i*step; c < len(body) {
+			cuts = append(cuts, c)
+		}
+	}
+	cuts = append(cuts, len(body))
+
+	out := make([]byte, 0, len(record)+recordHeaderLen*len(cuts))
+	start := 0
+	for _, c := range cuts {
+		if c <= start {
+			continue
+		}
+		out = append(out, record[0], record[1], record[2], byte((c-start)>>8), byte(c-start))
+		out = append(out, body[start:c]...)
+		start = c
+	}
+	return out
+}
+
+// FakeClientHello builds a TLS 1.3 ClientHello record for sni,
+// shaped like a browser handshake so that it passes DPI as a real one.
+func FakeClientHello(sni string) []byte {
+	random := make([]byte, 32+32+32)
+	_, _ = rand.Read(random)
+
+	var ext []byte
+	// server_name
+	name := []byte(sni)
+	ext = appendExtension(ext, 0x0000, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint16(b, uint16(3+len(name)))
+		b = append(b, 0x00)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(name)))
+		return append(b, name...)
+	})
+	// ec_point_formats
+	ext = appendExtension(ext, 0x000b, func(b []byte) []byte { return append(b, 0x01, 0x00) })
+	// supported_groups: x25519, secp256r1, secp384r1
+	ext = appendExtension(ext, 0x000a, func(b []byte) []byte {
+		return append(b, 0x00, 0x06, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18)
+	})
+	// application_layer_protocol_negotiation: h2, http/1.1
+	ext = appendExtension(ext, 0x0010, func(b []byte) []byte {
+		alpn := []byte("\x02h2\x08http/1.1")
+		b = binary.BigEndian.AppendUint16(b, uint16(len(alpn)))
+		return append(b, alpn...)
+	})
+	// signature_algorithms
+	ext = appendExtension(ext, 0x000d, func(b []byte) []byte {
+		return append(b, 0x00, 0x08, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03)
+	})
+	// key_share: x25519
+	ext = appendExtension(ext, 0x0033, func(b []byte) []byte {
+		b = append(b, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20)
+		return append(b, random[64:96]...)
+	})
+	// supported_versions: TLS 1.3, TLS 1.2
+	ext = appendExtension(ext, 0x002b, func(b []byte) []byte { return append(b, 0x04, 0x03, 0x04, 0x03, 0x03) })
+
+	var body []byte
+	body = append(body, 0x03, 0x03)
+	body = append(body, random[:32]...)
+	body = append(body, 0x20)
+	body = append(body, random[32:64]...)
+	// TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384, TLS_CHACHA20_POLY1305_SHA256,
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	body = append(body, 0x00, 0x0a, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x2b, 0xc0, 0x2f)
+	body = append(body, 0x01, 0x00)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	record := make([]byte, 0, 9+len(body))
+	record = append(record, 0x16, 0x03, 0x01)
+	record = binary.BigEndian.AppendUint16(record, uint16(4+len(body)))
+	record = append(record, 0x01, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	return append(record, body...)
+}
+
+func appendExtension(b []byte, typ uint16, data func([]byte) []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	lenAt := len(b)
+	b = append(b, 0, 0)
+	b = data(b)
+	binary.BigEndian.PutUint16(b[lenAt:], uint16(len(b)-lenAt-2))
+	return b
+}
@@ -0,0 +1,78 @@
+package tlsdesync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/sniff"
+)
+
+func TestFakeClientHello(t *testing.T) {
+	record := FakeClientHello("www.w3.org")
+	if !IsClientHello(record) {
+		t.Fatal("IsClientHello() = false")
+	}
+	if got := RecordLen(record); got != len(record) {
+		t.Fatalf("RecordLen() = %d, want %d", got, len(record))
+	}
+	if sni, off := sniff.LocateTLSSNI(record); sni != "www.w3.org" || string(record[off:off+len(sni)]) != sni {
+		t.Fatalf("LocateTLSSNI() = (%q, %d)", sni, off)
+	}
+}
+
+func TestSNISplitPoint(t *testing.T) {
+	record := FakeClientHello("example.com")
+	p := SNISplitPoint(record)
+	idx := bytes.Index(record, []byte("example.com"))
+	if p != idx+len("example.com")/2 {
+		t.Fatalf("SNISplitPoint() = %d, want %d", p, idx+len("example.com")/2)
+	}
+	if SNISplitPoint([]byte("GET / HTTP/1.1\r\n\r\n")) != -1 {
+		t.Fatal("SNISplitPoint() found SNI in plain HTTP")
+	}
+}
+
+// joinRecords reassembles the handshake carried by consecutive TLS records.
+func joinRecords(t *testing.T, data []byte) (int, []byte) {
+	t.Helper()
+	var n int
+	var body []byte
+	for len(data) > 0 {
+		l := RecordLen(data)
+		if l == 0 || l > len(data) {
+			t.Fatalf("malformed record at %d bytes left", len(data))
+		}
+		body = append(body, data[5:l]...)
+		data = data[l:]
+		n++
+	}
+	return n, body
+}
+
+func TestSplitRecord(t *testing.T) {
+	record := FakeClientHello("video.example.com")
+	for _, segments := range []int{2, 3, 5} {
+		out := SplitRecord(record, segments)
+		if out == nil {
+			t.Fatalf("SplitRecord(%d) = nil", segments)
+		}
+		n, body := joinRecords(t, out)
+		if n != segments {
+			t.Errorf("SplitRecord(%d) produced %d records", segments, n)
+		}
+		if !bytes.Equal(body, record[5:]) {
+			t.Errorf("SplitRecord(%d) changed the handshake", segments)
+		}
+		// the SNI must not be contained in any single record
+		if bytes.Contains(out, []byte("video.example.com")) {
+			t.Errorf("SplitRecord(%d) left the SNI intact", segments)
+		}
+	}
+
+	if SplitRecord(record[:len(record)-1], 2) != nil {
+		t.Error("SplitRecord() accepted a truncated record")
+	}
+	if SplitRecord(record, 1) != nil {
+		t.Error("SplitRecord() accepted a single segment")
+	}
+}
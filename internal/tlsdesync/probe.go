@@ -0,0 +1,309 @@
+package tlsdesync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProbeNone = "NONE"
+
+	maxProbeEntries  = 4096
+	probeSaveEvery   = time.Minute
+	confirmedRetries = 2
+)
+
+var activeProber atomic.Pointer[Prober]
+
+// ActiveProber returns the running prober, or nil when auto-probing is off.
+func ActiveProber() *Prober {
+	return activeProber.Load()
+}
+
+type probeCandidate struct {
+	name     string
+	strategy *Strategy
+}
+
+// probeCandidates lists the strategies tried in order for a failing destination,
+// from the least intrusive to the most.
+var probeCandidates = func() []probeCandidate {
+	candidates := []probeCandidate{
+		{ProbeNone, nil},
+		{MethodSNISplit, &Strategy{SNISplit: true}},
+		{MethodRecordSplit, &Strategy{RecordSplit: true, RecordSegments: DefaultRecordSegments}},
+		{MethodRecordSplit + "+" + MethodSNISplit, &Strategy{RecordSplit: true, SNISplit: true, RecordSegments: DefaultRecordSegments}},
+	}
+	for _, ttl := range []uint8{2, 3, 4, 5, 6, 8} {
+		candidates = append(candidates, probeCandidate{
+			fmt.Sprintf("%s+%s-TTL-%d", MethodFakeClientHello, MethodSNISplit, ttl),
+			&Strategy{FakeClientHello: true, SNISplit: true, FakeSNI: DefaultFakeSNI, FakeFooling: FoolingTTL, FakeTTL: ttl},
+		})
+	}
+	candidates = append(candidates, probeCandidate{
+		fmt.Sprintf("%s+%s-%s", MethodFakeClientHello, MethodSNISplit, FoolingBadsum),
+		&Strategy{FakeClientHello: true, SNISplit: true, FakeSNI: DefaultFakeSNI, FakeFooling: FoolingBadsum},
+	})
+	return candidates
+}()
+
+func candidateIndex(name string) int {
+	for i, c := range probeCandidates {
+		if c.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ProbeResult is the probing state of one destination.
+type ProbeResult struct {
+	Destination string    `json:"destination"`
+	Strategy    string    `json:"strategy"`
+	Confirmed   bool      `json:"confirmed"`
+	Failures    int       `json:"failures"`
+	Attempts    int       `json:"attempts"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Prober learns per destination which desync strategy lets the TLS handshake
+// complete. A destination is only tracked once a handshake to it fails; each
+// failure moves it to the next candidate until one succeeds.
+type Prober struct {
+	mu      sync.Mutex
+	results map[string]*ProbeResult
+	path    string
+	dirty   bool
+	done    chan struct{} // closed by Close
+	closed  sync.Once
+	now     func() time.Time
+}
+
+// NewProber creates a prober persisting its results to path, loading any previous results.
+func NewProber(path string) *Prober {
+	p := &Prober{
+		results: make(map[string]*ProbeResult),
+		path:    path,
+		done:    make(chan struct{}),
+		now:     time.Now,
+	}
+	if err := p.load(); err != nil {
+		slog.Warn("Prober load", slog.String("path", path), slog.Any("error", err))
+	}
+	return p
+}
+
+// Start makes the prober active and periodically saves its results.
+func (p *Prober) Start() {
+	activeProber.Store(p)
+	done := p.done
+	go func() {
+		ticker := time.NewTicker(probeSaveEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.Save(); err != nil {
+					slog.Warn("Prober save", slog.Any("error", err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	slog.Info("Desync auto-probe started", slog.String("path", p.path), slog.Int("destinations", p.Len()))
+}
+
+// Close deactivates the prober and saves its results.
+func (p *Prober) Close() error {
+	activeProber.CompareAndSwap(p, nil)
+	p.closed.Do(func() { close(p.done) })
+	return p.Save()
+}
+
+// ProbeKey returns the key a destination is tracked under: the SNI when known, the IP otherwise.
+func ProbeKey(sni, ip string) string {
+	if sni != "" {
+		return strings.ToLower(strings.TrimSuffix(sni, "."))
+	}
+	return ip
+}
+
+// Strategy returns the strategy currently assigned to key, or nil for none.
+func (p *Prober) Strategy(key string) *Strategy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.results[key]
+	if !ok {
+		return nil
+	}
+	if i := candidateIndex(r.Strategy); i >= 0 {
+		return probeCandidates[i].strategy
+	}
+	return nil
+}
+
+// Report records whether a TLS handshake to key completed.
+func (p *Prober) Report(key string, ok bool) {
+	if key == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, exists := p.results[key]
+	if !exists {
+		if ok {
+			return
+		}
+		p.evict()
+		r = &ProbeResult{Destination: key, Strategy: ProbeNone}
+		p.results[key] = r
+	}
+	r.Attempts++
+	r.UpdatedAt = p.now()
+	p.dirty = true
+
+	if ok {
+		if !r.Confirmed {
+			slog.Info("Desync probe confirmed", slog.String("destination", key), slog.String("strategy", r.Strategy))
+		}
+		r.Confirmed = true
+		r.Failures = 0
+		return
+	}
+
+	r.Failures++
+	retries := 1
+	if r.Confirmed {
+		retries = confirmedRetries
+	}
+	if r.Failures < retries {
+		return
+	}
+	next := probeCandidates[(candidateIndex(r.Strategy)+1)%len(probeCandidates)].name
+	slog.Info("Desync probe switching strategy", slog.String("destination", key), slog.String("from", r.Strategy), slog.String("to", next))
+	r.Strategy = next
+	r.Confirmed = false
+	r.Failures = 0
+}
+
+// evict drops the least recently updated result when the table is full.
+func (p *Prober) evict() {
+	if len(p.results) < maxProbeEntries {
+		return
+	}
+	var oldest *ProbeResult
+	for _, r := range p.results {
+		if oldest == nil || r.UpdatedAt.Before(oldest.UpdatedAt) {
+			oldest = r
+		}
+	}
+	delete(p.results, oldest.Destination)
+}
+
+// Results returns a snapshot of all results sorted by destination.
+func (p *Prober) Results() []ProbeResult {
+	p.mu.Lock()
+	results := make([]ProbeResult, 0, len(p.results))
+	for _, r := range p.results {
+		results = append(results, *r)
+	}
+	p.mu.Unlock()
+	sort.Slice(results, func(i, j int) bool { return results[i].Destination < results[j].Destination })
+	return results
+}
+
+// Reset forgets the result of key, or all results when key is empty.
+// It returns the number of results removed.
+func (p *Prober) Reset(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	if key == "" {
+		n = len(p.results)
+		p.results = make(map[string]*ProbeResult)
+	} else if _, ok := p.results[key]; ok {
+		delete(p.results, key)
+		n = 1
+	}
+	if n > 0 {
+		p.dirty = true
+	}
+	return n
+}
+
+func (p *Prober) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.results)
+}
+
+// Save writes the results to the prober's file if they changed since the
+// last save. When writing fails they are kept for the next save.
+func (p *Prober) Save() (err error) {
+	if p.path == "" {
+		return nil
+	}
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return nil
+	}
+	p.dirty = false
+	p.mu.Unlock()
+	defer func() {
+		if err != nil {
+			p.mu.Lock()
+			p.dirty = true
+			p.mu.Unlock()
+		}
+	}()
+
+	data, err := json.MarshalIndent(p.Results(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+func (p *Prober) load() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var results []ProbeResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+	for i := range results {
+		r := results[i]
+		if r.Destination == "" || candidateIndex(r.Strategy) < 0 {
+			continue
+		}
+		p.results[r.Destination] = &r
+	}
+	return nil
+}
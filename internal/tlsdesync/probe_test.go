@@ -0,0 +1,134 @@
+package tlsdesync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+func TestProberReport(t *testing.T) {
+	p := NewProber("")
+
+	p.Report("example.com", true)
+	if p.Len() != 0 {
+		t.Fatal("a successful handshake to an unknown destination should not be tracked")
+	}
+
+	p.Report("example.com", false)
+	if st := p.Strategy("example.com"); st == nil || !st.SNISplit || st.RecordSplit {
+		t.Fatalf("after one failure Strategy() = %+v, want SNI-SPLIT", st)
+	}
+	p.Report("example.com", false)
+	if st := p.Strategy("example.com"); st == nil || !st.RecordSplit {
+		t.Fatalf("after two failures Strategy() = %+v, want RECORD-SPLIT", st)
+	}
+
+	p.Report("example.com", true)
+	r := p.Results()[0]
+	if !r.Confirmed || r.Strategy != MethodRecordSplit || r.Attempts != 3 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+
+	// a confirmed strategy survives a single failure
+	p.Report("example.com", false)
+	if got := p.Results()[0].Strategy; got != MethodRecordSplit {
+		t.Fatalf("confirmed strategy switched to %s after one failure", got)
+	}
+	p.Report("example.com", false)
+	if got := p.Results()[0]; got.Strategy == MethodRecordSplit || got.Confirmed {
+		t.Fatalf("confirmed strategy kept after repeated failures: %+v", got)
+	}
+
+	// probing wraps around after the last candidate
+	for i := 0; i < len(probeCandidates); i++ {
+		p.Report("wrap.example.com", false)
+	}
+	if got := p.Results()[1].Strategy; got != ProbeNone {
+		t.Fatalf("Strategy after a full cycle = %s, want %s", got, ProbeNone)
+	}
+
+	if n := p.Reset("example.com"); n != 1 {
+		t.Fatalf("Reset() = %d, want 1", n)
+	}
+	if n := p.Reset(""); n != 1 {
+		t.Fatalf("Reset(\"\") = %d, want 1", n)
+	}
+}
+
+func TestProberPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probe.json")
+	p := NewProber(path)
+	p.Report("example.com", false)
+	p.Report("example.com", true)
+	p.Report("93.184.216.34", false)
+	if err := p.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded := NewProber(path)
+	if loaded.Len() != 2 {
+		t.Fatalf("loaded %d results, want 2", loaded.Len())
+	}
+	if st := loaded.Strategy("example.com"); st == nil || !st.SNISplit {
+		t.Fatalf("loaded Strategy() = %+v, want SNI-SPLIT", st)
+	}
+}
+
+func TestProberSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProber(filepath.Join(blocker, "probe.json"))
+	p.Report("example.com", false)
+	if err := p.Save(); err == nil {
+		t.Fatal("Save() under a file succeeded, want an error")
+	}
+
+	// The results not written are written by the next save.
+	p.path = filepath.Join(dir, "probe.json")
+	if err := p.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if loaded := NewProber(p.path); loaded.Len() != 1 {
+		t.Fatalf("loaded %d results after a failed save, want 1", loaded.Len())
+	}
+}
+
+func TestSelectorAutoProbe(t *testing.T) {
+	s, err := NewSelector(&config.DesyncConfig{
+		AutoProbe: true,
+		TLSStrategies: []config.DesyncTLSStrategy{
+			{Hostnames: "pinned.example.com", Methods: []string{"RECORD-SPLIT"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSelector() error = %v", err)
+	}
+	if !s.Probing(443) || s.Probing(80) || !s.PacketLevel() {
+		t.Fatal("auto-probe should cover port 443 only and need the packet queue")
+	}
+
+	p := NewProber("")
+	p.Start()
+	defer p.Close()
+
+	if st := s.Select("1.1.1.1", 443, "example.com"); st != nil {
+		t.Fatalf("Select() = %+v before any failure, want nil", st)
+	}
+	p.Report("example.com", false)
+	if st := s.Select("1.1.1.1", 443, "Example.com."); st == nil || !st.SNISplit {
+		t.Fatalf("Select() = %+v, want the probed SNI-SPLIT", st)
+	}
+	p.Report("pinned.example.com", false)
+	if st := s.Select("1.1.1.1", 443, "pinned.example.com"); st == nil || !st.RecordSplit || st.SNISplit {
+		t.Fatalf("Select() = %+v, configured strategies must take precedence", st)
+	}
+	p.Report("1.1.1.1", false)
+	if st := s.Select("1.1.1.1", 443, ""); st == nil {
+		t.Fatal("Select() without SNI should fall back to the IP")
+	}
+}
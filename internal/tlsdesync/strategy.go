@@ -0,0 +1,238 @@
+package tlsdesync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sunbk201/ua3f/internal/config"
+	"github.com/sunbk201/ua3f/internal/dns"
+)
+
+const (
+	MethodSNISplit        = "SNI-SPLIT"
+	MethodRecordSplit     = "RECORD-SPLIT"
+	MethodFakeClientHello = "FAKE-CLIENTHELLO"
+
+	FoolingTTL    = "TTL"
+	FoolingBadsum = "BADSUM"
+)
+
+const (
+	DefaultPort           = 443
+	DefaultRecordSegments = 2
+	DefaultFakeSNI        = "www.w3.org"
+	DefaultFakeTTL        = 3
+)
+
+// Strategy describes how ClientHello packets matching its ports and hostnames are desynced.
+type Strategy struct {
+	Ports     []uint16
+	Hostnames []string
+
+	SNISplit        bool
+	RecordSplit     bool
+	FakeClientHello bool
+
+	RecordSegments int
+	FakeSNI        string
+	FakeFooling    string
+	FakeTTL        uint8
+}
+
+func NewStrategy(c config.DesyncTLSStrategy) (*Strategy, error) {
+	st := &Strategy{
+		RecordSegments: DefaultRecordSegments,
+		FakeSNI:        DefaultFakeSNI,
+		FakeFooling:    FoolingTTL,
+		FakeTTL:        DefaultFakeTTL,
+	}
+	for _, m := range c.Methods {
+		switch strings.ToUpper(strings.TrimSpace(m)) {
+		case MethodSNISplit:
+			st.SNISplit = true
+		case MethodRecordSplit:
+			st.RecordSplit = true
+		case MethodFakeClientHello:
+			st.FakeClientHello = true
+		default:
+			return nil, fmt.Errorf("unknown tls desync method %q", m)
+		}
+	}
+
+	ports, err := ParsePorts(c.Ports)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) == 0 {
+		ports = []uint16{DefaultPort}
+	}
+	st.Ports = ports
+
+	for _, h := range strings.Split(c.Hostnames, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			st.Hostnames = append(st.Hostnames, h)
+		}
+	}
+
+	if c.RecordSegments > 1 {
+		st.RecordSegments = c.RecordSegments
+	}
+	if c.FakeSNI != "" {
+		st.FakeSNI = c.FakeSNI
+	}
+	if c.FakeFooling != "" {
+		st.FakeFooling = strings.ToUpper(c.FakeFooling)
+	}
+	if c.FakeTTL > 0 {
+		st.FakeTTL = c.FakeTTL
+	}
+	return st, nil
+}
+
+// Match reports whether the strategy applies to a ClientHello sent to port with the given SNI.
+// A strategy without hostnames matches any SNI, including none.
+func (st *Strategy) Match(port uint16, sni string) bool {
+	matched := false
+	for _, p := range st.Ports {
+		if p == port {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	if len(st.Hostnames) == 0 {
+		return true
+	}
+	return sni != "" && dns.MatchDomain(sni, st.Hostnames)
+}
+
+// Enabled reports whether TLS desync is configured, either through strategies or auto-probing.
+func Enabled(cfg *config.DesyncConfig) bool {
+	return cfg.TLS || cfg.AutoProbe
+}
+
+// Selector picks the first strategy matching a ClientHello.
+type Selector struct {
+	strategies []*Strategy
+	autoProbe  bool
+	probePorts []uint16
+}
+
+// NewSelector builds a Selector from the desync config.
+// Without configured strategies, SNI-SPLIT is applied on port 443 unless auto-probing is on.
+func NewSelector(cfg *config.DesyncConfig) (*Selector, error) {
+	s := &Selector{autoProbe: cfg.AutoProbe}
+	if s.autoProbe {
+		ports, err := ParsePorts(cfg.ProbePorts)
+		if err != nil {
+			return nil, fmt.Errorf("probe-ports: %w", err)
+		}
+		if len(ports) == 0 {
+			ports = []uint16{DefaultPort}
+		}
+		s.probePorts = ports
+	}
+	strategies := cfg.TLSStrategies
+	if len(strategies) == 0 && cfg.TLS && !cfg.AutoProbe {
+		strategies = []config.DesyncTLSStrategy{{Methods: []string{MethodSNISplit}}}
+	}
+	for i, c := range strategies {
+		st, err := NewStrategy(c)
+		if err != nil {
+			return nil, fmt.Errorf("tls-strategies[%d]: %w", i, err)
+		}
+		s.strategies = append(s.strategies, st)
+	}
+	return s, nil
+}
+
+// Select returns the first strategy matching port and sni, or nil.
+// Destinations not covered by a configured strategy fall back to the
+// strategy learned by the active prober, keyed by sni or ip.
+func (s *Selector) Select(ip string, port uint16, sni string) *Strategy {
+	if s == nil {
+		return nil
+	}
+	for _, st := range s.strategies {
+		if st.Match(port, sni) {
+			return st
+		}
+	}
+	if s.Probing(port) {
+		if p := ActiveProber(); p != nil {
+			return p.Strategy(ProbeKey(sni, ip))
+		}
+	}
+	return nil
+}
+
+// Probing reports whether connections to port are auto-probed.
+func (s *Selector) Probing(port uint16) bool {
+	if s == nil || !s.autoProbe {
+		return false
+	}
+	for _, p := range s.probePorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Ports returns the destination ports covered by any strategy or by auto-probing.
+func (s *Selector) Ports() []uint16 {
+	seen := make(map[uint16]struct{})
+	var ports []uint16
+	add := func(list []uint16) {
+		for _, p := range list {
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				ports = append(ports, p)
+			}
+		}
+	}
+	for _, st := range s.strategies {
+		add(st.Ports)
+	}
+	add(s.probePorts)
+	return ports
+}
+
+// PacketLevel reports whether any strategy needs to modify packets,
+// i.e. SNI-SPLIT or FAKE-CLIENTHELLO. Auto-probing may pick either.
+func (s *Selector) PacketLevel() bool {
+	if s.autoProbe {
+		return true
+	}
+	for _, st := range s.strategies {
+		if st.SNISplit || st.FakeClientHello {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePorts parses a comma-separated port list.
+func ParsePorts(s string) ([]uint16, error) {
+	parts := strings.Split(s, ",")
+	ports := make([]uint16, 0, len(parts))
+
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		v, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", p, err)
+		}
+
+		ports = append(ports, uint16(v))
+	}
+
+	return ports, nil
+}
@@ -0,0 +1,74 @@
+package tlsdesync
+
+import (
+	"testing"
+
+	"github.com/sunbk201/ua3f/internal/config"
+)
+
+func TestSelector(t *testing.T) {
+	s, err := NewSelector(&config.DesyncConfig{
+		TLS: true,
+		TLSStrategies: []config.DesyncTLSStrategy{
+			{Hostnames: "googlevideo.com", Methods: []string{"FAKE-CLIENTHELLO", "SNI-SPLIT"}, FakeFooling: "BADSUM"},
+			{Ports: "443, 8443", Methods: []string{"RECORD-SPLIT"}, RecordSegments: 4},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSelector() error = %v", err)
+	}
+
+	tests := []struct {
+		port   uint16
+		sni    string
+		fake   bool
+		record bool
+	}{
+		{443, "rr1.googlevideo.com", true, false},
+		{443, "example.com", false, true},
+		{443, "", false, true},
+		{8443, "rr1.googlevideo.com", false, true},
+		{80, "example.com", false, false},
+	}
+	for _, tt := range tests {
+		st := s.Select("", tt.port, tt.sni)
+		if !tt.fake && !tt.record {
+			if st != nil {
+				t.Errorf("Select(%d, %q) = %+v, want nil", tt.port, tt.sni, st)
+			}
+			continue
+		}
+		if st == nil {
+			t.Errorf("Select(%d, %q) = nil", tt.port, tt.sni)
+			continue
+		}
+		if st.FakeClientHello != tt.fake || st.RecordSplit != tt.record {
+			t.Errorf("Select(%d, %q) = %+v", tt.port, tt.sni, st)
+		}
+	}
+
+	if got := s.Ports(); len(got) != 2 || got[0] != 443 || got[1] != 8443 {
+		t.Errorf("Ports() = %v, want [443 8443]", got)
+	}
+	if !s.PacketLevel() {
+		t.Error("PacketLevel() = false")
+	}
+}
+
+func TestSelectorDefault(t *testing.T) {
+	s, err := NewSelector(&config.DesyncConfig{TLS: true})
+	if err != nil {
+		t.Fatalf("NewSelector() error = %v", err)
+	}
+	st := s.Select("", 443, "example.com")
+	if st == nil || !st.SNISplit {
+		t.Fatalf("default strategy = %+v, want SNI-SPLIT on 443", st)
+	}
+
+	if _, err := NewSelector(&config.DesyncConfig{TLSStrategies: []config.DesyncTLSStrategy{{Methods: []string{"OOB"}}}}); err == nil {
+		t.Error("NewSelector() accepted an unknown method")
+	}
+	if _, err := NewSelector(&config.DesyncConfig{TLSStrategies: []config.DesyncTLSStrategy{{Ports: "https", Methods: []string{"SNI-SPLIT"}}}}); err == nil {
+		t.Error("NewSelector() accepted an invalid port")
+	}
+}
@@ -57,13 +57,16 @@ function M.read_conn_stats()
     local file = io.open("/var/log/ua3f/conn_stats", "r")
     if file then
         for line in file:lines() do
-            local protocol, srcAddr, destAddr, duration = line:match("^(%S+)%s(%S+)%s(%S+)%s(.+)$")
+            local protocol, srcAddr, destAddr, duration, upload, download =
+                line:match("^(%S+)%s(%S+)%s(%S+)%s(%d+)%s?(%d*)%s?(%d*)$")
             if protocol and srcAddr and destAddr and duration then
                 table.insert(stats, {
                     protocol = protocol,
                     srcAddr = srcAddr,
                     destAddr = destAddr,
-                    duration = duration
+                    duration = duration,
+                    upload = upload ~= "" and upload or "0",
+                    download = download ~= "" and download or "0"
                 })
             end
         end